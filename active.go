@@ -0,0 +1,133 @@
+package bitcask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+// checkpointPeriodically is the background task checkpointing the current
+// datafile every configured interval, see WithActiveDir()
+func (b *Bitcask) checkpointPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.config.CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A checkpoint that failed is retried with the next one
+		b.checkpointActive()
+	}
+}
+
+// checkpointActive rotates the current datafile, unless it is empty, which
+// moves it out of the active directory into the database
+func (b *Bitcask) checkpointActive() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if b.curr.Size() == 0 {
+		return nil
+	}
+	return b.rotate(1)
+}
+
+// currDir returns the directory the current datafile is written in: the
+// active directory of WithActiveDir() if any, the database's otherwise
+func (b *Bitcask) currDir() string {
+	if b.config.ActiveDir != "" {
+		return b.config.ActiveDir
+	}
+	return b.path
+}
+
+// checkpoint moves the closed datafile with the given id from the active
+// directory into the database. It is copied, as they are usually on
+// different file systems, and renamed into place once synced so it is
+// always complete in one of them.
+func (b *Bitcask) checkpoint(id int) error {
+	name := fmt.Sprintf("%09d.data", id)
+	src, err := fs.Open(b.fsys, filepath.Join(b.config.ActiveDir, name))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	path := filepath.Join(b.path, name)
+	dst, err := b.fsys.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := b.fsys.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	src.Close()
+	return b.fsys.Remove(src.Name())
+}
+
+// restoreActive checkpoints the datafiles left in the active directory by
+// a crash, see WithActiveDir()
+func (b *Bitcask) restoreActive() error {
+	if err := b.fsys.MkdirAll(b.config.ActiveDir, 0700); err != nil {
+		return err
+	}
+	fns, err := internal.GetDatafiles(b.fsys, b.config.ActiveDir)
+	if err != nil {
+		return err
+	}
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		// Already moved into the database if crashing before removing it
+		name := fmt.Sprintf("%09d.data", id)
+		if fs.Exists(b.fsys, filepath.Join(b.path, name)) {
+			if err := b.fsys.Remove(filepath.Join(b.config.ActiveDir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.checkpoint(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openDatafile calls `open` with the directory of a datafile to open it:
+// the database's, or the active directory (see WithActiveDir()) for the
+// current datafile unless it was checkpointed meanwhile
+func (b *Bitcask) openDatafile(open func(dir string) error) error {
+	err := open(b.path)
+	if b.config.ActiveDir == "" || !os.IsNotExist(err) {
+		return err
+	}
+	if err = open(b.config.ActiveDir); !os.IsNotExist(err) {
+		return err
+	}
+	return open(b.path)
+}
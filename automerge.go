@@ -0,0 +1,73 @@
+package bitcask
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// PauseAutoMerge stops automatic merges (see WithAutoMerge()) from starting
+// until ResumeAutoMerge() is called, a merge already running completes
+func (b *Bitcask) PauseAutoMerge() {
+	atomic.StoreInt32(&b.autoMergePaused, 1)
+}
+
+// ResumeAutoMerge resumes automatic merges paused by PauseAutoMerge()
+func (b *Bitcask) ResumeAutoMerge() {
+	atomic.StoreInt32(&b.autoMergePaused, 0)
+}
+
+// autoMerge is the background task merging the database every configured
+// interval once the thresholds are reached. A merge running when the task is
+// stopped is aborted.
+func (b *Bitcask) autoMerge(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.config.AutoMergeInterval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if atomic.LoadInt32(&b.autoMergePaused) == 1 || !b.needsMerge() {
+			continue
+		}
+		if err := b.merge(ctx, MergeOptions{}); err != nil && err != ErrMergeInProgress && err != ErrFrozen && err != context.Canceled {
+			atomic.AddUint64(&b.autoMergeErrors, 1)
+		}
+	}
+}
+
+// needsMerge returns true if there are dead bytes to reclaim and the
+// configured thresholds are reached
+func (b *Bitcask) needsMerge() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	total := b.datafileBytes()
+	dead := total - atomic.LoadInt64(&b.liveBytes)
+	if dead <= 0 {
+		return false
+	}
+
+	deadRatio, datafiles := b.config.AutoMergeDeadRatio, b.config.AutoMergeDatafiles
+	if deadRatio <= 0 && datafiles <= 0 {
+		return true
+	}
+	if deadRatio > 0 && float64(dead)/float64(total) >= deadRatio {
+		return true
+	}
+	return datafiles > 0 && len(b.datafiles)+1 >= datafiles
+}
@@ -0,0 +1,239 @@
+package bitcask
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+// backupFile is a file of a backup and the number of bytes of it to archive
+type backupFile struct {
+	name string
+	size int64
+}
+
+// Backup writes a consistent backup of the database to `w` as a tar archive
+// of its configuration, datafiles, index and deleted buckets (see
+// DeleteBucket()), which can be restored with
+// Restore(). The datafiles are archived as they were when the backup was
+// started while reads, writes and merges carry on, as with Snapshot(). All
+// on-disk formats are independent of the platform, so a backup can be
+// restored on a different machine or architecture.
+func (b *Bitcask) Backup(w io.Writer) error {
+	b.mu.Lock()
+	b.quiesce()
+
+	// Every datafile is archived, not only those holding live keys, so the
+	// index can still be rebuilt from the datafiles of the backup
+	files := []backupFile{{name: b.curr.Name(), size: b.curr.Size()}}
+	ids := []int{b.curr.FileID()}
+	for id, df := range b.datafiles {
+		if id != b.curr.FileID() {
+			files = append(files, backupFile{name: df.Name(), size: df.Size()})
+			ids = append(ids, id)
+		}
+	}
+	s := &snapshot{b: b}
+	b.trie.ForEach(s.adder())
+	s.pin(ids...)
+	defer s.release()
+	pos := b.position()
+
+	config, err := json.Marshal(b.config)
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	manifest, err := json.Marshal(b.buckets)
+	mergedEnd := b.mergedEnd()
+	version := b.version
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The index is built from the snapshot as the saved one may be stale
+	t := art.New()
+	for i, key := range s.keys {
+		t.Insert(key, s.items[i])
+	}
+	temp, err := fs.TempDir(b.fsys, b.path, "backup")
+	if err != nil {
+		return err
+	}
+	defer b.fsys.RemoveAll(temp)
+	index := filepath.Join(temp, "index")
+	if err := b.indexer.Save(t, pos, index); err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	hdr := &tar.Header{Name: "config.json", Mode: 0600, Size: int64(len(config)), ModTime: now}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(config); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err := archiveFile(b.fsys, tw, filepath.Base(file.name), file, now)
+		if os.IsNotExist(err) && b.config.ActiveDir != "" {
+			// The current datafile was checkpointed meanwhile, see
+			// WithActiveDir()
+			file.name = filepath.Join(b.path, filepath.Base(file.name))
+			err = archiveFile(b.fsys, tw, filepath.Base(file.name), file, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr = &tar.Header{Name: "buckets", Mode: 0600, Size: int64(len(manifest)), ModTime: now}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+	// Seqs before the last merge stay unavailable, see Replay()
+	if mergedEnd > 0 {
+		merged := []byte(strconv.Itoa(mergedEnd))
+		hdr = &tar.Header{Name: "merged", Mode: 0600, Size: int64(len(merged)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(merged); err != nil {
+			return err
+		}
+	}
+
+	// Versions stay increasing in the restored database, see saveVersion()
+	if version > 0 {
+		mark := []byte(strconv.FormatUint(version, 10))
+		hdr = &tar.Header{Name: "version", Mode: 0600, Size: int64(len(mark)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(mark); err != nil {
+			return err
+		}
+	}
+
+	stat, err := b.fsys.Stat(index)
+	if err != nil {
+		return err
+	}
+	if err := archiveFile(b.fsys, tw, "index", backupFile{name: index, size: stat.Size()}, now); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// archiveFile writes the first `size` bytes of the file to the archive
+func archiveFile(fsys fs.FileSystem, tw *tar.Writer, name string, file backupFile, modTime time.Time) error {
+	f, err := fs.Open(fsys, file.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: file.size, ModTime: modTime}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, file.size)
+	return err
+}
+
+// Restore restores a backup written by Backup() from `r` into a new
+// database at the given path, which must not exist or be empty. If the
+// backup cannot be restored the files restored so far are removed again.
+func Restore(r io.Reader, path string) (err error) {
+	if fns, err := ioutil.ReadDir(path); err == nil && len(fns) > 0 {
+		return fmt.Errorf("restoring into %s: %w", path, os.ErrExist)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+
+	var restored []string
+	defer func() {
+		if err != nil {
+			for _, fn := range restored {
+				os.Remove(fn)
+			}
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !backupName(hdr.Name) {
+			return fmt.Errorf("restoring %s: unexpected file in backup", hdr.Name)
+		}
+
+		fn := filepath.Join(path, hdr.Name)
+		restored = append(restored, fn)
+		if err := restoreFile(fn, tr); err != nil {
+			return err
+		}
+	}
+
+	if !internal.Exists(filepath.Join(path, "config.json")) {
+		return fmt.Errorf("restoring into %s: no config.json in backup", path)
+	}
+	// The index is archived last, without it the backup was cut short
+	if !internal.Exists(filepath.Join(path, "index")) {
+		return fmt.Errorf("restoring into %s: no index in backup", path)
+	}
+	return nil
+}
+
+// backupName returns true for the names of the files of a backup
+func backupName(name string) bool {
+	if name == "config.json" || name == "index" || name == "buckets" || name == "merged" || name == "version" {
+		return true
+	}
+	var id int
+	n, err := fmt.Sscanf(name, "%09d.data", &id)
+	return err == nil && n == 1 && name == fmt.Sprintf("%09d.data", id)
+}
+
+// restoreFile writes the contents of `r` to a new file
+func restoreFile(fn string, r io.Reader) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,172 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/metrics"
+)
+
+// Batch is a set of puts and deletes applied atomically by Write()
+type Batch struct {
+	entries []internal.Entry
+}
+
+// NewBatch returns an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds storing the key and value to the batch
+func (bt *Batch) Put(key, value []byte) {
+	key = append([]byte(nil), key...)
+	value = append([]byte(nil), value...)
+	bt.entries = append(bt.entries, internal.NewEntry(key, value))
+}
+
+// Delete adds deleting the key to the batch
+func (bt *Batch) Delete(key []byte) {
+	key = append([]byte(nil), key...)
+	bt.entries = append(bt.entries, internal.NewEntry(key, []byte{}))
+}
+
+// Len returns the number of puts and deletes in the batch
+func (bt *Batch) Len() int {
+	return len(bt.entries)
+}
+
+// Reset empties the batch so it can be reused
+func (bt *Batch) Reset() {
+	bt.entries = bt.entries[:0]
+}
+
+// Write applies the puts and deletes of the batch in order, atomically: the
+// batch is written to the current datafile and synced to disk before any
+// of it is visible, and a batch only partially written when crashing is
+// discarded as a whole by recovery or when rebuilding the index.
+func (b *Bitcask) Write(bt *Batch) (err error) {
+	if len(bt.entries) == 0 {
+		return nil
+	}
+	defer b.observe(metrics.Put, time.Now(), &err)
+
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if err := b.checkEntries(bt.entries); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	// The batch is left as is, it may be written again
+	return b.write(append([]internal.Entry(nil), bt.entries...), false)
+}
+
+// checkEntries checks the sizes of the keys and values of the entries
+func (b *Bitcask) checkEntries(entries []internal.Entry) error {
+	for _, e := range entries {
+		if len(e.Key) == 0 {
+			return ErrEmptyKey
+		}
+		if uint32(len(e.Key)) > b.config.MaxKeySize {
+			return ErrKeyTooLarge
+		}
+		if uint64(len(e.Value)) > b.maxValueSize() {
+			return ErrValueTooLarge
+		}
+	}
+	return nil
+}
+
+// write writes the entries as a batch and indexes them. Their values are
+// encoded (see encode()) unless `encoded` is set as they were read from
+// the datafiles. The caller must hold the write lock with no Put() in
+// flight, see quiesce().
+func (b *Bitcask) write(entries []internal.Entry, encoded bool) error {
+	for i, e := range entries {
+		if len(e.Value) == 0 {
+			continue
+		}
+		value := e.Value
+		if encoded && len(b.schemas) > 0 {
+			var err error
+			if value, err = b.value(e); err != nil {
+				return err
+			}
+		}
+		if err := b.validate(e.Key, value); err != nil {
+			return err
+		}
+		if encoded {
+			continue
+		}
+		if err := b.encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	if err := b.checkLimits(entries); err != nil {
+		return err
+	}
+
+	if b.curr.Size() >= int64(b.config.MaxDatafileSize) {
+		if err := b.rotate(1); err != nil {
+			return err
+		}
+	}
+
+	// The whole batch goes to the current datafile however large it is, so
+	// a partially written batch is always at the end of a datafile
+	items := make([]internal.Item, len(entries))
+	_, written, err := b.curr.Write(data.NewBatchHeader(len(entries)))
+	if err == nil {
+		for i, e := range entries {
+			var offset, n int64
+			e.Origin = b.config.NodeID
+			b.stamp(&e)
+			if offset, n, err = b.curr.Write(e); err != nil {
+				break
+			}
+			items[i] = internal.Item{FileID: b.curr.FileID(), Offset: offset, Size: n, Expiry: e.Expiry}
+			written += n
+		}
+	}
+	if err == nil {
+		err = b.sync(b.curr)
+	}
+	if err != nil {
+		// Nothing is written after a failed batch
+		if rerr := b.rotate(1); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	atomic.AddUint64(&b.bytesWritten, uint64(written))
+
+	for i, e := range entries {
+		if len(e.Value) == 0 {
+			if old, deleted := b.trie.Delete(e.Key); deleted {
+				b.untrackSizes(e.Key, old.(internal.Item))
+				b.notifyDelete(e.Key, Seq{FileID: items[i].FileID, Offset: items[i].Offset + items[i].Size})
+			}
+			continue
+		}
+		if old, updated := b.trie.Insert(e.Key, items[i]); updated {
+			b.untrackSizes(e.Key, old.(internal.Item))
+		}
+		b.trackSizes(e.Key, items[i])
+		b.addBloom(e.Key)
+		b.notifyPut(e.Key, items[i])
+	}
+
+	keys := make([][]byte, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return b.evict(keys...)
+}
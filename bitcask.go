@@ -1,23 +1,30 @@
 package bitcask
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
+	"runtime/pprof"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gofrs/flock"
 	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/fs"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
 	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/internal/jsonpath"
+	"github.com/prologic/bitcask/metrics"
 )
 
 var (
@@ -42,23 +49,243 @@ var (
 	// ErrDatabaseLocked is the error returned if the database is locked
 	// (typically opened by another process)
 	ErrDatabaseLocked = errors.New("error: database locked")
+
+	// ErrStaleLock is the error returned by Open() if the database is locked
+	// by a process that is not running anymore, see WithForceLock()
+	ErrStaleLock = errors.New("error: database locked by a process that is not running")
+
+	// ErrTooManyOpenFiles is the error returned by Open() if the limit on
+	// open files is too low for the number of datafiles in the database
+	ErrTooManyOpenFiles = errors.New("error: too many open files")
+
+	// ErrInsufficientDiskSpace is the error returned by Open() if there is
+	// less free disk space than configured with WithMinFreeDiskSpace and by
+	// Merge() if there is not enough free disk space to merge
+	ErrInsufficientDiskSpace = errors.New("error: insufficient disk space")
+
+	// ErrInvalidDatafiles is the error returned by Open() and Reopen() if the
+	// datafile ids do not give a reliable order of the entries, unless
+	// tolerated with WithTolerateInvalidDatafiles
+	ErrInvalidDatafiles = errors.New("error: invalid datafiles")
+
+	// ErrInvalidPath is the error returned by GetPath() and SetPath() for a
+	// malformed path
+	ErrInvalidPath = jsonpath.ErrInvalidPath
+
+	// ErrPathNotFound is the error returned by GetPath() and SetPath() if the
+	// path does not exist in the value
+	ErrPathNotFound = jsonpath.ErrNotFound
+
+	// ErrInvalidJSON is the error returned by GetPath() and SetPath() if the
+	// value (or the value to set) is not valid JSON
+	ErrInvalidJSON = jsonpath.ErrInvalidJSON
+
+	// ErrSchemaViolation is the error returned if a value does not satisfy
+	// the schema registered for a prefix of its key (see RegisterSchema())
+	ErrSchemaViolation = errors.New("error: schema violation")
+
+	// ErrUnsupportedFormatVersion is the error returned for an unknown
+	// on-disk format version
+	ErrUnsupportedFormatVersion = errors.New("error: unsupported format version")
+
+	// ErrFormatVersionMismatch is the error returned by Open() when trying
+	// to change the format version of a database that already has data
+	ErrFormatVersionMismatch = errors.New("error: format version mismatch")
+
+	// ErrCompressionNotSupported is the error returned by Open() with a
+	// compression if the format version of the database does not store it
+	ErrCompressionNotSupported = errors.New("error: compression not supported by format version")
+
+	// ErrUnsupportedCompression is the error returned for an unknown
+	// compression
+	ErrUnsupportedCompression = errors.New("error: unsupported compression")
+
+	// ErrInvalidEncryptionKey is the error returned by Open() for an
+	// encrypted database opened with a wrong or without encryption key,
+	// see WithEncryption()
+	ErrInvalidEncryptionKey = errors.New("error: invalid encryption key")
+
+	// ErrEncryptionMismatch is the error returned by Open() when trying to
+	// encrypt a database that already has unencrypted data
+	ErrEncryptionMismatch = errors.New("error: encryption mismatch")
+
+	// ErrReadOnly is the error returned by writes to and merges of a
+	// database opened read-only, see OpenReadOnly()
+	ErrReadOnly = errors.New("error: read only database")
+
+	// ErrSnapshotClosed is the error returned when reading from a Snapshot
+	// that was closed
+	ErrSnapshotClosed = errors.New("error: snapshot closed")
+
+	// ErrMergeInProgress is the error returned if Merge() is called while
+	// another merge is still running
+	ErrMergeInProgress = errors.New("error: merge already in progress")
+
+	// ErrTTLNotSupported is the error returned by PutWithTTL() and by Open()
+	// in trash mode if the format version of the database does not store
+	// expiries
+	ErrTTLNotSupported = errors.New("error: ttl not supported by format version")
+
+	// ErrInvalidTTL is the error returned by PutWithTTL() for a ttl that is
+	// not positive
+	ErrInvalidTTL = errors.New("error: invalid ttl")
+
+	// ErrKeyExists is the error returned by PutWithOptions() with
+	// NoOverwrite if the key already exists
+	ErrKeyExists = errors.New("error: key exists")
+
+	// ErrCorrupted is the error returned if the index refers to an entry
+	// that is missing or not of the key, see WithCorruptionPolicy()
+	ErrCorrupted = errors.New("error: corrupted data")
+
+	// ErrOriginNotSupported is the error returned by Open() with a node id
+	// and by PutWithMeta() with an origin if the format version of the
+	// database does not store origins
+	ErrOriginNotSupported = errors.New("error: origin not supported by format version")
+
+	// ErrConflict is the error returned by Txn.Commit() if a key read by
+	// the transaction was modified since, and by PutIfVersion() and
+	// DeleteIfVersion() if the key is not at the expected version
+	ErrConflict = errors.New("error: transaction conflict")
+
+	// ErrVersionNotSupported is the error returned by PutIfVersion(),
+	// DeleteIfVersion() and Changes() if the format version of the database
+	// does not store versions
+	ErrVersionNotSupported = errors.New("error: version not supported by format version")
+
+	// ErrTxnDone is the error returned when using a Txn that was committed
+	// or discarded
+	ErrTxnDone = errors.New("error: transaction done")
+
+	// ErrDatabaseFull is the error returned by writes that would take the
+	// database over the limits of WithMaxDatastoreSize() or WithMaxKeys()
+	// with the EvictNone policy
+	ErrDatabaseFull = errors.New("error: database full")
 )
 
 // Bitcask is a struct that represents a on-disk LSM and WAL data structure
 // and in-memory hash of key/value pairs as per the Bitcask paper and seen
 // in the Riak database.
 type Bitcask struct {
+	// retries and retryFailures are accessed atomically and must stay
+	// 64-bit aligned (first in the struct) for 32-bit platforms
+	retries       uint64
+	retryFailures uint64
+
+	bytesWritten        uint64
+	merges              uint64
+	mergeBytesRead      uint64
+	mergeBytesWritten   uint64
+	mergeBytesReclaimed uint64
+	autoMergeErrors     uint64
+	evictions           uint64
+
+	gets              uint64
+	puts              uint64
+	deletes           uint64
+	syncs             uint64
+	lastMergeDuration int64
+	readLatency       internal.Latencies
+	writeLatency      internal.Latencies
+
+	// lastActive is when the last operation completed in nanoseconds, see
+	// WithIdleTimeout()
+	lastActive   int64
+	idleReleases uint64
+	corruptions  uint64
+
+	merging         int32
+	autoMergePaused int32
+
 	mu sync.RWMutex
 
-	*flock.Flock
+	// writers is signalled as Put() calls writing outside of the lock are
+	// published in the order of their tickets, both guarded by mu
+	writers   *sync.Cond
+	inflight  int
+	tickets   uint64
+	published uint64
+	// writeErr is the error of the entry failed to be written at
+	// writeErrOffset, failing the entries reserved after it until the
+	// current datafile is truncated, guarded by mu
+	writeErr       error
+	writeErrOffset int64
+	// version is the latest version written, see stamp(), guarded by mu
+	version uint64
+
+	*Flock
 
 	config    *config.Config
 	options   []Option
 	path      string
+	fsys      fs.FileSystem
 	curr      data.Datafile
 	datafiles map[int]data.Datafile
 	trie      art.Tree
 	indexer   index.Indexer
+	fds       *data.Cache
+	tasks     *tasks
+
+	// aead encrypts values, nil if the database is not encrypted
+	aead cipher.AEAD
+
+	// now returns the current time keys expire against
+	now func() time.Time
+
+	keySizes   internal.Histogram
+	valueSizes internal.Histogram
+	// liveBytes is the size of the entries of all live keys
+	liveBytes int64
+	// files holds the current datafile followed by the other datafiles
+	// for Stats() to read without locking, see publishDatafiles()
+	files atomic.Value
+
+	lastRecovery *internal.RecoveryReport
+
+	// opened is when the database was opened and openedLiveBytes its live
+	// bytes then, see Forecast()
+	opened          time.Time
+	openedLiveBytes int64
+
+	// buckets is the manifest of the deleted buckets, see DeleteBucket()
+	buckets buckets
+
+	// dirty are the keys changed since the last delta of the index log and
+	// indexLogPos the position of the index then, nil and zero if there is
+	// no index log (see WithIndexLog())
+	dirty        map[string]struct{}
+	indexLogPos  index.Position
+	indexLogSize int64
+
+	// bloom filters the keys of the index, nil without WithBloomFilter()
+	bloom *bloom
+	// reads schedules reads by priority, see Priority
+	reads *readScheduler
+
+	// evictor orders the keys to evict, nil unless the database is limited
+	// and evicts keys (see EvictionPolicy)
+	evictor *evictor
+
+	// shared is the shared lock and frozenIDs the datafiles of the frozen
+	// generation of a database opened with OpenShared()
+	shared    *Flock
+	frozenIDs map[int]bool
+
+	// indexed is the size of every datafile indexed by a read-only
+	// database, see Refresh()
+	indexed map[int]int64
+
+	schemas map[string]Schema
+
+	// watchMu guards the watchers, see Watch()
+	watchMu  sync.Mutex
+	watchers map[*watcher]struct{}
+
+	// pinMu guards the datafiles pinned by snapshots and the merged away
+	// datafiles whose removal is deferred until they are unpinned
+	pinMu   sync.Mutex
+	pins    map[int]int
+	retired map[int]data.Datafile
 }
 
 // Stats is a struct returned by Stats() on an open Bitcask instance
@@ -66,34 +293,278 @@ type Stats struct {
 	Datafiles int
 	Keys      int
 	Size      int64
+
+	// Retries is the number of times a transient I/O error was retried
+	Retries uint64
+	// RetryFailures is the number of operations that still failed with a
+	// transient I/O error after exhausting all retries
+	RetryFailures uint64
+
+	// BackgroundTasks is the number of background tasks currently running
+	BackgroundTasks int
+	// TaskPanics is the number of panics recovered from background tasks
+	TaskPanics uint64
+
+	// BytesWritten is the number of bytes written by Put and Delete
+	BytesWritten uint64
+	// Merges is the number of merges performed
+	Merges uint64
+	// MergeBytesRead is the number of bytes read by merges
+	MergeBytesRead uint64
+	// MergeBytesWritten is the number of bytes written by merges
+	MergeBytesWritten uint64
+	// MergeBytesReclaimed is the number of bytes of disk space reclaimed by
+	// merges
+	MergeBytesReclaimed uint64
+	// AutoMergeErrors is the number of automatic merges that failed
+	AutoMergeErrors uint64
+	// Evictions is the number of keys evicted to keep the database within
+	// its limits, see EvictionPolicy
+	Evictions uint64
+	// WriteAmplification is the ratio of all bytes written (including
+	// merges) to the bytes written by Put and Delete
+	WriteAmplification float64
+	// MergeReadAmplification is the number of bytes read by merges per byte
+	// of disk space reclaimed
+	MergeReadAmplification float64
+
+	// Gets, Puts and Deletes are the number of reads, writes and deletes
+	// since the database was opened, see metrics.Op
+	Gets    uint64
+	Puts    uint64
+	Deletes uint64
+	// Syncs is the number of times a datafile was synced to disk
+	Syncs uint64
+	// ReadLatency is the distribution of the durations of reads
+	ReadLatency LatencyHistogram
+	// WriteLatency is the distribution of the durations of writes and
+	// deletes
+	WriteLatency LatencyHistogram
+	// LastMergeDuration is how long the last successful merge took
+	LastMergeDuration time.Duration
+
+	// OpenDatafiles is the number of immutable datafiles currently open,
+	// only counted with WithMaxOpenFiles() or WithIdleTimeout()
+	OpenDatafiles int
+	// IdleReleases is the number of times the datafiles were closed as the
+	// database was idle, see WithIdleTimeout()
+	IdleReleases uint64
+	// Corruptions is the number of times corrupted data was found, see
+	// WithCorruptionPolicy()
+	Corruptions uint64
+
+	// LiveBytes is the size of the entries of all live keys
+	LiveBytes int64
+	// DeadBytes is the size of the overwritten and deleted entries in the
+	// datafiles, which is reclaimed by Merge()
+	DeadBytes int64
+
+	// KeySizes is the distribution of the sizes of all live keys
+	KeySizes SizeHistogram
+	// ValueSizes is the distribution of the sizes of all live values
+	ValueSizes SizeHistogram
+
+	// BloomFilterChecks is the number of lookups checked against the filter
+	// of WithBloomFilter(), BloomFilterNegatives how many of them it
+	// answered without the index and BloomFilterFalsePositives how many of
+	// the others found no key
+	BloomFilterChecks         uint64
+	BloomFilterNegatives      uint64
+	BloomFilterFalsePositives uint64
+	// BloomFilterKeys is the number of keys in the filter, including keys
+	// deleted since it was last rebuilt, and BloomFilterBytes its size
+	BloomFilterKeys  int
+	BloomFilterBytes int
+}
+
+// RecoveryReport describes the recovery actions taken when opening a
+// database, see LastRecovery() and WithRecoveryHandler()
+type RecoveryReport = internal.RecoveryReport
+
+// SizeHistogram is an approximate distribution of sizes in bytes. Sizes are
+// counted in power of two buckets so percentiles are upper bounds.
+type SizeHistogram struct {
+	Count   uint64
+	Total   uint64
+	P50     uint64
+	P90     uint64
+	P99     uint64
+	Max     uint64
+	Buckets []internal.Bucket
+}
+
+func newSizeHistogram(h *internal.Histogram) SizeHistogram {
+	return SizeHistogram{
+		Count:   h.Count(),
+		Total:   h.Sum(),
+		P50:     h.Quantile(0.5),
+		P90:     h.Quantile(0.9),
+		P99:     h.Quantile(0.99),
+		Max:     h.Quantile(1),
+		Buckets: h.Buckets(),
+	}
+}
+
+// LatencyHistogram is an approximate distribution of durations. Durations
+// are counted in power of two nanosecond buckets so percentiles are upper
+// bounds.
+type LatencyHistogram struct {
+	Count uint64
+	Total time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+func newLatencyHistogram(l *internal.Latencies) LatencyHistogram {
+	h := l.Histogram()
+	return LatencyHistogram{
+		Count: h.Count(),
+		Total: time.Duration(h.Sum()),
+		P50:   time.Duration(h.Quantile(0.5)),
+		P90:   time.Duration(h.Quantile(0.9)),
+		P99:   time.Duration(h.Quantile(0.99)),
+		Max:   time.Duration(h.Quantile(1)),
+	}
 }
 
 // Stats returns statistics about the database including the number of
 // data files, keys and overall size on disk of the data
 func (b *Bitcask) Stats() (stats Stats, err error) {
-	if stats.Size, err = internal.DirSize(b.path); err != nil {
+	if stats.Size, err = fs.Size(b.fsys, b.path); err != nil {
 		return
 	}
 
-	b.mu.RLock()
-	stats.Datafiles = len(b.datafiles)
-	stats.Keys = b.trie.Size()
-	b.mu.RUnlock()
+	// Stats are read without locking so polling them never holds up
+	// writers, they may be slightly inconsistent with each other
+	keySizes := b.keySizes.Snapshot()
+	stats.Keys = int(keySizes.Count())
+	stats.KeySizes = newSizeHistogram(&keySizes)
+	valueSizes := b.valueSizes.Snapshot()
+	stats.ValueSizes = newSizeHistogram(&valueSizes)
+
+	var total int64
+	files, _ := b.files.Load().([]data.Datafile)
+	for _, df := range files {
+		total += df.Size()
+	}
+	if len(files) > 0 {
+		stats.Datafiles = len(files) - 1
+	}
+	stats.LiveBytes = atomic.LoadInt64(&b.liveBytes)
+	stats.DeadBytes = total - stats.LiveBytes
+
+	stats.Retries = atomic.LoadUint64(&b.retries)
+	stats.RetryFailures = atomic.LoadUint64(&b.retryFailures)
+	stats.BackgroundTasks = int(atomic.LoadInt64(&b.tasks.running))
+	stats.TaskPanics = atomic.LoadUint64(&b.tasks.panics)
+
+	stats.BytesWritten = atomic.LoadUint64(&b.bytesWritten)
+	stats.Merges = atomic.LoadUint64(&b.merges)
+	stats.MergeBytesRead = atomic.LoadUint64(&b.mergeBytesRead)
+	stats.MergeBytesWritten = atomic.LoadUint64(&b.mergeBytesWritten)
+	stats.MergeBytesReclaimed = atomic.LoadUint64(&b.mergeBytesReclaimed)
+	stats.AutoMergeErrors = atomic.LoadUint64(&b.autoMergeErrors)
+	stats.Evictions = atomic.LoadUint64(&b.evictions)
+	stats.Gets = atomic.LoadUint64(&b.gets)
+	stats.Puts = atomic.LoadUint64(&b.puts)
+	stats.Deletes = atomic.LoadUint64(&b.deletes)
+	stats.Syncs = atomic.LoadUint64(&b.syncs)
+	stats.ReadLatency = newLatencyHistogram(&b.readLatency)
+	stats.WriteLatency = newLatencyHistogram(&b.writeLatency)
+	stats.LastMergeDuration = time.Duration(atomic.LoadInt64(&b.lastMergeDuration))
+	stats.OpenDatafiles = b.fds.Len()
+	stats.IdleReleases = atomic.LoadUint64(&b.idleReleases)
+	stats.Corruptions = atomic.LoadUint64(&b.corruptions)
+	if stats.BytesWritten > 0 {
+		stats.WriteAmplification = float64(stats.BytesWritten+stats.MergeBytesWritten) / float64(stats.BytesWritten)
+	}
+	if stats.MergeBytesReclaimed > 0 {
+		stats.MergeReadAmplification = float64(stats.MergeBytesRead) / float64(stats.MergeBytesReclaimed)
+	}
+	b.bloomStats(&stats)
 
 	return
 }
 
+// datafileBytes returns the size of all datafiles. The caller must hold at
+// least the read lock.
+func (b *Bitcask) datafileBytes() int64 {
+	total := b.curr.Size()
+	for _, df := range b.datafiles {
+		total += df.Size()
+	}
+	return total
+}
+
+// publishDatafiles publishes the current set of datafiles for Stats(). The
+// caller must hold the write lock.
+func (b *Bitcask) publishDatafiles() {
+	files := make([]data.Datafile, 0, len(b.datafiles)+1)
+	if b.curr != nil {
+		files = append(files, b.curr)
+	}
+	for _, df := range b.datafiles {
+		files = append(files, df)
+	}
+	b.files.Store(files)
+}
+
+// observe records an operation started at `start` failing with `*err` for
+// Stats() and the metrics collector set with WithMetrics()
+func (b *Bitcask) observe(op metrics.Op, start time.Time, err *error) {
+	d := time.Since(start)
+	atomic.StoreInt64(&b.lastActive, start.Add(d).UnixNano())
+	switch op {
+	case metrics.Get:
+		atomic.AddUint64(&b.gets, 1)
+		b.readLatency.Observe(d)
+	case metrics.Put:
+		atomic.AddUint64(&b.puts, 1)
+		b.writeLatency.Observe(d)
+	case metrics.Delete:
+		atomic.AddUint64(&b.deletes, 1)
+		b.writeLatency.Observe(d)
+	case metrics.Merge:
+		if *err == nil {
+			atomic.StoreInt64(&b.lastMergeDuration, int64(d))
+		}
+	case metrics.Sync:
+		atomic.AddUint64(&b.syncs, 1)
+	}
+
+	if b.config.Metrics != nil {
+		b.config.Metrics.Observe(op, d, *err)
+	}
+}
+
 // Close closes the database and removes the lock. It is important to call
 // Close() as this is the only way to cleanup the lock held by the open
-// database.
+// database. All background tasks are stopped and waited for before the
+// database is closed.
 func (b *Bitcask) Close() error {
-	defer func() {
-		b.Flock.Unlock()
-		os.Remove(b.Flock.Path())
-	}()
+	b.tasks.close()
+	b.unwatchAll()
+	defer b.unlockShared()
+
+	// A read-only database holds no lock and must leave the writer's alone
+	if !b.config.ReadOnly && b.fsys == fs.OS {
+		defer func() {
+			b.Flock.Unlock()
+			os.Remove(b.Flock.Path())
+		}()
+	}
 
-	if err := b.indexer.Save(b.trie, filepath.Join(b.path, "index")); err != nil {
-		return err
+	return b.close()
+}
+
+// close saves the index and closes all datafiles without releasing the lock
+func (b *Bitcask) close() error {
+	if !b.config.ReadOnly {
+		if err := b.saveIndex(); err != nil {
+			return err
+		}
 	}
 
 	for _, df := range b.datafiles {
@@ -102,114 +573,664 @@ func (b *Bitcask) Close() error {
 		}
 	}
 
-	return b.curr.Close()
+	b.pinMu.Lock()
+	for id, df := range b.retired {
+		delete(b.retired, id)
+		if err := b.removeDatafile(df); err != nil {
+			b.pinMu.Unlock()
+			return err
+		}
+	}
+	b.pinMu.Unlock()
+
+	if err := b.curr.Close(); err != nil {
+		return err
+	}
+	if b.config.ActiveDir != "" && !b.config.ReadOnly {
+		return b.checkpoint(b.curr.FileID())
+	}
+	return nil
+}
+
+// Path returns the directory of the database
+func (b *Bitcask) Path() string {
+	return b.path
+}
+
+// FileSystem returns the file system storing the database
+func (b *Bitcask) FileSystem() fs.FileSystem {
+	return b.fsys
 }
 
 // Sync flushes all buffers to disk ensuring all data is written
 func (b *Bitcask) Sync() error {
-	return b.curr.Sync()
+	return b.sync(b.curr)
+}
+
+// sync syncs the datafile to disk retrying transient I/O errors
+func (b *Bitcask) sync(df data.Datafile) (err error) {
+	defer b.observe(metrics.Sync, time.Now(), &err)
+	return b.retry(df.Sync)
 }
 
 // Get retrieves the value of the given key. If the key is not found or an/I/O
 // error occurs a null byte slice is returned along with the error.
-func (b *Bitcask) Get(key []byte) ([]byte, error) {
-	var df data.Datafile
+func (b *Bitcask) Get(key []byte) (value []byte, err error) {
+	defer b.observe(metrics.Get, time.Now(), &err)
 
+	if !b.bloom.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	defer b.reads.foreground(time.Now())
 	b.mu.RLock()
+	defer b.mu.RUnlock()
+	value, err = b.get(key)
+	b.bloom.missed(err != ErrKeyNotFound)
+	if err == nil {
+		b.evictor.read(key)
+	}
+	return value, err
+}
+
+// Meta is the metadata stored along with a value
+type Meta struct {
+	// Expiry is when the key expires, zero if never (see PutWithTTL())
+	Expiry time.Time
+	// Origin is the id of the node that wrote the value, zero if unknown
+	// (see WithNodeID())
+	Origin uint32
+
+	// Version is the version of the value, which increases with every
+	// write to the database (see PutIfVersion()), and Timestamp when it was
+	// written, both zero if the format version does not store them. Size is
+	// the size of the value. They are only set by GetWithMeta().
+	Version   uint64
+	Timestamp time.Time
+	Size      int64
+}
+
+// GetWithMeta retrieves the value of the given key like Get() along with
+// its metadata
+func (b *Bitcask) GetWithMeta(key []byte) (value []byte, meta Meta, err error) {
+	defer b.observe(metrics.Get, time.Now(), &err)
+
+	if !b.bloom.mayContain(key) {
+		return nil, meta, ErrKeyNotFound
+	}
+
+	defer b.reads.foreground(time.Now())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, err := b.getEntry(key)
+	b.bloom.missed(err != ErrKeyNotFound)
+	if err != nil {
+		return nil, meta, err
+	}
+	b.evictor.read(key)
+	if e.Expiry != 0 {
+		meta.Expiry = time.Unix(0, e.Expiry)
+	}
+	meta.Origin = e.Origin
+	meta.Version = e.Version
+	if e.Timestamp != 0 {
+		meta.Timestamp = time.Unix(0, e.Timestamp)
+	}
+	value, err = b.value(e)
+	meta.Size = int64(len(value))
+	return value, meta, err
+}
+
+// ReadOptions are the options of a single read, see GetWithOptions()
+type ReadOptions struct {
+	// VerifyChecksum verifies the checksum of the value as Get() does,
+	// skipping it makes bulk reads faster but may return corrupted values
+	VerifyChecksum bool
+	// Snapshot reads the value as of the given snapshot rather than the
+	// current one, see Snapshot()
+	Snapshot *Snapshot
+	// Priority is the priority of the read, background reads such as bulk
+	// reads are throttled while foreground ones are slow (see Priority)
+	Priority Priority
+}
+
+// GetWithOptions retrieves the value of the given key like Get() with the
+// given options. Note that the zero ReadOptions do not verify checksums.
+func (b *Bitcask) GetWithOptions(key []byte, opts ReadOptions) (value []byte, err error) {
+	defer b.observe(metrics.Get, time.Now(), &err)
+
+	if opts.Priority == PriorityBackground {
+		b.reads.background()
+	} else {
+		defer b.reads.foreground(time.Now())
+	}
+	if opts.Snapshot != nil {
+		return opts.Snapshot.get(key, opts.VerifyChecksum)
+	}
+	if !b.bloom.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, err := b.readEntry(key, opts.VerifyChecksum)
+	b.bloom.missed(err != ErrKeyNotFound)
+	if err != nil {
+		return nil, err
+	}
+	b.evictor.read(key)
+	return b.value(e)
+}
+
+// get retrieves the value of the given key. The caller must hold at least
+// the read lock.
+func (b *Bitcask) get(key []byte) ([]byte, error) {
+	e, err := b.getEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.value(e)
+}
+
+// value returns the decrypted and decompressed value of the entry
+func (b *Bitcask) value(e internal.Entry) ([]byte, error) {
+	value, err := b.decrypt(e.Value)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Compression(e.Compression).Decompress(value, b.config.MaxValueSize)
+}
+
+// encode compresses the value of the entry as configured, unless it does
+// not get any smaller, and then encrypts it. Tombstones are left as is.
+func (b *Bitcask) encode(e *internal.Entry) error {
+	if len(e.Value) == 0 {
+		return nil
+	}
+
+	if compression := b.compression(e.Key); compression != codec.CompressionNone {
+		value, err := compression.Compress(e.Value)
+		if err != nil {
+			return err
+		}
+		if len(value) < len(e.Value) {
+			e.Value = value
+			e.Compression = uint8(compression)
+		}
+	}
+
+	value, err := b.encrypt(e.Value)
+	if err != nil {
+		return err
+	}
+	e.Value = value
+	e.Checksum = crc32.ChecksumIEEE(value)
+	return nil
+}
+
+// compression returns how the value of the key is compressed as configured,
+// see WithPrefixCodec()
+func (b *Bitcask) compression(key []byte) codec.Compression {
+	compression, longest := b.config.Compression, -1
+	for _, p := range b.config.PrefixCompression {
+		if len(p.Prefix) > longest && bytes.HasPrefix(key, p.Prefix) {
+			compression, longest = p.Compression, len(p.Prefix)
+		}
+	}
+	return codec.Compression(compression)
+}
+
+// recompress compresses the value of the entry as currently configured if
+// it was compressed otherwise, so merges convert the values written before
+// the compression was changed. The entry is left as is if it would get
+// larger, as merges reserve datafile ids for the live bytes as they are.
+func (b *Bitcask) recompress(e internal.Entry) (internal.Entry, error) {
+	if len(e.Value) == 0 || e.Compression == uint8(b.compression(e.Key)) {
+		return e, nil
+	}
+
+	value, err := b.value(e)
+	if err != nil {
+		return e, err
+	}
+	re := e
+	re.Value, re.Compression = value, 0
+	if err := b.encode(&re); err != nil {
+		return e, err
+	}
+	if len(re.Value) > len(e.Value) {
+		return e, nil
+	}
+	return re, nil
+}
+
+// getEntry retrieves the entry of the given key as per get()
+func (b *Bitcask) getEntry(key []byte) (internal.Entry, error) {
+	return b.readEntry(key, true)
+}
+
+// readEntry retrieves the entry of the given key verifying its checksum if
+// `verify` is set. The caller must hold at least the read lock.
+func (b *Bitcask) readEntry(key []byte, verify bool) (internal.Entry, error) {
+	var df data.Datafile
+
 	value, found := b.trie.Search(key)
 	if !found {
-		b.mu.RUnlock()
-		return nil, ErrKeyNotFound
+		return internal.Entry{}, ErrKeyNotFound
 	}
 
 	item := value.(internal.Item)
+	if item.Expired(b.now().UnixNano()) {
+		return internal.Entry{}, ErrKeyNotFound
+	}
 
 	if item.FileID == b.curr.FileID() {
 		df = b.curr
 	} else {
 		df = b.datafiles[item.FileID]
 	}
+	if df == nil {
+		return internal.Entry{}, b.onCorruption(key, item, ErrCorrupted)
+	}
 
-	e, err := df.ReadAt(item.Offset, item.Size)
-	b.mu.RUnlock()
+	var e internal.Entry
+	err := b.retry(func() (err error) {
+		e, err = df.ReadAt(item.Offset, item.Size)
+		return
+	})
+	if err == io.EOF || codec.IsCorruptedData(err) {
+		return internal.Entry{}, b.onCorruption(key, item, ErrCorrupted)
+	}
 	if err != nil {
-		return nil, err
+		return internal.Entry{}, err
 	}
 
-	checksum := crc32.ChecksumIEEE(e.Value)
-	if checksum != e.Checksum {
-		return nil, ErrChecksumFailed
+	if verify && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return internal.Entry{}, b.onCorruption(key, item, ErrChecksumFailed)
+	}
+	if !bytes.Equal(e.Key, key) {
+		return internal.Entry{}, b.onCorruption(key, item, ErrCorrupted)
 	}
 
-	return e.Value, nil
+	return e, nil
 }
 
 // Has returns true if the key exists in the database, false otherwise.
 func (b *Bitcask) Has(key []byte) bool {
+	if !b.bloom.mayContain(key) {
+		return false
+	}
+
 	b.mu.RLock()
-	_, found := b.trie.Search(key)
+	value, found := b.trie.Search(key)
 	b.mu.RUnlock()
+	found = found && !value.(internal.Item).Expired(b.now().UnixNano())
+	b.bloom.missed(found)
 	return found
 }
 
-// Put stores the key and value in the database.
+// HasMulti returns whether each of the given keys exists in the database
+// like Has(), all checked against the index at the same time
+func (b *Bitcask) HasMulti(keys [][]byte) []bool {
+	found := make([]bool, len(keys))
+	now := b.now().UnixNano()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for i, key := range keys {
+		if !b.bloom.mayContain(key) {
+			continue
+		}
+		value, ok := b.trie.Search(key)
+		found[i] = ok && !value.(internal.Item).Expired(now)
+		b.bloom.missed(found[i])
+	}
+	return found
+}
+
+// Put stores the key and value in the database. Concurrent calls write
+// their entries in parallel and only serialize to reserve space in the
+// current datafile and to update the index.
 func (b *Bitcask) Put(key, value []byte) error {
+	return b.putEntry(b.newEntry(key, value), WriteOptions{})
+}
+
+// PutWithTTL stores the key and value in the database like Put() with the
+// key expiring after the given ttl. Expired keys are not found by Get() and
+// Has(), skipped by Keys(), Scan() and Fold() and removed by Merge().
+// The database must use format version 2, see WithFormatVersion().
+func (b *Bitcask) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if !b.format().HasExpiry() {
+		return ErrTTLNotSupported
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	e := b.newEntry(key, value)
+	e.Expiry = b.now().Add(ttl).UnixNano()
+	return b.putEntry(e, WriteOptions{})
+}
+
+// PutWithMeta stores the key and value in the database like Put() with the
+// given metadata rather than the metadata of this database, e.g. to restore
+// or combine the keys of several nodes. A zero expiry or origin is not
+// stored. The database must use a format version storing the metadata.
+func (b *Bitcask) PutWithMeta(key, value []byte, meta Meta) error {
+	if !meta.Expiry.IsZero() && !b.format().HasExpiry() {
+		return ErrTTLNotSupported
+	}
+	if meta.Origin != 0 && !b.format().HasOrigin() {
+		return ErrOriginNotSupported
+	}
+
+	e := internal.NewEntry(key, value)
+	if !meta.Expiry.IsZero() {
+		e.Expiry = meta.Expiry.UnixNano()
+	}
+	e.Origin = meta.Origin
+	return b.putEntry(e, WriteOptions{})
+}
+
+// WriteOptions are the options of a single write, see PutWithOptions()
+type WriteOptions struct {
+	// TTL expires the key after the given duration as with PutWithTTL(),
+	// taking precedence over Meta.Expiry
+	TTL time.Duration
+	// Sync syncs the value to disk before returning as if the database was
+	// opened with WithSync(true)
+	Sync bool
+	// Meta is the metadata stored with the value as with PutWithMeta(),
+	// except that a zero origin stores the node id of this database
+	Meta Meta
+	// NoOverwrite fails with ErrKeyExists rather than overwriting the value
+	// of a key that exists
+	NoOverwrite bool
+}
+
+// PutWithOptions stores the key and value in the database like Put() with
+// the given options. The zero WriteOptions write like Put().
+func (b *Bitcask) PutWithOptions(key, value []byte, opts WriteOptions) error {
+	if opts.TTL < 0 {
+		return ErrInvalidTTL
+	}
+	if (opts.TTL > 0 || !opts.Meta.Expiry.IsZero()) && !b.format().HasExpiry() {
+		return ErrTTLNotSupported
+	}
+	if opts.Meta.Origin != 0 && !b.format().HasOrigin() {
+		return ErrOriginNotSupported
+	}
+
+	e := b.newEntry(key, value)
+	if opts.Meta.Origin != 0 {
+		e.Origin = opts.Meta.Origin
+	}
+	if opts.TTL > 0 {
+		e.Expiry = b.now().Add(opts.TTL).UnixNano()
+	} else if !opts.Meta.Expiry.IsZero() {
+		e.Expiry = opts.Meta.Expiry.UnixNano()
+	}
+	return b.putEntry(e, opts)
+}
+
+// newEntry returns a new entry written by this node
+func (b *Bitcask) newEntry(key, value []byte) internal.Entry {
+	e := internal.NewEntry(key, value)
+	e.Origin = b.config.NodeID
+	return e
+}
+
+// putEntry stores the entry as per Put() with the sync and overwrite
+// behaviour of the given options
+func (b *Bitcask) putEntry(e internal.Entry, opts WriteOptions) error {
+	return b.putEntryIf(e, opts, nil)
+}
+
+// putEntryIf stores the entry as per putEntry() if `check`, called with the
+// write lock held and no Put() in flight, returns no error
+func (b *Bitcask) putEntryIf(e internal.Entry, opts WriteOptions, check func() error) (err error) {
+	defer b.observe(metrics.Put, time.Now(), &err)
+
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	key, value := e.Key, e.Value
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
 	if uint32(len(key)) > b.config.MaxKeySize {
 		return ErrKeyTooLarge
 	}
-	if uint64(len(value)) > b.config.MaxValueSize {
+	if uint64(len(value)) > b.maxValueSize() {
 		return ErrValueTooLarge
 	}
 
+	if err := b.encode(&e); err != nil {
+		return err
+	}
+
 	b.mu.Lock()
-	offset, n, err := b.put(key, value)
+	if opts.NoOverwrite {
+		// The key may be written by a Put() not published yet
+		b.quiesce()
+		if item, found := b.trie.Search(key); found && !item.(internal.Item).Expired(b.now().UnixNano()) {
+			b.mu.Unlock()
+			return ErrKeyExists
+		}
+	}
+	if check != nil {
+		b.quiesce()
+		if err := check(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	if err := b.validate(key, value); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if b.limited() && b.evictor == nil {
+		b.quiesce()
+		if err := b.checkLimits([]internal.Entry{e}); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+
+	// Wait for in-flight writes to the current datafile before rotating it
+	for b.curr.Size() >= int64(b.config.MaxDatafileSize) {
+		if b.inflight > 0 {
+			b.writers.Wait()
+			continue
+		}
+		if err := b.rotate(1); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+
+	// Reserve space for the entry and a ticket ordering its publication in
+	// the index, the entry itself is written without holding the lock
+	b.stamp(&e)
+	curr := b.curr
+	offset, n, err := curr.Reserve(e)
 	if err != nil {
 		b.mu.Unlock()
 		return err
 	}
+	ticket := b.tickets
+	b.tickets++
+	b.inflight++
+	b.mu.Unlock()
+
+	err = curr.WriteAt(e, offset)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Publish in reservation order so the index always agrees with the
+	// order of the entries on disk, and acknowledge the entry only once all
+	// entries reserved before it are written and synced: recovery truncates
+	// a datafile at the first entry never written
+	for b.published != ticket {
+		b.writers.Wait()
+	}
+	if err == nil && b.writeErr != nil {
+		err = b.writeErr
+	}
+	if err == nil && (b.config.Sync || opts.Sync) {
+		b.mu.Unlock()
+		err = b.sync(curr)
+		b.mu.Lock()
+	}
+	if err != nil && b.writeErr == nil {
+		b.writeErr, b.writeErrOffset = err, offset
+	}
+	b.published++
+	b.inflight--
+	b.writers.Broadcast()
+
+	if b.writeErr != nil && b.inflight == 0 {
+		// Nothing is written after a failed entry, the entries reserved
+		// after it failed too
+		if terr := curr.Truncate(b.writeErrOffset); terr != nil {
+			return terr
+		}
+		b.writeErr = nil
+		if rerr := b.rotate(1); rerr != nil {
+			return rerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&b.bytesWritten, uint64(n))
+
+	item := internal.Item{FileID: curr.FileID(), Offset: offset, Size: n, Expiry: e.Expiry}
+	if old, updated := b.trie.Insert(key, item); updated {
+		b.untrackSizes(key, old.(internal.Item))
+	}
+	b.trackSizes(key, item)
+	b.addBloom(key)
+	b.notifyPut(key, item)
+
+	return b.evict(key)
+}
+
+// quiesce waits for all in-flight Put() calls to be published. The caller
+// must hold the write lock, which is released while waiting, and must call
+// quiesce before anything else that relies on the lock.
+func (b *Bitcask) quiesce() {
+	for b.inflight > 0 {
+		b.writers.Wait()
+	}
+}
+
+// set stores the key and value and indexes it. The caller must hold the
+// write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) set(key, value []byte) error {
+	if err := b.validate(key, value); err != nil {
+		return err
+	}
+	if err := b.checkLimits([]internal.Entry{b.newEntry(key, value)}); err != nil {
+		return err
+	}
+
+	offset, n, err := b.put(key, value)
+	if err != nil {
+		return err
+	}
 
 	if b.config.Sync {
-		if err := b.curr.Sync(); err != nil {
-			b.mu.Unlock()
+		if err := b.sync(b.curr); err != nil {
 			return err
 		}
 	}
 
 	item := internal.Item{FileID: b.curr.FileID(), Offset: offset, Size: n}
-	b.trie.Insert(key, item)
-	b.mu.Unlock()
+	if old, updated := b.trie.Insert(key, item); updated {
+		b.untrackSizes(key, old.(internal.Item))
+	}
+	b.trackSizes(key, item)
+	b.addBloom(key)
+	b.notifyPut(key, item)
 
-	return nil
+	return b.evict(key)
 }
 
 // Delete deletes the named key. If the key doesn't exist or an I/O error
 // occurs the error is returned.
-func (b *Bitcask) Delete(key []byte) error {
+//
+// In trash mode (see WithTrash()) an existing key is moved to the trash
+// instead, unless it is already in the trash.
+func (b *Bitcask) Delete(key []byte) (err error) {
+	defer b.observe(metrics.Delete, time.Now(), &err)
+
 	b.mu.Lock()
-	_, _, err := b.put(key, []byte{})
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	return b.delete(key)
+}
+
+// delete deletes the key as per Delete(). The caller must hold the write
+// lock with no Put() in flight, see quiesce().
+func (b *Bitcask) delete(key []byte) error {
+	if b.config.TrashWindow > 0 {
+		if trashed, err := b.trash(key); trashed || err != nil {
+			return err
+		}
+	}
+
+	offset, n, err := b.put(key, []byte{})
 	if err != nil {
-		b.mu.Unlock()
 		return err
 	}
-	b.trie.Delete(key)
-	b.mu.Unlock()
+	if old, deleted := b.trie.Delete(key); deleted {
+		b.untrackSizes(key, old.(internal.Item))
+		b.notifyDelete(key, Seq{FileID: b.curr.FileID(), Offset: offset + n})
+	}
 
 	return nil
 }
 
 // DeleteAll deletes all the keys. If an I/O error occurs the error is returned.
+//
+// In trash mode (see WithTrash()) all keys not in the trash yet are moved to
+// the trash instead, as a single batch like RenamePrefix().
 func (b *Bitcask) DeleteAll() (err error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	defer b.observe(metrics.Delete, time.Now(), &err)
+
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if b.config.TrashWindow > 0 {
+		return b.trashAll()
+	}
 
 	b.trie.ForEach(func(node art.Node) bool {
-		_, _, err = b.put(node.Key(), []byte{})
-		return err == nil
+		var offset, n int64
+		if offset, n, err = b.put(node.Key(), []byte{}); err != nil {
+			return false
+		}
+		b.notifyDelete(node.Key(), Seq{FileID: b.curr.FileID(), Offset: offset + n})
+		b.markDirty(node.Key())
+		return true
 	})
 	b.trie = art.New()
+	b.evictor.load(b.trie)
+	b.keySizes.Reset()
+	b.valueSizes.Reset()
+	atomic.StoreInt64(&b.liveBytes, 0)
+	b.rebuildBloom(0)
 
 	return
 }
@@ -217,38 +1238,64 @@ func (b *Bitcask) DeleteAll() (err error) {
 // Scan performs a prefix scan of keys matching the given prefix and calling
 // the function `f` with the keys found. If the function returns an error
 // no further keys are processed and the first error returned.
-func (b *Bitcask) Scan(prefix []byte, f func(key []byte) error) (err error) {
-	b.trie.ForEachPrefix(prefix, func(node art.Node) bool {
-		// Skip the root node
-		if len(node.Key()) == 0 {
-			return true
+//
+// Like Fold() the scan iterates over a snapshot of the matching keys.
+func (b *Bitcask) Scan(prefix []byte, f func(key []byte) error) error {
+	b.mu.RLock()
+	s := b.snapshot(prefix)
+	b.mu.RUnlock()
+	defer s.release()
+
+	for _, key := range s.keys {
+		if err := f(key); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if err = f(node.Key()); err != nil {
-			return false
+// Range calls the function `f` with the keys between `start` and `end`
+// (both inclusive) in order. If the function returns an error no further
+// keys are processed and the error returned.
+//
+// Like Fold() the range iterates over a snapshot of the matching keys.
+func (b *Bitcask) Range(start, end []byte, f func(key []byte) error) error {
+	b.mu.RLock()
+	s := b.snapshotRange(start, end)
+	b.mu.RUnlock()
+	defer s.release()
+
+	for _, key := range s.keys {
+		if err := f(key); err != nil {
+			return err
 		}
-		return true
-	})
-	return
+	}
+	return nil
 }
 
-// Len returns the total number of keys in the database
+// Len returns the total number of keys in the database, including expired
+// keys not yet removed by Merge()
 func (b *Bitcask) Len() int {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.trie.Size()
 }
 
-// Keys returns all keys in the database as a channel of keys
+// Keys returns all keys in the database as a channel of keys. The keys are
+// taken from a snapshot of the index at the time of the call which is held
+// until the channel has been drained.
 func (b *Bitcask) Keys() chan []byte {
+	b.mu.RLock()
+	s := b.snapshot(nil)
+	b.mu.RUnlock()
+
 	ch := make(chan []byte)
 	go func() {
-		b.mu.RLock()
-		defer b.mu.RUnlock()
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), b.labels("keys")))
+		defer s.release()
 
-		for it := b.trie.Iterator(); it.HasNext(); {
-			node, _ := it.Next()
-			ch <- node.Key()
+		for _, key := range s.keys {
+			ch <- key
 		}
 		close(ch)
 	}()
@@ -259,153 +1306,631 @@ func (b *Bitcask) Keys() chan []byte {
 // Fold iterates over all keys in the database calling the function `f` for
 // each key. If the function returns an error, no further keys are processed
 // and the error returned.
-func (b *Bitcask) Fold(f func(key []byte) error) (err error) {
+//
+// Fold iterates over a snapshot of the keys taken when it is called and
+// does not hold any lock while calling `f`, so `f` is free to read and
+// write the database and a concurrent Merge() does not remove datafiles
+// from under it. Keys written after the snapshot are not visited.
+func (b *Bitcask) Fold(f func(key []byte) error) error {
 	b.mu.RLock()
-	defer b.mu.RUnlock()
+	s := b.snapshot(nil)
+	b.mu.RUnlock()
+	defer s.release()
+
+	for _, key := range s.keys {
+		if err := f(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put inserts a new (key, value). Both key and value are valid inputs. The
+// caller must hold the write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) put(key, value []byte) (int64, int64, error) {
+	if b.config.ReadOnly {
+		return -1, 0, ErrReadOnly
+	}
+
+	size := b.curr.Size()
+	if size >= int64(b.config.MaxDatafileSize) {
+		if err := b.rotate(1); err != nil {
+			return -1, 0, err
+		}
+	}
+
+	e := b.newEntry(key, value)
+	if err := b.encode(&e); err != nil {
+		return -1, 0, err
+	}
+	b.stamp(&e)
+	offset, n, err := b.curr.Write(e)
+	if err != nil {
+		return offset, n, err
+	}
+	atomic.AddUint64(&b.bytesWritten, uint64(n))
+	return offset, n, nil
+}
+
+// position returns the position of the datafiles the index is saved at. The
+// caller must hold the write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) position() index.Position {
+	ids := make([]int, 0, len(b.datafiles))
+	for id := range b.datafiles {
+		if id != b.curr.FileID() {
+			ids = append(ids, id)
+		}
+	}
+	return index.Position{Generation: index.Generation(ids), FileID: b.curr.FileID(), Offset: b.curr.Size()}
+}
+
+// format returns the on-disk format of the datafiles
+func (b *Bitcask) format() codec.Format {
+	return codec.Format(b.config.FormatVersion)
+}
+
+// rotate closes the current datafile, reopening it read-only, and starts a
+// new current datafile `gap` ids after it. The caller must hold the write
+// lock.
+func (b *Bitcask) rotate(gap int) error {
+	if err := b.curr.Close(); err != nil {
+		return err
+	}
+
+	id := b.curr.FileID()
+	if b.config.ActiveDir != "" {
+		if err := b.checkpoint(id); err != nil {
+			return err
+		}
+	}
+
+	df, err := b.fds.Open(b.path, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+	if err != nil {
+		return err
+	}
+
+	b.datafiles[id] = df
+
+	curr, err := data.NewDatafile(b.fsys, b.currDir(), id+gap, false, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+	if err != nil {
+		return err
+	}
+	b.curr = curr
+	b.publishDatafiles()
+
+	return nil
+}
+
+// trackSizes records the key and value size of a live item in the size
+// histograms, untrackSizes removes them once the item is overwritten or
+// deleted. The caller must hold the write lock.
+func (b *Bitcask) trackSizes(key []byte, item internal.Item) {
+	b.markDirty(key)
+	b.evictor.add(key)
+	atomic.AddInt64(&b.liveBytes, item.Size)
+	b.keySizes.Add(uint64(len(key)))
+	b.valueSizes.Add(b.format().ValueSize(uint64(len(key)), item.Size, item.Expiry))
+}
+
+func (b *Bitcask) untrackSizes(key []byte, item internal.Item) {
+	b.markDirty(key)
+	b.evictor.remove(key)
+	atomic.AddInt64(&b.liveBytes, -item.Size)
+	b.keySizes.Remove(uint64(len(key)))
+	b.valueSizes.Remove(b.format().ValueSize(uint64(len(key)), item.Size, item.Expiry))
+}
+
+// retry calls `fn` retrying transient I/O errors as per the configured
+// retry policy and records the outcome for Stats()
+func (b *Bitcask) retry(fn func() error) error {
+	retries, err := internal.Retry(b.config.RetryAttempts, b.config.RetryBackoff, fn)
+	if retries > 0 {
+		atomic.AddUint64(&b.retries, uint64(retries))
+	}
+	if err != nil && internal.IsTransientError(err) {
+		atomic.AddUint64(&b.retryFailures, 1)
+	}
+	return err
+}
+
+// Reopen reloads the datafiles and the index of the database from disk.
+// If the index has to be rebuilt from the datafiles this is recorded as a
+// recovery (see LastRecovery()).
+func (b *Bitcask) Reopen() error {
+	report, err := b.reopen(nil)
+	if err != nil {
+		return err
+	}
+	b.recovered(report)
+	return nil
+}
+
+// reopen reloads the datafiles and the index. If the index had to be
+// rebuilt this is recorded in the given recovery report (created if nil)
+// which is returned, otherwise the given report is returned unchanged.
+func (b *Bitcask) reopen(report *internal.RecoveryReport) (*internal.RecoveryReport, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if b.config.ActiveDir != "" && !b.config.ReadOnly {
+		if err := b.restoreActive(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !b.config.TolerateInvalidDatafiles {
+		if err := checkDatafiles(b.fsys, b.path, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.loadBuckets(); err != nil {
+		return nil, err
+	}
+
+	// The index saved by the writer is stale, rebuild it from the datafiles
+	if b.config.ReadOnly {
+		return report, b.refresh(true)
+	}
+
+	return b.load(report)
+}
+
+// load loads the datafiles and the index of a writable database as reopen()
+// does. The caller must hold the write lock.
+func (b *Bitcask) load(report *internal.RecoveryReport) (*internal.RecoveryReport, error) {
+	datafiles, lastID, err := loadDatafiles(b.fsys, b.fds, b.path, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+	if err != nil {
+		return nil, err
+	}
+	t, found, err := loadIndex(b.fsys, b.path, b.indexer, b.config.MaxKeySize, datafiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// The datafiles checkpointed from the active directory are immutable
+	if b.config.ActiveDir != "" && len(datafiles) > 0 {
+		lastID++
+	}
+	curr, err := data.NewDatafile(b.fsys, b.currDir(), lastID, false, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && len(datafiles) > 0 {
+		if report == nil {
+			report = &internal.RecoveryReport{Time: time.Now()}
+		}
+		report.IndexRebuilt = true
+		report.IndexedKeys = t.Size()
+	}
+
+	b.trie = t
+	b.curr = curr
+	b.datafiles = datafiles
+	b.publishDatafiles()
+	b.dropBuckets()
+	if b.version, err = b.lastVersion(); err != nil {
+		return nil, err
+	}
 
+	b.keySizes.Reset()
+	b.valueSizes.Reset()
+	atomic.StoreInt64(&b.liveBytes, 0)
 	b.trie.ForEach(func(node art.Node) bool {
-		if err = f(node.Key()); err != nil {
-			return false
-		}
+		b.trackSizes(node.Key(), node.Value().(internal.Item))
 		return true
 	})
+	b.evictor.load(b.trie)
+	b.rebuildBloom(b.trie.Size())
 
-	return
+	// The deltas of the index left by a crash are compacted into it
+	if fs.Exists(b.fsys, filepath.Join(b.path, "index.log")) {
+		if err := b.saveIndex(); err != nil {
+			return nil, err
+		}
+	} else if err := b.resetIndexLog(b.position()); err != nil {
+		return nil, err
+	}
+
+	return report, nil
 }
 
-// put inserts a new (key, value). Both key and value are valid inputs.
-func (b *Bitcask) put(key, value []byte) (int64, int64, error) {
-	size := b.curr.Size()
-	if size >= int64(b.config.MaxDatafileSize) {
-		err := b.curr.Close()
-		if err != nil {
-			return -1, 0, err
-		}
+// recovered records the given recovery report (if any) as the last recovery
+// and passes it to the configured recovery handler
+func (b *Bitcask) recovered(report *internal.RecoveryReport) {
+	if report == nil {
+		return
+	}
 
-		id := b.curr.FileID()
+	b.mu.Lock()
+	b.lastRecovery = report
+	b.mu.Unlock()
 
-		df, err := data.NewDatafile(b.path, id, true, b.config.MaxKeySize, b.config.MaxValueSize)
-		if err != nil {
-			return -1, 0, err
-		}
+	if b.config.RecoveryHandler != nil {
+		b.config.RecoveryHandler(*report)
+	}
+}
 
-		b.datafiles[id] = df
+// LastRecovery returns a report of the last recovery performed on the
+// database, such as truncating the corrupted tail of a datafile or
+// rebuilding the index, or nil if no recovery was needed since the database
+// was opened.
+func (b *Bitcask) LastRecovery() *RecoveryReport {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-		id = b.curr.FileID() + 1
-		curr, err := data.NewDatafile(b.path, id, false, b.config.MaxKeySize, b.config.MaxValueSize)
-		if err != nil {
-			return -1, 0, err
-		}
-		b.curr = curr
+	if b.lastRecovery == nil {
+		return nil
 	}
+	report := *b.lastRecovery
+	return &report
+}
 
-	e := internal.NewEntry(key, value)
-	return b.curr.Write(e)
+// Merge merges all datafiles in the database. Old keys are squashed
+// and deleted keys removes. Duplicate key/value pairs are also removed.
+// Call this function periodically to reclaim disk space.
+//
+// Reads and writes continue while a merge is running and datafiles still
+// in use by Fold(), Scan() or Keys() are only removed once they are done.
+// Only one merge may run at a time, otherwise ErrMergeInProgress is
+// returned. If there is not enough free disk space for the merged datafiles
+// (leaving the minimum set with WithMinFreeDiskSpace) ErrInsufficientDiskSpace
+// is returned before anything is written.
+//
+// With WithMaxFilesPerMerge(n) a merge only merges the n oldest datafiles
+// of the merge pass in progress, and the next merge continues the pass, even
+// after the database is reopened, until all datafiles the pass started with
+// were merged.
+//
+// MergeWithOptions() also reports the progress of the merge, limits its I/O
+// rate or only merges the datafiles with the most dead bytes.
+func (b *Bitcask) Merge() error {
+	return b.MergeContext(context.Background())
 }
 
-func (b *Bitcask) Reopen() error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// MergeContext merges the database like Merge() unless the context is done
+// first. A merge aborted by the context leaves the database as it was and
+// returns the error of the context.
+func (b *Bitcask) MergeContext(ctx context.Context) (err error) {
+	pprof.Do(ctx, b.labels("merge"), func(ctx context.Context) {
+		err = b.merge(ctx, MergeOptions{})
+	})
+	return
+}
 
-	datafiles, lastID, err := loadDatafiles(b.path, b.config.MaxKeySize, b.config.MaxValueSize)
-	if err != nil {
+// labels returns the pprof labels used to annotate internal work of the
+// given kind so it can be told apart in CPU and goroutine profiles
+func (b *Bitcask) labels(task string) pprof.LabelSet {
+	return pprof.Labels("bitcask", task, "path", b.path)
+}
+
+// merge rewrites the live entries of the immutable datafiles (see
+// mergeDatafiles()) into new datafiles without blocking reads and writes for
+// the duration:
+//
+//  1. With the write lock held the current datafile is rotated and a
+//     snapshot of the index is taken. The new current datafile is started
+//     far enough ahead to leave a gap in the datafile ids for the merged
+//     datafiles, so entries written during the merge still take precedence
+//     over the merged ones should the index ever be rebuilt.
+//  2. Without any lock held the live entries of the snapshot are copied
+//     into the merged datafiles which are then moved into the database.
+//  3. With the write lock held again keys that were not changed in the
+//     meantime are pointed at the merged datafiles and the old datafiles
+//     are removed, or retired until no snapshot pins them anymore.
+//
+// The merge is aborted if the context is done before step 2 moves the merged
+// datafiles into the database.
+func (b *Bitcask) merge(ctx context.Context, opts MergeOptions) (err error) {
+	defer b.observe(metrics.Merge, time.Now(), &err)
+
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if !atomic.CompareAndSwapInt32(&b.merging, 0, 1) {
+		return ErrMergeInProgress
+	}
+	defer atomic.StoreInt32(&b.merging, 0)
+
+	if b.frozen() {
+		return ErrFrozen
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	t, err := loadIndex(b.path, b.indexer, b.config.MaxKeySize, datafiles)
+
+	sizeBefore, err := fs.Size(b.fsys, b.path)
 	if err != nil {
 		return err
 	}
 
-	curr, err := data.NewDatafile(b.path, lastID, false, b.config.MaxKeySize, b.config.MaxValueSize)
+	// Temporary path for the merged datafiles
+	temp, err := fs.TempDir(b.fsys, b.path, "merge")
 	if err != nil {
 		return err
 	}
+	defer b.fsys.RemoveAll(temp)
 
-	b.trie = t
-	b.curr = curr
-	b.datafiles = datafiles
-
-	return nil
-}
+	b.mu.Lock()
+	b.quiesce()
+	s := b.snapshot(nil)
+	defer s.release()
+
+	liveBytes := make(map[int]int64)
+	liveItems := make(map[int]int)
+	for _, item := range s.items {
+		liveBytes[item.FileID] += item.Size
+		liveItems[item.FileID]++
+	}
 
-// Merge merges all datafiles in the database. Old keys are squashed
-// and deleted keys removes. Duplicate key/value pairs are also removed.
-// Call this function periodically to reclaim disk space.
-func (b *Bitcask) Merge() error {
-	// Temporary merged database path
-	temp, err := ioutil.TempDir(b.path, "merge")
-	if err != nil {
+	merged, passEnd := b.mergeDatafiles()
+	if opts.MinDeadRatio > 0 {
+		if merged = b.deadDatafiles(merged, liveBytes, opts.MinDeadRatio); len(merged) == 0 {
+			b.mu.Unlock()
+			return nil
+		}
+	}
+	inMerge := make(map[int]bool, len(merged))
+	deadBytes := make(map[int]int64, len(merged))
+	var live int64
+	for _, id := range merged {
+		inMerge[id] = true
+		live += liveBytes[id]
+		if opts.Progress != nil {
+			size := b.curr.Size()
+			if df, ok := b.datafiles[id]; ok {
+				size = df.Size()
+			}
+			deadBytes[id] = size - liveBytes[id]
+		}
+	}
+	// Refuse to merge rather than run out of disk space half way through
+	if err := checkMergeSpace(b.path, b.config, live); err != nil {
+		b.mu.Unlock()
 		return err
 	}
-	defer os.RemoveAll(temp)
 
-	// Create a merged database
-	mdb, err := Open(temp, b.options...)
-	if err != nil {
+	gap := int(live/int64(b.config.MaxDatafileSize)) + 1
+	if err := b.rotate(gap + 1); err != nil {
+		b.mu.Unlock()
 		return err
 	}
+	first := b.curr.FileID() - gap
+	b.mu.Unlock()
 
-	// Rewrite all key/value pairs into merged database
-	// Doing this automatically strips deleted keys and
-	// old key/value pairs
-	err = b.Fold(func(key []byte) error {
-		value, err := b.Get(key)
+	// Rewrite all live entries into the merged datafiles. Doing this
+	// automatically strips deleted keys and old key/value pairs
+	var (
+		out          data.Datafile
+		ids          []int
+		items        = make([]internal.Item, len(s.items))
+		bytesRead    uint64
+		bytesWritten uint64
+		progress     = MergeProgress{TotalDatafiles: len(merged)}
+		limiter      = newThrottle(opts.RateLimit)
+	)
+	// done reports the progress once all live entries of a datafile were
+	// copied, see copied()
+	done := func(id int) {
+		progress.Datafiles++
+		progress.BytesCopied = bytesWritten
+		progress.BytesReclaimed += uint64(deadBytes[id])
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	copied := func(id int) {
+		if liveItems[id]--; liveItems[id] == 0 {
+			done(id)
+		}
+	}
+	for _, id := range merged {
+		if liveItems[id] == 0 {
+			done(id)
+		}
+	}
+	for i := range s.keys {
+		if !inMerge[s.items[i].FileID] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			if out != nil {
+				out.Close()
+			}
+			return err
+		}
+		b.reads.background()
+		e, err := s.entry(i, true)
+		if err == ErrKeyNotFound {
+			// Corrupted and dropped as per the corruption policy
+			copied(s.items[i].FileID)
+			continue
+		}
 		if err != nil {
+			if out != nil {
+				out.Close()
+			}
+			return err
+		}
+		bytesRead += uint64(s.items[i].Size)
+		if e, err = b.recompress(e); err != nil {
+			if out != nil {
+				out.Close()
+			}
 			return err
 		}
 
-		if err := mdb.Put(key, value); err != nil {
+		if out == nil || out.Size() >= int64(b.config.MaxDatafileSize) {
+			if out != nil {
+				if err := out.Close(); err != nil {
+					return err
+				}
+			}
+			out, err = data.NewDatafile(b.fsys, temp, first+len(ids), false, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+			if err != nil {
+				return err
+			}
+			ids = append(ids, out.FileID())
+		}
+
+		offset, n, err := out.Write(e)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		bytesWritten += uint64(n)
+		items[i] = internal.Item{FileID: out.FileID(), Offset: offset, Size: n, Expiry: e.Expiry}
+		copied(s.items[i].FileID)
+		if err := limiter.wait(ctx, s.items[i].Size+n); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if out != nil {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	// Only the gap of the last merge of a merge pass is left, the others are
+	// filled with empty datafiles which the next pass merges away
+	for passEnd != 0 && len(ids) < gap {
+		out, err := data.NewDatafile(b.fsys, temp, first+len(ids), false, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+		if err != nil {
+			return err
+		}
+		if err := out.Close(); err != nil {
 			return err
 		}
+		ids = append(ids, out.FileID())
+	}
 
-		return nil
-	})
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-
-	err = mdb.Close()
-	if err != nil {
+	// Seqs before the merged datafiles are not replayable anymore
+	if err := b.saveMergedEnd(first + gap); err != nil {
 		return err
 	}
 
-	// Close the database
-	err = b.Close()
-	if err != nil {
-		return err
+	// Move the merged datafiles into the database
+	datafiles := make([]data.Datafile, 0, len(ids))
+	for _, id := range ids {
+		name := fmt.Sprintf("%09d.data", id)
+		if err := b.fsys.Rename(filepath.Join(temp, name), filepath.Join(b.path, name)); err != nil {
+			return err
+		}
+		df, err := b.fds.Open(b.path, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+		if err != nil {
+			return err
+		}
+		datafiles = append(datafiles, df)
 	}
 
-	// Remove all data files
-	files, err := ioutil.ReadDir(b.path)
-	if err != nil {
+	b.mu.Lock()
+	b.quiesce()
+	for i, key := range s.keys {
+		if !inMerge[s.items[i].FileID] {
+			continue
+		}
+		if value, found := b.trie.Search(key); found && value.(internal.Item) == s.items[i] {
+			if items[i].Size == 0 {
+				// Dropped as corrupted
+				b.trie.Delete(key)
+				b.untrackSizes(key, s.items[i])
+				continue
+			}
+			b.trie.Insert(key, items[i])
+		}
+	}
+	// Expired keys were not merged, remove them unless written meanwhile
+	for i, key := range s.expired {
+		if value, found := b.trie.Search(key); found && value.(internal.Item) == s.expiredItems[i] {
+			b.trie.Delete(key)
+			b.untrackSizes(key, s.expiredItems[i])
+		}
+	}
+	for _, df := range datafiles {
+		b.datafiles[df.FileID()] = df
+	}
+	b.publishDatafiles()
+	// Drop the keys deleted since the filter was built
+	b.rebuildBloom(b.trie.Size())
+	// The merged datafiles may hold the latest version
+	if err := b.saveVersion(b.position()); err != nil {
+		b.mu.Unlock()
 		return err
 	}
-	for _, file := range files {
-		if !file.IsDir() {
-			err := os.RemoveAll(path.Join([]string{b.path, file.Name()}...))
-			if err != nil {
+	for _, id := range merged {
+		if df, ok := b.datafiles[id]; ok {
+			if err := b.retire(df); err != nil {
+				b.mu.Unlock()
 				return err
 			}
 		}
 	}
+	if err := b.pruneBuckets(); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	err = b.saveIndex()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.release()
+
+	if err := b.saveMergePass(passEnd); err != nil {
+		return err
+	}
+
+	atomic.AddUint64(&b.merges, 1)
+	atomic.AddUint64(&b.mergeBytesRead, bytesRead)
+	atomic.AddUint64(&b.mergeBytesWritten, bytesWritten)
+	if sizeAfter, err := fs.Size(b.fsys, b.path); err == nil && sizeAfter < sizeBefore {
+		atomic.AddUint64(&b.mergeBytesReclaimed, uint64(sizeBefore-sizeAfter))
+	}
+
+	return nil
+}
 
-	// Rename all merged data files
-	files, err = ioutil.ReadDir(mdb.path)
+// removeMergeDebris removes the temporary directories of merges and backups
+// that were interrupted by a crash
+func removeMergeDebris(fsys fs.FileSystem, path string) error {
+	dirs, err := fs.Glob(fsys, path, "merge[0-9]*")
 	if err != nil {
 		return err
 	}
-	for _, file := range files {
-		err := os.Rename(
-			path.Join([]string{mdb.path, file.Name()}...),
-			path.Join([]string{b.path, file.Name()}...),
-		)
-		if err != nil {
+	backups, err := fs.Glob(fsys, path, "backup[0-9]*")
+	if err != nil {
+		return err
+	}
+	for _, dir := range append(dirs, backups...) {
+		if err := fsys.RemoveAll(dir); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	// And finally reopen the database
-	return b.Reopen()
+// fileSystem returns the file system the database at the given path is
+// stored in: the one of the options, a new in-memory one for MemoryPath or
+// the operating system's
+func fileSystem(path string, options []Option) fs.FileSystem {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		// Errors are reported when the options are applied again by Open()
+		_ = opt(cfg)
+	}
+	if cfg.FileSystem != nil {
+		return cfg.FileSystem
+	}
+	if path == MemoryPath {
+		return fs.NewMemory()
+	}
+	return fs.OS
 }
 
 // Open opens the database at the given path with optional options.
@@ -417,61 +1942,250 @@ func Open(path string, options ...Option) (*Bitcask, error) {
 		err error
 	)
 
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return nil, err
-	}
-
+	fsys := fileSystem(path, options)
 	configPath := filepath.Join(path, "config.json")
-	if internal.Exists(configPath) {
-		cfg, err = config.Load(configPath)
+	exists := fs.Exists(fsys, configPath)
+	if exists {
+		cfg, err = config.Load(fsys, configPath)
 		if err != nil {
 			return nil, err
 		}
+		// Runtime options are not persisted, see newDefaultConfig()
+		cfg.RetryAttempts, cfg.RetryBackoff = DefaultRetryAttempts, DefaultRetryBackoff
+		cfg.TaskRestarts, cfg.TaskBackoff = DefaultTaskRestarts, DefaultTaskBackoff
 	} else {
 		cfg = newDefaultConfig()
 	}
+	formatVersion := cfg.FormatVersion
 
 	bitcask := &Bitcask{
-		Flock:   flock.New(filepath.Join(path, "lock")),
+		Flock:   newFlock(filepath.Join(path, "lock")),
 		config:  cfg,
 		options: options,
 		path:    path,
-		indexer: index.NewIndexer(),
+		fsys:    fsys,
+		indexer: index.NewIndexer(fsys),
+		schemas: make(map[string]Schema),
+		pins:    make(map[int]int),
+		retired: make(map[int]data.Datafile),
+		now:     time.Now,
 	}
+	bitcask.writers = sync.NewCond(&bitcask.mu)
 
 	for _, opt := range options {
 		if err := opt(bitcask.config); err != nil {
 			return nil, err
 		}
 	}
+	cfg.FileSystem = fsys
 
-	locked, err := bitcask.Flock.TryLock()
-	if err != nil {
+	if cfg.ReadOnly {
+		if !exists {
+			return nil, &os.PathError{Op: "open", Path: configPath, Err: os.ErrNotExist}
+		}
+	} else if err := bitcask.fsys.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	if !codec.Format(cfg.FormatVersion).Valid() {
+		return nil, ErrUnsupportedFormatVersion
+	}
+	if cfg.NodeID != 0 && !codec.Format(cfg.FormatVersion).HasOrigin() {
+		return nil, ErrOriginNotSupported
+	}
+	if cfg.TrashWindow > 0 && !codec.Format(cfg.FormatVersion).HasExpiry() {
+		return nil, ErrTTLNotSupported
+	}
+	if !codec.Compression(cfg.Compression).Valid() {
+		return nil, ErrUnsupportedCompression
+	}
+	if cfg.Compression != 0 && !codec.Format(cfg.FormatVersion).HasCompression() {
+		return nil, ErrCompressionNotSupported
+	}
+	for _, p := range cfg.PrefixCompression {
+		if !codec.Compression(p.Compression).Valid() {
+			return nil, ErrUnsupportedCompression
+		}
+		if p.Compression != 0 && !codec.Format(cfg.FormatVersion).HasCompression() {
+			return nil, ErrCompressionNotSupported
+		}
+	}
+	if exists && cfg.FormatVersion != formatVersion {
+		fns, err := internal.GetDatafiles(bitcask.fsys, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(fns) > 0 {
+			return nil, ErrFormatVersionMismatch
+		}
+	}
+
+	if bitcask.aead, err = openEncryption(path, cfg); err != nil {
+		return nil, err
+	}
+
+	bitcask.tasks = newTasks(cfg.WorkerPool, cfg.TaskRestarts, cfg.TaskBackoff)
+	bitcask.fds = data.NewCache(bitcask.fsys, cfg.MaxOpenFiles, cfg.IdleTimeout > 0, cfg.DisableMMap)
+	if cfg.BloomFilter > 0 {
+		bitcask.bloom = &bloom{fpr: cfg.BloomFilter}
+	}
+	bitcask.reads = newReadScheduler(cfg.ReadLatencyTarget)
+	if !cfg.ReadOnly && bitcask.limited() && EvictionPolicy(cfg.EvictionPolicy) != EvictNone {
+		bitcask.evictor = newEvictor(EvictionPolicy(cfg.EvictionPolicy))
+	}
+	bitcask.lastActive = time.Now().UnixNano()
+
+	if err := preflight(path, cfg); err != nil {
 		return nil, err
 	}
 
-	if !locked {
-		return nil, ErrDatabaseLocked
+	if cfg.ReadOnly {
+		if cfg.Shared {
+			if bitcask.frozenIDs, err = bitcask.loadFrozen(); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := bitcask.reopen(nil); err != nil {
+			bitcask.unlockShared()
+			return nil, err
+		}
+		bitcask.openedAt(time.Now())
+		if cfg.IdleTimeout > 0 {
+			bitcask.tasks.run(bitcask.labels("idle"), bitcask.releaseIdle)
+		}
+		return bitcask, nil
+	}
+
+	// Databases in other file systems than the operating system's are not
+	// shared between processes
+	if bitcask.fsys == fs.OS {
+		if err := bitcask.lock(); err != nil {
+			return nil, err
+		}
 	}
 
+	// Release the lock if the database fails to open
+	opened := false
+	defer func() {
+		if !opened {
+			bitcask.Flock.Unlock()
+		}
+	}()
+
 	if err := cfg.Save(configPath); err != nil {
 		return nil, err
 	}
 
+	if err := removeMergeDebris(bitcask.fsys, path); err != nil {
+		return nil, err
+	}
+
+	var report *internal.RecoveryReport
 	if cfg.AutoRecovery {
-		if err := data.CheckAndRecover(path, cfg); err != nil {
+		if report, err = data.CheckAndRecover(path, cfg); err != nil {
 			return nil, fmt.Errorf("recovering database: %s", err)
 		}
 	}
-	if err := bitcask.Reopen(); err != nil {
+	if report, err = bitcask.reopen(report); err != nil {
 		return nil, err
 	}
+	bitcask.recovered(report)
+	bitcask.openedAt(time.Now())
+
+	if cfg.AutoMergeInterval > 0 {
+		bitcask.tasks.run(bitcask.labels("automerge"), bitcask.autoMerge)
+	}
+	if cfg.IdleTimeout > 0 {
+		bitcask.tasks.run(bitcask.labels("idle"), bitcask.releaseIdle)
+	}
+	if cfg.SyncInterval > 0 {
+		bitcask.tasks.run(bitcask.labels("sync"), bitcask.syncPeriodically)
+	}
+	if cfg.IndexLogInterval > 0 {
+		bitcask.tasks.run(bitcask.labels("indexlog"), bitcask.logIndexPeriodically)
+	}
+	if cfg.ActiveDir != "" && cfg.CheckpointInterval > 0 {
+		bitcask.tasks.run(bitcask.labels("checkpoint"), bitcask.checkpointPeriodically)
+	}
 
+	opened = true
 	return bitcask, nil
 }
 
-func loadDatafiles(path string, maxKeySize uint32, maxValueSize uint64) (datafiles map[int]data.Datafile, lastID int, err error) {
-	fns, err := internal.GetDatafiles(path)
+// indexDatafile indexes the entries of the datafile in order, skipping
+// those before the offset `from`. The entries of a batch are only indexed
+// if the batch was completely written. If `tail` is set the datafile may
+// still be written to by another process, so indexing stops at the first
+// entry that is not completely written yet.
+func indexDatafile(t art.Tree, df data.Datafile, from int64, tail bool) error {
+	index := func(e internal.Entry, offset, n int64) {
+		if offset < from {
+			return
+		}
+		// Tombstone value  (deleted key)
+		if len(e.Value) == 0 {
+			t.Delete(e.Key)
+			return
+		}
+		t.Insert(e.Key, internal.Item{FileID: df.FileID(), Offset: offset, Size: n, Expiry: e.Expiry})
+	}
+
+	var offset int64
+	for {
+		e, n, err := df.Read()
+		if err != nil {
+			if err == io.EOF || tail {
+				return nil
+			}
+			return err
+		}
+		if tail && incomplete(e) {
+			return nil
+		}
+
+		count, ok := data.BatchHeader(e)
+		if !ok {
+			index(e, offset, n)
+			offset += n
+			continue
+		}
+		offset += n
+
+		type batchEntry struct {
+			e         internal.Entry
+			offset, n int64
+		}
+		batch := make([]batchEntry, 0, count)
+		for len(batch) < count {
+			e, n, err := df.Read()
+			if err == io.EOF || err != nil && tail || err == nil && tail && incomplete(e) {
+				// Partially written batch at the end of the datafile
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			batch = append(batch, batchEntry{e, offset, n})
+			offset += n
+		}
+		for _, be := range batch {
+			index(be.e, be.offset, be.n)
+		}
+	}
+}
+
+// incomplete returns true for an entry read from the tail of a datafile
+// that is not completely written yet, such as the space reserved by a
+// concurrent Put() in another process
+func incomplete(e internal.Entry) bool {
+	if _, ok := data.BatchHeader(e); ok {
+		return false
+	}
+	return len(e.Key) == 0 || crc32.ChecksumIEEE(e.Value) != e.Checksum
+}
+
+func loadDatafiles(fsys fs.FileSystem, fds *data.Cache, path string, maxKeySize uint32, maxValueSize uint64, format codec.Format) (datafiles map[int]data.Datafile, lastID int, err error) {
+	fns, err := internal.GetDatafiles(fsys, path)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -483,7 +2197,7 @@ func loadDatafiles(path string, maxKeySize uint32, maxValueSize uint64) (datafil
 
 	datafiles = make(map[int]data.Datafile, len(ids))
 	for _, id := range ids {
-		datafiles[id], err = data.NewDatafile(path, id, true, maxKeySize, maxValueSize)
+		datafiles[id], err = fds.Open(path, id, maxKeySize, maxValueSize, format)
 		if err != nil {
 			return
 		}
@@ -508,34 +2222,61 @@ func getSortedDatafiles(datafiles map[int]data.Datafile) []data.Datafile {
 	return out
 }
 
-func loadIndex(path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile) (art.Tree, error) {
-	t, found, err := indexer.Load(filepath.Join(path, "index"), maxKeySize)
-	if err != nil {
-		return nil, err
+// loadIndex loads the saved index along with the deltas of the index log
+// following it (see WithIndexLog()) and indexes the entries written after
+// them, or rebuilds the index from the datafiles if it was not saved,
+// is corrupted or was saved before the datafiles were last merged. It
+// returns false if the index was rebuilt.
+func loadIndex(fsys fs.FileSystem, path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile) (art.Tree, bool, error) {
+	t, pos, found, err := indexer.Load(filepath.Join(path, "index"), maxKeySize)
+	if err != nil && !index.IsIndexCorruption(err) {
+		return nil, found, err
 	}
-	if !found {
-		sortedDatafiles := getSortedDatafiles(datafiles)
-		for _, df := range sortedDatafiles {
-			var offset int64
-			for {
-				e, n, err := df.Read()
-				if err != nil {
-					if err == io.EOF {
-						break
-					}
-					return nil, err
-				}
-				// Tombstone value  (deleted key)
-				if len(e.Value) == 0 {
-					t.Delete(e.Key)
-					offset += n
+	if found && (err != nil || !indexedUpTo(pos, datafiles)) {
+		t, found = art.New(), false
+	}
+	if found {
+		valid := func(pos index.Position) bool { return indexedUpTo(pos, datafiles) }
+		if pos, err = index.ApplyDeltas(fsys, filepath.Join(path, "index.log"), t, pos, maxKeySize, valid); err != nil {
+			return nil, found, err
+		}
+	}
+
+	for _, df := range getSortedDatafiles(datafiles) {
+		var from int64
+		if found {
+			if df.FileID() < pos.FileID {
+				continue
+			}
+			if df.FileID() == pos.FileID {
+				// A current datafile shorter than the position was
+				// truncated, there is nothing to catch up with
+				if df.Size() <= pos.Offset {
 					continue
 				}
-				item := internal.Item{FileID: df.FileID(), Offset: offset, Size: n}
-				t.Insert(e.Key, item)
-				offset += n
+				from = pos.Offset
 			}
 		}
+		if err := indexDatafile(t, df, from, false); err != nil {
+			return nil, found, err
+		}
+	}
+	return t, found, nil
+}
+
+// indexedUpTo returns true if the index saved at the position indexes the
+// datafiles up to it: the immutable datafiles are still of its generation
+// and its current datafile still exists
+func indexedUpTo(pos index.Position, datafiles map[int]data.Datafile) bool {
+	if _, ok := datafiles[pos.FileID]; !ok {
+		return false
+	}
+
+	var ids []int
+	for id := range datafiles {
+		if id < pos.FileID {
+			ids = append(ids, id)
+		}
 	}
-	return t, nil
+	return index.Generation(ids) == pos.Generation
 }
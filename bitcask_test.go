@@ -1,32 +1,76 @@
 package bitcask
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/prologic/bitcask/filter"
+	"github.com/prologic/bitcask/fs"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/index"
 	"github.com/prologic/bitcask/internal/mocks"
+	"github.com/prologic/bitcask/metrics"
 )
 
 var (
 	ErrMockError = errors.New("error: mock error")
 )
 
+// faultyFS calls fault with the data written to its files, failing the write
+// if it returns an error
+type faultyFS struct {
+	fs.FileSystem
+	fault func(p []byte) error
+}
+
+func (fsys *faultyFS) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	f, err := fsys.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: f, fault: fsys.fault}, nil
+}
+
+type faultyFile struct {
+	fs.File
+	fault func(p []byte) error
+}
+
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fault(p); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
 type sortByteArrays [][]byte
 
 func (b sortByteArrays) Len() int {
@@ -59,6 +103,12 @@ func skipIfWindows(t *testing.T) {
 	}
 }
 
+func skipIfNoFreeDiskSpace(t *testing.T) {
+	if _, ok, _ := internal.FreeDiskSpace(os.TempDir()); !ok {
+		t.Skip("Skipping this test as free disk space is unavailable")
+	}
+}
+
 func TestAll(t *testing.T) {
 	var (
 		db      *Bitcask
@@ -95,6 +145,11 @@ func TestAll(t *testing.T) {
 		assert.True(db.Has([]byte("foo")))
 	})
 
+	t.Run("HasMulti", func(t *testing.T) {
+		assert.Equal([]bool{true, false, true}, db.HasMulti([][]byte{[]byte("foo"), []byte("bar"), []byte("foo")}))
+		assert.Equal([]bool{}, db.HasMulti(nil))
+	})
+
 	t.Run("Keys", func(t *testing.T) {
 		keys := make([][]byte, 0)
 		for key := range db.Keys() {
@@ -379,7 +434,14 @@ func TestAutoRecovery(t *testing.T) {
 			err = f.Close()
 			require.NoError(err)
 
-			db, err = Open(testdir, WithAutoRecovery(autoRecovery))
+			var reports []RecoveryReport
+			db, err = Open(
+				testdir,
+				WithAutoRecovery(autoRecovery),
+				WithRecoveryHandler(func(report RecoveryReport) {
+					reports = append(reports, report)
+				}),
+			)
 			require.NoError(err)
 			defer db.Close()
 			// Check that all values but the last are still intact.
@@ -400,9 +462,20 @@ func TestAutoRecovery(t *testing.T) {
 				// in a corrupted state. The index isn't coherent with
 				// the datafile.
 				require.Equal(n, numKeys)
+				require.Nil(db.LastRecovery())
+				require.Empty(reports)
 				return
 			}
 
+			report := db.LastRecovery()
+			require.NotNil(report)
+			require.Equal("000000000.data", report.Datafile)
+			require.Equal(int64(len("foo9")+len("bar9")+codec.MetaInfoSize-1), report.TruncatedBytes)
+			require.Equal(n-1, report.RecoveredEntries)
+			require.True(report.IndexRebuilt)
+			require.Equal(n-1, report.IndexedKeys)
+			require.Equal([]RecoveryReport{*report}, reports)
+
 			require.Equal(n-1, numKeys, "The index should have n-1 keys")
 
 			// Double-check explicitly the corrupted one isn't here.
@@ -658,11 +731,71 @@ func TestStats(t *testing.T) {
 			assert.Equal(stats.Keys, 1)
 		})
 
+		t.Run("SizeHistograms", func(t *testing.T) {
+			assert.NoError(db.Put([]byte("hello"), []byte("world, hello!")))
+			assert.NoError(db.Put([]byte("hello"), []byte("world")))
+			assert.NoError(db.Put([]byte("deleted"), []byte("value")))
+			assert.NoError(db.Delete([]byte("deleted")))
+
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(uint64(2), stats.KeySizes.Count)
+			assert.Equal(uint64(8), stats.KeySizes.Total)
+			assert.Equal(uint64(7), stats.KeySizes.Max)
+			assert.Equal(uint64(2), stats.ValueSizes.Count)
+			assert.Equal(uint64(8), stats.ValueSizes.Total)
+			assert.Equal([]internal.Bucket{{UpperBound: 3, Count: 1}, {UpperBound: 7, Count: 1}}, stats.ValueSizes.Buckets)
+
+			assert.NoError(db.Reopen())
+			stats, err = db.Stats()
+			assert.NoError(err)
+			assert.Equal(uint64(2), stats.ValueSizes.Count)
+			assert.Equal(uint64(8), stats.ValueSizes.Total)
+		})
+
 		t.Run("Sync", func(t *testing.T) {
 			err = db.Sync()
 			assert.NoError(err)
 		})
 
+		t.Run("Operations", func(t *testing.T) {
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(uint64(1), stats.Gets)
+			assert.Equal(uint64(4), stats.Puts)
+			assert.Equal(uint64(1), stats.Deletes)
+			assert.Equal(uint64(1), stats.Syncs)
+			assert.Equal(uint64(1), stats.ReadLatency.Count)
+			assert.Equal(uint64(5), stats.WriteLatency.Count)
+			assert.True(stats.WriteLatency.Max >= stats.WriteLatency.P50)
+			assert.True(stats.LiveBytes > 0)
+			assert.True(stats.DeadBytes > 0)
+
+			assert.NoError(db.Merge())
+			stats, err = db.Stats()
+			assert.NoError(err)
+			assert.True(stats.LastMergeDuration > 0)
+			assert.Equal(int64(0), stats.DeadBytes)
+		})
+
+		t.Run("WithoutLocking", func(t *testing.T) {
+			db.mu.Lock()
+			done := make(chan Stats)
+			go func() {
+				stats, err := db.Stats()
+				assert.NoError(err)
+				done <- stats
+			}()
+			select {
+			case stats := <-done:
+				assert.Equal(db.trie.Size(), stats.Keys)
+				assert.Equal(len(db.datafiles), stats.Datafiles)
+			case <-time.After(5 * time.Second):
+				t.Error("Stats() is blocked by the write lock")
+			}
+			db.mu.Unlock()
+		})
+
 		t.Run("Close", func(t *testing.T) {
 			err = db.Close()
 			assert.NoError(err)
@@ -670,6 +803,43 @@ func TestStats(t *testing.T) {
 	})
 }
 
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var (
+		mu     sync.Mutex
+		ops    []metrics.Op
+		failed []metrics.Op
+	)
+	collector := metrics.CollectorFunc(func(op metrics.Op, d time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		ops = append(ops, op)
+		if err != nil {
+			failed = append(failed, op)
+		}
+	})
+
+	db, err := Open(testdir, WithMetrics(collector), WithSync(true))
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	_, err = db.Get([]byte("foo"))
+	assert.NoError(err)
+	_, err = db.Get([]byte("bar"))
+	assert.Equal(ErrKeyNotFound, err)
+	assert.NoError(db.Delete([]byte("foo")))
+	assert.NoError(db.Merge())
+
+	assert.Equal([]metrics.Op{metrics.Sync, metrics.Put, metrics.Get, metrics.Get, metrics.Delete, metrics.Merge}, ops)
+	assert.Equal([]metrics.Op{metrics.Get}, failed)
+}
+
 func TestStatsError(t *testing.T) {
 	var (
 		db  *Bitcask
@@ -829,6 +999,14 @@ func TestMerge(t *testing.T) {
 		assert.True(s3.Size > s1.Size)
 		assert.True(s3.Size < s2.Size)
 
+		assert.Equal(uint64(1), s3.Merges)
+		assert.Equal(uint64(11*22), s3.BytesWritten)
+		assert.Equal(uint64(22), s3.MergeBytesRead)
+		assert.Equal(uint64(22), s3.MergeBytesWritten)
+		assert.True(s3.MergeBytesReclaimed > 0)
+		assert.Equal(float64(12)/float64(11), s3.WriteAmplification)
+		assert.Equal(float64(22)/float64(s3.MergeBytesReclaimed), s3.MergeReadAmplification)
+
 		t.Run("Sync", func(t *testing.T) {
 			err = db.Sync()
 			assert.NoError(err)
@@ -895,6 +1073,91 @@ func TestGetErrors(t *testing.T) {
 		_, err = db.Get([]byte("foo"))
 		assert.Error(err)
 		assert.Equal(ErrChecksumFailed, err)
+
+		_, err = db.GetWithOptions([]byte("foo"), ReadOptions{VerifyChecksum: true})
+		assert.Equal(ErrChecksumFailed, err)
+		val, err := db.GetWithOptions([]byte("foo"), ReadOptions{})
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("TransientReadError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32), WithRetryPolicy(2, 0))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Size").Return(int64(22))
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.Entry{},
+			syscall.EINTR,
+		).Once()
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.NewEntry([]byte("foo"), []byte("bar")),
+			nil,
+		)
+		db.curr = mockDatafile
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(1), stats.Retries)
+		assert.Equal(uint64(0), stats.RetryFailures)
+	})
+
+	t.Run("RetryPolicyNotPersisted", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithRetryPolicy(0, 0))
+		assert.NoError(err)
+		assert.NoError(db.Close())
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+		assert.Equal(DefaultRetryAttempts, db.config.RetryAttempts)
+		assert.Equal(DefaultRetryBackoff, db.config.RetryBackoff)
+	})
+
+	t.Run("TransientReadErrorExhausted", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32), WithRetryPolicy(2, 0))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Size").Return(int64(22))
+		mockDatafile.On("ReadAt", int64(0), int64(22)).Return(
+			internal.Entry{},
+			syscall.EAGAIN,
+		)
+		db.curr = mockDatafile
+
+		_, err = db.Get([]byte("foo"))
+		assert.Equal(syscall.EAGAIN, err)
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(2), stats.Retries)
+		assert.Equal(uint64(1), stats.RetryFailures)
 	})
 
 }
@@ -927,17 +1190,19 @@ func TestPutErrors(t *testing.T) {
 		db, err := Open(testdir)
 		assert.NoError(err)
 
+		e := internal.Entry{
+			Checksum: 0x76ff8caa,
+			Key:      []byte("foo"),
+			Offset:   0,
+			Value:    []byte("bar"),
+		}
 		mockDatafile := new(mocks.Datafile)
 		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x76ff8caa,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte("bar"),
-			},
-		).Return(int64(0), int64(0), ErrMockError)
+		mockDatafile.On("Reserve", e).Return(int64(0), int64(22), nil)
+		mockDatafile.On("WriteAt", e, int64(0)).Return(ErrMockError)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Truncate", int64(0)).Return(nil)
+		mockDatafile.On("Close").Return(nil)
 		db.curr = mockDatafile
 
 		err = db.Put([]byte("foo"), []byte("bar"))
@@ -951,18 +1216,20 @@ func TestPutErrors(t *testing.T) {
 		db, err := Open(testdir, WithSync(true))
 		assert.NoError(err)
 
+		e := internal.Entry{
+			Checksum: 0x78240498,
+			Key:      []byte("bar"),
+			Offset:   0,
+			Value:    []byte("baz"),
+		}
 		mockDatafile := new(mocks.Datafile)
 		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x78240498,
-				Key:      []byte("bar"),
-				Offset:   0,
-				Value:    []byte("baz"),
-			},
-		).Return(int64(0), int64(0), nil)
+		mockDatafile.On("Reserve", e).Return(int64(0), int64(22), nil)
+		mockDatafile.On("WriteAt", e, int64(0)).Return(nil)
 		mockDatafile.On("Sync").Return(ErrMockError)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Truncate", int64(0)).Return(nil)
+		mockDatafile.On("Close").Return(nil)
 		db.curr = mockDatafile
 
 		err = db.Put([]byte("bar"), []byte("baz"))
@@ -970,6 +1237,54 @@ func TestPutErrors(t *testing.T) {
 		assert.Equal(ErrMockError, err)
 	})
 
+	t.Run("WriteErrorHole", func(t *testing.T) {
+		started := make(chan struct{})
+		written := make(chan struct{})
+		release := make(chan struct{})
+		fsys := &faultyFS{FileSystem: fs.NewMemory(), fault: func(p []byte) error {
+			switch {
+			case bytes.Contains(p, []byte("slow")):
+				close(started)
+				<-release
+				return ErrMockError
+			case bytes.Contains(p, []byte("fast")):
+				close(written)
+			}
+			return nil
+		}}
+		db, err := Open("db", WithFileSystem(fsys))
+		require.NoError(t, err)
+		require.NoError(t, db.Put([]byte("a"), []byte("1")))
+
+		// The entry reserved after the failed one is written but lost with
+		// it on recovery, so it fails too
+		errs := make(chan error, 2)
+		go func() { errs <- db.Put([]byte("slow"), []byte("2")) }()
+		<-started
+		go func() { errs <- db.Put([]byte("fast"), []byte("3")) }()
+		<-written
+		close(release)
+		assert.Equal(ErrMockError, <-errs)
+		assert.Equal(ErrMockError, <-errs)
+
+		require.NoError(t, db.Put([]byte("b"), []byte("4")))
+		require.NoError(t, db.Close())
+
+		// Nothing was written after the hole, rebuild the index from the
+		// datafiles
+		require.NoError(t, fsys.Remove("db/index"))
+		db, err = Open("db", WithFileSystem(fsys))
+		require.NoError(t, err)
+		defer db.Close()
+		for key, value := range map[string]string{"a": "1", "b": "4"} {
+			v, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal([]byte(value), v)
+		}
+		assert.False(db.Has([]byte("slow")))
+		assert.False(db.Has([]byte("fast")))
+	})
+
 	t.Run("EmptyKey", func(t *testing.T) {
 		testdir, err := ioutil.TempDir("", "bitcask")
 		assert.NoError(err)
@@ -1034,6 +1349,97 @@ func TestOpenErrors(t *testing.T) {
 		assert.Error(err)
 		assert.Equal("strconv.ParseInt: parsing \"000000000xxx\": invalid syntax", err.Error())
 	})
+
+	t.Run("InsufficientDiskSpace", func(t *testing.T) {
+		skipIfNoFreeDiskSpace(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		_, err = Open(testdir, WithMinFreeDiskSpace(^uint64(0)))
+		assert.Error(err)
+		assert.True(errors.Is(err, ErrInsufficientDiskSpace))
+
+		// The failed preflight check must not leave the database locked
+		db, err := Open(testdir, WithMinFreeDiskSpace(1))
+		assert.NoError(err)
+		assert.NoError(db.Close())
+	})
+
+	t.Run("InvalidDatafiles", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			corrupt func(testdir string) error
+		}{
+			{"DuplicateId", func(testdir string) error {
+				return os.Link(filepath.Join(testdir, "000000000.data"), filepath.Join(testdir, "0.data"))
+			}},
+			{"FutureFile", func(testdir string) error {
+				future := time.Now().Add(time.Hour)
+				return os.Chtimes(filepath.Join(testdir, "000000000.data"), future, future)
+			}},
+			{"MissingFiles", func(testdir string) error {
+				for _, id := range []int{3, 5} {
+					fn := filepath.Join(testdir, fmt.Sprintf("%09d.data", id))
+					if err := ioutil.WriteFile(fn, nil, 0600); err != nil {
+						return err
+					}
+				}
+				return nil
+			}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				testdir, err := ioutil.TempDir("", "bitcask")
+				assert.NoError(err)
+				defer os.RemoveAll(testdir)
+
+				db, err := Open(testdir)
+				assert.NoError(err)
+				assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+				assert.NoError(db.Close())
+
+				assert.NoError(tt.corrupt(testdir))
+
+				_, err = Open(testdir)
+				assert.Error(err)
+				assert.True(errors.Is(err, ErrInvalidDatafiles))
+
+				db, err = Open(testdir, WithTolerateInvalidDatafiles(true))
+				assert.NoError(err)
+				val, err := db.Get([]byte("foo"))
+				assert.NoError(err)
+				assert.Equal([]byte("bar"), val)
+				assert.NoError(db.Close())
+
+				// Tolerating them once does not persist
+				_, err = Open(testdir)
+				assert.True(errors.Is(err, ErrInvalidDatafiles))
+			})
+		}
+	})
+
+	t.Run("MergeGap", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+		assert.NoError(db.Merge())
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Merge())
+		assert.NoError(db.Close())
+
+		// The gap left by the merge is expected
+		db, err = Open(testdir)
+		assert.NoError(err)
+		assert.NoError(db.Close())
+	})
 }
 
 func TestCloseErrors(t *testing.T) {
@@ -1048,7 +1454,7 @@ func TestCloseErrors(t *testing.T) {
 		assert.NoError(err)
 
 		mockIndexer := new(mocks.Indexer)
-		mockIndexer.On("Save", db.trie, filepath.Join(db.path, "index")).Return(ErrMockError)
+		mockIndexer.On("Save", db.trie, db.position(), filepath.Join(db.path, "index")).Return(ErrMockError)
 		db.indexer = mockIndexer
 
 		err = db.Close()
@@ -1074,6 +1480,8 @@ func TestCloseErrors(t *testing.T) {
 		assert.NoError(err)
 
 		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Size").Return(int64(0))
 		mockDatafile.On("Close").Return(ErrMockError)
 		db.curr = mockDatafile
 
@@ -1143,6 +1551,8 @@ func TestMergeErrors(t *testing.T) {
 		assert.NoError(err)
 
 		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Size").Return(int64(0))
 		mockDatafile.On("Close").Return(ErrMockError)
 		db.curr = mockDatafile
 
@@ -1156,10 +1566,13 @@ func TestMergeErrors(t *testing.T) {
 		assert.NoError(err)
 		defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir)
+		db, err := Open(testdir, WithMaxDatafileSize(22))
 		assert.NoError(err)
 
+		// foo is written to the first datafile which is immutable by the
+		// time bar is written
 		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("bar"), []byte("baz")))
 
 		mockDatafile := new(mocks.Datafile)
 		mockDatafile.On("FileID").Return(0)
@@ -1167,13 +1580,163 @@ func TestMergeErrors(t *testing.T) {
 			internal.Entry{},
 			ErrMockError,
 		)
-		db.curr = mockDatafile
+		db.datafiles[0] = mockDatafile
 
 		err = db.Merge()
 		assert.Error(err)
 		assert.Equal(ErrMockError, err)
 	})
 
+	t.Run("InsufficientDiskSpace", func(t *testing.T) {
+		skipIfNoFreeDiskSpace(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 4; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		}
+		s1, err := db.Stats()
+		assert.NoError(err)
+
+		db.config.MinFreeDiskSpace = 1 << 62
+		err = db.Merge()
+		assert.True(errors.Is(err, ErrInsufficientDiskSpace))
+
+		// Nothing was merged and no temporary files are left behind
+		s2, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(s1.Datafiles, s2.Datafiles)
+		dirs, err := filepath.Glob(filepath.Join(testdir, "merge*"))
+		assert.NoError(err)
+		assert.Empty(dirs)
+
+		db.config.MinFreeDiskSpace = 0
+		assert.NoError(db.Merge())
+	})
+
+	t.Run("RemoveDebris", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		// Simulate a merge interrupted by a crash
+		debris := filepath.Join(testdir, "merge123456")
+		assert.NoError(os.MkdirAll(debris, 0755))
+		assert.NoError(ioutil.WriteFile(filepath.Join(debris, "000000001.data"), []byte("foo"), 0600))
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.False(internal.Exists(debris))
+	})
+
+}
+
+func TestMergeWithOptions(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	open := func(options ...Option) (*Bitcask, func()) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		db, err := Open(testdir, options...)
+		require.NoError(err)
+		return db, func() {
+			db.Close()
+			os.RemoveAll(testdir)
+		}
+	}
+
+	t.Run("Progress", func(t *testing.T) {
+		db, cleanup := open(WithMaxDatafileSize(64))
+		defer cleanup()
+
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		}
+		for i := 0; i < 5; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("changed")))
+		}
+
+		var progress []MergeProgress
+		require.NoError(db.MergeWithOptions(MergeOptions{
+			Progress: func(p MergeProgress) { progress = append(progress, p) },
+		}))
+
+		require.NotEmpty(progress)
+		last := progress[len(progress)-1]
+		assert.Equal(len(progress), last.TotalDatafiles)
+		assert.Equal(last.TotalDatafiles, last.Datafiles)
+		assert.True(last.BytesCopied > 0)
+		assert.True(last.BytesReclaimed > 0)
+		for i := 1; i < len(progress); i++ {
+			assert.Equal(progress[i-1].Datafiles+1, progress[i].Datafiles)
+			assert.True(progress[i-1].BytesCopied <= progress[i].BytesCopied)
+		}
+
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(int64(last.BytesCopied), stats.LiveBytes)
+		assert.Equal(10, db.Len())
+	})
+
+	t.Run("MinDeadRatio", func(t *testing.T) {
+		db, cleanup := open(WithMaxDatafileSize(1))
+		defer cleanup()
+
+		require.NoError(db.Put([]byte("a"), []byte("1")))
+		require.NoError(db.Put([]byte("b"), []byte("1")))
+		require.NoError(db.Put([]byte("a"), []byte("2")))
+		require.NoError(db.Put([]byte("c"), []byte("1")))
+
+		// Only the first datafile is all dead
+		var progress []MergeProgress
+		require.NoError(db.MergeWithOptions(MergeOptions{
+			MinDeadRatio: 0.5,
+			Progress:     func(p MergeProgress) { progress = append(progress, p) },
+		}))
+		require.Len(progress, 1)
+		assert.Equal(1, progress[0].TotalDatafiles)
+		assert.Equal(uint64(0), progress[0].BytesCopied)
+
+		for key, value := range map[string]string{"a": "2", "b": "1", "c": "1"} {
+			v, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal([]byte(value), v)
+		}
+
+		// Nothing is merged if no datafile has enough dead bytes
+		stats, err := db.Stats()
+		require.NoError(err)
+		require.NoError(db.MergeWithOptions(MergeOptions{MinDeadRatio: 0.5}))
+		after, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(stats.Merges, after.Merges)
+		assert.Equal(stats.Datafiles, after.Datafiles)
+	})
+
+	t.Run("RateLimit", func(t *testing.T) {
+		db, cleanup := open()
+		defer cleanup()
+
+		value := make([]byte, 500)
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), value))
+		}
+
+		// About 10KB are read and written
+		start := time.Now()
+		require.NoError(db.MergeWithOptions(MergeOptions{RateLimit: 50000}))
+		assert.True(time.Since(start) >= 150*time.Millisecond)
+		assert.Equal(10, db.Len())
+	})
 }
 
 func TestConcurrent(t *testing.T) {
@@ -1253,253 +1816,4487 @@ func TestConcurrent(t *testing.T) {
 	})
 }
 
-func TestScan(t *testing.T) {
+func TestMaxOpenFiles(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	var db *Bitcask
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithMaxOpenFiles(2))
+	assert.NoError(err)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("k%02d", i))
+		assert.NoError(db.Put(key, []byte("bar")))
+	}
+
+	check := func() {
+		for i := 0; i < 20; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("k%02d", i)))
 			assert.NoError(err)
-		})
+			assert.Equal([]byte("bar"), value)
+		}
+		assert.True(db.fds.Len() <= 2)
+	}
 
-		t.Run("Put", func(t *testing.T) {
-			var items = map[string][]byte{
-				"1":     []byte("1"),
-				"2":     []byte("2"),
-				"3":     []byte("3"),
-				"food":  []byte("pizza"),
-				"foo":   []byte([]byte("foo")),
-				"fooz":  []byte("fooz ball"),
-				"hello": []byte("world"),
-			}
-			for k, v := range items {
-				err = db.Put([]byte(k), v)
-				assert.NoError(err)
-			}
-		})
-	})
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.True(stats.Datafiles > 2)
+	check()
 
-	t.Run("Scan", func(t *testing.T) {
-		var (
-			vals     [][]byte
-			expected = [][]byte{
-				[]byte("foo"),
-				[]byte("fooz ball"),
-				[]byte("pizza"),
-			}
-		)
+	t.Run("RebuildIndex", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
 
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			val, err := db.Get(key)
-			assert.NoError(err)
-			vals = append(vals, val)
-			return nil
-		})
-		vals = SortByteArrays(vals)
-		assert.Equal(expected, vals)
+		db, err = Open(testdir, WithMaxOpenFiles(2))
+		assert.NoError(err)
+		assert.Equal(20, db.Len())
+		check()
 	})
 
-	t.Run("ScanErrors", func(t *testing.T) {
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			return ErrMockError
-		})
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		check()
+		assert.NoError(db.Close())
 	})
 }
 
-func TestLocking(t *testing.T) {
+func TestConcurrentMerge(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	db, err := Open(testdir)
+	db, err := Open(testdir, WithMaxDatafileSize(64))
 	assert.NoError(err)
 	defer db.Close()
 
-	_, err = Open(testdir)
-	assert.Error(err)
-	assert.Equal(ErrDatabaseLocked, err)
-}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		assert.NoError(db.Put(key, []byte("v0")))
+	}
 
-type benchmarkTestCase struct {
-	name string
-	size int
-}
+	t.Run("FoldPinsDatafiles", func(t *testing.T) {
+		s1, err := db.Stats()
+		assert.NoError(err)
 
-func BenchmarkGet(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
-	}
+		var merged bool
+		err = db.Fold(func(key []byte) error {
+			if !merged {
+				merged = true
+				assert.NoError(db.Merge())
 
-	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer os.RemoveAll(testdir)
+				// The merged away datafiles are kept until Fold returns
+				for id := 0; id < s1.Datafiles; id++ {
+					assert.True(internal.Exists(filepath.Join(testdir, fmt.Sprintf("%09d.data", id))))
+				}
+			}
+			_, err := db.Get(key)
+			return err
+		})
+		assert.NoError(err)
+		assert.True(merged)
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"512B", 512},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
-	}
+		for id := 0; id < s1.Datafiles; id++ {
+			assert.False(internal.Exists(filepath.Join(testdir, fmt.Sprintf("%09d.data", id))))
+		}
+	})
 
-	for _, tt := range tests {
-		b.Run(tt.name, func(b *testing.B) {
-			b.SetBytes(int64(tt.size))
+	t.Run("MergeInProgress", func(t *testing.T) {
+		atomic.StoreInt32(&db.merging, 1)
+		assert.Equal(ErrMergeInProgress, db.Merge())
+		atomic.StoreInt32(&db.merging, 0)
+	})
 
-			key := []byte("foo")
-			value := []byte(strings.Repeat(" ", tt.size))
+	t.Run("PutGetFold", func(t *testing.T) {
+		wg := &sync.WaitGroup{}
+		wg.Add(3)
 
-			options := []Option{
-				WithMaxKeySize(uint32(len(key))),
-				WithMaxValueSize(uint64(tt.size)),
+		go func() {
+			defer wg.Done()
+			for n := 1; n <= 10; n++ {
+				for i := 0; i < 100; i++ {
+					key := []byte(fmt.Sprintf("k%d", i))
+					assert.NoError(db.Put(key, []byte(fmt.Sprintf("v%d", n))))
+				}
 			}
-			db, err := Open(testdir, options...)
-			if err != nil {
-				b.Fatal(err)
+		}()
+
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 10; n++ {
+				err := db.Fold(func(key []byte) error {
+					_, err := db.Get(key)
+					return err
+				})
+				assert.NoError(err)
 			}
+		}()
 
-			err = db.Put(key, value)
-			if err != nil {
-				b.Fatal(err)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 5; n++ {
+				assert.NoError(db.Merge())
 			}
+		}()
 
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				val, err := db.Get(key)
-				if err != nil {
-					b.Fatal(err)
-				}
-				if !bytes.Equal(val, value) {
-					b.Errorf("unexpected value")
+		wg.Wait()
+
+		assert.NoError(db.Merge())
+		for i := 0; i < 100; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("k%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("v10"), value)
+		}
+
+		assert.NoError(db.Reopen())
+		assert.Equal(100, db.Len())
+		for i := 0; i < 100; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("k%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("v10"), value)
+		}
+	})
+}
+
+func TestConcurrentPut(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	assert.NoError(err)
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprintf("k%d", i%10))
+				assert.NoError(db.Put(key, []byte(fmt.Sprintf("w%d-%d", w, i))))
+				if i%25 == 0 {
+					assert.NoError(db.Delete(key))
 				}
 			}
-			b.StopTimer()
-			db.Close()
-		})
+		}(w)
 	}
-}
+	wg.Wait()
+
+	expected := make(map[string][]byte)
+	assert.NoError(db.Fold(func(key []byte) error {
+		value, err := db.Get(key)
+		expected[string(key)] = value
+		return err
+	}))
+	assert.NoError(db.Close())
+
+	// The index rebuilt from the datafiles agrees with the published one
+	assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
 
-func BenchmarkPut(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
+	assert.Equal(len(expected), db.Len())
+	for key, value := range expected {
+		actual, err := db.Get([]byte(key))
+		assert.NoError(err)
+		assert.Equal(value, actual)
 	}
+}
 
-	tests := []benchmarkTestCase{
-		{"128B", 128},
-		{"256B", 256},
-		{"1K", 1024},
-		{"2K", 2048},
-		{"4K", 4096},
-		{"8K", 8192},
-		{"16K", 16384},
-		{"32K", 32768},
-	}
+func TestBatch(t *testing.T) {
+	assert := assert.New(t)
 
-	variants := map[string][]Option{
-		"NoSync": {
-			WithSync(false),
-		},
-		"Sync": {
-			WithSync(true),
-		},
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	check := func() {
+		assert.Equal(2, db.Len())
+		value, err := db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world!"), value)
+		value, err = db.Get([]byte("bitcask"))
+		assert.NoError(err)
+		assert.Equal([]byte("rocks"), value)
+		assert.False(db.Has([]byte("foo")))
 	}
 
-	for name, options := range variants {
-		testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer os.RemoveAll(testdir)
+	t.Run("Write", func(t *testing.T) {
+		batch := NewBatch()
+		batch.Put([]byte("hello"), []byte("world"))
+		batch.Put([]byte("bitcask"), []byte("rocks"))
+		batch.Delete([]byte("foo"))
+		batch.Put([]byte("hello"), []byte("world!"))
+		assert.Equal(4, batch.Len())
 
-		db, err := Open(testdir, options...)
-		if err != nil {
-			b.Fatal(err)
-		}
-		defer db.Close()
+		assert.NoError(db.Write(batch))
+		check()
+	})
 
-		for _, tt := range tests {
-			b.Run(tt.name+name, func(b *testing.B) {
-				b.SetBytes(int64(tt.size))
+	t.Run("Invalid", func(t *testing.T) {
+		batch := NewBatch()
+		batch.Put([]byte("foo"), []byte("bar"))
+		batch.Put(nil, []byte("bar"))
+		assert.Equal(ErrEmptyKey, db.Write(batch))
 
-				key := []byte("foo")
-				value := []byte(strings.Repeat(" ", tt.size))
-				b.ResetTimer()
-				for i := 0; i < b.N; i++ {
-					err := db.Put(key, value)
-					if err != nil {
-						b.Fatal(err)
-					}
+		batch.Reset()
+		assert.Equal(0, batch.Len())
+		assert.NoError(db.Write(batch))
+		check()
+	})
+
+	t.Run("ReIndex", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		check()
+		assert.NoError(db.Close())
+	})
+
+	t.Run("PartialBatch", func(t *testing.T) {
+		skipIfWindows(t)
+
+		for _, autoRecovery := range []bool{false, true} {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			db, err := Open(testdir)
+			assert.NoError(err)
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+			batch := NewBatch()
+			for i := 0; i < 3; i++ {
+				batch.Put([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i)))
+			}
+			assert.NoError(db.Write(batch))
+			assert.NoError(db.Close())
+
+			// Crash before the last entry of the batch was written, mid
+			// entry when recovering
+			truncate := int64(codec.MetaInfoSize + 4)
+			if autoRecovery {
+				truncate--
+			}
+			fn := filepath.Join(testdir, "000000000.data")
+			stat, err := os.Stat(fn)
+			assert.NoError(err)
+			assert.NoError(os.Truncate(fn, stat.Size()-truncate))
+			assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+			db, err = Open(testdir, WithAutoRecovery(autoRecovery))
+			assert.NoError(err)
+			assert.Equal(1, db.Len())
+			assert.True(db.Has([]byte("foo")))
+			assert.False(db.Has([]byte("k0")))
+
+			if autoRecovery {
+				report := db.LastRecovery()
+				if assert.NotNil(report) {
+					assert.Equal(1, report.RecoveredEntries)
 				}
-			})
+			}
+			assert.NoError(db.Close())
 		}
-	}
+	})
 }
 
-func BenchmarkScan(b *testing.B) {
-	currentDir, err := os.Getwd()
-	if err != nil {
-		b.Fatal(err)
-	}
+func TestTxn(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
 
-	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
-	if err != nil {
-		b.Fatal(err)
-	}
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
 	defer os.RemoveAll(testdir)
 
 	db, err := Open(testdir)
-	if err != nil {
-		b.Fatal(err)
-	}
+	require.NoError(err)
 	defer db.Close()
 
-	var items = map[string][]byte{
-		"1":     []byte("1"),
-		"2":     []byte("2"),
-		"3":     []byte("3"),
-		"food":  []byte("pizza"),
-		"foo":   []byte([]byte("foo")),
-		"fooz":  []byte("fooz ball"),
-		"hello": []byte("world"),
-	}
-	for k, v := range items {
-		err := db.Put([]byte(k), v)
-		if err != nil {
-			b.Fatal(err)
-		}
-	}
+	require.NoError(db.Put([]byte("counter"), []byte("1")))
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
 
-	var expected = [][]byte{[]byte("foo"), []byte("food"), []byte("fooz")}
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		tx := db.Begin()
+		value, err := tx.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.Equal([]byte("1"), value)
+
+		assert.NoError(tx.Put([]byte("counter"), []byte("2")))
+		assert.NoError(tx.Delete([]byte("foo")))
+		value, err = tx.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.Equal([]byte("2"), value)
+		_, err = tx.Get([]byte("foo"))
+		assert.Equal(ErrKeyNotFound, err)
+
+		// Nothing is visible before the commit
+		value, err = db.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.Equal([]byte("1"), value)
+		assert.True(db.Has([]byte("foo")))
+
+		assert.NoError(tx.Commit())
+		value, err = db.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.Equal([]byte("2"), value)
+		assert.False(db.Has([]byte("foo")))
+
+		assert.Equal(ErrTxnDone, tx.Commit())
+		assert.Equal(ErrTxnDone, tx.Put([]byte("foo"), []byte("bar")))
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		tx := db.Begin()
+		_, err := tx.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.NoError(tx.Put([]byte("counter"), []byte("3")))
+
+		assert.NoError(db.Put([]byte("counter"), []byte("10")))
+		assert.Equal(ErrConflict, tx.Commit())
+		value, err := db.Get([]byte("counter"))
+		assert.NoError(err)
+		assert.Equal([]byte("10"), value)
+	})
+
+	t.Run("UniqueConstraint", func(t *testing.T) {
+		tx := db.Begin()
+		_, err := tx.Get([]byte("user"))
+		assert.Equal(ErrKeyNotFound, err)
+		assert.NoError(tx.Put([]byte("user"), []byte("alice")))
+
+		assert.NoError(db.Put([]byte("user"), []byte("bob")))
+		assert.Equal(ErrConflict, tx.Commit())
+
+		// Keys written but not read do not conflict
+		tx = db.Begin()
+		assert.NoError(tx.Put([]byte("user"), []byte("carol")))
+		assert.NoError(db.Put([]byte("user"), []byte("dave")))
+		assert.NoError(tx.Commit())
+		value, err := db.Get([]byte("user"))
+		assert.NoError(err)
+		assert.Equal([]byte("carol"), value)
+	})
+
+	t.Run("Discard", func(t *testing.T) {
+		tx := db.Begin()
+		assert.NoError(tx.Put([]byte("discarded"), []byte("value")))
+		tx.Discard()
+		assert.Equal(ErrTxnDone, tx.Commit())
+		_, err := tx.Get([]byte("discarded"))
+		assert.Equal(ErrTxnDone, err)
+		assert.False(db.Has([]byte("discarded")))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tx := db.Begin()
+		assert.Equal(ErrEmptyKey, tx.Put(nil, []byte("value")))
+		tx.Discard()
+	})
+
+	t.Run("Counter", func(t *testing.T) {
+		require.NoError(db.Put([]byte("count"), []byte("0")))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					for {
+						tx := db.Begin()
+						value, err := tx.Get([]byte("count"))
+						if !assert.NoError(err) {
+							return
+						}
+						n, _ := strconv.Atoi(string(value))
+						assert.NoError(tx.Put([]byte("count"), []byte(strconv.Itoa(n+1))))
+						if err := tx.Commit(); err != ErrConflict {
+							assert.NoError(err)
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.Get([]byte("count"))
+		assert.NoError(err)
+		assert.Equal([]byte("80"), value)
+	})
+}
+
+func TestEviction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	open := func(options ...Option) (*Bitcask, func()) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		db, err := Open(testdir, options...)
+		require.NoError(err)
+		return db, func() {
+			db.Close()
+			os.RemoveAll(testdir)
+		}
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		db, cleanup := open(WithMaxKeys(2))
+		defer cleanup()
+		assert.NoError(db.Put([]byte("a"), []byte("1")))
+		assert.NoError(db.Put([]byte("b"), []byte("2")))
+		assert.Equal(ErrDatabaseFull, db.Put([]byte("c"), []byte("3")))
+		assert.False(db.Has([]byte("c")))
+
+		// Overwrites and deletes do not grow the database
+		assert.NoError(db.Put([]byte("a"), []byte("10")))
+		assert.NoError(db.Delete([]byte("b")))
+		assert.NoError(db.Put([]byte("c"), []byte("3")))
+
+		b := NewBatch()
+		b.Put([]byte("d"), []byte("4"))
+		assert.Equal(ErrDatabaseFull, db.Write(b))
+		b = NewBatch()
+		b.Delete([]byte("a"))
+		b.Put([]byte("d"), []byte("4"))
+		assert.NoError(db.Write(b))
+		assert.Equal(2, db.Len())
+	})
+
+	t.Run("MaxDatastoreSize", func(t *testing.T) {
+		db, cleanup := open(WithMaxDatastoreSize(100))
+		defer cleanup()
+		value := make([]byte, 40)
+		assert.NoError(db.Put([]byte("a"), value))
+		assert.Equal(ErrDatabaseFull, db.Put([]byte("b"), value))
+
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.True(stats.LiveBytes <= 100)
+	})
+
+	t.Run("Oldest", func(t *testing.T) {
+		db, cleanup := open(WithMaxKeys(2), WithEvictionPolicy(EvictOldest))
+		defer cleanup()
+		assert.NoError(db.Put([]byte("a"), []byte("1")))
+		assert.NoError(db.Put([]byte("b"), []byte("2")))
+		_, err := db.Get([]byte("a"))
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("c"), []byte("3")))
+
+		assert.False(db.Has([]byte("a")))
+		assert.True(db.Has([]byte("b")))
+		assert.True(db.Has([]byte("c")))
+
+		// Overwriting a key makes it the newest
+		assert.NoError(db.Put([]byte("b"), []byte("20")))
+		assert.NoError(db.Put([]byte("d"), []byte("4")))
+		assert.False(db.Has([]byte("c")))
+		assert.True(db.Has([]byte("b")))
+
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(uint64(2), stats.Evictions)
+		assert.Equal(2, stats.Keys)
+	})
+
+	t.Run("LRU", func(t *testing.T) {
+		db, cleanup := open(WithMaxKeys(2), WithEvictionPolicy(EvictLRU))
+		defer cleanup()
+		assert.NoError(db.Put([]byte("a"), []byte("1")))
+		assert.NoError(db.Put([]byte("b"), []byte("2")))
+		_, err := db.Get([]byte("a"))
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("c"), []byte("3")))
+
+		assert.True(db.Has([]byte("a")))
+		assert.False(db.Has([]byte("b")))
+		assert.True(db.Has([]byte("c")))
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		db, cleanup := open(WithMaxKeys(2), WithEvictionPolicy(EvictOldest))
+		defer cleanup()
+		assert.NoError(db.Put([]byte("a"), []byte("1")))
+
+		// The keys of the batch are kept even if over the limit
+		b := NewBatch()
+		b.Put([]byte("b"), []byte("2"))
+		b.Put([]byte("c"), []byte("3"))
+		b.Put([]byte("d"), []byte("4"))
+		assert.NoError(db.Write(b))
+		assert.False(db.Has([]byte("a")))
+		assert.Equal(3, db.Len())
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxKeys(2), WithEvictionPolicy(EvictOldest))
+		require.NoError(err)
+		assert.NoError(db.Put([]byte("b"), []byte("1")))
+		assert.NoError(db.Put([]byte("a"), []byte("2")))
+		require.NoError(db.Close())
+
+		// Keys are evicted in the order they were written to the datafiles
+		db, err = Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+		assert.NoError(db.Put([]byte("c"), []byte("3")))
+		assert.False(db.Has([]byte("b")))
+		assert.True(db.Has([]byte("a")))
+	})
+}
+
+func TestChanges(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	changes := func(db *Bitcask, since uint64) []Change {
+		it, err := db.Changes(since)
+		require.NoError(err)
+		defer it.Close()
+
+		var changes []Change
+		for it.Next() {
+			changes = append(changes, it.Change())
+		}
+		require.NoError(it.Err())
+		return changes
+	}
+
+	t.Run("NotSupported", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+
+		_, err = db.Changes(0)
+		assert.Equal(ErrVersionNotSupported, err)
+	})
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(5), WithMaxDatafileSize(64))
+	require.NoError(err)
+	defer func() { db.Close() }()
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Delete([]byte("a")))
+	b := NewBatch()
+	b.Put([]byte("c"), []byte("3"))
+	b.Put([]byte("b"), []byte("4"))
+	require.NoError(db.Write(b))
+
+	t.Run("All", func(t *testing.T) {
+		all := changes(db, 0)
+		require.Len(all, 5)
+		for i, c := range all {
+			assert.Equal(uint64(i+1), c.Seq)
+			assert.False(c.Time.IsZero())
+		}
+		assert.Equal(Change{Type: EventPut, Key: []byte("a"), Value: []byte("1"), Seq: 1, Time: all[0].Time}, all[0])
+		assert.Equal(EventDelete, all[2].Type)
+		assert.Equal([]byte("a"), all[2].Key)
+		assert.Nil(all[2].Value)
+		assert.Equal([]byte("4"), all[4].Value)
+
+		_, meta, err := db.GetWithMeta([]byte("b"))
+		require.NoError(err)
+		assert.Equal(meta.Version, all[4].Seq)
+	})
+
+	t.Run("Since", func(t *testing.T) {
+		since := changes(db, 3)
+		require.Len(since, 2)
+		assert.Equal([]byte("c"), since[0].Key)
+		assert.Equal(uint64(4), since[0].Seq)
+
+		assert.Empty(changes(db, 5))
+		_, err := db.Changes(6)
+		assert.Equal(ErrSeqUnavailable, err)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Close())
+		db, err = Open(testdir)
+		require.NoError(err)
+
+		require.NoError(db.Put([]byte("d"), []byte("5")))
+		since := changes(db, 5)
+		require.Len(since, 1)
+		assert.Equal(uint64(6), since[0].Seq)
+	})
+
+	t.Run("Merged", func(t *testing.T) {
+		require.NoError(db.Merge())
+
+		_, err := db.Changes(3)
+		assert.Equal(ErrSeqUnavailable, err)
+		assert.Empty(changes(db, 6))
+
+		// The whole log as merged
+		all := changes(db, 0)
+		require.Len(all, 3)
+		for _, c := range all {
+			assert.Equal(EventPut, c.Type)
+		}
+
+		require.NoError(db.Delete([]byte("c")))
+		since := changes(db, 6)
+		require.Len(since, 1)
+		assert.Equal(EventDelete, since[0].Type)
+		assert.Equal(uint64(7), since[0].Seq)
+	})
+
+	t.Run("MergedReopen", func(t *testing.T) {
+		require.NoError(db.Put([]byte("e"), []byte("6")))
+		require.NoError(db.Delete([]byte("e")))
+		require.NoError(db.Merge())
+		require.NoError(db.Close())
+		db, err = Open(testdir)
+		require.NoError(err)
+
+		// The last change seen was merged away and stays available
+		assert.Empty(changes(db, 9))
+		_, err = db.Changes(10)
+		assert.Equal(ErrSeqUnavailable, err)
+
+		require.NoError(db.Put([]byte("f"), []byte("7")))
+		since := changes(db, 9)
+		require.Len(since, 1)
+		assert.Equal([]byte("f"), since[0].Key)
+		assert.Equal(uint64(10), since[0].Seq)
+	})
+}
+
+func TestVersion(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(5))
+	require.NoError(err)
+
+	version := func(key string) uint64 {
+		_, meta, err := db.GetWithMeta([]byte(key))
+		if err == ErrKeyNotFound {
+			return 0
+		}
+		require.NoError(err)
+		return meta.Version
+	}
+
+	t.Run("Meta", func(t *testing.T) {
+		start := time.Now()
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		require.NoError(db.Put([]byte("hello"), []byte("world")))
+
+		value, meta, err := db.GetWithMeta([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), value)
+		assert.Equal(int64(5), meta.Size)
+		assert.True(meta.Version > version("foo"))
+		assert.False(meta.Timestamp.Before(start.Truncate(time.Second)))
+		assert.False(meta.Timestamp.After(time.Now()))
+	})
+
+	t.Run("PutIfVersion", func(t *testing.T) {
+		v := version("foo")
+		assert.Equal(ErrConflict, db.PutIfVersion([]byte("foo"), []byte("baz"), v-1))
+		assert.NoError(db.PutIfVersion([]byte("foo"), []byte("baz"), v))
+		assert.Equal(ErrConflict, db.PutIfVersion([]byte("foo"), []byte("qux"), v))
+		value, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), value)
+		assert.True(version("foo") > v)
+
+		// Version zero creates a key
+		assert.NoError(db.PutIfVersion([]byte("new"), []byte("value"), 0))
+		assert.Equal(ErrConflict, db.PutIfVersion([]byte("new"), []byte("value"), 0))
+	})
+
+	t.Run("DeleteIfVersion", func(t *testing.T) {
+		v := version("new")
+		assert.Equal(ErrConflict, db.DeleteIfVersion([]byte("new"), v+1))
+		assert.True(db.Has([]byte("new")))
+		assert.NoError(db.DeleteIfVersion([]byte("new"), v))
+		assert.False(db.Has([]byte("new")))
+		assert.NoError(db.PutIfVersion([]byte("new"), []byte("again"), 0))
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		v := version("new")
+		bt := NewBatch()
+		bt.Put([]byte("new"), []byte("batched"))
+		bt.Put([]byte("other"), []byte("batched"))
+		require.NoError(db.Write(bt))
+		assert.True(version("new") > v)
+		assert.True(version("other") > version("new"))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		v := version("other")
+		require.NoError(db.Merge())
+		assert.Equal(v, version("other"))
+
+		require.NoError(db.Close())
+		db, err = Open(testdir)
+		require.NoError(err)
+		assert.Equal(v, version("other"))
+		require.NoError(db.Put([]byte("latest"), []byte("value")))
+		assert.True(version("latest") > v)
+	})
+
+	t.Run("Counter", func(t *testing.T) {
+		require.NoError(db.Put([]byte("count"), []byte("0")))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					for {
+						value, meta, err := db.GetWithMeta([]byte("count"))
+						if !assert.NoError(err) {
+							return
+						}
+						n, _ := strconv.Atoi(string(value))
+						err = db.PutIfVersion([]byte("count"), []byte(strconv.Itoa(n+1)), meta.Version)
+						if err != ErrConflict {
+							assert.NoError(err)
+							break
+						}
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		value, err := db.Get([]byte("count"))
+		assert.NoError(err)
+		assert.Equal([]byte("80"), value)
+	})
+
+	t.Run("MergedAway", func(t *testing.T) {
+		require.NoError(db.Put([]byte("gone"), []byte("value")))
+		require.NoError(db.Put([]byte("count"), []byte("overwritten")))
+		require.NoError(db.Delete([]byte("gone")))
+
+		// The latest versions only live in the datafiles merged away
+		it, err := db.Changes(0)
+		require.NoError(err)
+		var last uint64
+		for it.Next() {
+			last = it.Change().Seq
+		}
+		require.NoError(it.Err())
+		require.NoError(it.Close())
+		require.NoError(db.Merge())
+
+		require.NoError(db.Close())
+		db, err = Open(testdir)
+		require.NoError(err)
+		require.NoError(db.Put([]byte("after"), []byte("value")))
+		assert.True(version("after") > last)
+	})
+
+	t.Run("SavedMark", func(t *testing.T) {
+		v := version("after")
+		require.NoError(db.Close())
+
+		// Only the entries written after the saved index are read when
+		// reopening, not the corrupted ones before
+		files, err := filepath.Glob(filepath.Join(testdir, "*.data"))
+		require.NoError(err)
+		f, err := os.OpenFile(files[0], os.O_WRONLY, 0)
+		require.NoError(err)
+		_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, 8), 0)
+		require.NoError(err)
+		require.NoError(f.Close())
+
+		db, err = Open(testdir)
+		require.NoError(err)
+		require.NoError(db.Put([]byte("marked"), []byte("value")))
+		assert.True(version("marked") > v)
+	})
+	require.NoError(db.Close())
+
+	t.Run("NotSupported", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithFormatVersion(4))
+		require.NoError(err)
+		defer db.Close()
+
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		_, meta, err := db.GetWithMeta([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal(uint64(0), meta.Version)
+		assert.True(meta.Timestamp.IsZero())
+		assert.Equal(ErrVersionNotSupported, db.PutIfVersion([]byte("foo"), []byte("baz"), 0))
+		assert.Equal(ErrVersionNotSupported, db.DeleteIfVersion([]byte("foo"), 0))
+	})
+}
+
+func TestJSONPath(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("doc"), []byte(`{"a": {"b": [1, 2, {"c": "foo"}]}}`)))
+	assert.NoError(db.Put([]byte("bar"), []byte("bar")))
+
+	t.Run("GetPath", func(t *testing.T) {
+		value, err := db.GetPath([]byte("doc"), "a.b[2].c")
+		assert.NoError(err)
+		assert.Equal([]byte(`"foo"`), value)
+
+		value, err = db.GetPath([]byte("doc"), "a.b[1]")
+		assert.NoError(err)
+		assert.Equal([]byte(`2`), value)
+
+		_, err = db.GetPath([]byte("doc"), "a.x")
+		assert.Equal(ErrPathNotFound, err)
+		_, err = db.GetPath([]byte("doc"), "a..b")
+		assert.Equal(ErrInvalidPath, err)
+		_, err = db.GetPath([]byte("bar"), "a")
+		assert.Equal(ErrPathNotFound, err)
+		_, err = db.GetPath([]byte("nope"), "a")
+		assert.Equal(ErrKeyNotFound, err)
+	})
+
+	t.Run("SetPath", func(t *testing.T) {
+		assert.NoError(db.SetPath([]byte("doc"), "a.b[2].c", []byte(`"bar"`)))
+		assert.NoError(db.SetPath([]byte("doc"), "a.d", []byte(`true`)))
+
+		value, err := db.Get([]byte("doc"))
+		assert.NoError(err)
+		assert.Equal([]byte(`{"a": {"b": [1, 2, {"c": "bar"}],"d":true}}`), value)
+
+		assert.Equal(ErrInvalidJSON, db.SetPath([]byte("doc"), "a.d", []byte(`{`)))
+		assert.Equal(ErrPathNotFound, db.SetPath([]byte("doc"), "a.b[3]", []byte(`3`)))
+		assert.Equal(ErrKeyNotFound, db.SetPath([]byte("nope"), "a", []byte(`3`)))
+	})
+}
+
+func TestSchemas(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	schema, err := NewJSONSchema([]byte(`{"type": "object", "required": ["name"]}`))
+	assert.NoError(err)
+	db.RegisterSchema([]byte("user:"), schema)
+	assert.Len(db.Schemas(), 1)
+
+	assert.NoError(db.Put([]byte("user:1"), []byte(`{"name": "alice"}`)))
+	assert.NoError(db.Put([]byte("other"), []byte("not json")))
+
+	err = db.Put([]byte("user:2"), []byte(`{"age": 1}`))
+	assert.True(errors.Is(err, ErrSchemaViolation))
+	assert.False(db.Has([]byte("user:2")))
+
+	err = db.SetPath([]byte("user:1"), "name", []byte(`null`))
+	assert.NoError(err)
+	err = db.SetPath([]byte("user:1"), "", []byte(`[]`))
+	assert.True(errors.Is(err, ErrSchemaViolation))
+
+	db.RegisterSchema([]byte("user:"), nil)
+	assert.Empty(db.Schemas())
+	assert.NoError(db.Put([]byte("user:2"), []byte(`{"age": 1}`)))
+}
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	var db *Bitcask
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			var items = map[string][]byte{
+				"1":     []byte("1"),
+				"2":     []byte("2"),
+				"3":     []byte("3"),
+				"food":  []byte("pizza"),
+				"foo":   []byte([]byte("foo")),
+				"fooz":  []byte("fooz ball"),
+				"hello": []byte("world"),
+			}
+			for k, v := range items {
+				err = db.Put([]byte(k), v)
+				assert.NoError(err)
+			}
+		})
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var (
+			vals     [][]byte
+			expected = [][]byte{
+				[]byte("foo"),
+				[]byte("fooz ball"),
+				[]byte("pizza"),
+			}
+		)
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		var keys [][]byte
 		err = db.Scan([]byte("fo"), func(key []byte) error {
-			keys = append(keys, key)
+			val, err := db.Get(key)
+			assert.NoError(err)
+			vals = append(vals, val)
+			return nil
+		})
+		vals = SortByteArrays(vals)
+		assert.Equal(expected, vals)
+	})
+
+	t.Run("ScanErrors", func(t *testing.T) {
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			return ErrMockError
+		})
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		var keys []string
+		err = db.Range([]byte("2"), []byte("food"), func(key []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal([]string{"2", "3", "foo", "food"}, keys)
+
+		err = db.Range([]byte("1"), []byte("3"), func(key []byte) error {
+			return ErrMockError
+		})
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("Iterator", func(t *testing.T) {
+		it := db.Iterator()
+		assert.Nil(it.Key())
+
+		var keys []string
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		assert.Equal([]string{"1", "2", "3", "foo", "food", "fooz", "hello"}, keys)
+		assert.Nil(it.Key())
+
+		it.Seek([]byte("fooa"))
+		assert.True(it.Next())
+		assert.Equal([]byte("food"), it.Key())
+		val, err := it.Value()
+		assert.NoError(err)
+		assert.Equal([]byte("pizza"), val)
+
+		// Writes while iterating neither repeat nor reorder keys
+		assert.NoError(db.Put([]byte("a"), []byte("a")))
+		assert.NoError(db.Put([]byte("goo"), []byte("goo")))
+		assert.NoError(db.Delete([]byte("fooz")))
+		keys = nil
+		for it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		assert.Equal([]string{"goo", "hello"}, keys)
+
+		_, err = it.Value()
+		assert.Equal(ErrKeyNotFound, err)
+	})
+}
+
+func TestLocking(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	_, err = Open(testdir)
+	assert.Error(err)
+	assert.Equal(ErrDatabaseLocked, err)
+}
+
+func TestLockTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	require.NoError(err)
+
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := Open(testdir, WithOpenTimeout(50*time.Millisecond))
+		assert.Equal(ErrDatabaseLocked, err)
+		assert.True(time.Since(start) >= 50*time.Millisecond)
+	})
+
+	t.Run("Released", func(t *testing.T) {
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			db.Close()
+		}()
+		db, err := Open(testdir, WithOpenTimeout(10*time.Second))
+		require.NoError(err)
+		require.NoError(db.Close())
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		lock := newFlock(filepath.Join(testdir, "lock"))
+		require.NoError(lock.LockContext(context.Background()))
+		defer lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		assert.Equal(context.DeadlineExceeded, newFlock(filepath.Join(testdir, "lock")).LockContext(ctx))
+		assert.Equal(ErrDatabaseLocked, newFlock(filepath.Join(testdir, "lock")).LockWithTimeout(0))
+	})
+}
+
+func TestStaleLock(t *testing.T) {
+	if running, ok := internal.ProcessRunning(os.Getpid()); !ok || !running {
+		t.Skip("Process liveness is not supported on this platform")
+	}
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	// Hold the lock on behalf of a process that is not running
+	path := filepath.Join(testdir, "lock")
+	lock := newFlock(path)
+	locked, err := lock.TryLock()
+	require.NoError(err)
+	require.True(locked)
+	defer lock.Unlock()
+	host, _ := os.Hostname()
+	require.NoError(ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %s\n", math.MaxInt32, host)), 0600))
+
+	_, err = Open(testdir)
+	assert.Equal(ErrStaleLock, err)
+
+	db, err = Open(testdir, WithForceLock())
+	require.NoError(err)
+	defer db.Close()
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+	assert.Equal(fmt.Sprintf("%d %s\n", os.Getpid(), host), string(data))
+
+	// The lock of a running process is not stale
+	_, err = Open(testdir, WithForceLock())
+	assert.Equal(ErrDatabaseLocked, err)
+}
+
+func TestDebugHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	server := httptest.NewServer(db.DebugHandlers())
+	defer server.Close()
+
+	t.Run("Stats", func(t *testing.T) {
+		res, err := http.Get(server.URL + "/debug/bitcask/stats")
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		var stats Stats
+		assert.NoError(json.NewDecoder(res.Body).Decode(&stats))
+		assert.Equal(1, stats.Keys)
+	})
+
+	t.Run("Pprof", func(t *testing.T) {
+		res, err := http.Get(server.URL + "/debug/pprof/goroutine?debug=1")
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("Schemas", func(t *testing.T) {
+		schema, err := NewJSONSchema([]byte(`{"type":"object"}`))
+		assert.NoError(err)
+		db.RegisterSchema([]byte("user:"), schema)
+
+		res, err := http.Get(server.URL + "/debug/bitcask/schemas")
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.Equal(http.StatusOK, res.StatusCode)
+
+		var schemas map[string]map[string]string
+		assert.NoError(json.NewDecoder(res.Body).Decode(&schemas))
+		assert.Equal(map[string]string{"type": "object"}, schemas["user:"])
+	})
+}
+
+func TestBackgroundTasks(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var spawned int32
+	pool := func(task func()) {
+		atomic.AddInt32(&spawned, 1)
+		go task()
+	}
+
+	db, err := Open(testdir, WithWorkerPool(pool), WithTaskRestartPolicy(1, 0))
+	assert.NoError(err)
+
+	var runs int32
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	db.tasks.run(db.labels("test"), func(stop <-chan struct{}) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			panic("boom")
+		}
+		close(started)
+		<-stop
+		close(stopped)
+	})
+	<-started
+
+	stats, err := db.Stats()
+	assert.NoError(err)
+	assert.Equal(1, stats.BackgroundTasks)
+	assert.Equal(uint64(1), stats.TaskPanics)
+	assert.Equal(int32(1), atomic.LoadInt32(&spawned))
+	assert.Equal(int32(2), atomic.LoadInt32(&runs))
+
+	assert.NoError(db.Close())
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected background task to be stopped by Close()")
+	}
+	assert.Equal(int64(0), atomic.LoadInt64(&db.tasks.running))
+
+	// The restart policy is not persisted
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(DefaultTaskRestarts, db.tasks.maxRestarts)
+	assert.Equal(DefaultTaskBackoff, db.tasks.backoff)
+}
+
+func TestFormatVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(1), WithMaxDatafileSize(64))
+	assert.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	assert.NoError(db.Delete([]byte("foo9")))
+
+	check := func() {
+		assert.Equal(9, db.Len())
+		for i := 0; i < 9; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), value)
+		}
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(9*3), stats.ValueSizes.Total)
+	}
+
+	t.Run("Compact", func(t *testing.T) {
+		check()
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		// Compact records of "fooN"/"bar" take 13 bytes rather than 23 and
+		// the tombstone of "foo9" 10 bytes
+		assert.Equal(uint64(10*13+10), stats.BytesWritten)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		check()
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		check()
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		assert.NoError(db.Close())
+
+		_, err = Open(testdir, WithFormatVersion(0))
+		assert.Equal(ErrFormatVersionMismatch, err)
+
+		db, err = Open(testdir, WithFormatVersion(1))
+		assert.NoError(err)
+		check()
+		assert.NoError(db.Close())
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err = Open(testdir, WithFormatVersion(6))
+		assert.Equal(ErrUnsupportedFormatVersion, err)
+	})
+}
+
+func TestTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(2), WithMaxDatafileSize(64))
+	assert.NoError(err)
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	assert.NoError(db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	assert.NoError(db.PutWithTTL([]byte("baz"), []byte("qux"), time.Hour))
+	assert.NoError(db.Put([]byte("hello"), []byte("world")))
+	assert.Equal(ErrInvalidTTL, db.PutWithTTL([]byte("foo"), []byte("bar"), 0))
+
+	check := func(expired bool) {
+		val, err := db.Get([]byte("foo"))
+		if expired {
+			assert.Equal(ErrKeyNotFound, err)
+			assert.False(db.Has([]byte("foo")))
+		} else {
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+			assert.True(db.Has([]byte("foo")))
+		}
+		assert.Equal([]bool{!expired, true}, db.HasMulti([][]byte{[]byte("foo"), []byte("hello")}))
+
+		var keys []string
+		assert.NoError(db.Scan(nil, func(key []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		}))
+		if expired {
+			assert.Equal([]string{"baz", "hello"}, keys)
+		} else {
+			assert.Equal([]string{"baz", "foo", "hello"}, keys)
+		}
+
+		val, err = db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), val)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		check(false)
+		now = now.Add(time.Minute)
+		check(true)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		db.now = func() time.Time { return now }
+		check(true)
+
+		// The expiries are also kept in the index file
+		assert.NoError(db.Close())
+		db, err = Open(testdir)
+		assert.NoError(err)
+		db.now = func() time.Time { return now }
+		check(true)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.Equal(3, db.Len())
+		assert.NoError(db.Merge())
+		assert.Equal(2, db.Len())
+		check(true)
+
+		// Merged away, the key does not come back once the clock is reset
+		now = now.Add(-time.Minute)
+		check(true)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(ErrTTLNotSupported, db.PutWithTTL([]byte("foo"), []byte("bar"), time.Minute))
+	})
+
+	assert.NoError(db.Close())
+}
+
+func TestOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(3), WithNodeID(1))
+	assert.NoError(err)
+
+	expiry := time.Now().Add(time.Hour).Truncate(0)
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.PutWithMeta([]byte("baz"), []byte("qux"), Meta{Origin: 2, Expiry: expiry}))
+	bt := NewBatch()
+	bt.Put([]byte("hello"), []byte("world"))
+	assert.NoError(db.Write(bt))
+
+	check := func() {
+		for key, expected := range map[string]Meta{
+			"foo":   {Origin: 1},
+			"baz":   {Origin: 2, Expiry: expiry},
+			"hello": {Origin: 1},
+		} {
+			_, meta, err := db.GetWithMeta([]byte(key))
+			assert.NoError(err)
+			assert.Equal(expected.Origin, meta.Origin)
+			assert.True(expected.Expiry.Equal(meta.Expiry))
+		}
+	}
+	check()
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		check()
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		check()
+		assert.NoError(db.Close())
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		_, err = Open(testdir, WithNodeID(1))
+		assert.Equal(ErrOriginNotSupported, err)
+
+		db, err := Open(testdir, WithFormatVersion(2))
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(ErrOriginNotSupported, db.PutWithMeta([]byte("foo"), []byte("bar"), Meta{Origin: 1}))
+		assert.NoError(db.PutWithMeta([]byte("foo"), []byte("bar"), Meta{Expiry: time.Now().Add(time.Hour)}))
+		_, meta, err := db.GetWithMeta([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal(uint32(0), meta.Origin)
+	})
+}
+
+func TestUnion(t *testing.T) {
+	assert := assert.New(t)
+
+	open := func(options ...Option) *Bitcask {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		db, err := Open(testdir, options...)
+		assert.NoError(err)
+		return db
+	}
+	cleanup := func(dbs ...*Bitcask) {
+		for _, db := range dbs {
+			db.Close()
+			os.RemoveAll(db.path)
+		}
+	}
+
+	a := open(WithFormatVersion(3), WithNodeID(1))
+	b := open(WithFormatVersion(3), WithNodeID(2))
+	defer cleanup(a, b)
+
+	assert.NoError(a.Put([]byte("a"), []byte("1")))
+	assert.NoError(a.Put([]byte("both"), []byte("a")))
+	assert.NoError(b.Put([]byte("b"), []byte("2")))
+	assert.NoError(b.Put([]byte("both"), []byte("b")))
+
+	tests := []struct {
+		name     string
+		resolve  ConflictFunc
+		expected string
+		origin   uint32
+	}{
+		{"PreferA", PreferA, "a", 1},
+		{"PreferB", PreferB, "b", 2},
+		{"Callback", func(key, a, b []byte) ([]byte, error) {
+			return append(append([]byte{}, a...), b...), nil
+		}, "ab", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := open(WithFormatVersion(3))
+			defer cleanup(dst)
+
+			assert.NoError(Union(dst, a, b, tt.resolve))
+			assert.Equal(3, dst.Len())
+
+			for key, expected := range map[string]string{"a": "1", "b": "2", "both": tt.expected} {
+				val, err := dst.Get([]byte(key))
+				assert.NoError(err)
+				assert.Equal([]byte(expected), val)
+			}
+			_, meta, err := dst.GetWithMeta([]byte("both"))
+			assert.NoError(err)
+			assert.Equal(tt.origin, meta.Origin)
+		})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		dst := open(WithFormatVersion(3))
+		defer cleanup(dst)
+
+		err := Union(dst, a, b, func(key, a, b []byte) ([]byte, error) {
+			return nil, ErrMockError
+		})
+		assert.Equal(ErrMockError, err)
+
+		// The origins cannot be stored
+		dst = open()
+		defer cleanup(dst)
+		assert.Equal(ErrOriginNotSupported, Union(dst, a, b, PreferA))
+	})
+}
+
+func TestAutoMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithAutoMerge(5*time.Millisecond))
+	assert.NoError(err)
+	defer db.Close()
+
+	waitForMerges := func(n uint64) bool {
+		for i := 0; i < 200; i++ {
+			stats, err := db.Stats()
+			assert.NoError(err)
+			if stats.Merges >= n {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte(fmt.Sprintf("bar%d", i))))
+		}
+		assert.True(waitForMerges(1))
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar9"), val)
+		assert.False(db.needsMerge())
+	})
+
+	t.Run("Pause", func(t *testing.T) {
+		db.PauseAutoMerge()
+		stats, err := db.Stats()
+		assert.NoError(err)
+
+		assert.NoError(db.Delete([]byte("foo")))
+		time.Sleep(50 * time.Millisecond)
+		after, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(stats.Merges, after.Merges)
+
+		db.ResumeAutoMerge()
+		assert.True(waitForMerges(stats.Merges + 1))
+		assert.Equal(0, db.Len())
+	})
+
+	t.Run("Thresholds", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		// One dead entry out of two
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+
+		db.config.AutoMergeDeadRatio = 0.6
+		assert.False(db.needsMerge())
+		db.config.AutoMergeDeadRatio = 0.5
+		assert.True(db.needsMerge())
+
+		db.config.AutoMergeDeadRatio = 0
+		db.config.AutoMergeDatafiles = 10
+		assert.False(db.needsMerge())
+		db.config.AutoMergeDatafiles = 1
+		assert.True(db.needsMerge())
+	})
+}
+
+type benchmarkTestCase struct {
+	name string
+	size int
+}
+
+func BenchmarkGet(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"512B", 512},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			b.SetBytes(int64(tt.size))
+
+			key := []byte("foo")
+			value := []byte(strings.Repeat(" ", tt.size))
+
+			options := []Option{
+				WithMaxKeySize(uint32(len(key))),
+				WithMaxValueSize(uint64(tt.size)),
+			}
+			db, err := Open(testdir, options...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			err = db.Put(key, value)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				val, err := db.Get(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !bytes.Equal(val, value) {
+					b.Errorf("unexpected value")
+				}
+			}
+			b.StopTimer()
+			db.Close()
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tests := []benchmarkTestCase{
+		{"128B", 128},
+		{"256B", 256},
+		{"1K", 1024},
+		{"2K", 2048},
+		{"4K", 4096},
+		{"8K", 8192},
+		{"16K", 16384},
+		{"32K", 32768},
+	}
+
+	variants := map[string][]Option{
+		"NoSync": {
+			WithSync(false),
+		},
+		"Sync": {
+			WithSync(true),
+		},
+	}
+
+	for name, options := range variants {
+		testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, tt := range tests {
+			b.Run(tt.name+name, func(b *testing.B) {
+				b.SetBytes(int64(tt.size))
+
+				key := []byte("foo")
+				value := []byte(strings.Repeat(" ", tt.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					err := db.Put(key, value)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkFormat compares the disk usage (disk-B/op) of the on-disk format
+// versions for small keys and values
+func BenchmarkFormat(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tests := []benchmarkTestCase{
+		{"8B", 8},
+		{"32B", 32},
+		{"128B", 128},
+	}
+
+	for _, version := range []int{0, 1, 2} {
+		for _, tt := range tests {
+			b.Run(fmt.Sprintf("%sV%d", tt.name, version), func(b *testing.B) {
+				testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer os.RemoveAll(testdir)
+
+				db, err := Open(testdir, WithFormatVersion(version))
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer db.Close()
+
+				b.SetBytes(int64(tt.size))
+
+				value := []byte(strings.Repeat(" ", tt.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := db.Put([]byte(fmt.Sprintf("key%08d", i)), value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				stats, err := db.Stats()
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(stats.BytesWritten)/float64(b.N), "disk-B/op")
+			})
+		}
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	var items = map[string][]byte{
+		"1":     []byte("1"),
+		"2":     []byte("2"),
+		"3":     []byte("3"),
+		"food":  []byte("pizza"),
+		"foo":   []byte([]byte("foo")),
+		"fooz":  []byte("fooz ball"),
+		"hello": []byte("world"),
+	}
+	for k, v := range items {
+		err := db.Put([]byte(k), v)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var expected = [][]byte{[]byte("foo"), []byte("food"), []byte("fooz")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var keys [][]byte
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		keys = SortByteArrays(keys)
+		if !reflect.DeepEqual(expected, keys) {
+			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	t.Run("NotExist", func(t *testing.T) {
+		_, err := OpenReadOnly(filepath.Join(testdir, "missing"))
+		assert.True(os.IsNotExist(err))
+	})
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	ro, err := OpenReadOnly(testdir)
+	assert.NoError(err)
+
+	t.Run("Get", func(t *testing.T) {
+		val, err := ro.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Writes", func(t *testing.T) {
+		assert.Equal(ErrReadOnly, ro.Put([]byte("foo"), []byte("baz")))
+		assert.Equal(ErrReadOnly, ro.Delete([]byte("foo")))
+		assert.Equal(ErrReadOnly, ro.DeleteAll())
+		assert.Equal(ErrReadOnly, ro.Merge())
+
+		batch := NewBatch()
+		batch.Put([]byte("foo"), []byte("baz"))
+		assert.Equal(ErrReadOnly, ro.Write(batch))
+
+		val, err := ro.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		}
+		assert.NoError(db.Delete([]byte("foo")))
+		assert.False(ro.Has([]byte("key9")))
+
+		assert.NoError(ro.Refresh())
+		assert.Equal(10, ro.Len())
+		assert.False(ro.Has([]byte("foo")))
+		val, err := ro.Get([]byte("key9"))
+		assert.NoError(err)
+		assert.Equal([]byte("value"), val)
+
+		// Entries appended to the same datafile
+		assert.NoError(db.Put([]byte("key0"), []byte("new")))
+		assert.NoError(ro.Refresh())
+		val, err = ro.Get([]byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		assert.NoError(db.Put([]byte("foo"), []byte("merged")))
+
+		assert.NoError(ro.Refresh())
+		assert.Equal(11, ro.Len())
+		val, err := ro.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("merged"), val)
+		val, err = ro.Get([]byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		assert.NoError(ro.Close())
+
+		// The writer still holds its lock
+		_, err := Open(testdir)
+		assert.Equal(ErrDatabaseLocked, err)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	})
+}
+
+func TestMove(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(2))
+	assert.NoError(err)
+	defer func() {
+		db.Close()
+	}()
+
+	t.Run("Move", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Move([]byte("foo"), []byte("baz")))
+		assert.False(db.Has([]byte("foo")))
+		val, err := db.Get([]byte("baz"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("new")))
+		assert.NoError(db.Move([]byte("foo"), []byte("baz")))
+		val, err := db.Get([]byte("baz"))
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+		assert.Equal(1, db.Len())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		assert.Equal(ErrKeyNotFound, db.Move([]byte("foo"), []byte("baz")))
+		assert.Equal(ErrEmptyKey, db.Move([]byte("baz"), []byte{}))
+		assert.True(db.Has([]byte("baz")))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("bar"), time.Hour))
+		assert.NoError(db.Move([]byte("ttl"), []byte("ttl2")))
+		_, meta, err := db.GetWithMeta([]byte("ttl2"))
+		assert.NoError(err)
+		assert.False(meta.Expiry.IsZero())
+		assert.NoError(db.Delete([]byte("ttl2")))
+	})
+
+	t.Run("RenamePrefix", func(t *testing.T) {
+		assert.NoError(db.DeleteAll())
+		assert.NoError(db.Put([]byte("a/1"), []byte("1")))
+		assert.NoError(db.Put([]byte("a/a/2"), []byte("2")))
+		assert.NoError(db.Put([]byte("a/2"), []byte("3")))
+		assert.NoError(db.Put([]byte("b/1"), []byte("4")))
+
+		// a/a/2 is renamed to a/2 which is itself renamed to 2
+		assert.NoError(db.RenamePrefix([]byte("a/"), []byte("")))
+		expected := map[string]string{"1": "1", "a/2": "2", "2": "3", "b/1": "4"}
+		assert.Equal(len(expected), db.Len())
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal([]byte(value), val)
+		}
+
+		assert.Equal(ErrEmptyKey, db.RenamePrefix([]byte("b/1"), []byte("")))
+		assert.True(db.Has([]byte("b/1")))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+		db, err = Open(testdir)
+		assert.NoError(err)
+
+		assert.Equal(4, db.Len())
+		val, err := db.Get([]byte("a/2"))
+		assert.NoError(err)
+		assert.Equal([]byte("2"), val)
+		assert.False(db.Has([]byte("a/1")))
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+
+	snap := db.Snapshot()
+
+	assert.NoError(db.Put([]byte("key0"), []byte("new")))
+	assert.NoError(db.Delete([]byte("key1")))
+	assert.NoError(db.Put([]byte("key10"), []byte("value10")))
+	assert.NoError(db.Merge())
+
+	t.Run("Get", func(t *testing.T) {
+		assert.Equal(10, snap.Len())
+		for i := 0; i < 10; i++ {
+			val, err := snap.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), val)
+		}
+		assert.False(snap.Has([]byte("key10")))
+		_, err := snap.Get([]byte("key10"))
+		assert.Equal(ErrKeyNotFound, err)
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var keys []string
+		assert.NoError(snap.Scan([]byte("key1"), func(key []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		}))
+		assert.Equal([]string{"key1"}, keys)
+
+		var n int
+		assert.NoError(snap.Fold(func(key []byte) error {
+			n++
+			return nil
+		}))
+		assert.Equal(10, n)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		before, err := internal.GetDatafiles(fs.OS, testdir)
+		assert.NoError(err)
+
+		assert.NoError(snap.Close())
+		assert.NoError(snap.Close())
+		_, err = snap.Get([]byte("key2"))
+		assert.Equal(ErrSnapshotClosed, err)
+
+		// The merged away datafiles are removed once released
+		after, err := internal.GetDatafiles(fs.OS, testdir)
+		assert.NoError(err)
+		assert.True(len(after) < len(before))
+
+		val, err := db.Get([]byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("new"), val)
+	})
+}
+
+func TestCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(2))
+	assert.NoError(err)
+	defer db.Close()
+
+	t.Run("Copy", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Copy([]byte("foo"), []byte("baz"), false))
+		for _, key := range []string{"foo", "baz"} {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+
+		assert.Equal(ErrKeyNotFound, db.Copy([]byte("missing"), []byte("baz"), false))
+		assert.Equal(ErrEmptyKey, db.Copy([]byte("foo"), []byte{}, false))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		assert.NoError(db.PutWithTTL([]byte("ttl"), []byte("bar"), time.Hour))
+
+		assert.NoError(db.Copy([]byte("ttl"), []byte("kept"), true))
+		_, meta, err := db.GetWithMeta([]byte("kept"))
+		assert.NoError(err)
+		assert.False(meta.Expiry.IsZero())
+
+		assert.NoError(db.Copy([]byte("ttl"), []byte("dropped"), false))
+		_, meta, err = db.GetWithMeta([]byte("dropped"))
+		assert.NoError(err)
+		assert.True(meta.Expiry.IsZero())
+	})
+}
+
+func TestBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(filepath.Join(testdir, "db"), WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	assert.NoError(db.Delete([]byte("key0")))
+
+	var buf bytes.Buffer
+	assert.NoError(db.Backup(&buf))
+	assert.NoError(db.Put([]byte("key1"), []byte("new")))
+	assert.NoError(db.Merge())
+
+	check := func(db *Bitcask) {
+		assert.Equal(9, db.Len())
+		assert.False(db.Has([]byte("key0")))
+		for i := 1; i < 10; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), val)
+		}
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		path := filepath.Join(testdir, "restored")
+		assert.NoError(Restore(bytes.NewReader(buf.Bytes()), path))
+
+		restored, err := Open(path)
+		assert.NoError(err)
+		check(restored)
+		assert.NoError(restored.Close())
+
+		// The datafiles alone give the same keys
+		assert.NoError(os.Remove(filepath.Join(path, "index")))
+		restored, err = Open(path)
+		assert.NoError(err)
+		check(restored)
+		assert.NoError(restored.Close())
+	})
+
+	t.Run("NotEmpty", func(t *testing.T) {
+		err := Restore(bytes.NewReader(buf.Bytes()), filepath.Join(testdir, "db"))
+		assert.True(os.IsExist(errors.Unwrap(err)))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		path := filepath.Join(testdir, "invalid")
+		assert.Error(Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), path))
+		fns, err := ioutil.ReadDir(path)
+		assert.NoError(err)
+		assert.Empty(fns)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	value := bytes.Repeat([]byte(`{"foo": "bar"}`), 100)
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := Open(testdir, WithFormatVersion(3), WithCompression(CompressionGzip))
+		assert.Equal(ErrCompressionNotSupported, err)
+		_, err = Open(testdir, WithFormatVersion(4), WithCompression(Compression(42)))
+		assert.Equal(ErrUnsupportedCompression, err)
+	})
+
+	db, err := Open(testdir, WithFormatVersion(4), WithCompression(CompressionGzip))
+	assert.NoError(err)
+
+	t.Run("Put", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), value))
+		assert.NoError(db.Put([]byte("small"), []byte("bar")))
+		batch := NewBatch()
+		batch.Put([]byte("batch"), value)
+		assert.NoError(db.Write(batch))
+		assert.NoError(db.Copy([]byte("foo"), []byte("copy"), false))
+
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.True(stats.Size < int64(len(value)))
+
+		for _, key := range []string{"foo", "batch", "copy"} {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+		val, _, err := db.GetWithMeta([]byte("small"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	t.Run("Mixed", func(t *testing.T) {
+		assert.NoError(db.Merge())
+		assert.NoError(db.Close())
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir, WithCompression(CompressionNone))
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("plain"), value))
+
+		snap := db.Snapshot()
+		defer snap.Close()
+		for _, key := range []string{"foo", "batch", "copy", "plain"} {
+			val, err := snap.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+	})
+
+	t.Run("Recompress", func(t *testing.T) {
+		compressions := func() (compressions []uint8) {
+			for _, key := range []string{"foo", "batch", "copy", "plain"} {
+				e, err := db.getEntry([]byte(key))
+				assert.NoError(err)
+				compressions = append(compressions, e.Compression)
+			}
+			return
+		}
+
+		// Values are not decompressed as they would get larger
+		gzip := uint8(CompressionGzip)
+		assert.NoError(db.Merge())
+		assert.Equal([]uint8{gzip, gzip, gzip, 0}, compressions())
+
+		assert.NoError(db.Close())
+		db, err = Open(testdir, WithCompression(CompressionGzip))
+		assert.NoError(err)
+		assert.NoError(db.Merge())
+		assert.Equal([]uint8{gzip, gzip, gzip, gzip}, compressions())
+
+		for _, key := range []string{"foo", "batch", "copy", "plain"} {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+		val, err := db.Get([]byte("small"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
+
+	assert.NoError(db.Close())
+}
+
+func TestPrefixCodec(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	value := bytes.Repeat([]byte(`{"foo": "bar"}`), 100)
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := Open(testdir, WithFormatVersion(3), WithPrefixCodec([]byte("logs/"), CompressionGzip))
+		assert.Equal(ErrCompressionNotSupported, err)
+		_, err = Open(testdir, WithFormatVersion(4), WithPrefixCodec([]byte("logs/"), Compression(42)))
+		assert.Equal(ErrUnsupportedCompression, err)
+	})
+
+	db, err := Open(testdir, WithFormatVersion(4), WithCompression(CompressionGzip),
+		WithPrefixCodec([]byte("images/"), CompressionNone),
+		WithPrefixCodec([]byte("images/svg/"), CompressionGzip),
+	)
+	require.NoError(err)
+
+	compression := func(key string) uint8 {
+		e, err := db.getEntry([]byte(key))
+		require.NoError(err)
+		return e.Compression
+	}
+	gzip := uint8(CompressionGzip)
+
+	t.Run("Put", func(t *testing.T) {
+		for _, key := range []string{"logs/1", "images/1", "images/svg/1"} {
+			require.NoError(db.Put([]byte(key), value))
+		}
+		assert.Equal(gzip, compression("logs/1"))
+		assert.Equal(uint8(0), compression("images/1"))
+		assert.Equal(gzip, compression("images/svg/1"))
+
+		for _, key := range []string{"logs/1", "images/1", "images/svg/1"} {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err)
+			assert.Equal(value, val)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Close())
+
+		// The prefixes are kept and can be changed
+		db, err = Open(testdir, WithPrefixCodec([]byte("logs/"), CompressionNone), WithPrefixCodec([]byte("images/"), CompressionGzip))
+		require.NoError(err)
+		require.NoError(db.Put([]byte("images/2"), value))
+		require.NoError(db.Put([]byte("logs/2"), value))
+		assert.Equal(gzip, compression("images/2"))
+		assert.Equal(uint8(0), compression("logs/2"))
+
+		// Merges recompress as configured unless values would get larger
+		require.NoError(db.Merge())
+		assert.Equal(gzip, compression("images/1"))
+		assert.Equal(gzip, compression("logs/1"))
+		val, err := db.Get([]byte("images/1"))
+		assert.NoError(err)
+		assert.Equal(value, val)
+	})
+
+	require.NoError(db.Close())
+}
+
+func TestTrash(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	t.Run("Unsupported", func(t *testing.T) {
+		_, err := Open(testdir, WithTrash(time.Hour))
+		assert.Equal(ErrTTLNotSupported, err)
+	})
+
+	db, err := Open(testdir, WithFormatVersion(2), WithTrash(time.Hour), WithMaxKeySize(16))
+	assert.NoError(err)
+	defer db.Close()
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	t.Run("Undelete", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Delete([]byte("foo")))
+		assert.False(db.Has([]byte("foo")))
+		assert.True(db.Has([]byte(TrashPrefix + "foo")))
+
+		assert.NoError(db.Undelete([]byte("foo")))
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.False(db.Has([]byte(TrashPrefix + "foo")))
+		assert.Equal(ErrKeyNotFound, db.Undelete([]byte("foo")))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		assert.NoError(db.Delete([]byte("foo")))
+		now = now.Add(2 * time.Hour)
+		assert.Equal(ErrKeyNotFound, db.Undelete([]byte("foo")))
+		assert.False(db.Has([]byte(TrashPrefix + "foo")))
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Delete([]byte("foo")))
+		assert.NoError(db.Delete([]byte(TrashPrefix + "foo")))
+		assert.Equal(ErrKeyNotFound, db.Undelete([]byte("foo")))
+
+		assert.NoError(db.Put([]byte("0123456789"), []byte("bar")))
+		assert.Equal(ErrKeyTooLarge, db.Delete([]byte("0123456789")))
+		assert.True(db.Has([]byte("0123456789")))
+		assert.NoError(db.Delete([]byte("missing")))
+	})
+
+	t.Run("DeleteAll", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("baz"), []byte("qux")))
+		assert.Equal(ErrKeyTooLarge, db.DeleteAll())
+		assert.Equal(3, db.Len())
+
+		assert.NoError(db.Move([]byte("0123456789"), []byte("big")))
+		assert.NoError(db.DeleteAll())
+		var trashed int
+		assert.NoError(db.Scan([]byte(TrashPrefix), func(key []byte) error {
+			trashed++
+			return nil
+		}))
+		assert.Equal(3, trashed)
+		assert.Equal(3, db.Len())
+
+		assert.NoError(db.Undelete([]byte("baz")))
+		val, err := db.Get([]byte("baz"))
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), val)
+	})
+}
+
+func TestGetWithOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	snap := db.Snapshot()
+	defer snap.Close()
+	assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+
+	for _, verify := range []bool{false, true} {
+		val, err := db.GetWithOptions([]byte("foo"), ReadOptions{VerifyChecksum: verify})
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), val)
+
+		val, err = db.GetWithOptions([]byte("foo"), ReadOptions{VerifyChecksum: verify, Snapshot: snap})
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	}
+
+	_, err = db.GetWithOptions([]byte("missing"), ReadOptions{})
+	assert.Equal(ErrKeyNotFound, err)
+}
+
+func TestEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	key := bytes.Repeat([]byte("k"), 32)
+	value := bytes.Repeat([]byte("secret"), 10)
+
+	db, err := Open(testdir, WithEncryption(key), WithFormatVersion(4), WithCompression(CompressionGzip), WithMaxValueSize(128))
+	assert.NoError(err)
+
+	t.Run("Put", func(t *testing.T) {
+		assert.NoError(db.Put([]byte("foo"), value))
+		assert.NoError(db.Put([]byte("bar"), []byte("x")))
+		assert.NoError(db.Move([]byte("bar"), []byte("baz")))
+		assert.Equal(ErrValueTooLarge, db.Put([]byte("large"), make([]byte, 128)))
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal(value, val)
+		val, err = db.Get([]byte("baz"))
+		assert.NoError(err)
+		assert.Equal([]byte("x"), val)
+
+		assert.NoError(db.Merge())
+		assert.NoError(db.Close())
+
+		fns, err := internal.GetDatafiles(fs.OS, testdir)
+		assert.NoError(err)
+		for _, fn := range fns {
+			data, err := ioutil.ReadFile(fn)
+			assert.NoError(err)
+			assert.False(bytes.Contains(data, []byte("secret")))
+		}
+	})
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		_, err := Open(testdir)
+		assert.Equal(ErrInvalidEncryptionKey, err)
+		_, err = Open(testdir, WithEncryption(bytes.Repeat([]byte("x"), 32)))
+		assert.Equal(ErrInvalidEncryptionKey, err)
+		_, err = Open(testdir, WithEncryption([]byte("short")))
+		assert.True(errors.Is(err, ErrInvalidEncryptionKey))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+		db, err = Open(testdir, WithEncryption(key))
+		assert.NoError(err)
+		defer db.Close()
+
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal(value, val)
+		assert.Equal(2, db.Len())
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Close())
+
+		_, err = Open(testdir, WithEncryption(key))
+		assert.Equal(ErrEncryptionMismatch, err)
+	})
+}
+
+func TestPutWithOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(3), WithNodeID(1))
+	assert.NoError(err)
+	defer db.Close()
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	t.Run("Default", func(t *testing.T) {
+		assert.NoError(db.PutWithOptions([]byte("foo"), []byte("bar"), WriteOptions{}))
+		val, meta, err := db.GetWithMeta([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.Equal(Meta{Origin: 1, Size: 3}, meta)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		assert.NoError(db.PutWithOptions([]byte("ttl"), []byte("bar"), WriteOptions{
+			TTL:  time.Minute,
+			Meta: Meta{Expiry: now.Add(time.Hour), Origin: 2},
+		}))
+		_, meta, err := db.GetWithMeta([]byte("ttl"))
+		assert.NoError(err)
+		assert.Equal(now.Add(time.Minute).UnixNano(), meta.Expiry.UnixNano())
+		assert.Equal(uint32(2), meta.Origin)
+
+		assert.Equal(ErrInvalidTTL, db.PutWithOptions([]byte("ttl"), []byte("bar"), WriteOptions{TTL: -time.Second}))
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.NoError(db.PutWithOptions([]byte("sync"), []byte("bar"), WriteOptions{Sync: true}))
+		synced, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(stats.Syncs+1, synced.Syncs)
+	})
+
+	t.Run("NoOverwrite", func(t *testing.T) {
+		opts := WriteOptions{NoOverwrite: true}
+		assert.Equal(ErrKeyExists, db.PutWithOptions([]byte("foo"), []byte("baz"), opts))
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+
+		assert.NoError(db.PutWithOptions([]byte("new"), []byte("baz"), opts))
+
+		// An expired key can be written again
+		now = now.Add(2 * time.Minute)
+		assert.NoError(db.PutWithOptions([]byte("ttl"), []byte("baz"), opts))
+	})
+
+	t.Run("NotSupported", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.Equal(ErrTTLNotSupported, db.PutWithOptions([]byte("foo"), []byte("bar"), WriteOptions{TTL: time.Minute}))
+		assert.Equal(ErrOriginNotSupported, db.PutWithOptions([]byte("foo"), []byte("bar"), WriteOptions{Meta: Meta{Origin: 2}}))
+	})
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	assert.NoError(err)
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	next := func(events <-chan Event) Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return Event{}
+		}
+	}
+
+	t.Run("Events", func(t *testing.T) {
+		events, cancel := db.Watch([]byte("foo"))
+		defer cancel()
+
+		assert.NoError(db.Put([]byte("foo1"), []byte("bar")))
+		assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+		assert.NoError(db.Delete([]byte("foo1")))
+		assert.NoError(db.Delete([]byte("foo1")))
+		assert.NoError(db.Move([]byte("bar"), []byte("foo2")))
+		assert.NoError(db.DeleteAll())
+
+		e := next(events)
+		assert.Equal(EventPut, e.Type)
+		assert.Equal([]byte("foo1"), e.Key)
+		assert.Equal(int64(3), e.Size)
+		assert.Equal(now, e.Time)
+		prev := e.Seq
+		e = next(events)
+		assert.Equal(Event{Type: EventDelete, Key: []byte("foo1"), Time: now, Seq: e.Seq}, e)
+		assert.True(e.Seq.Offset > prev.Offset)
+		e = next(events)
+		assert.Equal(EventPut, e.Type)
+		assert.Equal([]byte("foo2"), e.Key)
+		e = next(events)
+		assert.Equal(EventDelete, e.Type)
+		assert.Equal([]byte("foo2"), e.Key)
+		assert.Len(events, 0)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		events, cancel := db.Watch(nil)
+		cancel()
+		cancel()
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		_, ok := <-events
+		assert.False(ok)
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		events, cancel := db.Watch(nil)
+		defer cancel()
+
+		for i := 0; i < watchBufferSize+10; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		}
+		for i := 0; i < watchBufferSize; i++ {
+			assert.Equal(EventPut, next(events).Type)
+		}
+		assert.Len(events, 0)
+
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Equal(EventOverflow, next(events).Type)
+		assert.Equal(EventPut, next(events).Type)
+	})
+
+	t.Run("BufferSize", func(t *testing.T) {
+		events, cancel := db.WatchWithOptions(nil, WatchOptions{BufferSize: 2})
+		defer cancel()
+
+		for i := 0; i < 3; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+		assert.Equal([]byte("foo0"), next(events).Key)
+		assert.Equal([]byte("foo1"), next(events).Key)
+		assert.Len(events, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Equal(EventOverflow, next(events).Type)
+	})
+
+	t.Run("DropOldest", func(t *testing.T) {
+		events, cancel := db.WatchWithOptions(nil, WatchOptions{Policy: WatchDropOldest, BufferSize: 2})
+		defer cancel()
+
+		for i := 0; i < 5; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+		assert.Equal([]byte("foo3"), next(events).Key)
+		assert.Equal([]byte("foo4"), next(events).Key)
+		assert.Len(events, 0)
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		events, cancel := db.WatchWithOptions(nil, WatchOptions{Policy: WatchBlock, BufferSize: 1, BlockTimeout: 20 * time.Millisecond})
+		defer cancel()
+
+		// The write waits for the watcher to make room
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.Equal([]byte("foo0"), next(events).Key)
+		}()
+		assert.NoError(db.Put([]byte("foo0"), []byte("bar")))
+		assert.NoError(db.Put([]byte("foo1"), []byte("bar")))
+		<-done
+		assert.Equal([]byte("foo1"), next(events).Key)
+
+		// Until it times out
+		assert.NoError(db.Put([]byte("foo2"), []byte("bar")))
+		start := time.Now()
+		assert.NoError(db.Put([]byte("foo3"), []byte("bar")))
+		assert.True(time.Since(start) >= 20*time.Millisecond)
+		// And the watcher caught up
+		start = time.Now()
+		assert.NoError(db.Put([]byte("foo4"), []byte("bar")))
+		assert.True(time.Since(start) < 20*time.Millisecond)
+		assert.Equal([]byte("foo2"), next(events).Key)
+		assert.NoError(db.Put([]byte("foo5"), []byte("bar")))
+		assert.Equal(EventOverflow, next(events).Type)
+	})
+
+	t.Run("Coalesce", func(t *testing.T) {
+		events, cancel := db.WatchWithOptions([]byte("foo"), WatchOptions{Policy: WatchCoalesce, BufferSize: 3})
+		defer cancel()
+
+		// The first event is taken by the goroutine delivering them
+		assert.NoError(db.Put([]byte("foo0"), []byte("bar")))
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(db.Put([]byte("foo1"), []byte("bar")))
+		assert.NoError(db.Put([]byte("foo2"), []byte("bar")))
+		assert.NoError(db.Put([]byte("foo1"), []byte("baz!")))
+		assert.NoError(db.Delete([]byte("foo2")))
+		assert.Equal([]byte("foo0"), next(events).Key)
+		e := next(events)
+		assert.Equal([]byte("foo1"), e.Key)
+		assert.Equal(int64(4), e.Size)
+		e = next(events)
+		assert.Equal(Event{Type: EventDelete, Key: []byte("foo2"), Time: now, Seq: e.Seq}, e)
+
+		for i := 0; i < 5; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(EventOverflow, next(events).Type)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Equal([]byte("foo"), next(events).Key)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		events, cancel := db.Watch(nil)
+		coalesced, cancelCoalesced := db.WatchWithOptions(nil, WatchOptions{Policy: WatchCoalesce})
+		assert.NoError(db.Close())
+		_, ok := <-events
+		assert.False(ok)
+		_, ok = <-coalesced
+		assert.False(ok)
+		cancel()
+		cancelCoalesced()
+	})
+}
+
+func TestReplication(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	primary, err := Open(filepath.Join(testdir, "primary"), WithMaxDatafileSize(64))
+	assert.NoError(err)
+	defer primary.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	served := make(chan error)
+	go func() { served <- primary.ServeReplication(l) }()
+
+	// waitFor waits until the replica has the value of the key (or not)
+	waitFor := func(db *Bitcask, key, value []byte) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			val, err := db.Get(key)
+			if (value == nil && err == ErrKeyNotFound) || (err == nil && bytes.Equal(val, value)) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("key %s not replicated", key)
+	}
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(primary.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+
+	path := filepath.Join(testdir, "follower")
+	f, err := Follow(l.Addr().String(), path)
+	assert.NoError(err)
+
+	t.Run("CatchUp", func(t *testing.T) {
+		assert.Equal(10, f.DB().Len())
+		val, err := f.DB().Get([]byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("value"), val)
+		assert.Equal(ErrReadOnly, f.DB().Put([]byte("foo"), []byte("bar")))
+	})
+
+	t.Run("Follow", func(t *testing.T) {
+		assert.NoError(primary.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(primary.Delete([]byte("key0")))
+		waitFor(f.DB(), []byte("foo"), []byte("bar"))
+		waitFor(f.DB(), []byte("key0"), nil)
+
+		assert.NoError(primary.Merge())
+		assert.NoError(primary.Put([]byte("foo"), []byte("baz")))
+		waitFor(f.DB(), []byte("foo"), []byte("baz"))
+		assert.Equal(10, f.DB().Len())
+		assert.NoError(f.Err())
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		assert.NoError(f.Close())
+		assert.NoError(primary.Put([]byte("hello"), []byte("world")))
+
+		f, err = Follow(l.Addr().String(), path)
+		assert.NoError(err)
+		waitFor(f.DB(), []byte("hello"), []byte("world"))
+		assert.Equal(11, f.DB().Len())
+	})
+
+	t.Run("Promote", func(t *testing.T) {
+		assert.NoError(l.Close())
+		assert.Error(<-served)
+
+		db, err := f.PromoteToPrimary()
+		assert.NoError(err)
+		defer db.Close()
+
+		assert.NoError(db.Put([]byte("foo"), []byte("qux")))
+		val, err := db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), val)
+		assert.Equal(11, db.Len())
+	})
+
+	t.Run("ProtocolErrors", func(t *testing.T) {
+		var manifest bytes.Buffer
+		manifest.Write(replicationMagic[:])
+		binary.Write(&manifest, binary.BigEndian, uint32(math.MaxUint32))
+		_, err := readManifest(bufio.NewReader(&manifest), 10)
+		assert.Equal(errReplicationProtocol, err)
+
+		for _, size := range []int64{-1, maxConfigSize + 1} {
+			var msg bytes.Buffer
+			msg.WriteByte(msgConfig)
+			binary.Write(&msg, binary.BigEndian, size)
+			f := &Follower{path: testdir}
+			assert.Equal(errReplicationProtocol, f.apply(bufio.NewReader(&msg)))
+		}
+	})
+}
+
+func TestActiveDir(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	datafiles := func(dir string) []string {
+		fns, err := filepath.Glob(filepath.Join(dir, "*.data"))
+		require.NoError(err)
+		return fns
+	}
+	copyDir := func(src, dst string) {
+		require.NoError(os.MkdirAll(dst, 0700))
+		files, err := ioutil.ReadDir(src)
+		require.NoError(err)
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+			require.NoError(err)
+			require.NoError(ioutil.WriteFile(filepath.Join(dst, fi.Name()), data, 0600))
+		}
+	}
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+	path := filepath.Join(testdir, "db")
+	active := filepath.Join(testdir, "active")
+
+	t.Run("Close", func(t *testing.T) {
+		db, err := Open(path, WithActiveDir(active, 0))
+		require.NoError(err)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Len(datafiles(active), 1)
+		assert.Empty(datafiles(path))
+
+		require.NoError(db.Close())
+		assert.Empty(datafiles(active))
+		assert.Len(datafiles(path), 1)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		db, err := Open(path)
+		require.NoError(err)
+		defer db.Close()
+
+		// The datafiles checkpointed are not written to anymore
+		require.NoError(db.Put([]byte("hello"), []byte("world")))
+		assert.Len(datafiles(active), 1)
+		assert.Len(datafiles(path), 1)
+		value, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+	})
+
+	t.Run("Checkpoint", func(t *testing.T) {
+		db, err := Open(path, WithActiveDir(active, 10*time.Millisecond))
+		require.NoError(err)
+		defer db.Close()
+
+		require.NoError(db.Put([]byte("baz"), []byte("qux")))
+		for deadline := time.Now().Add(5 * time.Second); len(datafiles(path)) < 3 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Len(datafiles(path), 3)
+
+		for _, key := range []string{"foo", "hello", "baz"} {
+			assert.True(db.Has([]byte(key)), key)
+		}
+		value, err := db.Get([]byte("baz"))
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+
+		var changes int
+		require.NoError(db.Replay(nil, Seq{}, func(Event) error {
+			changes++
+			return nil
+		}))
+		assert.Equal(3, changes)
+	})
+
+	t.Run("Crash", func(t *testing.T) {
+		db, err := Open(path, WithActiveDir(active, 0))
+		require.NoError(err)
+		require.NoError(db.Put([]byte("crash"), []byte("test")))
+
+		// Copy the files as they are on disk, as if the process was killed
+		crashed := filepath.Join(testdir, "crashed")
+		copyDir(path, crashed)
+		copyDir(active, filepath.Join(testdir, "crashed-active"))
+		require.NoError(db.Close())
+
+		db, err = Open(crashed, WithActiveDir(filepath.Join(testdir, "crashed-active"), 0))
+		require.NoError(err)
+		defer db.Close()
+		value, err := db.Get([]byte("crash"))
+		assert.NoError(err)
+		assert.Equal([]byte("test"), value)
+		assert.Equal(4, db.Len())
+	})
+}
+
+func TestCrashConsistency(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	path := filepath.Join(testdir, "db")
+	model := map[string]string{}
+
+	// crash copies the files of the database as they are on disk, as if the
+	// process was killed at this point
+	crashes := 0
+	crash := func() string {
+		crashes++
+		dst := filepath.Join(testdir, fmt.Sprintf("crash%d", crashes))
+		require.NoError(os.MkdirAll(dst, 0700))
+		files, err := ioutil.ReadDir(path)
+		require.NoError(err)
+		for _, fi := range files {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(path, fi.Name()))
+			require.NoError(err)
+			require.NoError(ioutil.WriteFile(filepath.Join(dst, fi.Name()), data, 0600))
+		}
+		return dst
+	}
+
+	check := func(path string) {
+		db, err := Open(path, WithMaxDatafileSize(128))
+		require.NoError(err)
+		defer db.Close()
+
+		assert.Equal(len(model), db.Len())
+		for key, value := range model {
+			val, err := db.Get([]byte(key))
+			assert.NoError(err, key)
+			assert.Equal(value, string(val), key)
+		}
+	}
+
+	db, err := Open(path, WithMaxDatafileSize(128))
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		require.NoError(db.Put([]byte(key), []byte(value)))
+		model[key] = value
+	}
+	require.NoError(db.Close())
+
+	t.Run("EveryWrite", func(t *testing.T) {
+		// The index saved on close is stale after every following write
+		db, err := Open(path, WithMaxDatafileSize(128))
+		require.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%d", i%13)
+			if i%4 == 3 {
+				require.NoError(db.Delete([]byte(key)))
+				delete(model, key)
+			} else {
+				value := fmt.Sprintf("value%d.%d", i%13, i)
+				require.NoError(db.Put([]byte(key), []byte(value)))
+				model[key] = value
+			}
+			check(crash())
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		old, err := ioutil.ReadFile(filepath.Join(path, "index"))
+		require.NoError(err)
+
+		db, err := Open(path, WithMaxDatafileSize(128))
+		require.NoError(err)
+		require.NoError(db.Merge())
+		require.NoError(db.Put([]byte("merged"), []byte("yes")))
+		model["merged"] = "yes"
+		require.NoError(db.Close())
+
+		// An index of the datafiles before the merge is of another generation
+		dst := crash()
+		require.NoError(ioutil.WriteFile(filepath.Join(dst, "index"), old, 0600))
+		check(dst)
+	})
+
+	t.Run("TornIndex", func(t *testing.T) {
+		data, err := ioutil.ReadFile(filepath.Join(path, "index"))
+		require.NoError(err)
+
+		for n := 0; n < len(data); n++ {
+			dst := crash()
+			require.NoError(ioutil.WriteFile(filepath.Join(dst, "index"), data[:n], 0600))
+			require.NoError(ioutil.WriteFile(filepath.Join(dst, "index.tmp"), data[n:], 0600))
+			check(dst)
+			require.NoError(os.RemoveAll(dst))
+		}
+	})
+
+	t.Run("IndexLog", func(t *testing.T) {
+		db, err := Open(path, WithMaxDatafileSize(128), WithIndexLog(time.Hour))
+		require.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key%d", i%13)
+			switch {
+			case i == 20:
+				require.NoError(db.DeleteAll())
+				model = map[string]string{}
+			case i%4 == 3:
+				require.NoError(db.Delete([]byte(key)))
+				delete(model, key)
+			default:
+				value := fmt.Sprintf("value%d.%d", i%13, i)
+				require.NoError(db.Put([]byte(key), []byte(value)))
+				model[key] = value
+			}
+			if i%3 == 0 {
+				require.NoError(db.logIndex())
+
+				// The deltas follow on from the saved index
+				tree, pos, _, err := db.indexer.Load(filepath.Join(path, "index"), db.config.MaxKeySize)
+				require.NoError(err)
+				valid := func(index.Position) bool { return true }
+				pos, err = index.ApplyDeltas(db.fsys, filepath.Join(path, "index.log"), tree, pos, db.config.MaxKeySize, valid)
+				require.NoError(err)
+				assert.Equal(db.indexLogPos, pos)
+				assert.Equal(db.trie.Size(), tree.Size())
+			}
+
+			// The deltas are compacted into the index when reopening
+			dst := crash()
+			check(dst)
+			assert.False(internal.Exists(filepath.Join(dst, "index.log")))
+		}
+
+		require.NoError(db.Merge())
+		assert.False(internal.Exists(filepath.Join(path, "index.log")))
+		check(crash())
+	})
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	require.NoError(db.Delete([]byte("key0")))
+
+	t.Run("Healthy", func(t *testing.T) {
+		report, err := db.Check(false)
+		assert.NoError(err)
+		assert.Empty(report.Errors)
+		assert.True(report.OK())
+		assert.Equal(len(db.datafiles)+1, report.Datafiles)
+		assert.Equal(11, report.Entries)
+		assert.Equal(9, report.Keys)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		// Flip the last byte of the value of key1 in its datafile
+		item, _ := db.trie.Search([]byte("key1"))
+		df := db.datafiles[item.(internal.Item).FileID]
+		f, err := os.OpenFile(df.Name(), os.O_RDWR, 0)
+		require.NoError(err)
+		offset := item.(internal.Item).Offset + item.(internal.Item).Size - codec.MetaInfoSize + int64(len("key1value1")) - 1
+		buf := make([]byte, 1)
+		_, err = f.ReadAt(buf, offset)
+		require.NoError(err)
+		buf[0] ^= 0xff
+		_, err = f.WriteAt(buf, offset)
+		require.NoError(err)
+		require.NoError(f.Close())
+
+		report, err := db.Check(false)
+		assert.NoError(err)
+		assert.False(report.OK())
+		if assert.Len(report.Errors, 2) {
+			assert.Equal(filepath.Base(df.Name()), report.Errors[0].Datafile)
+			assert.Equal(item.(internal.Item).Offset, report.Errors[0].Offset)
+			assert.Equal([]byte("key1"), report.Errors[0].Key)
+			assert.Equal(ErrChecksumFailed.Error(), report.Errors[0].Err)
+			assert.Equal([]byte("key1"), report.Errors[1].Key)
+		}
+	})
+
+	t.Run("Repair", func(t *testing.T) {
+		s := db.Snapshot()
+		_, err := db.Check(true)
+		assert.Equal(ErrSnapshotsOpen, err)
+		require.NoError(s.Close())
+
+		// Tear the last entry of the current datafile
+		require.NoError(db.Put([]byte("torn"), []byte("value")))
+		stat, err := os.Stat(db.curr.Name())
+		require.NoError(err)
+		require.NoError(os.Truncate(db.curr.Name(), stat.Size()-2))
+
+		report, err := db.Check(true)
+		assert.NoError(err)
+		assert.True(report.Repaired)
+		assert.Len(report.Errors, 4)
+		assert.True(report.TruncatedBytes > 0)
+		if recovery := db.LastRecovery(); assert.NotNil(recovery) {
+			assert.True(recovery.IndexRebuilt)
+			assert.Equal(report.TruncatedBytes, recovery.TruncatedBytes)
+		}
+
+		report, err = db.Check(false)
+		assert.NoError(err)
+		assert.True(report.OK())
+		assert.False(db.Has([]byte("key1")))
+		assert.False(db.Has([]byte("torn")))
+		// Entries after the corrupted one in its datafile are lost too
+		assert.False(db.Has([]byte("key2")))
+		val, err := db.Get([]byte("key9"))
+		assert.NoError(err)
+		assert.Equal([]byte("value9"), val)
+
+		require.NoError(db.Put([]byte("torn"), []byte("again")))
+		val, err = db.Get([]byte("torn"))
+		assert.NoError(err)
+		assert.Equal([]byte("again"), val)
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		ro, err := OpenReadOnly(testdir)
+		require.NoError(err)
+		defer ro.Close()
+		_, err = ro.Check(true)
+		assert.Equal(ErrReadOnly, err)
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	now := time.Unix(1000, 0)
+	src, err := Open(filepath.Join(testdir, "src"), WithFormatVersion(3), WithNodeID(7))
+	require.NoError(err)
+	defer src.Close()
+	src.now = func() time.Time { return now }
+
+	require.NoError(src.Put([]byte("foo"), []byte("bar")))
+	require.NoError(src.PutWithTTL([]byte("ttl"), []byte("soon"), time.Minute))
+	require.NoError(src.PutWithTTL([]byte("short"), []byte("gone"), time.Second))
+	require.NoError(src.Put([]byte("deleted"), []byte("x")))
+	require.NoError(src.Delete([]byte("deleted")))
+
+	require.NoError(src.Put([]byte("binary"), []byte{0, 0xff, '\n', ','}))
+
+	for _, format := range []Format{FormatJSON, FormatCSV} {
+		t.Run(format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(src.Export(&buf, format))
+			lines := 4
+			if format == FormatCSV {
+				lines++
+			}
+			assert.Equal(lines, strings.Count(buf.String(), "\n"))
+
+			dst, err := Open(filepath.Join(testdir, format.String()), WithFormatVersion(3))
+			require.NoError(err)
+			defer dst.Close()
+			dst.now = func() time.Time { return now.Add(10 * time.Second) }
+
+			require.NoError(dst.Import(bytes.NewReader(buf.Bytes()), format))
+			assert.Equal(3, dst.Len())
+
+			value, meta, err := dst.GetWithMeta([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), value)
+			assert.Equal(uint32(7), meta.Origin)
+			assert.True(meta.Expiry.IsZero())
+
+			value, meta, err = dst.GetWithMeta([]byte("ttl"))
+			assert.NoError(err)
+			assert.Equal([]byte("soon"), value)
+			assert.True(meta.Expiry.Equal(now.Add(time.Minute)))
+
+			value, err = dst.Get([]byte("binary"))
+			assert.NoError(err)
+			assert.Equal([]byte{0, 0xff, '\n', ','}, value)
+
+			assert.False(dst.Has([]byte("short")))
+
+			t.Run("Merge", func(t *testing.T) {
+				require.NoError(dst.Put([]byte("foo"), []byte("local")))
+				require.NoError(dst.Put([]byte("local"), []byte("x")))
+				require.NoError(dst.ImportWithMode(bytes.NewReader(buf.Bytes()), format, ImportMerge))
+				assert.Equal(4, dst.Len())
+				value, err := dst.Get([]byte("foo"))
+				assert.NoError(err)
+				assert.Equal([]byte("bar"), value)
+				assert.True(dst.Has([]byte("local")))
+			})
+
+			t.Run("Replace", func(t *testing.T) {
+				require.NoError(dst.ImportWithMode(bytes.NewReader(buf.Bytes()), format, ImportReplace))
+				assert.Equal(3, dst.Len())
+				assert.False(dst.Has([]byte("local")))
+			})
+		})
+	}
+
+	dst, err := Open(filepath.Join(testdir, "dst"))
+	require.NoError(err)
+	defer dst.Close()
+	require.NoError(dst.Put([]byte("keep"), []byte("x")))
+
+	assert.Error(dst.Import(strings.NewReader("{not json"), FormatJSON))
+	assert.Error(dst.Import(strings.NewReader("a,b\n"), FormatCSV))
+	assert.Error(dst.Import(strings.NewReader("key,value,origin,expiry\n!,,,\n"), FormatCSV))
+	assert.Equal(ErrUnsupportedFormat, dst.Import(strings.NewReader(""), Format(42)))
+	assert.Equal(ErrUnsupportedFormat, dst.Export(ioutil.Discard, Format(42)))
+
+	// A failed replace deletes nothing
+	assert.Error(dst.ImportWithMode(strings.NewReader("{not json"), FormatJSON, ImportReplace))
+	assert.True(dst.Has([]byte("keep")))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithIdleTimeout(50*time.Millisecond))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	get := func() {
+		for i := 0; i < 5; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), val)
+		}
+	}
+	get()
+
+	stats, err := db.Stats()
+	require.NoError(err)
+	assert.Equal(stats.Datafiles, stats.OpenDatafiles)
+	assert.True(stats.OpenDatafiles > 0)
+
+	released := func() uint64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			stats, err = db.Stats()
+			require.NoError(err)
+			if stats.IdleReleases > 0 && stats.OpenDatafiles == 0 || time.Now().After(deadline) {
+				return stats.IdleReleases
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	assert.Equal(uint64(1), released())
+
+	// Datafiles are only closed once per idle period
+	time.Sleep(200 * time.Millisecond)
+	stats, err = db.Stats()
+	require.NoError(err)
+	assert.Equal(uint64(1), stats.IdleReleases)
+
+	// and are reopened on demand
+	get()
+	stats, err = db.Stats()
+	require.NoError(err)
+	assert.Equal(stats.Datafiles, stats.OpenDatafiles)
+	assert.Equal(uint64(2), released())
+}
+
+func TestCorruptionPolicy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var corruptions []Corruption
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithCorruptionHandler(func(c Corruption) {
+		corruptions = append(corruptions, c)
+	}))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+
+	// Flip the last byte of the value of key1 in its datafile
+	value, _ := db.trie.Search([]byte("key1"))
+	item := value.(internal.Item)
+	f, err := os.OpenFile(db.datafiles[item.FileID].Name(), os.O_RDWR, 0)
+	require.NoError(err)
+	offset := item.Offset + item.Size - codec.MetaInfoSize + int64(len("key1value1")) - 1
+	buf := make([]byte, 1)
+	_, err = f.ReadAt(buf, offset)
+	require.NoError(err)
+	buf[0] ^= 0xff
+	_, err = f.WriteAt(buf, offset)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	t.Run("Fail", func(t *testing.T) {
+		_, err := db.Get([]byte("key1"))
+		assert.Equal(ErrChecksumFailed, err)
+		if assert.Len(corruptions, 1) {
+			assert.Equal([]byte("key1"), corruptions[0].Key)
+			assert.Equal(item.FileID, corruptions[0].FileID)
+			assert.Equal(item.Offset, corruptions[0].Offset)
+			assert.Equal(ErrChecksumFailed, corruptions[0].Err)
+		}
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(1), stats.Corruptions)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		db.config.CorruptionPolicy = int(CorruptionPanic)
+		defer func() {
+			c, ok := recover().(*Corruption)
+			if assert.True(ok) {
+				assert.Equal([]byte("key1"), c.Key)
+				assert.Contains(c.Error(), "key1")
+			}
+		}()
+		db.Get([]byte("key1"))
+	})
+
+	t.Run("Degrade", func(t *testing.T) {
+		db.config.CorruptionPolicy = int(CorruptionDegrade)
+		_, err := db.Get([]byte("key1"))
+		assert.Equal(ErrKeyNotFound, err)
+		value, err := db.Get([]byte("key2"))
+		assert.NoError(err)
+		assert.Equal([]byte("value2"), value)
+		stats, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(3), stats.Corruptions)
+
+		// Merging drops the corrupted key
+		require.NoError(db.Merge())
+		assert.False(db.Has([]byte("key1")))
+		assert.Equal(9, db.Len())
+		assert.Len(corruptions, 4)
+
+		_, err = db.Get([]byte("key1"))
+		assert.Equal(ErrKeyNotFound, err)
+		assert.Len(corruptions, 4)
+	})
+}
+
+func TestSyncPolicy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	var syncs int64
+	collector := metrics.CollectorFunc(func(op metrics.Op, d time.Duration, err error) {
+		if op == metrics.Sync {
+			atomic.AddInt64(&syncs, 1)
+		}
+	})
+
+	t.Run("Always", func(t *testing.T) {
+		db, err := Open(filepath.Join(testdir, "always"), WithMetrics(collector), WithSyncPolicy(SyncAlways))
+		require.NoError(err)
+		defer db.Close()
+
+		atomic.StoreInt64(&syncs, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+		assert.Equal(int64(2), atomic.LoadInt64(&syncs))
+	})
+
+	t.Run("Never", func(t *testing.T) {
+		db, err := Open(filepath.Join(testdir, "never"), WithMetrics(collector), WithSyncPolicy(SyncNever))
+		require.NoError(err)
+		defer db.Close()
+
+		atomic.StoreInt64(&syncs, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Equal(int64(0), atomic.LoadInt64(&syncs))
+		assert.NoError(db.Sync())
+		assert.Equal(int64(1), atomic.LoadInt64(&syncs))
+	})
+
+	t.Run("WithSync", func(t *testing.T) {
+		db, err := Open(filepath.Join(testdir, "bool"), WithMetrics(collector), WithSync(true))
+		require.NoError(err)
+
+		atomic.StoreInt64(&syncs, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.Equal(int64(1), atomic.LoadInt64(&syncs))
+		assert.NoError(db.Close())
+
+		db, err = Open(filepath.Join(testdir, "bool"), WithMetrics(collector), WithSync(false))
+		require.NoError(err)
+		defer db.Close()
+
+		atomic.StoreInt64(&syncs, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("baz")))
+		assert.Equal(int64(0), atomic.LoadInt64(&syncs))
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		assert.Equal(SyncNever, SyncInterval(0))
+
+		db, err := Open(filepath.Join(testdir, "interval"), WithMetrics(collector), WithSyncPolicy(SyncInterval(10*time.Millisecond)))
+		require.NoError(err)
+		defer db.Close()
+
+		atomic.StoreInt64(&syncs, 0)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&syncs) == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(int64(1), atomic.LoadInt64(&syncs))
+
+		// Nothing written, nothing synced
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(int64(1), atomic.LoadInt64(&syncs))
+	})
+}
+
+func TestMaxFilesPerMerge(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	options := []Option{WithMaxDatafileSize(64), WithMaxFilesPerMerge(3)}
+	db, err := Open(testdir, options...)
+	require.NoError(err)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d-%d", i, round))))
+		}
+	}
+	require.NoError(db.Delete([]byte("key0")))
+
+	check := func() {
+		assert.False(db.Has([]byte("key0")))
+		for i := 1; i < 10; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d-2", i)), value)
+		}
+	}
+
+	pass := len(db.datafiles) + 1
+	merges := 0
+	for {
+		require.NoError(db.Merge())
+		merges++
+		check()
+		if !internal.Exists(filepath.Join(testdir, "merge")) {
+			break
+		}
+
+		// The pass continues once reopened
+		require.NoError(db.Close())
+		db, err = Open(testdir, options...)
+		require.NoError(err)
+		check()
+		require.True(merges < pass)
+	}
+	defer db.Close()
+	assert.Equal((pass+2)/3, merges)
+
+	// The next merge starts a new pass
+	require.NoError(db.Merge())
+	check()
+	assert.True(internal.Exists(filepath.Join(testdir, "merge")) == (len(db.datafiles) > 3))
+}
+
+func TestMMap(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32), WithMMap(false))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+	assert.True(len(db.datafiles) > 0)
+	for i := 0; i < 5; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("value%d", i)), value)
+	}
+	require.NoError(db.Merge())
+	for i := 0; i < 5; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("value%d", i)), value)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	t.Run("MemoryPath", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		db, err := Open(MemoryPath, WithMaxDatafileSize(32))
+		require.NoError(err)
+		defer db.Close()
+
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+		}
+		require.NoError(db.Delete([]byte("key0")))
+		require.NoError(db.Merge())
+
+		assert.False(db.Has([]byte("key0")))
+		for i := 1; i < 10; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), value)
+		}
+		assert.False(internal.Exists(MemoryPath))
+	})
+
+	t.Run("WithFileSystem", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fsys := fs.NewMemory()
+		db, err := Open("db", WithFileSystem(fsys), WithMaxDatafileSize(32))
+		require.NoError(err)
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+		}
+		require.NoError(db.Close())
+		assert.True(fs.Exists(fsys, filepath.Join("db", "config.json")))
+		assert.False(internal.Exists("db"))
+
+		db, err = Open("db", WithFileSystem(fsys))
+		require.NoError(err)
+		defer db.Close()
+		assert.Equal(fsys, db.FileSystem())
+		for i := 0; i < 10; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), value)
+		}
+	})
+}
+
+func TestContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	t.Run("Done", func(t *testing.T) {
+		_, err := db.GetContext(canceled, []byte("key0"))
+		assert.Equal(context.Canceled, err)
+		assert.Equal(context.Canceled, db.PutContext(canceled, []byte("key0"), []byte("changed")))
+		assert.Equal(context.Canceled, db.DeleteContext(canceled, []byte("key1")))
+		assert.Equal(context.Canceled, db.ScanContext(canceled, nil, func(key []byte) error { return nil }))
+		assert.Equal(context.Canceled, db.MergeContext(canceled))
+
+		value, err := db.Get([]byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("value0"), value)
+		assert.True(db.Has([]byte("key1")))
+	})
+
+	t.Run("NotDone", func(t *testing.T) {
+		ctx := context.Background()
+		require.NoError(db.PutContext(ctx, []byte("key0"), []byte("changed")))
+		value, err := db.GetContext(ctx, []byte("key0"))
+		assert.NoError(err)
+		assert.Equal([]byte("changed"), value)
+		require.NoError(db.DeleteContext(ctx, []byte("key1")))
+		assert.False(db.Has([]byte("key1")))
+		require.NoError(db.MergeContext(ctx))
+		assert.Equal(9, db.Len())
+	})
+
+	t.Run("ScanCanceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		var keys int
+		err := db.ScanContext(ctx, []byte("key"), func(key []byte) error {
+			keys++
+			if keys == 3 {
+				cancel()
+			}
 			return nil
 		})
-		if err != nil {
-			b.Fatal(err)
+		assert.Equal(context.Canceled, err)
+		assert.Equal(3, keys)
+	})
+}
+
+func TestBuildFilter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithFormatVersion(2))
+	require.NoError(err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	require.NoError(db.Delete([]byte("key0")))
+	require.NoError(db.PutWithTTL([]byte("expired"), []byte("value"), time.Minute))
+	now := time.Now().Add(time.Hour)
+	db.now = func() time.Time { return now }
+
+	_, err = db.BuildFilter(0)
+	assert.Equal(filter.ErrInvalidRate, err)
+
+	f, err := db.BuildFilter(0.0001)
+	require.NoError(err)
+	for i := 1; i < 100; i++ {
+		assert.True(f.Contains([]byte(fmt.Sprintf("key%d", i))))
+	}
+	assert.False(f.Contains([]byte("key0")))
+	assert.False(f.Contains([]byte("expired")))
+}
+
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	_, err = Open(testdir, WithBloomFilter(1))
+	assert.Equal(filter.ErrInvalidRate, err)
+
+	db, err := Open(testdir, WithBloomFilter(0.01))
+	require.NoError(err)
+
+	// Enough keys to grow the filter
+	const n = 3000
+	for i := 0; i < n; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	require.NoError(db.Delete([]byte("key0")))
+
+	for i := 1; i < n; i++ {
+		assert.True(db.Has([]byte(fmt.Sprintf("key%d", i))))
+	}
+	assert.False(db.Has([]byte("key0")))
+	val, err := db.Get([]byte("key1"))
+	assert.NoError(err)
+	assert.Equal([]byte("value"), val)
+	for i := 0; i < n; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("missing%d", i)))
+		assert.Equal(ErrKeyNotFound, err)
+	}
+	assert.Equal([]bool{true, false, false}, db.HasMulti([][]byte{[]byte("key1"), []byte("key0"), []byte("missing")}))
+
+	stats, err := db.Stats()
+	require.NoError(err)
+	assert.Equal(uint64(2*n+4), stats.BloomFilterChecks)
+	assert.True(stats.BloomFilterNegatives > n*9/10)
+	// The deleted key is still in the filter
+	assert.True(stats.BloomFilterFalsePositives >= 2)
+	assert.Equal(stats.BloomFilterChecks, stats.BloomFilterNegatives+stats.BloomFilterFalsePositives+n+1)
+	assert.Equal(n, stats.BloomFilterKeys)
+	assert.True(stats.BloomFilterBytes > 0)
+
+	t.Run("Merge", func(t *testing.T) {
+		require.NoError(db.Merge())
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(n-1, stats.BloomFilterKeys)
+		assert.True(db.Has([]byte("key1")))
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		batch := NewBatch()
+		batch.Put([]byte("batched"), []byte("value"))
+		require.NoError(db.Write(batch))
+		assert.True(db.Has([]byte("batched")))
+	})
+
+	t.Run("DeleteAll", func(t *testing.T) {
+		require.NoError(db.DeleteAll())
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(0, stats.BloomFilterKeys)
+		assert.False(db.Has([]byte("key1")))
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.True(db.Has([]byte("foo")))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Close())
+		db, err = Open(testdir, WithBloomFilter(0.01))
+		require.NoError(err)
+		defer db.Close()
+		assert.True(db.Has([]byte("foo")))
+		assert.False(db.Has([]byte("key1")))
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(1, stats.BloomFilterKeys)
+	})
+}
+
+func TestBucket(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	require.NoError(err)
+	defer func() { db.Close() }()
+
+	users, groups := db.Bucket("users"), db.Bucket("groups")
+	assert.Equal("users", users.Name())
+	for i := 0; i < 5; i++ {
+		require.NoError(users.Put([]byte(fmt.Sprintf("user%d", i)), []byte("user")))
+		require.NoError(groups.Put([]byte(fmt.Sprintf("group%d", i)), []byte("group")))
+	}
+	require.NoError(users.Put([]byte("shared"), []byte("user")))
+	require.NoError(groups.Put([]byte("shared"), []byte("group")))
+	require.NoError(db.Put([]byte("shared"), []byte("db")))
+
+	val, err := users.Get([]byte("shared"))
+	assert.NoError(err)
+	assert.Equal([]byte("user"), val)
+	val, err = groups.Get([]byte("shared"))
+	assert.NoError(err)
+	assert.Equal([]byte("group"), val)
+	val, err = db.Get([]byte("shared"))
+	assert.NoError(err)
+	assert.Equal([]byte("db"), val)
+	assert.True(users.Has([]byte("user0")))
+	assert.False(groups.Has([]byte("user0")))
+
+	require.NoError(users.Delete([]byte("user0")))
+	assert.False(users.Has([]byte("user0")))
+	_, err = users.Get([]byte("user0"))
+	assert.Equal(ErrKeyNotFound, err)
+
+	var keys []string
+	require.NoError(users.Scan([]byte("user"), func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}))
+	assert.Equal([]string{"user1", "user2", "user3", "user4"}, keys)
+
+	t.Run("InvalidName", func(t *testing.T) {
+		assert.Equal(ErrInvalidBucketName, db.Bucket("").Put([]byte("foo"), []byte("bar")))
+		assert.Equal(ErrInvalidBucketName, db.Bucket("a\x00b").Put([]byte("foo"), []byte("bar")))
+		assert.Equal(ErrInvalidBucketName, db.DeleteBucket(""))
+		assert.Equal(ErrEmptyKey, users.Put(nil, []byte("bar")))
+	})
+
+	t.Run("DeleteBucket", func(t *testing.T) {
+		require.NoError(db.DeleteBucket("users"))
+		assert.False(users.Has([]byte("user1")))
+		assert.False(users.Has([]byte("shared")))
+		assert.True(groups.Has([]byte("shared")))
+		assert.Equal(7, db.Len())
+
+		// The bucket can be used again
+		require.NoError(users.Put([]byte("user9"), []byte("user")))
+		assert.True(users.Has([]byte("user9")))
+		assert.False(users.Has([]byte("user1")))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Close())
+		// The index is rebuilt from the datafiles
+		require.NoError(os.Remove(filepath.Join(testdir, "index")))
+		db, err = Open(testdir, WithMaxDatafileSize(128))
+		require.NoError(err)
+		users, groups = db.Bucket("users"), db.Bucket("groups")
+
+		assert.Equal(8, db.Len())
+		assert.False(users.Has([]byte("user1")))
+		assert.True(users.Has([]byte("user9")))
+		assert.True(groups.Has([]byte("group1")))
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		require.NoError(db.Merge())
+		assert.Empty(db.buckets.Dropped)
+		assert.Equal(uint64(1), db.buckets.Generations["users"])
+
+		require.NoError(db.Close())
+		require.NoError(os.Remove(filepath.Join(testdir, "index")))
+		db, err = Open(testdir, WithMaxDatafileSize(128))
+		require.NoError(err)
+		users = db.Bucket("users")
+		assert.Equal(8, db.Len())
+		assert.True(users.Has([]byte("user9")))
+		assert.False(users.Has([]byte("user1")))
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		require.NoError(db.DeleteBucket("groups"))
+		var buf bytes.Buffer
+		require.NoError(db.Backup(&buf))
+
+		path := filepath.Join(testdir, "restored")
+		require.NoError(Restore(bytes.NewReader(buf.Bytes()), path))
+		require.NoError(os.Remove(filepath.Join(path, "index")))
+		restored, err := Open(path)
+		require.NoError(err)
+		defer restored.Close()
+		assert.Equal(2, restored.Len())
+		assert.False(restored.Bucket("groups").Has([]byte("group1")))
+	})
+
+	t.Run("ReadOnly", func(t *testing.T) {
+		ro, err := OpenReadOnly(testdir)
+		require.NoError(err)
+		defer ro.Close()
+		assert.True(ro.Bucket("users").Has([]byte("user9")))
+		assert.Equal(ErrReadOnly, ro.DeleteBucket("users"))
+
+		require.NoError(db.DeleteBucket("users"))
+		require.NoError(ro.Refresh())
+		assert.False(ro.Bucket("users").Has([]byte("user9")))
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(256))
+	require.NoError(err)
+	defer func() { db.Close() }()
+
+	replay := func(prefix []byte, from Seq) ([]Event, error) {
+		var events []Event
+		err := db.Replay(prefix, from, func(e Event) error {
+			events = append(events, e)
+			return nil
+		})
+		return events, err
+	}
+	next := func(events <-chan Event) Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return Event{}
 		}
-		keys = SortByteArrays(keys)
-		if !reflect.DeepEqual(expected, keys) {
-			b.Fatal(fmt.Errorf("expected keys=#%v got=%#v", expected, keys))
+	}
+
+	require.NoError(db.Put([]byte("foo1"), []byte("bar")))
+	require.NoError(db.Put([]byte("foo2"), []byte("bar")))
+	require.NoError(db.Put([]byte("bar"), []byte("bar")))
+	require.NoError(db.Delete([]byte("foo1")))
+	batch := NewBatch()
+	batch.Put([]byte("foo3"), []byte("bar"))
+	batch.Delete([]byte("foo2"))
+	require.NoError(db.Write(batch))
+
+	t.Run("Replay", func(t *testing.T) {
+		events, err := replay([]byte("foo"), Seq{})
+		require.NoError(err)
+		require.Len(events, 5)
+		for i, want := range []struct {
+			typ EventType
+			key string
+		}{{EventPut, "foo1"}, {EventPut, "foo2"}, {EventDelete, "foo1"}, {EventPut, "foo3"}, {EventDelete, "foo2"}} {
+			assert.Equal(want.typ, events[i].Type)
+			assert.Equal([]byte(want.key), events[i].Key)
+		}
+		assert.Equal(int64(3), events[0].Size)
+
+		// Resuming, also within a batch
+		rest, err := replay([]byte("foo"), events[3].Seq)
+		require.NoError(err)
+		assert.Equal(events[4:], rest)
+		rest, err = replay(nil, events[1].Seq)
+		require.NoError(err)
+		require.Len(rest, 4)
+		assert.Equal([]byte("bar"), rest[0].Key)
+
+		end, err := replay(nil, events[4].Seq)
+		require.NoError(err)
+		assert.Empty(end)
+		_, err = replay(nil, Seq{FileID: 42})
+		assert.Equal(ErrSeqUnavailable, err)
+	})
+
+	t.Run("Live", func(t *testing.T) {
+		first, err := replay([]byte("foo"), Seq{})
+		require.NoError(err)
+
+		events, cancel, err := db.Subscribe([]byte("foo"), first[2].Seq)
+		require.NoError(err)
+		require.NoError(db.Put([]byte("foo4"), []byte("bar")))
+
+		assert.Equal(first[3], next(events))
+		assert.Equal(first[4], next(events))
+		e := next(events)
+		assert.Equal([]byte("foo4"), e.Key)
+		assert.False(e.Time.IsZero())
+
+		// The live events resume the log
+		rest, err := replay([]byte("foo"), first[4].Seq)
+		require.NoError(err)
+		require.Len(rest, 1)
+		assert.Equal(e.Seq, rest[0].Seq)
+
+		cancel()
+		_, ok := <-events
+		assert.False(ok)
+	})
+
+	t.Run("Switchover", func(t *testing.T) {
+		const n = 500
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < n; i++ {
+				assert.NoError(db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")))
+			}
+		}()
+
+		// Subscribe while writing, every key is delivered exactly once
+		time.Sleep(time.Millisecond)
+		events, cancel, err := db.Subscribe([]byte("key"), Seq{})
+		require.NoError(err)
+		defer cancel()
+		for i := 0; i < n; i++ {
+			e := next(events)
+			require.Equal([]byte(fmt.Sprintf("key%03d", i)), e.Key)
+		}
+		<-done
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected event %s", e.Key)
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		before, err := replay([]byte("foo"), Seq{})
+		require.NoError(err)
+
+		require.NoError(db.Merge())
+		require.NoError(db.Put([]byte("foo5"), []byte("bar")))
+
+		_, err = replay(nil, before[len(before)-1].Seq)
+		assert.Equal(ErrSeqUnavailable, err)
+		_, _, err = db.Subscribe(nil, before[len(before)-1].Seq)
+		assert.Equal(ErrSeqUnavailable, err)
+
+		// The merged log holds the live keys
+		events, err := replay([]byte("foo"), Seq{})
+		require.NoError(err)
+		var keys []string
+		for _, e := range events {
+			keys = append(keys, string(e.Key))
+		}
+		assert.Equal([]string{"foo3", "foo4", "foo5"}, keys)
+
+		require.NoError(db.Close())
+		db, err = Open(testdir, WithMaxDatafileSize(256))
+		require.NoError(err)
+		_, err = replay(nil, before[len(before)-1].Seq)
+		assert.Equal(ErrSeqUnavailable, err)
+		// Only Seqs after the merge can be resumed from
+		_, err = replay(nil, events[1].Seq)
+		assert.Equal(ErrSeqUnavailable, err)
+		rest, err := replay(nil, events[2].Seq)
+		require.NoError(err)
+		assert.Empty(rest)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		events, _, err := db.Subscribe(nil, Seq{})
+		require.NoError(err)
+		require.NoError(db.Close())
+		for range events {
+		}
+	})
+}
+
+func TestReadPriority(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	slow := func(s *readScheduler) {
+		for i := 0; i < 50; i++ {
+			s.foreground(time.Now().Add(-50 * time.Millisecond))
+		}
+	}
+	elapsed := func(s *readScheduler, n int) time.Duration {
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			s.background()
+		}
+		return time.Since(start)
+	}
+
+	t.Run("Fast", func(t *testing.T) {
+		s := newReadScheduler(0)
+		for i := 0; i < 50; i++ {
+			s.foreground(time.Now())
+		}
+		assert.True(elapsed(s, 100) < 50*time.Millisecond)
+	})
+
+	t.Run("Slow", func(t *testing.T) {
+		s := newReadScheduler(10 * time.Millisecond)
+		slow(s)
+		assert.True(elapsed(s, 3) >= 150*time.Millisecond)
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		s := newReadScheduler(10 * time.Millisecond)
+		slow(s)
+		atomic.StoreInt64(&s.last, time.Now().Add(-2*readSchedulerIdle).UnixNano())
+		assert.True(elapsed(s, 3) < 50*time.Millisecond)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		s := newReadScheduler(-1)
+		slow(s)
+		assert.True(elapsed(s, 3) < 50*time.Millisecond)
+	})
+
+	t.Run("ReadOptions", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithReadLatencyTarget(time.Hour))
+		require.NoError(err)
+		defer db.Close()
+
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		value, err := db.GetWithOptions([]byte("foo"), ReadOptions{Priority: PriorityBackground})
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		_, err = db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.True(atomic.LoadInt64(&db.reads.last) > 0)
+	})
+}
+
+func TestWarmup(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64))
+	require.NoError(err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("a/%d", i)), []byte("value")))
+		require.NoError(db.Put([]byte(fmt.Sprintf("b/%d", i)), []byte("value")))
+	}
+
+	wait := func(done <-chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("warmup not done")
 		}
 	}
+
+	t.Run("Prefixes", func(t *testing.T) {
+		wait(db.Warmup([]byte("a/"), []byte("b/1")))
+
+		// Warming up is not counted as reads
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(uint64(0), stats.Gets)
+	})
+
+	t.Run("All", func(t *testing.T) {
+		wait(db.Warmup())
+		value, err := db.Get([]byte("b/9"))
+		assert.NoError(err)
+		assert.Equal([]byte("value"), value)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		require.NoError(db.Close())
+		wait(db.Warmup())
+	})
+}
+
+func TestForecast(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(1024))
+	require.NoError(err)
+	defer db.Close()
+
+	f, err := db.Forecast(time.Hour)
+	require.NoError(err)
+	assert.Equal(float64(0), f.WriteRate)
+	assert.Len(f.Points, forecastPoints+1)
+
+	// Every key is written twice, half of the bytes written are dead
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+	stats, err := db.Stats()
+	require.NoError(err)
+	db.opened = time.Now().Add(-time.Hour)
+
+	t.Run("NoMerges", func(t *testing.T) {
+		f, err := db.Forecast(time.Hour)
+		require.NoError(err)
+		assert.InDelta(float64(stats.BytesWritten)/3600, f.WriteRate, 0.1)
+		assert.InDelta(f.WriteRate/2, f.DeadGrowthRate, 0.1)
+		assert.Equal(0, f.Merges)
+
+		first, last := f.Points[0], f.Points[len(f.Points)-1]
+		assert.Equal(stats.LiveBytes, first.LiveBytes)
+		assert.Equal(stats.Size, first.Size)
+		assert.InDelta(float64(2*stats.LiveBytes), float64(last.LiveBytes), 2)
+		assert.InDelta(float64(stats.DeadBytes+stats.LiveBytes), float64(last.DeadBytes), 2)
+		assert.Equal(last.Size, f.PeakSize)
+		assert.True(last.Time.Sub(first.Time) == time.Hour)
+	})
+
+	t.Run("AutoMerge", func(t *testing.T) {
+		// Without thresholds every automatic merge with dead bytes merges
+		db.config.AutoMergeInterval = 10 * time.Minute
+		db.config.AutoMergeDeadRatio = 0
+		db.config.AutoMergeDatafiles = 0
+		defer func() { db.config.AutoMergeInterval = 0 }()
+
+		f, err := db.Forecast(time.Hour)
+		require.NoError(err)
+		assert.Equal(6, f.Merges)
+		last := f.Points[len(f.Points)-1]
+		assert.True(last.DeadBytes < stats.DeadBytes)
+		// Merges need room for a copy of the live bytes
+		assert.True(f.PeakSize > last.Size)
+	})
+
+	t.Run("Datafiles", func(t *testing.T) {
+		require.NoError(db.Close())
+		db, err = OpenReadOnly(testdir)
+		require.NoError(err)
+		defer db.Close()
+
+		f, err := db.Forecast(time.Hour)
+		require.NoError(err)
+		assert.True(f.WriteRate >= 0)
+		assert.InDelta(f.WriteRate*float64(stats.DeadBytes)/float64(stats.LiveBytes+stats.DeadBytes), f.DeadGrowthRate, 0.1)
+	})
+}
+
+func TestFreeze(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(32))
+	require.NoError(err)
+	defer db.Close()
+
+	_, err = OpenShared(testdir)
+	assert.Equal(ErrNotFrozen, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("frozen")))
+	}
+	require.NoError(db.Freeze())
+	require.NoError(db.Put([]byte("key0"), []byte("changed")))
+	require.NoError(db.Put([]byte("key5"), []byte("new")))
+	require.NoError(db.Delete([]byte("key1")))
+
+	shared, err := OpenShared(testdir)
+	require.NoError(err)
+	assert.Equal(5, shared.Len())
+	for i := 0; i < 5; i++ {
+		value, err := shared.Get([]byte(fmt.Sprintf("key%d", i)))
+		assert.NoError(err)
+		assert.Equal([]byte("frozen"), value)
+	}
+	assert.False(shared.Has([]byte("key5")))
+	assert.NoError(shared.Refresh())
+	assert.Equal(5, shared.Len())
+	assert.Equal(ErrReadOnly, shared.Put([]byte("key"), []byte("value")))
+	assert.Equal(ErrReadOnly, shared.Freeze())
+
+	assert.Equal(ErrFrozen, db.Merge())
+	assert.Equal(ErrFrozenInUse, db.Thaw())
+	assert.Equal(ErrFrozenInUse, db.Freeze())
+
+	require.NoError(shared.Close())
+	require.NoError(db.Thaw())
+	require.NoError(db.Merge())
+	_, err = OpenShared(testdir)
+	assert.Equal(ErrNotFrozen, err)
+
+	value, err := db.Get([]byte("key0"))
+	assert.NoError(err)
+	assert.Equal([]byte("changed"), value)
+	assert.False(db.Has([]byte("key1")))
+}
+
+func TestGetReader(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	value := make([]byte, 1<<20)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+
+	t.Run("Stream", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxValueSize(1<<21))
+		require.NoError(err)
+		defer db.Close()
+		require.NoError(db.Put([]byte("foo"), value))
+
+		r, size, err := db.GetReader([]byte("foo"))
+		require.NoError(err)
+		assert.Equal(int64(len(value)), size)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value, data)
+		assert.NoError(r.Close())
+
+		// Merging meanwhile keeps the datafile until closed
+		r, _, err = db.GetReader([]byte("foo"))
+		require.NoError(err)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		require.NoError(db.Merge())
+		data, err = ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value, data)
+		assert.NoError(r.Close())
+
+		_, _, err = db.GetReader([]byte("bar"))
+		assert.Equal(ErrKeyNotFound, err)
+	})
+
+	t.Run("ChecksumError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxValueSize(1<<21))
+		require.NoError(err)
+		defer db.Close()
+		require.NoError(db.Put([]byte("foo"), value))
+		require.NoError(db.Sync())
+
+		// Flip the last byte of the value
+		f, err := os.OpenFile(filepath.Join(testdir, "000000000.data"), os.O_RDWR, 0)
+		require.NoError(err)
+		stat, err := f.Stat()
+		require.NoError(err)
+		_, err = f.WriteAt([]byte{^value[len(value)-1]}, stat.Size()-5)
+		require.NoError(err)
+		require.NoError(f.Close())
+
+		r, _, err := db.GetReader([]byte("foo"))
+		require.NoError(err)
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(ErrChecksumFailed, err)
+
+		// Ranges are not verified
+		data, err := db.GetRange([]byte("foo"), 0, 3)
+		assert.NoError(err)
+		assert.Equal(value[:3], data)
+	})
+
+	t.Run("Compressed", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxValueSize(1<<21), WithFormatVersion(5), WithCompression(CompressionGzip))
+		require.NoError(err)
+		defer db.Close()
+		require.NoError(db.Put([]byte("foo"), value))
+
+		r, size, err := db.GetReader([]byte("foo"))
+		require.NoError(err)
+		assert.Equal(int64(len(value)), size)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value, data)
+		assert.NoError(r.Close())
+
+		data, err = db.GetRange([]byte("foo"), 1000, 10)
+		assert.NoError(err)
+		assert.Equal(value[1000:1010], data)
+	})
+}
+
+func TestGetRange(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	require.NoError(err)
+	defer db.Close()
+	require.NoError(db.Put([]byte("foo"), []byte("0123456789")))
+
+	data, err := db.GetRange([]byte("foo"), 2, 3)
+	assert.NoError(err)
+	assert.Equal([]byte("234"), data)
+
+	data, err = db.GetRange([]byte("foo"), 8, 5)
+	assert.NoError(err)
+	assert.Equal([]byte("89"), data)
+
+	data, err = db.GetRange([]byte("foo"), 10, 1)
+	assert.NoError(err)
+	assert.Empty(data)
+
+	_, err = db.GetRange([]byte("foo"), 11, 1)
+	assert.Equal(ErrInvalidRange, err)
+	_, err = db.GetRange([]byte("foo"), -1, 1)
+	assert.Equal(ErrInvalidRange, err)
+	_, err = db.GetRange([]byte("bar"), 0, 1)
+	assert.Equal(ErrKeyNotFound, err)
 }
@@ -0,0 +1,102 @@
+// Package bitcasktest provides helpers to test applications using Bitcask:
+// temporary databases seeded with data, and golden files of the bytes of
+// their datafiles.
+package bitcasktest
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+var update = flag.Bool("bitcasktest.update", false, "update the golden files of bitcasktest")
+
+// Fixture opens a database with the given options in a temporary directory
+// and puts the seed key/value pairs into it in key order, so the datafiles
+// of the same seed are the same. The database is closed and its directory
+// removed when the test completes.
+func Fixture(t testing.TB, seed map[string][]byte, options ...bitcask.Option) *bitcask.Bitcask {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "bitcasktest")
+	if err != nil {
+		t.Fatalf("error creating the fixture directory: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := bitcask.Open(dir, options...)
+	if err != nil {
+		t.Fatalf("error opening the fixture: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	keys := make([]string, 0, len(seed))
+	for key := range seed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := db.Put([]byte(key), seed[key]); err != nil {
+			t.Fatalf("error seeding key %q of the fixture: %s", key, err)
+		}
+	}
+
+	return db
+}
+
+// Datafiles returns the bytes of the datafiles of the database in order
+func Datafiles(t testing.TB, db *bitcask.Bitcask) []byte {
+	t.Helper()
+
+	if err := db.Sync(); err != nil {
+		t.Fatalf("error syncing the database: %s", err)
+	}
+	names, err := internal.GetDatafiles(db.FileSystem(), db.Path())
+	if err != nil {
+		t.Fatalf("error listing the datafiles: %s", err)
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		data, err := fs.ReadFile(db.FileSystem(), name)
+		if err != nil {
+			t.Fatalf("error reading datafile: %s", err)
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+// AssertGolden fails the test if the bytes of the datafiles of the database
+// differ from the golden file. Running the tests with -bitcasktest.update
+// writes the golden file instead.
+func AssertGolden(t testing.TB, db *bitcask.Bitcask, golden string) {
+	t.Helper()
+
+	data := Datafiles(t, db)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+			t.Fatalf("error creating the golden file directory: %s", err)
+		}
+		if err := ioutil.WriteFile(golden, data, 0644); err != nil {
+			t.Fatalf("error writing the golden file: %s", err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("error reading the golden file (run with -bitcasktest.update to create it): %s", err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Errorf("datafiles differ from the golden file %s (run with -bitcasktest.update to update it):\nexpected: %x\nactual:   %x", golden, expected, data)
+	}
+}
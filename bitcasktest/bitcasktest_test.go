@@ -0,0 +1,55 @@
+package bitcasktest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixture(t *testing.T) {
+	assert := assert.New(t)
+
+	var path string
+	t.Run("Seeded", func(t *testing.T) {
+		db := Fixture(t, map[string][]byte{
+			"foo":   []byte("bar"),
+			"hello": []byte("world"),
+		})
+		path = db.Path()
+
+		assert.Equal(2, db.Len())
+		value, err := db.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), value)
+	})
+
+	// Cleaned up once the test completed
+	_, err := os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestAssertGolden(t *testing.T) {
+	assert := assert.New(t)
+
+	seed := map[string][]byte{
+		"a": []byte("1"),
+		"b": []byte("2"),
+		"c": {0, 0xff},
+	}
+	golden := filepath.Join(t.TempDir(), "golden", "datafiles")
+
+	*update = true
+	AssertGolden(t, Fixture(t, seed), golden)
+	*update = false
+
+	// The same seed makes the same datafiles
+	AssertGolden(t, Fixture(t, seed), golden)
+
+	db := Fixture(t, seed)
+	assert.NoError(db.Put([]byte("d"), []byte("3")))
+	mock := &testing.T{}
+	AssertGolden(mock, db, golden)
+	assert.True(mock.Failed())
+}
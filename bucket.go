@@ -0,0 +1,277 @@
+package bitcask
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+// bucketPrefix starts the keys of all buckets, see Bucket()
+const bucketPrefix = "\x00bucket\x00"
+
+// ErrInvalidBucketName is the error returned for an empty bucket name or
+// one containing a null byte
+var ErrInvalidBucketName = errors.New("error: invalid bucket name")
+
+// Bucket is a namespace of keys within a database, see Bitcask.Bucket()
+type Bucket struct {
+	db   *Bitcask
+	name string
+}
+
+// Bucket returns the bucket of the database with the given name, a separate
+// keyspace with its own Put(), Get(), Delete() and Scan() so many sets of
+// keys can share a database rather than each having its own directory and
+// lock. Buckets exist as long as they have keys and can be deleted as a
+// whole with DeleteBucket().
+//
+// The keys of a bucket are stored in the database prefixed with the bucket
+// name, so they are visible to Scan(), Fold() and the like of the database
+// under the reserved prefix "\x00bucket\x00" and the prefix counts towards
+// the maximum key size (see WithMaxKeySize()).
+func (b *Bitcask) Bucket(name string) *Bucket {
+	return &Bucket{db: b, name: name}
+}
+
+// Name returns the name of the bucket
+func (bk *Bucket) Name() string {
+	return bk.name
+}
+
+// key returns the key of the database storing the given key of the bucket
+func (bk *Bucket) key(key []byte) ([]byte, error) {
+	prefix, err := bk.prefix()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	return append(prefix, key...), nil
+}
+
+// prefix returns the prefix of the keys of the current generation of the
+// bucket
+func (bk *Bucket) prefix() ([]byte, error) {
+	if bk.name == "" || strings.IndexByte(bk.name, 0) >= 0 {
+		return nil, ErrInvalidBucketName
+	}
+
+	bk.db.mu.RLock()
+	generation := bk.db.buckets.Generations[bk.name]
+	bk.db.mu.RUnlock()
+	return bucketKeyPrefix(bk.name, generation), nil
+}
+
+// Put stores the key and value in the bucket like Bitcask.Put()
+func (bk *Bucket) Put(key, value []byte) error {
+	k, err := bk.key(key)
+	if err != nil {
+		return err
+	}
+	return bk.db.Put(k, value)
+}
+
+// Get retrieves the value of the key of the bucket like Bitcask.Get()
+func (bk *Bucket) Get(key []byte) ([]byte, error) {
+	k, err := bk.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return bk.db.Get(k)
+}
+
+// Has returns true if the key exists in the bucket, false otherwise
+func (bk *Bucket) Has(key []byte) bool {
+	k, err := bk.key(key)
+	if err != nil {
+		return false
+	}
+	return bk.db.Has(k)
+}
+
+// Delete deletes the key of the bucket like Bitcask.Delete()
+func (bk *Bucket) Delete(key []byte) error {
+	k, err := bk.key(key)
+	if err != nil {
+		return err
+	}
+	return bk.db.Delete(k)
+}
+
+// Scan performs a prefix scan of the keys of the bucket like
+// Bitcask.Scan(), calling `f` with the keys found without the bucket prefix
+func (bk *Bucket) Scan(prefix []byte, f func(key []byte) error) error {
+	p, err := bk.prefix()
+	if err != nil {
+		return err
+	}
+	return bk.db.Scan(append(p, prefix...), func(key []byte) error {
+		return f(key[len(p):])
+	})
+}
+
+// DeleteBucket deletes all the keys of the bucket with the given name at
+// once. Rather than writing a tombstone for every key the bucket starts a
+// new generation of keys, while the keys of the deleted generation are
+// dropped from the index right away and from the datafiles by the next
+// merges (see Merge()). The bucket can be used again right away.
+func (b *Bitcask) DeleteBucket(name string) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return ErrInvalidBucketName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	generation := b.buckets.Generations[name]
+	manifest := buckets{Generations: make(map[string]uint64, len(b.buckets.Generations)+1)}
+	for n, g := range b.buckets.Generations {
+		manifest.Generations[n] = g
+	}
+	manifest.Generations[name] = generation + 1
+	manifest.Dropped = append(append(manifest.Dropped, b.buckets.Dropped...), droppedBucket{
+		Name:       name,
+		Generation: generation,
+		Datafile:   b.curr.FileID(),
+	})
+	// The generation is dropped for good before any key is, so its keys
+	// never reappear when the index is rebuilt
+	if err := b.saveBuckets(manifest); err != nil {
+		return err
+	}
+	b.buckets = manifest
+
+	// Nothing is written, the keys are deleted at the end of the log
+	seq := Seq{FileID: b.curr.FileID(), Offset: b.curr.Size()}
+	for _, key := range b.dropPrefix(bucketKeyPrefix(name, generation)) {
+		b.notifyDelete(key, seq)
+	}
+	return nil
+}
+
+// bucketKeyPrefix returns the prefix of the keys of the given generation of
+// a bucket. Names hold no null byte, so no prefix is a prefix of another.
+func bucketKeyPrefix(name string, generation uint64) []byte {
+	return []byte(fmt.Sprintf("%s%s\x00%d\x00", bucketPrefix, name, generation))
+}
+
+// buckets is the manifest of the deleted buckets of a database, stored in
+// its `buckets` file
+type buckets struct {
+	// Generations is the current generation of every bucket deleted so
+	// far, it is zero for other buckets
+	Generations map[string]uint64 `json:"generations"`
+	// Dropped are the generations of buckets that were deleted and whose
+	// keys may still be in the datafiles
+	Dropped []droppedBucket `json:"dropped,omitempty"`
+}
+
+// droppedBucket is a deleted generation of a bucket whose keys may still be
+// in the datafiles up to and including Datafile
+type droppedBucket struct {
+	Name       string `json:"name"`
+	Generation uint64 `json:"generation"`
+	Datafile   int    `json:"datafile"`
+}
+
+// loadBuckets loads the manifest of the deleted buckets, if any. The caller
+// must hold the write lock.
+func (b *Bitcask) loadBuckets() error {
+	data, err := fs.ReadFile(b.fsys, filepath.Join(b.path, "buckets"))
+	if os.IsNotExist(err) {
+		b.buckets = buckets{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var manifest buckets
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return err
+	}
+	b.buckets = manifest
+	return nil
+}
+
+// saveBuckets saves the manifest of the deleted buckets
+func (b *Bitcask) saveBuckets(manifest buckets) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Readers must never see a partial manifest
+	temp := filepath.Join(b.path, "buckets.tmp")
+	if err := fs.WriteFile(b.fsys, temp, data, 0600); err != nil {
+		return err
+	}
+	return b.fsys.Rename(temp, filepath.Join(b.path, "buckets"))
+}
+
+// dropBuckets drops the keys of the deleted generations of buckets from the
+// index, e.g. after rebuilding it from the datafiles. The caller must hold
+// the write lock.
+func (b *Bitcask) dropBuckets() {
+	for _, d := range b.buckets.Dropped {
+		b.dropPrefix(bucketKeyPrefix(d.Name, d.Generation))
+	}
+}
+
+// dropPrefix removes all keys with the given prefix from the index without
+// writing tombstones and returns them. The caller must hold the write lock.
+func (b *Bitcask) dropPrefix(prefix []byte) [][]byte {
+	var keys [][]byte
+	b.trie.ForEachPrefix(prefix, func(node art.Node) bool {
+		keys = append(keys, node.Key())
+		return true
+	})
+	for _, key := range keys {
+		if old, deleted := b.trie.Delete(key); deleted {
+			b.untrackSizes(key, old.(internal.Item))
+		}
+	}
+	return keys
+}
+
+// pruneBuckets forgets the deleted generations of buckets whose datafiles
+// were all merged away. The caller must hold the write lock.
+func (b *Bitcask) pruneBuckets() error {
+	if len(b.buckets.Dropped) == 0 {
+		return nil
+	}
+
+	// Retired datafiles are only kept for snapshots
+	oldest := b.curr.FileID()
+	for id := range b.datafiles {
+		if id < oldest {
+			oldest = id
+		}
+	}
+
+	manifest := buckets{Generations: b.buckets.Generations}
+	for _, d := range b.buckets.Dropped {
+		if d.Datafile >= oldest {
+			manifest.Dropped = append(manifest.Dropped, d)
+		}
+	}
+	if len(manifest.Dropped) == len(b.buckets.Dropped) {
+		return nil
+	}
+	if err := b.saveBuckets(manifest); err != nil {
+		return err
+	}
+	b.buckets = manifest
+	return nil
+}
@@ -0,0 +1,314 @@
+package bitcask
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// Change is a put or delete of a key as written to the log of a database,
+// see Changes()
+type Change struct {
+	// Type is EventPut or EventDelete
+	Type EventType
+	// Key and Value are the key and its new value, nil for deletes
+	Key   []byte
+	Value []byte
+	// Expiry is when the key expires, zero if never (see PutWithTTL())
+	Expiry time.Time
+	// Seq is the sequence number of the change, the version of the value
+	// (see GetWithMeta()), and Time when it was committed
+	Seq  uint64
+	Time time.Time
+}
+
+// Changes returns an iterator over the changes of the database committed
+// after the given sequence number, in commit order, up to the last change
+// committed when called. A consumer such as an external index or an
+// incremental backup resumes from the sequence number of the last change it
+// processed, tailing the database by calling Changes() again once done.
+// Sequence numbers are never reused, also across merges and reopens. The
+// database must use format version 5 whose entries carry their sequence
+// number.
+//
+// Merges rewrite the log: ErrSeqUnavailable is returned for a sequence
+// number before the last merge, except for zero which iterates over the
+// whole log as merged, i.e. the live keys before the merge in no particular
+// order and all changes after it in order. Changes of the keys of deleted
+// buckets are skipped (see DeleteBucket()). Reads and writes carry on while
+// iterating, the iterator must be closed once done.
+func (b *Bitcask) Changes(sinceSeq uint64) (*ChangeIterator, error) {
+	if !b.format().HasVersion() {
+		return nil, ErrVersionNotSupported
+	}
+
+	b.mu.Lock()
+	b.quiesce()
+	// The counter resumes from the high-water mark persisted by merges, see
+	// lastVersion(), so a consumer never misses changes of reused numbers
+	if sinceSeq > b.version {
+		b.mu.Unlock()
+		return nil, ErrSeqUnavailable
+	}
+	it := &ChangeIterator{
+		b:     b,
+		since: sinceSeq,
+		last:  b.version,
+		end:   Seq{FileID: b.curr.FileID(), Offset: b.curr.Size()},
+	}
+	for id := range b.datafiles {
+		it.ids = append(it.ids, id)
+	}
+	it.ids = append(it.ids, it.end.FileID)
+	sort.Ints(it.ids)
+	for _, d := range b.buckets.Dropped {
+		it.dropped = append(it.dropped, bucketKeyPrefix(d.Name, d.Generation))
+	}
+	merged := b.mergedEnd()
+
+	// Merges keep the datafiles until iterated
+	it.s = &snapshot{b: b}
+	it.s.pin(it.ids...)
+	b.mu.Unlock()
+
+	if sinceSeq > 0 {
+		if err := it.seek(merged); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// ChangeIterator iterates over the changes of a database, see Changes()
+//
+//	it, err := db.Changes(seq)
+//	...
+//	defer it.Close()
+//	for it.Next() {
+//		change := it.Change()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type ChangeIterator struct {
+	b       *Bitcask
+	since   uint64
+	last    uint64
+	end     Seq
+	ids     []int
+	dropped [][]byte
+	s       *snapshot
+
+	// df is the datafile being read and pending the changes read ahead
+	// from its current batch
+	df      data.Datafile
+	offset  int64
+	pending []Change
+
+	change Change
+	err    error
+}
+
+// seek skips the datafiles of the log before the change after `since`, and
+// returns ErrSeqUnavailable if it was merged away. Merges write datafiles
+// before the id `merged`, the sequence numbers of the others increase.
+func (it *ChangeIterator) seek(merged int) error {
+	start, first := -1, uint64(0)
+	for i, id := range it.ids {
+		if id < merged {
+			continue
+		}
+		v, err := it.firstSeq(id)
+		if err != nil {
+			return err
+		}
+		if v == 0 {
+			continue
+		}
+		if first == 0 {
+			first = v
+		}
+		if v > it.since+1 {
+			break
+		}
+		start = i
+	}
+
+	if first == 0 && it.since < it.last || first > it.since+1 {
+		return ErrSeqUnavailable
+	}
+	if start < 0 {
+		it.ids = nil
+		return nil
+	}
+	it.ids = it.ids[start:]
+	return nil
+}
+
+// firstSeq returns the sequence number of the first entry of the datafile,
+// zero if it has none
+func (it *ChangeIterator) firstSeq(id int) (uint64, error) {
+	b := it.b
+	var df data.Datafile
+	err := b.openDatafile(func(dir string) (err error) {
+		df, err = data.NewUnmappedDatafile(b.fsys, dir, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer df.Close()
+
+	for {
+		e, _, err := df.Read()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := data.BatchHeader(e); !ok {
+			return e.Version, nil
+		}
+	}
+}
+
+// Next advances the iterator to the next change returning false once there
+// are no more changes or an error occurred, see Err()
+func (it *ChangeIterator) Next() bool {
+	for len(it.pending) == 0 {
+		if it.err != nil || !it.fill() {
+			it.change = Change{}
+			return false
+		}
+	}
+	it.change, it.pending = it.pending[0], it.pending[1:]
+	return true
+}
+
+// Change returns the current change
+func (it *ChangeIterator) Change() Change {
+	return it.change
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close releases the datafiles of the iterator
+func (it *ChangeIterator) Close() error {
+	if it.df != nil {
+		it.df.Close()
+		it.df = nil
+	}
+	it.ids = nil
+	it.pending = nil
+	it.s.release()
+	return nil
+}
+
+// fill reads the changes of the next entry, or of the next batch as a whole
+// as indexDatafile() does, returning false at the end of the log
+func (it *ChangeIterator) fill() bool {
+	b := it.b
+	for {
+		if it.df == nil {
+			if len(it.ids) == 0 {
+				return false
+			}
+			// Datafiles are read on their own so as not to disturb other
+			// reads
+			var df data.Datafile
+			err := b.openDatafile(func(dir string) (err error) {
+				df, err = data.NewUnmappedDatafile(b.fsys, dir, it.ids[0], b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+				return
+			})
+			if err != nil {
+				it.err = err
+				return false
+			}
+			it.df, it.offset, it.ids = df, 0, it.ids[1:]
+		}
+
+		entries, ok := it.read()
+		if it.err != nil {
+			return false
+		}
+		if !ok {
+			it.df.Close()
+			it.df = nil
+			continue
+		}
+		for _, e := range entries {
+			if e.Version <= it.since || it.droppedKey(e.Key) {
+				continue
+			}
+			c := Change{Type: EventDelete, Key: e.Key, Seq: e.Version, Time: time.Unix(0, e.Timestamp)}
+			if len(e.Value) > 0 {
+				c.Type = EventPut
+				if c.Value, it.err = b.value(e); it.err != nil {
+					return false
+				}
+				if e.Expiry != 0 {
+					c.Expiry = time.Unix(0, e.Expiry)
+				}
+			}
+			it.pending = append(it.pending, c)
+		}
+		return true
+	}
+}
+
+// read reads the next entry or batch of entries of the datafile, returning
+// false at its end within the log
+func (it *ChangeIterator) read() ([]internal.Entry, bool) {
+	if it.df.FileID() == it.end.FileID && it.offset >= it.end.Offset {
+		return nil, false
+	}
+	e, n, err := it.df.Read()
+	if err == io.EOF {
+		return nil, false
+	}
+	if err != nil {
+		it.err = err
+		return nil, false
+	}
+	it.offset += n
+
+	count, ok := data.BatchHeader(e)
+	if !ok {
+		return []internal.Entry{e}, true
+	}
+	entries := make([]internal.Entry, 0, count)
+	for len(entries) < count {
+		e, n, err := it.df.Read()
+		if err == io.EOF {
+			// A partially written batch was never committed
+			return nil, false
+		}
+		if err != nil {
+			it.err = err
+			return nil, false
+		}
+		it.offset += n
+		entries = append(entries, e)
+	}
+	return entries, true
+}
+
+// droppedKey returns true for a key of a deleted bucket
+func (it *ChangeIterator) droppedKey(key []byte) bool {
+	for _, prefix := range it.dropped {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+)
+
+// CheckReport is the outcome of Check()
+type CheckReport struct {
+	// Datafiles is the number of datafiles checked
+	Datafiles int `json:"datafiles"`
+	// Entries is the number of entries read from the datafiles
+	Entries int `json:"entries"`
+	// Keys is the number of keys of the index checked
+	Keys int `json:"keys"`
+	// Errors are the problems found, none if the database is healthy
+	Errors []CheckError `json:"errors,omitempty"`
+	// Repaired is true if the problems found were repaired
+	Repaired bool `json:"repaired,omitempty"`
+	// TruncatedBytes is the number of bytes removed from the datafiles by
+	// the repair
+	TruncatedBytes int64 `json:"truncated_bytes,omitempty"`
+}
+
+// OK returns true if no problem was found
+func (r CheckReport) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// CheckError is a problem found by Check() in a datafile or with the value
+// of a key
+type CheckError struct {
+	// Datafile is the datafile of the problem
+	Datafile string `json:"datafile,omitempty"`
+	// Offset is the offset in the datafile of the entry with the problem
+	Offset int64 `json:"offset"`
+	// Key is the key whose value could not be read, if any
+	Key []byte `json:"key,omitempty"`
+	// Err describes the problem
+	Err string `json:"error"`
+}
+
+func (e CheckError) Error() string {
+	if e.Key != nil {
+		return fmt.Sprintf("%s@%d: key %q: %s", e.Datafile, e.Offset, e.Key, e.Err)
+	}
+	return fmt.Sprintf("%s@%d: %s", e.Datafile, e.Offset, e.Err)
+}
+
+// ErrSnapshotsOpen is the error returned by Check() asked to repair the
+// database while snapshots of it are open
+var ErrSnapshotsOpen = errors.New("error: cannot repair with open snapshots")
+
+// Check checks the integrity of the database: every entry of every
+// datafile must be readable with a valid checksum, and the value of every
+// key in the index must be readable. Problems found are returned in the
+// report, an error is only returned if the check itself failed. Like
+// Backup() the database is checked as it was when the check started while
+// reads, writes and merges carry on.
+//
+// With `repair` any datafile with a problem is truncated at its last valid
+// entry and the index is rebuilt from the datafiles, so the entries after a
+// torn write or a corrupted entry are lost. The repair blocks reads and
+// writes and fails with ErrSnapshotsOpen if any Snapshot() or iterator is
+// open.
+func (b *Bitcask) Check(repair bool) (CheckReport, error) {
+	if repair && b.config.ReadOnly {
+		return CheckReport{}, ErrReadOnly
+	}
+
+	report, cuts, err := b.check()
+	if err != nil || !repair || report.OK() {
+		return report, err
+	}
+
+	recovery, err := b.repair(cuts)
+	if err != nil {
+		return report, err
+	}
+	b.recovered(recovery)
+	report.Repaired = true
+	report.TruncatedBytes = recovery.TruncatedBytes
+	return report, nil
+}
+
+// check checks the database as Check() does returning along with the report
+// the offset of the first invalid entry of every datafile with a problem
+func (b *Bitcask) check() (CheckReport, map[string]int64, error) {
+	b.mu.Lock()
+	b.quiesce()
+
+	files := []backupFile{{name: b.curr.Name(), size: b.curr.Size()}}
+	ids := []int{b.curr.FileID()}
+	names := map[int]string{b.curr.FileID(): b.curr.Name()}
+	for id, df := range b.datafiles {
+		if id != b.curr.FileID() {
+			files = append(files, backupFile{name: df.Name(), size: df.Size()})
+			ids = append(ids, id)
+			names[id] = df.Name()
+		}
+	}
+	s := &snapshot{b: b}
+	b.trie.ForEach(s.adder())
+	s.pin(ids...)
+	defer s.release()
+	b.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	var report CheckReport
+	cuts := make(map[string]int64)
+	for _, file := range files {
+		if err := b.checkDatafile(file, &report, cuts); err != nil {
+			return report, nil, err
+		}
+	}
+
+	for i, key := range s.keys {
+		report.Keys++
+		b.reads.background()
+		e, err := s.entry(i, true)
+		if err == nil && !bytes.Equal(e.Key, key) {
+			err = fmt.Errorf("entry is of key %q", e.Key)
+		}
+		if err == nil {
+			_, err = b.value(e)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, CheckError{
+				Datafile: filepath.Base(names[s.items[i].FileID]),
+				Offset:   s.items[i].Offset,
+				Key:      key,
+				Err:      err.Error(),
+			})
+		}
+	}
+
+	return report, cuts, nil
+}
+
+// repair truncates the datafiles at the given offsets and rebuilds the index
+// from the datafiles
+func (b *Bitcask) repair(cuts map[string]int64) (*internal.RecoveryReport, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	b.pinMu.Lock()
+	pinned := len(b.pins) > 0
+	b.pinMu.Unlock()
+	if pinned {
+		return nil, ErrSnapshotsOpen
+	}
+
+	for _, df := range b.datafiles {
+		if err := df.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.curr.Close(); err != nil {
+		return nil, err
+	}
+
+	report := &internal.RecoveryReport{Time: time.Now()}
+	for name, offset := range cuts {
+		stat, err := b.fsys.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := truncate(b.fsys, name, offset); err != nil {
+			return nil, err
+		}
+		report.Datafile = filepath.Base(name)
+		report.TruncatedBytes += stat.Size() - offset
+	}
+
+	if err := b.fsys.Remove(filepath.Join(b.path, "index")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return b.load(report)
+}
+
+// truncate truncates the file to the given size
+func truncate(fsys fs.FileSystem, name string, size int64) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkDatafile reads every entry of the datafile up to its size recording
+// any problem in the report and the offset of the first invalid entry in
+// cuts
+func (b *Bitcask) checkDatafile(file backupFile, report *CheckReport, cuts map[string]int64) error {
+	f, err := fs.Open(b.fsys, file.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report.Datafiles++
+
+	dec := codec.NewDecoder(io.LimitReader(f, file.size), b.format(), b.config.MaxKeySize, b.config.MaxValueSize)
+	var offset int64
+	for {
+		var e internal.Entry
+		n, err := dec.Decode(&e)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if codec.IsCorruptedData(err) || err == io.ErrUnexpectedEOF {
+				// The following entries can't be found
+				if _, ok := cuts[file.name]; !ok {
+					cuts[file.name] = offset
+				}
+				report.Errors = append(report.Errors, CheckError{
+					Datafile: filepath.Base(file.name),
+					Offset:   offset,
+					Err:      err.Error(),
+				})
+				return nil
+			}
+			return err
+		}
+
+		report.Entries++
+		if _, ok := data.BatchHeader(e); !ok && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+			if _, ok := cuts[file.name]; !ok {
+				cuts[file.name] = offset
+			}
+			report.Errors = append(report.Errors, CheckError{
+				Datafile: filepath.Base(file.name),
+				Offset:   offset,
+				Key:      e.Key,
+				Err:      ErrChecksumFailed.Error(),
+			})
+		}
+		offset += n
+	}
+}
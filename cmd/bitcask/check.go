@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var checkCmd = &cobra.Command{
+	Use:     "check",
+	Aliases: []string{"fsck", "verify"},
+	Short:   "Check the integrity of the Database",
+	Long: `This checks that every entry of every datafile can be read with a
+valid checksum and that the value of every key in the index can be read. The
+report is displayed as JSON and the exit status is 3 if any problem is found.
+
+The database is opened read-only so it can be checked while it is in use.
+
+With --repair the database is instead opened for writing and any datafile
+with a problem is truncated at its last valid entry, losing the entries
+after it, and the index is rebuilt. The exit status is then 0 if the
+problems found were repaired.`,
+	Args: cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("repair", cmd.Flags().Lookup("repair"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+		repair := viper.GetBool("repair")
+
+		os.Exit(check(path, repair))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().BoolP(
+		"repair", "", false,
+		"Truncate corrupted datafiles and rebuild the index",
+	)
+}
+
+func check(path string, repair bool) int {
+	open := bitcask.OpenReadOnly
+	if repair {
+		open = bitcask.Open
+	}
+	db, err := open(path)
+	if err != nil {
+		log.WithError(err).Error("error opening database")
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.Check(repair)
+	if err != nil {
+		log.WithError(err).Error("error checking database")
+		return 2
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("error marshalling report")
+		return 2
+	}
+
+	fmt.Println(string(data))
+
+	if !report.OK() && !report.Repaired {
+		return 3
+	}
+	return 0
+}
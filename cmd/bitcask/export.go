@@ -1,11 +1,12 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"errors"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -14,8 +15,6 @@ import (
 	"github.com/prologic/bitcask"
 )
 
-var errNotAllDataWritten = errors.New("error: not all data written")
-
 var exportCmd = &cobra.Command{
 	Use:     "export",
 	Aliases: []string{"backup", "dump"},
@@ -25,13 +24,29 @@ key/values into a long-term portable archival format suitable for backup and
 restore purposes or migrating from older on-disk formats of Bitcask.
 
 All key/value pairs are base64 encoded and serialized as JSON one pair per
-line to form an output stream to either standard output or a file. You can
-optionally compress the output with standard compression tools such as gzip.`,
+line, along with their expiry and origin if any, to form an output stream to
+either standard output or a file. You can optionally compress the output with
+standard compression tools such as gzip.
+
+With --format=csv the key/value pairs are instead written as CSV records with
+a key,value,origin,expiry header, keys and values being base64 encoded.
+
+With --format=sql the key/value pairs are instead written as SQL statements
+creating and filling a kv(key BLOB PRIMARY KEY, value BLOB, ts, ttl) table,
+ts being the Unix time in seconds the value was written at and ttl the number
+of seconds left until the key expires, both NULL if not recorded. The table
+can be loaded into a queryable SQLite database with:
+
+  $ bitcask export --format=sql dump.sql && sqlite3 out.db < dump.sql`,
 	Args: cobra.RangeArgs(0, 1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("format", cmd.Flags().Lookup("format"))
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		var output string
 
 		path := viper.GetString("path")
+		format := viper.GetString("format")
 
 		if len(args) == 1 {
 			output = args[0]
@@ -39,13 +54,18 @@ optionally compress the output with standard compression tools such as gzip.`,
 			output = "-"
 		}
 
-		os.Exit(export(path, output))
+		os.Exit(export(path, output, format))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(exportCmd)
 
+	exportCmd.Flags().StringP(
+		"format", "f", "json",
+		"Output format, one of json, csv or sql",
+	)
+
 	exportCmd.PersistentFlags().IntP(
 		"with-max-datafile-size", "", bitcask.DefaultMaxDatafileSize,
 		"Maximum size of each datafile",
@@ -60,13 +80,13 @@ func init() {
 	)
 }
 
-type kvPair struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
+func export(path, output, format string) int {
+	if format != "json" && format != "csv" && format != "sql" {
+		log.WithField("format", format).Error("unsupported export format")
+		return 1
+	}
 
-func export(path, output string) int {
-	db, err := bitcask.Open(path)
+	db, err := bitcask.OpenReadOnly(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
@@ -84,19 +104,57 @@ func export(path, output string) int {
 		defer w.Close()
 	}
 
-	if err = db.Fold(exportKey(db, w)); err != nil {
+	if format != "sql" {
+		f := bitcask.FormatJSON
+		if format == "csv" {
+			f = bitcask.FormatCSV
+		}
+		if err := db.Export(w, f); err != nil {
+			log.WithError(err).
+				WithField("path", path).
+				WithField("output", output).
+				Error("error exporting keys")
+			return 2
+		}
+		return 0
+	}
+
+	_, err = io.WriteString(w, "BEGIN TRANSACTION;\n"+
+		"CREATE TABLE kv (key BLOB PRIMARY KEY, value BLOB, ts INTEGER, ttl INTEGER);\n")
+	if err != nil {
+		log.WithError(err).Error("error writing table")
+		return 2
+	}
+
+	snap := db.Snapshot()
+	defer snap.Close()
+
+	if err = snap.Fold(exportSQLKey(db, w)); err != nil {
 		log.WithError(err).
 			WithField("path", path).
 			WithField("output", output).
 			Error("error exporting keys")
 		return 2
 	}
+
+	if _, err := io.WriteString(w, "COMMIT;\n"); err != nil {
+		log.WithError(err).Error("error writing commit")
+		return 2
+	}
 	return 0
 }
 
-func exportKey(db *bitcask.Bitcask, w io.Writer) func(key []byte) error {
+// exportSQLKey writes each key/value pair as an SQL insert statement with
+// the key and value as hex blob literals along with the write time and the
+// remaining ttl of the key, NULL if the format version does not record the
+// write time or the key does not expire. Keys that expired or were skipped
+// as corrupted since the snapshot was taken are not exported.
+func exportSQLKey(db *bitcask.Bitcask, w io.Writer) func(key []byte) error {
 	return func(key []byte) error {
-		value, err := db.Get(key)
+		value, meta, err := db.GetWithMeta(key)
+		if err == bitcask.ErrKeyNotFound {
+			return nil
+		}
 		if err != nil {
 			log.WithError(err).
 				WithField("key", key).
@@ -104,35 +162,25 @@ func exportKey(db *bitcask.Bitcask, w io.Writer) func(key []byte) error {
 			return err
 		}
 
-		kv := kvPair{
-			Key:   base64.StdEncoding.EncodeToString([]byte(key)),
-			Value: base64.StdEncoding.EncodeToString(value),
+		ts, ttl := "NULL", "NULL"
+		if !meta.Timestamp.IsZero() {
+			ts = strconv.FormatInt(meta.Timestamp.Unix(), 10)
 		}
-
-		data, err := json.Marshal(&kv)
-		if err != nil {
-			log.WithError(err).
-				WithField("key", key).
-				Error("error serialzing key")
-			return err
+		if !meta.Expiry.IsZero() {
+			// Rounded up so keys about to expire are not exported as expired
+			left := (time.Until(meta.Expiry) + time.Second - 1) / time.Second
+			ttl = strconv.FormatInt(int64(left), 10)
 		}
 
-		if n, err := w.Write(data); err != nil || n != len(data) {
-			if err == nil && n != len(data) {
-				err = errNotAllDataWritten
-			}
+		_, err = fmt.Fprintf(w, "INSERT INTO kv (key, value, ts, ttl) VALUES (X'%s', X'%s', %s, %s);\n",
+			hex.EncodeToString(key), hex.EncodeToString(value), ts, ttl)
+		if err != nil {
 			log.WithError(err).
 				WithField("key", key).
-				WithField("n", n).
 				Error("error writing key")
 			return err
 		}
 
-		if _, err := w.Write([]byte("\n")); err != nil {
-			log.WithError(err).Error("error writing newline")
-			return err
-		}
-
 		return nil
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var forecastCmd = &cobra.Command{
+	Use:     "forecast",
+	Aliases: []string{},
+	Short:   "Forecast the disk usage of the Database",
+	Long: `This forecasts the disk usage of the Database over the given horizon
+from the rate its datafiles were written at since the last merge, its share of
+dead bytes and its automatic merges, and displays it along with when the disk
+would be full. It is a rough estimate for capacity planning.
+
+The database is opened read-only so it can be forecast while it is in use.`,
+	Args: cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("horizon", cmd.Flags().Lookup("horizon"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+		horizon := viper.GetDuration("horizon")
+
+		os.Exit(forecast(path, horizon))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(forecastCmd)
+
+	forecastCmd.Flags().DurationP(
+		"horizon", "", 30*24*time.Hour,
+		"How far ahead to forecast",
+	)
+}
+
+func forecast(path string, horizon time.Duration) int {
+	db, err := bitcask.OpenReadOnly(path)
+	if err != nil {
+		log.WithError(err).Error("error opening database")
+		return 1
+	}
+	defer db.Close()
+
+	f, err := db.Forecast(horizon)
+	if err != nil {
+		log.WithError(err).Error("error forecasting disk usage")
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Write rate:\t%.0f bytes/s\n", f.WriteRate)
+	fmt.Fprintf(w, "Live growth:\t%.0f bytes/s\n", f.LiveGrowthRate)
+	fmt.Fprintf(w, "Dead growth:\t%.0f bytes/s\n", f.DeadGrowthRate)
+	fmt.Fprintf(w, "Merges:\t%d\n", f.Merges)
+	fmt.Fprintf(w, "Peak size:\t%d bytes\n", f.PeakSize)
+	if !f.DiskFull.IsZero() {
+		fmt.Fprintf(w, "Disk full:\t%s\n", f.DiskFull.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "TIME\tSIZE\tLIVE\tDEAD")
+	for _, p := range f.Points {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", p.Time.Format(time.RFC3339), p.Size, p.LiveBytes, p.DeadBytes)
+	}
+	if err := w.Flush(); err != nil {
+		log.WithError(err).Error("error writing forecast")
+		return 1
+	}
+
+	return 0
+}
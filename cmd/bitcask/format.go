@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/format"
+)
+
+var formatCmd = &cobra.Command{
+	Use:     "format [<version>]",
+	Aliases: []string{},
+	Short:   "Display the on-disk format of entries",
+	Long: `This displays the offset, size, encoding and description of the fields
+of the entries of datafiles encoded by the given format version, or by the
+default format version if none is given.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		version := bitcask.DefaultFormatVersion
+		if len(args) == 1 {
+			var err error
+			if version, err = strconv.Atoi(args[0]); err != nil {
+				log.WithError(err).Error("error parsing format version")
+				os.Exit(1)
+			}
+		}
+
+		os.Exit(describe(version))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(formatCmd)
+}
+
+func describe(version int) int {
+	fields, err := format.Describe(version)
+	if err != nil {
+		log.WithError(err).Error("error describing format")
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tSIZE\tFIELD\tENCODING\tDESCRIPTION")
+	for _, field := range fields {
+		offset, size := "-", "-"
+		if field.Offset >= 0 {
+			offset = strconv.Itoa(field.Offset)
+		}
+		if field.Size >= 0 {
+			size = strconv.Itoa(field.Size)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", offset, size, field.Name, field.Encoding, field.Description)
+	}
+	if err := w.Flush(); err != nil {
+		log.WithError(err).Error("error writing format")
+		return 1
+	}
+
+	return 0
+}
@@ -31,7 +31,7 @@ func init() {
 }
 
 func get(path, key string) int {
-	db, err := bitcask.Open(path)
+	db, err := bitcask.OpenReadOnly(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
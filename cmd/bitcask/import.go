@@ -1,9 +1,6 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
-	"encoding/json"
 	"io"
 	"os"
 
@@ -20,12 +17,21 @@ var importCmd = &cobra.Command{
 	Short:   "Import a database",
 	Long: `This command allows you to import or restore a database from a
 previous export/dump using the export command either creating a new database
-or adding additional key/value pairs to an existing one.`,
+or adding additional key/value pairs to an existing one.
+
+With --replace the keys of an existing database that are not imported are
+deleted once the import is done.`,
 	Args: cobra.RangeArgs(0, 1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("format", cmd.Flags().Lookup("format"))
+		viper.BindPFlag("replace", cmd.Flags().Lookup("replace"))
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		var input string
 
 		path := viper.GetString("path")
+		format := viper.GetString("format")
+		replace := viper.GetBool("replace")
 
 		if len(args) == 1 {
 			input = args[0]
@@ -33,20 +39,44 @@ or adding additional key/value pairs to an existing one.`,
 			input = "-"
 		}
 
-		os.Exit(_import(path, input))
+		os.Exit(_import(path, input, format, replace))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringP(
+		"format", "f", "json",
+		"Input format, one of json or csv",
+	)
+	importCmd.Flags().BoolP(
+		"replace", "", false,
+		"Delete the keys of the database that are not imported",
+	)
 }
 
-func _import(path, input string) int {
+func _import(path, input, format string, replace bool) int {
 	var (
 		err error
 		r   io.ReadCloser
 	)
 
+	f := bitcask.FormatJSON
+	switch format {
+	case "json":
+	case "csv":
+		f = bitcask.FormatCSV
+	default:
+		log.WithField("format", format).Error("unsupported import format")
+		return 1
+	}
+
+	mode := bitcask.ImportMerge
+	if replace {
+		mode = bitcask.ImportReplace
+	}
+
 	db, err := bitcask.Open(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
@@ -66,40 +96,11 @@ func _import(path, input string) int {
 		}
 	}
 
-	var kv kvPair
-
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		if err := json.Unmarshal(scanner.Bytes(), &kv); err != nil {
-			log.WithError(err).
-				WithField("input", input).
-				Error("error reading input")
-			return 2
-		}
-
-		key, err := base64.StdEncoding.DecodeString(kv.Key)
-		if err != nil {
-			log.WithError(err).Error("error decoding key")
-			return 2
-		}
-
-		value, err := base64.StdEncoding.DecodeString(kv.Value)
-		if err != nil {
-			log.WithError(err).Error("error decoding value")
-			return 2
-		}
-
-		if err := db.Put(key, value); err != nil {
-			log.WithError(err).Error("error writing key/value")
-			return 2
-		}
-	}
-	if err := scanner.Err(); err != nil {
+	if err := db.ImportWithMode(r, f, mode); err != nil {
 		log.WithError(err).
 			WithField("input", input).
-			Error("error reading input")
+			Error("error importing keys")
 		return 2
-
 	}
 
 	return 0
@@ -29,7 +29,7 @@ func init() {
 }
 
 func keys(path string) int {
-	db, err := bitcask.Open(path)
+	db, err := bitcask.OpenReadOnly(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
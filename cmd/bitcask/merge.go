@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	log "github.com/sirupsen/logrus"
@@ -16,27 +17,62 @@ var mergeCmd = &cobra.Command{
 	Short:   "Merges the Datafiles in the Database",
 	Long: `This merges all non-active Datafiles in the Database and
 compacts the data stored on disk. Old values are removed as well as deleted
-keys.`,
+keys.
+
+With --rate-limit the merge reads and writes at most the given number of
+bytes per second, with --min-dead-ratio it only merges the datafiles up to
+the last one with at least that share of dead bytes, and with --progress it
+displays its progress as it merges every datafile.`,
 	Args: cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("rate-limit", cmd.Flags().Lookup("rate-limit"))
+		viper.BindPFlag("min-dead-ratio", cmd.Flags().Lookup("min-dead-ratio"))
+		viper.BindPFlag("progress", cmd.Flags().Lookup("progress"))
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		path := viper.GetString("path")
+		opts := bitcask.MergeOptions{
+			RateLimit:    viper.GetInt64("rate-limit"),
+			MinDeadRatio: viper.GetFloat64("min-dead-ratio"),
+		}
+		if viper.GetBool("progress") {
+			opts.Progress = func(p bitcask.MergeProgress) {
+				fmt.Printf(
+					"%d/%d datafiles, %d bytes copied, %d bytes reclaimed\n",
+					p.Datafiles, p.TotalDatafiles, p.BytesCopied, p.BytesReclaimed,
+				)
+			}
+		}
 
-		os.Exit(merge(path))
+		os.Exit(merge(path, opts))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(mergeCmd)
+
+	mergeCmd.Flags().Int64P(
+		"rate-limit", "", 0,
+		"Bytes read and written per second (0 for no limit)",
+	)
+	mergeCmd.Flags().Float64P(
+		"min-dead-ratio", "", 0,
+		"Share of dead bytes of the datafiles to merge (0 for all)",
+	)
+	mergeCmd.Flags().BoolP(
+		"progress", "", false,
+		"Display the progress of the merge",
+	)
 }
 
-func merge(path string) int {
+func merge(path string, opts bitcask.MergeOptions) int {
 	db, err := bitcask.Open(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
 	}
 
-	if err = db.Merge(); err != nil {
+	if err = db.MergeWithOptions(opts); err != nil {
 		log.WithError(err).Error("error merging database")
 		return 1
 	}
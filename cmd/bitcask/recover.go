@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/fs"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data/codec"
@@ -42,9 +43,11 @@ func init() {
 func recover(path string, dryRun bool) int {
 	maxKeySize := bitcask.DefaultMaxKeySize
 	maxValueSize := bitcask.DefaultMaxValueSize
-	if cfg, err := config.Load(filepath.Join(path, "config.json")); err == nil {
+	format := codec.Format(bitcask.DefaultFormatVersion)
+	if cfg, err := config.Load(fs.OS, filepath.Join(path, "config.json")); err == nil {
 		maxKeySize = cfg.MaxKeySize
 		maxValueSize = cfg.MaxValueSize
+		format = codec.Format(cfg.FormatVersion)
 	}
 
 	if err := recoverIndex(filepath.Join(path, "index"), maxKeySize, dryRun); err != nil {
@@ -52,13 +55,13 @@ func recover(path string, dryRun bool) int {
 		return 1
 	}
 
-	datafiles, err := internal.GetDatafiles(path)
+	datafiles, err := internal.GetDatafiles(fs.OS, path)
 	if err != nil {
 		log.WithError(err).Info("coudn't list existing datafiles")
 		return 1
 	}
 	for _, file := range datafiles {
-		if err := recoverDatafile(file, maxKeySize, maxValueSize, dryRun); err != nil {
+		if err := recoverDatafile(file, maxKeySize, maxValueSize, format, dryRun); err != nil {
 			log.WithError(err).Info("recovering data file")
 			return 1
 		}
@@ -68,7 +71,7 @@ func recover(path string, dryRun bool) int {
 }
 
 func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
-	t, found, err := index.NewIndexer().Load(path, maxKeySize)
+	t, _, found, err := index.NewIndexer(fs.OS).Load(path, maxKeySize)
 	if err != nil && !index.IsIndexCorruption(err) {
 		log.WithError(err).Info("opening the index file")
 	}
@@ -88,8 +91,9 @@ func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
 		return nil
 	}
 
-	// Leverage that t has the partiatially read tree even on corrupted files
-	err = index.NewIndexer().Save(t, "index.recovered")
+	// Leverage that t has the partiatially read tree even on corrupted files.
+	// It is saved without a position so the index is still rebuilt on open.
+	err = index.NewIndexer(fs.OS).Save(t, index.Position{}, "index.recovered")
 	if err != nil {
 		return fmt.Errorf("writing the recovered index file: %w", err)
 	}
@@ -98,7 +102,7 @@ func recoverIndex(path string, maxKeySize uint32, dryRun bool) error {
 	return nil
 }
 
-func recoverDatafile(path string, maxKeySize uint32, maxValueSize uint64, dryRun bool) error {
+func recoverDatafile(path string, maxKeySize uint32, maxValueSize uint64, format codec.Format, dryRun bool) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("opening the datafile: %w", err)
@@ -111,8 +115,8 @@ func recoverDatafile(path string, maxKeySize uint32, maxValueSize uint64, dryRun
 	}
 	defer fr.Close()
 
-	dec := codec.NewDecoder(f, maxKeySize, maxValueSize)
-	enc := codec.NewEncoder(fr)
+	dec := codec.NewDecoder(f, format, maxKeySize, maxValueSize)
+	enc := codec.NewEncoder(fr, format)
 	e := internal.Entry{}
 	for {
 		_, err = dec.Decode(&e)
@@ -33,7 +33,7 @@ func init() {
 }
 
 func scan(path, prefix string) int {
-	db, err := bitcask.Open(path)
+	db, err := bitcask.OpenReadOnly(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
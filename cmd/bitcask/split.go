@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var splitCmd = &cobra.Command{
+	Use:     "split <dir>",
+	Aliases: []string{"extract"},
+	Short:   "Extracts the keys under prefixes into new databases",
+	Long: `This copies all key/value pairs whose key starts with one of the
+prefixes given with --prefix into a new database per prefix, e.g. to offboard
+or migrate a tenant. The database in dir is left unchanged and may be written
+to by another process while it is split.
+
+The path of every new database is given by --out-template where {prefix} is
+replaced by the prefix, with characters other than letters, digits, '.', '-'
+and '_' replaced by '_', e.g.:
+
+  $ bitcask split db --prefix=tenants/acme/ --out-template=out/{prefix}
+
+Values are copied one at a time, so only the matching keys are held in memory.`,
+	Args: cobra.ExactArgs(1),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("prefix", cmd.Flags().Lookup("prefix"))
+		viper.BindPFlag("out-template", cmd.Flags().Lookup("out-template"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		prefixes := viper.GetStringSlice("prefix")
+		template := viper.GetString("out-template")
+
+		os.Exit(split(args[0], prefixes, template))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(splitCmd)
+
+	splitCmd.Flags().StringSliceP(
+		"prefix", "p", nil,
+		"Prefix of the keys to extract (may be repeated)",
+	)
+	splitCmd.Flags().StringP(
+		"out-template", "o", "",
+		"Path of the new databases, {prefix} is replaced by the prefix",
+	)
+}
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// splitPath returns the path of the new database for the given prefix
+func splitPath(template, prefix string) string {
+	name := unsafePathChars.ReplaceAllString(strings.Trim(prefix, "/"), "_")
+	return strings.Replace(template, "{prefix}", name, -1)
+}
+
+func split(path string, prefixes []string, template string) int {
+	if len(prefixes) == 0 {
+		log.Error("no prefixes given with --prefix")
+		return 2
+	}
+	if template == "" {
+		log.Error("no output path given with --out-template")
+		return 2
+	}
+
+	outs := make(map[string]string, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			log.Error("empty prefix")
+			return 2
+		}
+		out := splitPath(template, prefix)
+		if other, ok := outs[out]; ok {
+			log.WithField("out", out).Errorf("prefixes %q and %q have the same output path", other, prefix)
+			return 2
+		}
+		outs[out] = prefix
+	}
+
+	db, err := bitcask.OpenReadOnly(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Error("error opening database")
+		return 1
+	}
+	defer db.Close()
+
+	options, err := outputOptions(path)
+	if err != nil {
+		log.WithError(err).Error("error reading database configuration")
+		return 1
+	}
+
+	for _, prefix := range prefixes {
+		out := splitPath(template, prefix)
+		n, err := splitPrefix(db, prefix, out, options)
+		if err != nil {
+			log.WithError(err).WithField("prefix", prefix).WithField("out", out).Error("error extracting keys")
+			return 1
+		}
+		log.WithField("prefix", prefix).WithField("out", out).WithField("keys", n).Info("extracted keys")
+	}
+
+	return 0
+}
+
+// splitPrefix copies the keys under the prefix with their metadata into the
+// database at out, returning the number of keys copied
+func splitPrefix(db *bitcask.Bitcask, prefix, out string, options []bitcask.Option) (int, error) {
+	dst, err := bitcask.Open(out, options...)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+
+	var n int
+	err = db.Scan([]byte(prefix), func(key []byte) error {
+		value, meta, err := db.GetWithMeta(key)
+		if err == bitcask.ErrKeyNotFound {
+			// Expired since scanned
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.PutWithMeta(key, value, meta); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, dst.Sync()
+}
@@ -16,8 +16,9 @@ var statsCmd = &cobra.Command{
 	Use:     "stats",
 	Aliases: []string{},
 	Short:   "Display statis about the Database",
-	Long:    `This displays statistics about the Database"`,
-	Args:    cobra.ExactArgs(0),
+	Long: `This displays statistics about the Database including the
+distribution of the sizes of all live keys and values.`,
+	Args: cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		path := viper.GetString("path")
 
@@ -30,7 +31,7 @@ func init() {
 }
 
 func stats(path string) int {
-	db, err := bitcask.Open(path)
+	db, err := bitcask.OpenReadOnly(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal/config"
+)
+
+var unionCmd = &cobra.Command{
+	Use:     "union <dirA> <dirB>",
+	Aliases: []string{"combine"},
+	Short:   "Combines two databases into a new one",
+	Long: `This writes all key/value pairs of the databases in dirA and dirB
+into the database given by --out, e.g. to consolidate the databases of several
+shards or nodes into one.
+
+Keys found in both databases are resolved as per --prefer keeping the value
+of dirA (a) or of dirB (b). Records carry no write time so there is no newest
+value to prefer, see the Union() function of the bitcask package to resolve
+conflicts in code. The output database uses the largest format version and
+key and value size limits of dirA and dirB.`,
+	Args: cobra.ExactArgs(2),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("out", cmd.Flags().Lookup("out"))
+		viper.BindPFlag("prefer", cmd.Flags().Lookup("prefer"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		out := viper.GetString("out")
+		prefer := viper.GetString("prefer")
+
+		os.Exit(union(args[0], args[1], out, prefer))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(unionCmd)
+
+	unionCmd.Flags().StringP(
+		"out", "o", "",
+		"Path to the combined database",
+	)
+	unionCmd.Flags().String(
+		"prefer", "b",
+		"Database whose value is kept for keys in both (a or b)",
+	)
+}
+
+func union(pathA, pathB, out, prefer string) int {
+	if out == "" {
+		log.Error("no output database given with --out")
+		return 2
+	}
+
+	var resolve bitcask.ConflictFunc
+	switch prefer {
+	case "a":
+		resolve = bitcask.PreferA
+	case "b":
+		resolve = bitcask.PreferB
+	default:
+		log.WithField("prefer", prefer).Error("invalid conflict policy, expected a or b")
+		return 2
+	}
+
+	a, err := bitcask.Open(pathA)
+	if err != nil {
+		log.WithError(err).WithField("path", pathA).Error("error opening database")
+		return 1
+	}
+	defer a.Close()
+
+	b, err := bitcask.Open(pathB)
+	if err != nil {
+		log.WithError(err).WithField("path", pathB).Error("error opening database")
+		return 1
+	}
+	defer b.Close()
+
+	options, err := outputOptions(pathA, pathB)
+	if err != nil {
+		log.WithError(err).Error("error reading database configurations")
+		return 1
+	}
+
+	dst, err := bitcask.Open(out, options...)
+	if err != nil {
+		log.WithError(err).WithField("path", out).Error("error opening database")
+		return 1
+	}
+	defer dst.Close()
+
+	if err := bitcask.Union(dst, a, b, resolve); err != nil {
+		log.WithError(err).Error("error combining databases")
+		return 1
+	}
+
+	return 0
+}
+
+// outputOptions returns the options for a database able to store the keys
+// of the databases in the given paths
+func outputOptions(paths ...string) ([]bitcask.Option, error) {
+	var max config.Config
+	for _, path := range paths {
+		cfg, err := config.Load(fs.OS, filepath.Join(path, "config.json"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if cfg.FormatVersion > max.FormatVersion {
+			max.FormatVersion = cfg.FormatVersion
+		}
+		if cfg.MaxKeySize > max.MaxKeySize {
+			max.MaxKeySize = cfg.MaxKeySize
+		}
+		if cfg.MaxValueSize > max.MaxValueSize {
+			max.MaxValueSize = cfg.MaxValueSize
+		}
+	}
+
+	return []bitcask.Option{
+		bitcask.WithFormatVersion(max.FormatVersion),
+		bitcask.WithMaxKeySize(max.MaxKeySize),
+		bitcask.WithMaxValueSize(max.MaxValueSize),
+	}, nil
+}
@@ -2,18 +2,36 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
 
 	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/statsd"
 )
 
 var (
-	bind    string
-	debug   bool
-	version bool
+	bind      string
+	debug     bool
+	debugBind string
+	version   bool
+
+	replicationBind string
+
+	statsdAddr     string
+	statsdInterval time.Duration
+	statsdPrefix   string
+	statsdTags     string
+
+	webhookURL      string
+	webhookPrefixes string
+	webhookRetries  int
+	webhookBackoff  time.Duration
 )
 
 func init() {
@@ -26,6 +44,18 @@ func init() {
 	flag.BoolVarP(&debug, "debug", "d", false, "enable debug logging")
 
 	flag.StringVarP(&bind, "bind", "b", ":6379", "interface and port to bind to")
+	flag.StringVarP(&debugBind, "debug-bind", "", "", "interface and port to serve pprof and debug pages on")
+	flag.StringVarP(&replicationBind, "replication-bind", "", "", "interface and port to serve replication to followers on")
+
+	flag.StringVarP(&statsdAddr, "statsd-addr", "", "", "push stats to the StatsD server at this address")
+	flag.DurationVarP(&statsdInterval, "statsd-interval", "", statsd.DefaultInterval, "interval between StatsD pushes")
+	flag.StringVarP(&statsdPrefix, "statsd-prefix", "", statsd.DefaultPrefix, "prefix of StatsD metric names")
+	flag.StringVarP(&statsdTags, "statsd-tags", "", "", "comma separated DogStatsD tags (key:value)")
+
+	flag.StringVarP(&webhookURL, "webhook-url", "", "", "POST change events to this URL")
+	flag.StringVarP(&webhookPrefixes, "webhook-prefixes", "", "", "comma separated key prefixes to send change events for (default all keys)")
+	flag.IntVarP(&webhookRetries, "webhook-retries", "", 5, "number of times a failed change event delivery is retried")
+	flag.DurationVarP(&webhookBackoff, "webhook-backoff", "", time.Second, "initial delay between change event delivery retries")
 }
 
 func main() {
@@ -55,6 +85,54 @@ func main() {
 		os.Exit(2)
 	}
 
+	if debugBind != "" {
+		go func() {
+			if err := http.ListenAndServe(debugBind, server.db.DebugHandlers()); err != nil {
+				log.WithError(err).Error("error serving debug handlers")
+			}
+		}()
+	}
+
+	if replicationBind != "" {
+		l, err := net.Listen("tcp", replicationBind)
+		if err != nil {
+			log.WithError(err).Error("error listening for followers")
+			os.Exit(2)
+		}
+		go func() {
+			if err := server.db.ServeReplication(l); err != nil {
+				log.WithError(err).Error("error serving replication")
+			}
+		}()
+	}
+
+	if statsdAddr != "" {
+		options := []statsd.Option{
+			statsd.WithInterval(statsdInterval),
+			statsd.WithPrefix(statsdPrefix),
+		}
+		if statsdTags != "" {
+			options = append(options, statsd.WithTags(strings.Split(statsdTags, ",")...))
+		}
+
+		reporter, err := statsd.NewReporter(server.db, statsdAddr, options...)
+		if err != nil {
+			log.WithError(err).Error("error creating statsd reporter")
+			os.Exit(2)
+		}
+		reporter.Start()
+		defer reporter.Stop()
+	}
+
+	if webhookURL != "" {
+		var prefixes []string
+		if webhookPrefixes != "" {
+			prefixes = strings.Split(webhookPrefixes, ",")
+		}
+		server.webhook = newWebhook(webhookURL, prefixes, webhookRetries, webhookBackoff)
+		server.webhook.Start()
+	}
+
 	if err = server.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookQueueSize is the number of change events buffered for delivery,
+	// events are dropped (and logged) once the queue is full
+	webhookQueueSize = 1024
+
+	// webhookTimeout is the timeout of a single delivery attempt
+	webhookTimeout = 10 * time.Second
+)
+
+// event is a change event as POSTed to the webhook. Keys and values are
+// base64 encoded as per encoding/json.
+type event struct {
+	Op    string    `json:"op"`
+	Key   []byte    `json:"key"`
+	Value []byte    `json:"value,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// webhook POSTs change events of keys matching any of the given prefixes
+// (all keys if none) to a URL, retrying failed deliveries with a doubling
+// backoff. Events are delivered in order from a single goroutine.
+type webhook struct {
+	url      string
+	prefixes [][]byte
+	retries  int
+	backoff  time.Duration
+	client   *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	events chan event
+	wg     sync.WaitGroup
+}
+
+func newWebhook(url string, prefixes []string, retries int, backoff time.Duration) *webhook {
+	w := &webhook{
+		url:     url,
+		retries: retries,
+		backoff: backoff,
+		client:  &http.Client{Timeout: webhookTimeout},
+		events:  make(chan event, webhookQueueSize),
+	}
+	for _, prefix := range prefixes {
+		w.prefixes = append(w.prefixes, []byte(prefix))
+	}
+	return w
+}
+
+// notify queues a change event for delivery if the key matches. It never
+// blocks the caller and events notified after Stop are discarded.
+func (w *webhook) notify(op string, key, value []byte) {
+	if w == nil || !w.matches(key) {
+		return
+	}
+
+	e := event{
+		Op:    op,
+		Key:   append([]byte(nil), key...),
+		Value: append([]byte(nil), value...),
+		Time:  time.Now(),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.events <- e:
+	default:
+		log.WithField("key", string(key)).Warn("webhook queue full, dropping event")
+	}
+}
+
+func (w *webhook) matches(key []byte) bool {
+	if len(w.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range w.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts delivering queued events
+func (w *webhook) Start() {
+	w.wg.Add(1)
+	go pprof.Do(context.Background(), pprof.Labels("bitcaskd", "webhook"), func(context.Context) {
+		defer w.wg.Done()
+		for e := range w.events {
+			if err := w.deliver(e); err != nil {
+				log.WithError(err).
+					WithField("url", w.url).
+					WithField("key", string(e.Key)).
+					Error("error delivering webhook event")
+			}
+		}
+	})
+}
+
+// Stop stops accepting events and waits for queued events to be delivered
+func (w *webhook) Stop() {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+}
+
+func (w *webhook) deliver(e event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		if err = w.post(body); err == nil || attempt >= w.retries {
+			return err
+		}
+		log.WithError(err).WithField("url", w.url).Debug("retrying webhook event")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder is a webhook endpoint recording the events POSTed to it. The
+// first failures requests are answered with a 500.
+type recorder struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	events   []event
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var e event
+	if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, e)
+}
+
+// recorded returns the number of requests received and the keys of the
+// events recorded
+func (r *recorder) recorded() (int, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for _, e := range r.events {
+		keys = append(keys, string(e.Key))
+	}
+	return r.attempts, keys
+}
+
+func TestWebhook(t *testing.T) {
+	t.Run("Prefixes", func(t *testing.T) {
+		assert := assert.New(t)
+
+		r := &recorder{}
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		w := newWebhook(ts.URL, []string{"foo", "baz"}, 0, 0)
+		w.Start()
+		w.notify("set", []byte("foo1"), []byte("1"))
+		w.notify("set", []byte("bar1"), []byte("2"))
+		w.notify("del", []byte("baz1"), nil)
+		w.Stop()
+
+		_, keys := r.recorded()
+		assert.Equal([]string{"foo1", "baz1"}, keys)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		assert.Equal("set", r.events[0].Op)
+		assert.Equal([]byte("1"), r.events[0].Value)
+		assert.Equal("del", r.events[1].Op)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		assert := assert.New(t)
+
+		r := &recorder{failures: 2}
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		w := newWebhook(ts.URL, nil, 2, 10*time.Millisecond)
+		w.Start()
+		start := time.Now()
+		w.notify("set", []byte("foo"), []byte("bar"))
+		w.Stop()
+
+		// Backoff doubles between attempts: 10ms then 20ms
+		assert.True(time.Since(start) >= 30*time.Millisecond)
+		attempts, keys := r.recorded()
+		assert.Equal(3, attempts)
+		assert.Equal([]string{"foo"}, keys)
+	})
+
+	t.Run("RetriesExhausted", func(t *testing.T) {
+		assert := assert.New(t)
+
+		r := &recorder{failures: 3}
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		w := newWebhook(ts.URL, nil, 1, time.Millisecond)
+		w.Start()
+		w.notify("set", []byte("foo"), []byte("bar"))
+		w.notify("set", []byte("bar"), []byte("baz"))
+		w.Stop()
+
+		// foo fails twice and is given up, bar fails once then succeeds
+		attempts, keys := r.recorded()
+		assert.Equal(4, attempts)
+		assert.Equal([]string{"bar"}, keys)
+	})
+
+	t.Run("QueueFull", func(t *testing.T) {
+		assert := assert.New(t)
+
+		r := &recorder{}
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		// Not started yet so nothing drains the queue
+		w := newWebhook(ts.URL, nil, 0, 0)
+		for i := 0; i < webhookQueueSize+10; i++ {
+			w.notify("set", []byte("foo"), nil)
+		}
+		assert.Equal(webhookQueueSize, len(w.events))
+
+		w.Start()
+		w.Stop()
+		_, keys := r.recorded()
+		assert.Equal(webhookQueueSize, len(keys))
+	})
+
+	t.Run("NotifyAfterStop", func(t *testing.T) {
+		assert := assert.New(t)
+
+		r := &recorder{}
+		ts := httptest.NewServer(r)
+		defer ts.Close()
+
+		w := newWebhook(ts.URL, nil, 0, 0)
+		w.Start()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					w.notify("set", []byte("foo"), nil)
+				}
+			}()
+		}
+		w.Stop()
+		wg.Wait()
+
+		assert.NotPanics(func() { w.notify("set", []byte("foo"), nil) })
+		assert.NotPanics(w.Stop)
+	})
+}
@@ -0,0 +1,48 @@
+package bitcask
+
+import (
+	"context"
+)
+
+// GetContext retrieves the value of the given key like Get() unless the
+// context is done first, in which case the error of the context is returned
+func (b *Bitcask) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.Get(key)
+}
+
+// PutContext stores the key and value like Put() unless the context is done
+// first, in which case the error of the context is returned. A write that
+// started is not aborted so it is never partially applied.
+func (b *Bitcask) PutContext(ctx context.Context, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// DeleteContext deletes the key like Delete() unless the context is done
+// first, in which case the error of the context is returned. A delete that
+// started is not aborted so it is never partially applied.
+func (b *Bitcask) DeleteContext(ctx context.Context, key []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+// ScanContext performs a prefix scan like Scan() and stops with the error of
+// the context once it is done
+func (b *Bitcask) ScanContext(ctx context.Context, prefix []byte, f func(key []byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.Scan(prefix, func(key []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return f(key)
+	})
+}
@@ -0,0 +1,149 @@
+// Package cache implements caches with per-key expiry over Bitcask.
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/prologic/bitcask"
+)
+
+// ErrNotFound is the error returned for keys that are not found or expired
+var ErrNotFound = errors.New("error: key not found")
+
+// Cache is a key/value cache with per-key expiry
+type Cache interface {
+	// Get returns the value of the key or ErrNotFound
+	Get(key []byte) ([]byte, error)
+	// Set stores the value of the key which expires after ttl, or never if
+	// ttl is zero
+	Set(key, value []byte, ttl time.Duration) error
+	// Delete deletes the key
+	Delete(key []byte) error
+}
+
+// expirySize is the size of the expiry prepended to stored values, the
+// expiry time in Unix nanoseconds or zero if the value never expires
+const expirySize = 8
+
+// Store is a Cache storing values with their expiry in a Bitcask database
+// under a key prefix. Expired keys are deleted as they are read or by
+// Sweep().
+type Store struct {
+	db     *bitcask.Bitcask
+	prefix []byte
+	now    func() time.Time
+}
+
+// New returns a cache storing its keys under the given prefix of an already
+// open database, so it can share the database with other data
+func New(db *bitcask.Bitcask, prefix []byte) *Store {
+	return &Store{db: db, prefix: prefix, now: time.Now}
+}
+
+func (s *Store) key(key []byte) []byte {
+	return append(append([]byte{}, s.prefix...), key...)
+}
+
+// Get returns the value of the key or ErrNotFound if it is not found or
+// expired
+func (s *Store) Get(key []byte) ([]byte, error) {
+	value, _, err := s.GetWithExpiry(key)
+	return value, err
+}
+
+// GetWithExpiry returns the value of the key and its expiry time (zero if
+// it never expires) or ErrNotFound if it is not found or expired
+func (s *Store) GetWithExpiry(key []byte) ([]byte, time.Time, error) {
+	k := s.key(key)
+	data, err := s.db.Get(k)
+	if err == bitcask.ErrKeyNotFound {
+		return nil, time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	value, expired := s.decode(data)
+	if expired {
+		if err := s.db.Delete(k); err != nil {
+			return nil, time.Time{}, err
+		}
+		return nil, time.Time{}, ErrNotFound
+	}
+
+	var expiry time.Time
+	if nsec := int64(binary.BigEndian.Uint64(data)); nsec != 0 {
+		expiry = time.Unix(0, nsec)
+	}
+	return value, expiry, nil
+}
+
+// Set stores the value of the key which expires after ttl, or never if ttl
+// is zero
+func (s *Store) Set(key, value []byte, ttl time.Duration) error {
+	data := make([]byte, expirySize+len(value))
+	if ttl != 0 {
+		binary.BigEndian.PutUint64(data, uint64(s.now().Add(ttl).UnixNano()))
+	}
+	copy(data[expirySize:], value)
+	return s.db.Put(s.key(key), data)
+}
+
+// Delete deletes the key
+func (s *Store) Delete(key []byte) error {
+	return s.db.Delete(s.key(key))
+}
+
+// Sweep deletes all expired keys, returning the number of keys deleted
+func (s *Store) Sweep() (int, error) {
+	var n int
+	err := s.db.Scan(s.prefix, func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err == bitcask.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, expired := s.decode(data); expired {
+			n++
+			return s.db.Delete(key)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// All returns the values of all keys that have not expired
+func (s *Store) All() (map[string][]byte, error) {
+	all := make(map[string][]byte)
+	err := s.db.Scan(s.prefix, func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err == bitcask.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if value, expired := s.decode(data); !expired {
+			all[string(key[len(s.prefix):])] = value
+		}
+		return nil
+	})
+	return all, err
+}
+
+// decode splits a stored value into the value and whether it has expired.
+// Values too short to hold an expiry are treated as expired.
+func (s *Store) decode(data []byte) ([]byte, bool) {
+	if len(data) < expirySize {
+		return nil, true
+	}
+	expiry := int64(binary.BigEndian.Uint64(data))
+	if expiry != 0 && s.now().UnixNano() >= expiry {
+		return nil, true
+	}
+	return data[expirySize:], false
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := bitcask.Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	now := time.Now()
+	s := New(db, []byte("cache/"))
+	s.now = func() time.Time { return now }
+
+	var _ Cache = s
+
+	assert.NoError(db.Put([]byte("other"), []byte("data")))
+	assert.NoError(s.Set([]byte("foo"), []byte("bar"), time.Minute))
+	assert.NoError(s.Set([]byte("hello"), []byte("world"), time.Hour))
+	assert.NoError(s.Set([]byte("forever"), []byte("young"), 0))
+
+	value, err := s.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), value)
+
+	_, err = s.Get([]byte("other"))
+	assert.Equal(ErrNotFound, err)
+
+	t.Run("Expiry", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+
+		_, err := s.Get([]byte("foo"))
+		assert.Equal(ErrNotFound, err)
+		assert.False(db.Has([]byte("cache/foo")))
+
+		value, err := s.Get([]byte("hello"))
+		assert.NoError(err)
+		assert.Equal([]byte("world"), value)
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		now = now.Add(24 * time.Hour)
+
+		all, err := s.All()
+		assert.NoError(err)
+		assert.Equal(map[string][]byte{"forever": []byte("young")}, all)
+
+		n, err := s.Sweep()
+		assert.NoError(err)
+		assert.Equal(1, n)
+		assert.Equal(2, db.Len())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(s.Delete([]byte("forever")))
+		_, err := s.Get([]byte("forever"))
+		assert.Equal(ErrNotFound, err)
+		assert.True(db.Has([]byte("other")))
+	})
+}
@@ -0,0 +1,563 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/prologic/bitcask"
+)
+
+const (
+	// DefaultSize is the default number of keys held in memory by a Tiered
+	// cache
+	DefaultSize = 1024
+)
+
+// TieredOption is a function that configures a Tiered cache
+type TieredOption func(*Tiered)
+
+// WithSize sets the maximum number of keys held in memory
+func WithSize(size int) TieredOption {
+	return func(t *Tiered) {
+		t.size = size
+	}
+}
+
+// WithMaxCost limits the total cost of the keys held in memory, in addition
+// to their number set with WithSize(). The cost of a key is the size of its
+// key and value unless set with WithCost(). Values costing more than the
+// maximum are never held in memory. Zero (the default) means no limit.
+func WithMaxCost(maxCost int64) TieredOption {
+	return func(t *Tiered) {
+		t.maxCost = maxCost
+	}
+}
+
+// WithCost sets the function returning the cost of holding a key and its
+// value in memory, see WithMaxCost(). It is called with the lock of the
+// cache held so it must be cheap and must not use the cache.
+func WithCost(cost func(key, value []byte) int64) TieredOption {
+	return func(t *Tiered) {
+		t.cost = cost
+	}
+}
+
+// WithAdmission sets the admission policy deciding whether a key read
+// through or written is held in memory, given its cost (see WithCost()), so
+// e.g. large values read once do not evict many small hot keys. Rejected
+// keys are still read from and written to the backing cache. Like the cost
+// function it is called with the lock of the cache held.
+func WithAdmission(admit func(key, value []byte, cost int64) bool) TieredOption {
+	return func(t *Tiered) {
+		t.admit = admit
+	}
+}
+
+// WithWriteBehind makes Set() and Delete() return once the memory tier is
+// updated, writing to the backing cache in the background every interval
+// (and on Flush() and Close()). Writes not yet flushed are lost on crash
+// unless journaled, see WithJournal().
+func WithWriteBehind(interval time.Duration) TieredOption {
+	return func(t *Tiered) {
+		t.interval = interval
+	}
+}
+
+// WithJournal persists the writes pending in write-behind mode to the
+// given database under the key prefix until they are flushed, syncing it
+// every window writes, so at most window writes are lost on crash (all of
+// them if window is zero and the database is not opened WithSync()).
+// Journaled writes are queued again by Recover().
+func WithJournal(db *bitcask.Bitcask, prefix []byte, window int) TieredOption {
+	return func(t *Tiered) {
+		t.journal = db
+		t.journalPrefix = prefix
+		t.window = window
+	}
+}
+
+// TieredStats are the statistics of a Tiered cache
+type TieredStats struct {
+	// Pending is the number of writes queued for the backing cache
+	Pending int
+	// Flushed is the number of writes flushed to the backing cache
+	Flushed uint64
+	// FlushErrors is the number of failed attempts to flush a write
+	FlushErrors uint64
+	// Unsynced is the number of journaled writes not yet synced to disk
+	Unsynced int
+
+	// Keys is the number of keys held in memory and Cost their total cost,
+	// see WithCost()
+	Keys int
+	Cost int64
+	// Hits and Misses are the number of reads served from memory and read
+	// through from the backing cache
+	Hits   uint64
+	Misses uint64
+	// Evictions is the number of keys evicted from memory to make room
+	Evictions uint64
+	// Rejections is the number of keys not held in memory as they were
+	// rejected by the admission policy or cost more than the maximum
+	Rejections uint64
+}
+
+// Tiered layers an in-memory LRU cache over a backing cache, typically a
+// Store. Reads missing the memory tier read through to the backing cache.
+// Writes go through to the backing cache before updating the memory tier,
+// or with WithWriteBehind() update the memory tier and are written to the
+// backing cache later. Either way a Get() after a Set() or Delete() of the
+// same key sees its effect.
+type Tiered struct {
+	backing  Cache
+	size     int
+	maxCost  int64
+	cost     func(key, value []byte) int64
+	admit    func(key, value []byte, cost int64) bool
+	interval time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	lru       *list.List
+	items     map[string]*list.Element
+	totalCost int64
+
+	// writes counts writes so values read through are only cached if no
+	// write happened meanwhile, writeMu serializes writes through
+	writes  uint64
+	writeMu sync.Mutex
+
+	// pending are the writes not yet flushed in write-behind mode, at most
+	// one per key, and flushMu serializes flushes
+	pending map[string]*entry
+	flushMu sync.Mutex
+
+	// journal persists the pending writes, guarded by mu
+	journal       *bitcask.Bitcask
+	journalPrefix []byte
+	window        int
+	unsynced      int
+
+	flushed     uint64
+	flushErrors uint64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	rejections  uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// entry is a key held in memory or a pending write
+type entry struct {
+	key     string
+	value   []byte
+	expiry  time.Time
+	deleted bool
+	cost    int64
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !now.Before(e.expiry)
+}
+
+// expiryGetter is implemented by backing caches that can report the
+// expiry of a key, so values read through expire in memory on time
+type expiryGetter interface {
+	GetWithExpiry(key []byte) ([]byte, time.Time, error)
+}
+
+// NewTiered returns a tiered cache over the backing cache. Close() must be
+// called to flush pending writes in write-behind mode.
+func NewTiered(backing Cache, options ...TieredOption) *Tiered {
+	t := &Tiered{
+		backing: backing,
+		size:    DefaultSize,
+		now:     time.Now,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+		pending: make(map[string]*entry),
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+
+	if t.interval > 0 {
+		t.wg.Add(1)
+		go pprof.Do(context.Background(), pprof.Labels("bitcask", "write-behind"), func(context.Context) {
+			defer t.wg.Done()
+			t.flusher()
+		})
+	}
+
+	return t
+}
+
+func (t *Tiered) flusher() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Failed writes are kept pending and retried on the next tick
+			t.Flush()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Get returns the value of the key from memory, reading it through from the
+// backing cache if needed, or ErrNotFound
+func (t *Tiered) Get(key []byte) ([]byte, error) {
+	k := string(key)
+	now := t.now()
+
+	t.mu.Lock()
+	if e, ok := t.lookup(k); ok {
+		t.hits++
+		t.mu.Unlock()
+		if e.deleted || e.expired(now) {
+			return nil, ErrNotFound
+		}
+		return e.value, nil
+	}
+	writes := t.writes
+	t.misses++
+	t.mu.Unlock()
+
+	var (
+		value  []byte
+		expiry time.Time
+		err    error
+	)
+	if eg, ok := t.backing.(expiryGetter); ok {
+		value, expiry, err = eg.GetWithExpiry(key)
+	} else {
+		value, err = t.backing.Get(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A write since the read through may have made the value stale
+	if t.writes == writes {
+		t.add(&entry{key: k, value: value, expiry: expiry})
+	}
+	return value, nil
+}
+
+// lookup returns the entry of the key in memory or pending. The caller
+// must hold the lock.
+func (t *Tiered) lookup(k string) (*entry, bool) {
+	if elem, ok := t.items[k]; ok {
+		t.lru.MoveToFront(elem)
+		return elem.Value.(*entry), true
+	}
+	e, ok := t.pending[k]
+	return e, ok
+}
+
+// add adds or replaces the entry in memory evicting the least recently used
+// entries over the size or maximum cost. If the entry is not admitted any
+// older entry of the key is removed instead. The caller must hold the lock.
+func (t *Tiered) add(e *entry) {
+	if t.cost != nil {
+		e.cost = t.cost([]byte(e.key), e.value)
+	} else {
+		e.cost = int64(len(e.key) + len(e.value))
+	}
+	if (t.maxCost > 0 && e.cost > t.maxCost) || (t.admit != nil && !t.admit([]byte(e.key), e.value, e.cost)) {
+		t.rejections++
+		t.remove(e.key)
+		return
+	}
+
+	if elem, ok := t.items[e.key]; ok {
+		t.totalCost -= elem.Value.(*entry).cost
+		elem.Value = e
+		t.lru.MoveToFront(elem)
+	} else {
+		t.items[e.key] = t.lru.PushFront(e)
+	}
+	t.totalCost += e.cost
+
+	for t.lru.Len() > t.size || (t.maxCost > 0 && t.totalCost > t.maxCost) {
+		t.remove(t.lru.Back().Value.(*entry).key)
+		t.evictions++
+	}
+}
+
+// remove removes the key from memory. The caller must hold the lock.
+func (t *Tiered) remove(k string) {
+	if elem, ok := t.items[k]; ok {
+		t.lru.Remove(elem)
+		delete(t.items, k)
+		t.totalCost -= elem.Value.(*entry).cost
+	}
+}
+
+// Set stores the value of the key which expires after ttl, or never if ttl
+// is zero
+func (t *Tiered) Set(key, value []byte, ttl time.Duration) error {
+	e := &entry{key: string(key), value: value}
+	if ttl != 0 {
+		e.expiry = t.now().Add(ttl)
+	}
+
+	if t.interval > 0 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if err := t.journalWrite(e); err != nil {
+			return err
+		}
+		t.writes++
+		t.add(e)
+		t.pending[e.key] = e
+		return nil
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	// Drop the old value first so it is not read while the write is in
+	// flight, then cache the new value once it is written
+	t.mu.Lock()
+	t.writes++
+	t.remove(e.key)
+	t.mu.Unlock()
+
+	err := t.backing.Set(key, value, ttl)
+
+	// Counted again as a read through may have started before the write
+	t.mu.Lock()
+	t.writes++
+	if err == nil {
+		t.add(e)
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// Delete deletes the key
+func (t *Tiered) Delete(key []byte) error {
+	k := string(key)
+
+	if t.interval > 0 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		e := &entry{key: k, deleted: true}
+		if err := t.journalWrite(e); err != nil {
+			return err
+		}
+		t.writes++
+		t.remove(k)
+		t.pending[k] = e
+		return nil
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	t.mu.Lock()
+	t.writes++
+	t.remove(k)
+	t.mu.Unlock()
+
+	err := t.backing.Delete(key)
+
+	// Removed again as a read through may have cached the value meanwhile
+	t.mu.Lock()
+	t.writes++
+	t.remove(k)
+	t.mu.Unlock()
+	return err
+}
+
+// Pending returns the number of writes not yet flushed to the backing cache
+func (t *Tiered) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// Stats returns the statistics of the cache
+func (t *Tiered) Stats() TieredStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TieredStats{
+		Pending:     len(t.pending),
+		Flushed:     t.flushed,
+		FlushErrors: t.flushErrors,
+		Unsynced:    t.unsynced,
+		Keys:        t.lru.Len(),
+		Cost:        t.totalCost,
+		Hits:        t.hits,
+		Misses:      t.misses,
+		Evictions:   t.evictions,
+		Rejections:  t.rejections,
+	}
+}
+
+// journal operations
+const (
+	journalSet byte = iota
+	journalDelete
+)
+
+// journalWrite persists a pending write to the journal, if any. The caller
+// must hold the lock.
+func (t *Tiered) journalWrite(e *entry) error {
+	if t.journal == nil {
+		return nil
+	}
+
+	data := make([]byte, 1+expirySize+len(e.value))
+	if e.deleted {
+		data[0] = journalDelete
+	}
+	if !e.expiry.IsZero() {
+		binary.BigEndian.PutUint64(data[1:], uint64(e.expiry.UnixNano()))
+	}
+	copy(data[1+expirySize:], e.value)
+
+	if err := t.journal.Put(t.journalKey(e.key), data); err != nil {
+		return err
+	}
+
+	t.unsynced++
+	if t.window > 0 && t.unsynced >= t.window {
+		if err := t.journal.Sync(); err != nil {
+			return err
+		}
+		t.unsynced = 0
+	}
+	return nil
+}
+
+func (t *Tiered) journalKey(k string) []byte {
+	return append(append([]byte{}, t.journalPrefix...), k...)
+}
+
+// Recover queues again the writes left in the journal by a previous
+// instance that was not closed, returning the number of writes queued.
+// Writes made since NewTiered() take precedence.
+func (t *Tiered) Recover() (int, error) {
+	if t.journal == nil {
+		return 0, nil
+	}
+
+	var n int
+	err := t.journal.Scan(t.journalPrefix, func(key []byte) error {
+		data, err := t.journal.Get(key)
+		if err == bitcask.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) < 1+expirySize {
+			return errors.New("error: invalid journal entry")
+		}
+
+		e := &entry{
+			key:     string(key[len(t.journalPrefix):]),
+			value:   data[1+expirySize:],
+			deleted: data[0] == journalDelete,
+		}
+		if nsec := int64(binary.BigEndian.Uint64(data[1:])); nsec != 0 {
+			e.expiry = time.Unix(0, nsec)
+		}
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.pending[e.key]; ok {
+			return nil
+		}
+		t.writes++
+		if e.deleted {
+			t.remove(e.key)
+		} else {
+			t.add(e)
+		}
+		t.pending[e.key] = e
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Flush writes all pending writes to the backing cache. Writes that fail
+// are kept pending unless superseded and the first error is returned.
+func (t *Tiered) Flush() error {
+	t.flushMu.Lock()
+	defer t.flushMu.Unlock()
+
+	t.mu.Lock()
+	pending := make([]*entry, 0, len(t.pending))
+	for _, e := range t.pending {
+		pending = append(pending, e)
+	}
+	t.mu.Unlock()
+
+	var first error
+	for _, e := range pending {
+		var err error
+		switch {
+		case e.deleted:
+			err = t.backing.Delete([]byte(e.key))
+		case e.expiry.IsZero():
+			err = t.backing.Set([]byte(e.key), e.value, 0)
+		default:
+			if ttl := e.expiry.Sub(t.now()); ttl > 0 {
+				err = t.backing.Set([]byte(e.key), e.value, ttl)
+			} else {
+				err = t.backing.Delete([]byte(e.key))
+			}
+		}
+		if err != nil {
+			t.mu.Lock()
+			t.flushErrors++
+			t.mu.Unlock()
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+
+		// Keep the key pending if it was written again meanwhile
+		t.mu.Lock()
+		t.flushed++
+		if t.pending[e.key] == e {
+			delete(t.pending, e.key)
+			if t.journal != nil {
+				if err := t.journal.Delete(t.journalKey(e.key)); err != nil && first == nil {
+					first = err
+				}
+			}
+		}
+		t.mu.Unlock()
+	}
+	return first
+}
+
+// Close stops writing behind in the background and flushes pending writes.
+// It does not close the backing cache.
+func (t *Tiered) Close() error {
+	if t.interval > 0 {
+		close(t.stop)
+		t.wg.Wait()
+	}
+	return t.Flush()
+}
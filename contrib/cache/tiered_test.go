@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+// countingCache counts the calls to the backing cache
+type countingCache struct {
+	*Store
+	mu              sync.Mutex
+	gets, sets, del int
+	err             error
+}
+
+func (c *countingCache) GetWithExpiry(key []byte) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	return c.Store.GetWithExpiry(key)
+}
+
+func (c *countingCache) Set(key, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	c.sets++
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Store.Set(key, value, ttl)
+}
+
+func (c *countingCache) Delete(key []byte) error {
+	c.mu.Lock()
+	c.del++
+	c.mu.Unlock()
+	return c.Store.Delete(key)
+}
+
+func newCountingCache(t *testing.T) (*countingCache, func()) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(t, err)
+
+	db, err := bitcask.Open(testdir)
+	assert.NoError(t, err)
+
+	return &countingCache{Store: New(db, nil)}, func() {
+		db.Close()
+		os.RemoveAll(testdir)
+	}
+}
+
+func TestTiered(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("WriteThrough", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithSize(2))
+		defer c.Close()
+		var _ Cache = c
+
+		assert.NoError(c.Set([]byte("foo"), []byte("bar"), 0))
+		assert.Equal(1, backing.sets)
+
+		value, err := backing.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+
+		// Served from memory
+		value, err = c.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		assert.Equal(0, backing.gets)
+
+		// Evicted and read through
+		assert.NoError(c.Set([]byte("k1"), []byte("v1"), 0))
+		assert.NoError(c.Set([]byte("k2"), []byte("v2"), 0))
+		value, err = c.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		assert.Equal(1, backing.gets)
+
+		assert.NoError(c.Delete([]byte("foo")))
+		_, err = c.Get([]byte("foo"))
+		assert.Equal(ErrNotFound, err)
+		_, err = backing.Get([]byte("foo"))
+		assert.Equal(ErrNotFound, err)
+
+		// A failed write leaves neither tier changed
+		backing.err = errors.New("error: mock error")
+		assert.Error(c.Set([]byte("k1"), []byte("v3"), 0))
+		backing.err = nil
+		value, err = c.Get([]byte("k1"))
+		assert.NoError(err)
+		assert.Equal([]byte("v1"), value)
+	})
+
+	t.Run("MaxCost", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithMaxCost(16))
+		defer c.Close()
+
+		// Costing 6 each, the third evicts the first
+		assert.NoError(c.Set([]byte("k1"), []byte("v1v1"), 0))
+		assert.NoError(c.Set([]byte("k2"), []byte("v2v2"), 0))
+		assert.NoError(c.Set([]byte("k3"), []byte("v3v3"), 0))
+		stats := c.Stats()
+		assert.Equal(2, stats.Keys)
+		assert.Equal(int64(12), stats.Cost)
+		assert.Equal(uint64(1), stats.Evictions)
+
+		// Too large to be held in memory, the old value must not be served
+		assert.NoError(c.Set([]byte("k2"), make([]byte, 32), 0))
+		value, err := c.Get([]byte("k2"))
+		assert.NoError(err)
+		assert.Equal(make([]byte, 32), value)
+		stats = c.Stats()
+		assert.Equal(1, stats.Keys)
+		assert.Equal(int64(6), stats.Cost)
+		assert.Equal(uint64(2), stats.Rejections)
+		assert.Equal(uint64(1), stats.Misses)
+
+		_, err = c.Get([]byte("k3"))
+		assert.NoError(err)
+		assert.Equal(uint64(1), c.Stats().Hits)
+	})
+
+	t.Run("Admission", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing,
+			WithCost(func(key, value []byte) int64 { return 1 }),
+			WithAdmission(func(key, value []byte, cost int64) bool {
+				assert.Equal(int64(1), cost)
+				return len(value) < 4
+			}),
+		)
+		defer c.Close()
+
+		assert.NoError(c.Set([]byte("small"), []byte("bar"), 0))
+		assert.NoError(c.Set([]byte("large"), []byte("hello world"), 0))
+		for i := 0; i < 2; i++ {
+			_, err := c.Get([]byte("small"))
+			assert.NoError(err)
+			_, err = c.Get([]byte("large"))
+			assert.NoError(err)
+		}
+		assert.Equal(2, backing.gets)
+
+		stats := c.Stats()
+		assert.Equal(1, stats.Keys)
+		assert.Equal(int64(1), stats.Cost)
+		assert.Equal(uint64(3), stats.Rejections)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		now := time.Now()
+		c := NewTiered(backing)
+		c.now = func() time.Time { return now }
+		backing.now = c.now
+		defer c.Close()
+
+		assert.NoError(backing.Set([]byte("foo"), []byte("bar"), time.Minute))
+		value, err := c.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+
+		// Read through values expire in memory with the backing cache
+		now = now.Add(time.Hour)
+		_, err = c.Get([]byte("foo"))
+		assert.Equal(ErrNotFound, err)
+	})
+
+	t.Run("WriteBehind", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithSize(1), WithWriteBehind(time.Hour))
+
+		assert.NoError(c.Set([]byte("foo"), []byte("bar"), 0))
+		assert.NoError(c.Set([]byte("hello"), []byte("world"), time.Hour))
+		assert.NoError(c.Delete([]byte("hello")))
+		assert.Equal(2, c.Pending())
+		assert.Equal(0, backing.sets)
+
+		// Pending writes are seen even when evicted from memory
+		value, err := c.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		_, err = c.Get([]byte("hello"))
+		assert.Equal(ErrNotFound, err)
+		assert.Equal(0, backing.gets)
+
+		// Failed writes stay pending
+		backing.err = errors.New("error: mock error")
+		assert.Error(c.Flush())
+		assert.Equal(1, c.Pending())
+		backing.err = nil
+
+		assert.NoError(c.Close())
+		assert.Equal(0, c.Pending())
+		value, err = backing.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+	})
+
+	t.Run("Flusher", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithWriteBehind(10*time.Millisecond))
+		defer c.Close()
+
+		assert.NoError(c.Set([]byte("foo"), []byte("bar"), 0))
+		for i := 0; i < 100 && c.Pending() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(0, c.Pending())
+		value, err := backing.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+	})
+
+	t.Run("Journal", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		journal, err := bitcask.Open(testdir)
+		assert.NoError(err)
+
+		c := NewTiered(backing, WithWriteBehind(time.Hour), WithJournal(journal, []byte("j/"), 2))
+		assert.NoError(c.Set([]byte("foo"), []byte("bar"), time.Hour))
+		assert.NoError(backing.Set([]byte("baz"), []byte("qux"), 0))
+		assert.NoError(c.Delete([]byte("baz")))
+		assert.NoError(c.Set([]byte("a"), []byte("b"), 0))
+
+		stats := c.Stats()
+		assert.Equal(3, stats.Pending)
+		assert.Equal(1, stats.Unsynced)
+		assert.Equal(3, journal.Len())
+
+		// Simulate a crash: the pending writes are never flushed
+		assert.NoError(journal.Close())
+		journal, err = bitcask.Open(testdir)
+		assert.NoError(err)
+		defer journal.Close()
+
+		c = NewTiered(backing, WithWriteBehind(time.Hour), WithJournal(journal, []byte("j/"), 2))
+		assert.NoError(c.Set([]byte("a"), []byte("c"), 0))
+		n, err := c.Recover()
+		assert.NoError(err)
+		assert.Equal(2, n)
+		assert.Equal(3, c.Pending())
+
+		assert.NoError(c.Flush())
+		stats = c.Stats()
+		assert.Equal(0, stats.Pending)
+		assert.Equal(uint64(3), stats.Flushed)
+		assert.Equal(0, journal.Len())
+
+		value, expiry, err := backing.GetWithExpiry([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		assert.False(expiry.IsZero())
+		_, err = backing.Get([]byte("baz"))
+		assert.Equal(ErrNotFound, err)
+		value, err = backing.Get([]byte("a"))
+		assert.NoError(err)
+		assert.Equal([]byte("c"), value)
+		assert.NoError(c.Close())
+	})
+
+	t.Run("FlushErrors", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithWriteBehind(time.Hour))
+		assert.NoError(c.Set([]byte("foo"), []byte("bar"), 0))
+
+		backing.err = errors.New("error: backing failed")
+		assert.Error(c.Flush())
+		stats := c.Stats()
+		assert.Equal(1, stats.Pending)
+		assert.Equal(uint64(1), stats.FlushErrors)
+
+		backing.err = nil
+		assert.NoError(c.Close())
+		assert.Equal(uint64(1), c.Stats().Flushed)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		backing, cleanup := newCountingCache(t)
+		defer cleanup()
+
+		c := NewTiered(backing, WithSize(8))
+		defer c.Close()
+
+		wg := &sync.WaitGroup{}
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					key := []byte(fmt.Sprintf("k%d", i%10))
+					if i%3 == 0 {
+						assert.NoError(c.Delete(key))
+					} else {
+						assert.NoError(c.Set(key, []byte(fmt.Sprintf("v%d", w)), 0))
+					}
+					c.Get(key)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		// The memory tier agrees with the backing cache
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("k%d", i))
+			expected, err1 := backing.Get(key)
+			actual, err2 := c.Get(key)
+			assert.Equal(err1, err2)
+			assert.Equal(expected, actual)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+// Package gokv implements the philippgille/gokv Store interface over
+// Bitcask, so it can be used wherever a gokv.Store is expected:
+//
+//	type Store interface {
+//		Set(k string, v interface{}) error
+//		Get(k string, v interface{}) (found bool, err error)
+//		Delete(k string) error
+//		Close() error
+//	}
+//
+// Values are marshalled with a Codec, JSON by default.
+package gokv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+
+	"github.com/prologic/bitcask"
+)
+
+var (
+	// ErrEmptyKey is the error returned for an empty key
+	ErrEmptyKey = errors.New("error: the passed key is an empty string, which is invalid")
+
+	// ErrNilValue is the error returned for a nil value
+	ErrNilValue = errors.New("error: the passed value is nil, which is not allowed")
+)
+
+// Codec marshals and unmarshals values, like gokv's encoding.Codec
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON is a Codec using encoding/json
+	JSON Codec = jsonCodec{}
+
+	// Gob is a Codec using encoding/gob
+	Gob Codec = gobCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Options are the options of a Store
+type Options struct {
+	// Path of the database, "bitcask.db" by default
+	Path string
+	// Codec of the values, JSON by default
+	Codec Codec
+}
+
+// DefaultOptions are the default options
+var DefaultOptions = Options{
+	Path:  "bitcask.db",
+	Codec: JSON,
+}
+
+// Store is a gokv.Store backed by a Bitcask database
+type Store struct {
+	db    *bitcask.Bitcask
+	codec Codec
+}
+
+// NewStore opens the database at the path in the options, creating it if
+// it does not exist
+func NewStore(options Options) (Store, error) {
+	if options.Path == "" {
+		options.Path = DefaultOptions.Path
+	}
+	db, err := bitcask.Open(options.Path)
+	if err != nil {
+		return Store{}, err
+	}
+	return NewStoreFromDB(db, options.Codec), nil
+}
+
+// NewStoreFromDB returns a Store over an already open database, which is
+// closed by Close(). A nil codec defaults to JSON.
+func NewStoreFromDB(db *bitcask.Bitcask, codec Codec) Store {
+	if codec == nil {
+		codec = DefaultOptions.Codec
+	}
+	return Store{db: db, codec: codec}
+}
+
+// Set stores the marshalled value of the key
+func (s Store) Set(k string, v interface{}) error {
+	if k == "" {
+		return ErrEmptyKey
+	}
+	if v == nil {
+		return ErrNilValue
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(k), data)
+}
+
+// Get unmarshals the value of the key into v, which must be a pointer. If
+// the key is not found v is left untouched and found is false.
+func (s Store) Get(k string, v interface{}) (found bool, err error) {
+	if k == "" {
+		return false, ErrEmptyKey
+	}
+
+	data, err := s.db.Get([]byte(k))
+	if err == bitcask.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Delete deletes the key, deleting a missing key is not an error
+func (s Store) Delete(k string) error {
+	if k == "" {
+		return ErrEmptyKey
+	}
+	return s.db.Delete([]byte(k))
+}
+
+// Close closes the database
+func (s Store) Close() error {
+	return s.db.Close()
+}
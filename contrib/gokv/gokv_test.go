@@ -0,0 +1,54 @@
+package gokv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type foo struct {
+	Bar string
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	for _, codec := range []Codec{JSON, Gob} {
+		path := filepath.Join(testdir, "gob")
+		if codec == JSON {
+			path = filepath.Join(testdir, "json")
+		}
+
+		store, err := NewStore(Options{Path: path, Codec: codec})
+		assert.NoError(err)
+
+		assert.NoError(store.Set("foo", foo{Bar: "baz"}))
+
+		var actual foo
+		found, err := store.Get("foo", &actual)
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(foo{Bar: "baz"}, actual)
+
+		assert.NoError(store.Delete("foo"))
+		found, err = store.Get("foo", &actual)
+		assert.NoError(err)
+		assert.False(found)
+		assert.NoError(store.Delete("foo"))
+
+		assert.Equal(ErrEmptyKey, store.Set("", "bar"))
+		assert.Equal(ErrNilValue, store.Set("foo", nil))
+		_, err = store.Get("", &actual)
+		assert.Equal(ErrEmptyKey, err)
+		assert.Equal(ErrEmptyKey, store.Delete(""))
+
+		assert.NoError(store.Close())
+	}
+}
@@ -0,0 +1,231 @@
+// Package raftstore stores a hashicorp/raft log and stable state in
+// Bitcask.
+//
+// Store satisfies raft.StableStore structurally. raft.LogStore cannot be
+// implemented without depending on raft for its Log type, so Store
+// provides the same operations on encoded logs and a LogStore is a thin
+// wrapper in the application:
+//
+//	type logStore struct{ *raftstore.Store }
+//
+//	func (s logStore) GetLog(index uint64, log *raft.Log) error {
+//		data, err := s.GetLogData(index)
+//		if err == raftstore.ErrLogNotFound {
+//			return raft.ErrLogNotFound
+//		} else if err != nil {
+//			return err
+//		}
+//		return decode(data, log)
+//	}
+//
+//	func (s logStore) StoreLog(log *raft.Log) error {
+//		return s.StoreLogs([]*raft.Log{log})
+//	}
+//
+//	func (s logStore) StoreLogs(logs []*raft.Log) error {
+//		for _, log := range logs {
+//			data, err := encode(log)
+//			if err != nil {
+//				return err
+//			}
+//			if err := s.StoreLogData(log.Index, data); err != nil {
+//				return err
+//			}
+//		}
+//		return nil
+//	}
+//
+// with encode and decode using e.g. encoding/gob or msgpack.
+//
+// Logs are stored under sequenced keys (a prefix followed by the big endian
+// index) and log truncation deletes ranges of them, which the append-only
+// datafiles reclaim on Merge(). Raft logs can be large, so open the store
+// with a bitcask.WithMaxValueSize() suitable for the largest log.
+package raftstore
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/prologic/bitcask"
+)
+
+var (
+	// ErrKeyNotFound is the error returned by Get() and GetUint64() for a
+	// missing key. Its message is "not found" as raft relies on it.
+	ErrKeyNotFound = errors.New("not found")
+
+	// ErrLogNotFound is the error returned by GetLogData() for a missing
+	// log, the equivalent of raft.ErrLogNotFound
+	ErrLogNotFound = errors.New("log not found")
+)
+
+var (
+	logPrefix    = []byte("log/")
+	stablePrefix = []byte("stable/")
+)
+
+// Store is a raft log and stable store backed by a Bitcask database
+type Store struct {
+	db *bitcask.Bitcask
+
+	// mu guards the first and last index of the log, zero if empty
+	mu          sync.Mutex
+	first, last uint64
+}
+
+// Open opens the store at the given path, creating it if it does not exist
+func Open(path string, options ...bitcask.Option) (*Store, error) {
+	db, err := bitcask.Open(path, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// New returns a store over an already open database, which is closed by
+// Close()
+func New(db *bitcask.Bitcask) (*Store, error) {
+	s := &Store{db: db}
+
+	// Keys are scanned in order so the first and last logs are found
+	// without decoding all indexes
+	err := db.Scan(logPrefix, func(key []byte) error {
+		index := binary.BigEndian.Uint64(key[len(logPrefix):])
+		if s.first == 0 {
+			s.first = index
+		}
+		s.last = index
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func logKey(index uint64) []byte {
+	key := make([]byte, len(logPrefix)+8)
+	copy(key, logPrefix)
+	binary.BigEndian.PutUint64(key[len(logPrefix):], index)
+	return key
+}
+
+func stableKey(key []byte) []byte {
+	return append(append([]byte{}, stablePrefix...), key...)
+}
+
+// FirstIndex returns the first index written, or zero for no logs
+func (s *Store) FirstIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.first, nil
+}
+
+// LastIndex returns the last index written, or zero for no logs
+func (s *Store) LastIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, nil
+}
+
+// GetLogData returns the encoded log at the given index
+func (s *Store) GetLogData(index uint64) ([]byte, error) {
+	data, err := s.db.Get(logKey(index))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, ErrLogNotFound
+	}
+	return data, err
+}
+
+// StoreLogData stores the encoded log at the given index
+func (s *Store) StoreLogData(index uint64, data []byte) error {
+	if err := s.db.Put(logKey(index), data); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.first == 0 || index < s.first {
+		s.first = index
+	}
+	if index > s.last {
+		s.last = index
+	}
+	return nil
+}
+
+// DeleteRange deletes the logs from min to max inclusive
+func (s *Store) DeleteRange(min, max uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only indexes between first and last can exist
+	if min < s.first {
+		min = s.first
+	}
+	if max > s.last {
+		max = s.last
+	}
+	for index := min; index <= max && index != 0; index++ {
+		if err := s.db.Delete(logKey(index)); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case min <= s.first && max >= s.last:
+		s.first, s.last = 0, 0
+	case min <= s.first && max >= s.first:
+		s.first = max + 1
+	case max >= s.last && min <= s.last:
+		s.last = min - 1
+	}
+	return nil
+}
+
+// Set stores the value of a key of the stable store
+func (s *Store) Set(key, value []byte) error {
+	return s.db.Put(stableKey(key), value)
+}
+
+// Get returns the value of a key of the stable store
+func (s *Store) Get(key []byte) ([]byte, error) {
+	value, err := s.db.Get(stableKey(key))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+// SetUint64 stores the integer value of a key of the stable store
+func (s *Store) SetUint64(key []byte, value uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return s.Set(key, buf)
+}
+
+// GetUint64 returns the integer value of a key of the stable store
+func (s *Store) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, errors.New("error: value is not a uint64")
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
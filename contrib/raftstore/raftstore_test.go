@@ -0,0 +1,102 @@
+package raftstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	s, err := Open(testdir)
+	assert.NoError(err)
+
+	index := func() (uint64, uint64) {
+		first, err := s.FirstIndex()
+		assert.NoError(err)
+		last, err := s.LastIndex()
+		assert.NoError(err)
+		return first, last
+	}
+
+	t.Run("Log", func(t *testing.T) {
+		first, last := index()
+		assert.Equal(uint64(0), first)
+		assert.Equal(uint64(0), last)
+
+		for i := uint64(1); i <= 300; i++ {
+			assert.NoError(s.StoreLogData(i, []byte(fmt.Sprintf("log%d", i))))
+		}
+		first, last = index()
+		assert.Equal(uint64(1), first)
+		assert.Equal(uint64(300), last)
+
+		data, err := s.GetLogData(256)
+		assert.NoError(err)
+		assert.Equal([]byte("log256"), data)
+
+		_, err = s.GetLogData(301)
+		assert.Equal(ErrLogNotFound, err)
+	})
+
+	t.Run("DeleteRange", func(t *testing.T) {
+		// Compaction of the head of the log
+		assert.NoError(s.DeleteRange(1, 100))
+		first, last := index()
+		assert.Equal(uint64(101), first)
+		assert.Equal(uint64(300), last)
+		_, err := s.GetLogData(100)
+		assert.Equal(ErrLogNotFound, err)
+
+		// Truncation of conflicting entries at the tail of the log
+		assert.NoError(s.DeleteRange(251, 300))
+		first, last = index()
+		assert.Equal(uint64(101), first)
+		assert.Equal(uint64(250), last)
+	})
+
+	t.Run("Stable", func(t *testing.T) {
+		_, err := s.Get([]byte("CurrentTerm"))
+		assert.Equal("not found", err.Error())
+		_, err = s.GetUint64([]byte("CurrentTerm"))
+		assert.Equal(ErrKeyNotFound, err)
+
+		assert.NoError(s.SetUint64([]byte("CurrentTerm"), 42))
+		term, err := s.GetUint64([]byte("CurrentTerm"))
+		assert.NoError(err)
+		assert.Equal(uint64(42), term)
+
+		assert.NoError(s.Set([]byte("LastVoteCand"), []byte("node1")))
+		value, err := s.Get([]byte("LastVoteCand"))
+		assert.NoError(err)
+		assert.Equal([]byte("node1"), value)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(s.Close())
+		s, err = Open(testdir)
+		assert.NoError(err)
+
+		first, last := index()
+		assert.Equal(uint64(101), first)
+		assert.Equal(uint64(250), last)
+
+		term, err := s.GetUint64([]byte("CurrentTerm"))
+		assert.NoError(err)
+		assert.Equal(uint64(42), term)
+
+		assert.NoError(s.DeleteRange(0, 1000))
+		first, last = index()
+		assert.Equal(uint64(0), first)
+		assert.Equal(uint64(0), last)
+		assert.NoError(s.Close())
+	})
+}
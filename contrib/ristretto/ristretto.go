@@ -0,0 +1,107 @@
+// Package ristretto implements the method set of dgraph-io/ristretto's
+// Cache over Bitcask, for code written against a ristretto-like cache
+// interface such as:
+//
+//	type Cache interface {
+//		Get(key interface{}) (interface{}, bool)
+//		Set(key, value interface{}, cost int64) bool
+//		Del(key interface{})
+//	}
+//
+// Unlike ristretto, values are persisted rather than held in memory, so
+// they must be strings or byte slices and are returned as byte slices.
+// Keys may be strings, byte slices or integers. Costs are ignored as
+// nothing is ever evicted.
+package ristretto
+
+import (
+	"strconv"
+
+	"github.com/prologic/bitcask"
+)
+
+// Cache is a ristretto-like cache backed by a Bitcask database
+type Cache struct {
+	db *bitcask.Bitcask
+}
+
+// NewCache returns a cache over an already open database, which is closed
+// by Close()
+func NewCache(db *bitcask.Bitcask) *Cache {
+	return &Cache{db: db}
+}
+
+// Get returns the value of the key as a byte slice and true if it was
+// found, or nil and false otherwise
+func (c *Cache) Get(key interface{}) (interface{}, bool) {
+	k, ok := keyBytes(key)
+	if !ok {
+		return nil, false
+	}
+	value, err := c.db.Get(k)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// Set stores the value of the key and returns true, or false if the key or
+// value is of an unsupported type or it could not be stored
+func (c *Cache) Set(key, value interface{}, cost int64) bool {
+	k, ok := keyBytes(key)
+	if !ok {
+		return false
+	}
+
+	var v []byte
+	switch value := value.(type) {
+	case []byte:
+		v = value
+	case string:
+		v = []byte(value)
+	default:
+		return false
+	}
+
+	return c.db.Put(k, v) == nil
+}
+
+// Del deletes the key
+func (c *Cache) Del(key interface{}) {
+	if k, ok := keyBytes(key); ok {
+		c.db.Delete(k)
+	}
+}
+
+// Clear deletes all keys
+func (c *Cache) Clear() {
+	c.db.DeleteAll()
+}
+
+// Close closes the database
+func (c *Cache) Close() {
+	c.db.Close()
+}
+
+// keyBytes returns the key as bytes if it is of a supported type
+func keyBytes(key interface{}) ([]byte, bool) {
+	switch key := key.(type) {
+	case []byte:
+		return key, true
+	case string:
+		return []byte(key), true
+	case byte:
+		return []byte(strconv.FormatUint(uint64(key), 10)), true
+	case int:
+		return []byte(strconv.FormatInt(int64(key), 10)), true
+	case int32:
+		return []byte(strconv.FormatInt(int64(key), 10)), true
+	case int64:
+		return []byte(strconv.FormatInt(key, 10)), true
+	case uint32:
+		return []byte(strconv.FormatUint(uint64(key), 10)), true
+	case uint64:
+		return []byte(strconv.FormatUint(key, 10)), true
+	}
+	return nil, false
+}
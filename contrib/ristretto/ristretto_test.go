@@ -0,0 +1,47 @@
+package ristretto
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := bitcask.Open(testdir)
+	assert.NoError(err)
+	c := NewCache(db)
+	defer c.Close()
+
+	assert.True(c.Set("foo", "bar", 1))
+	assert.True(c.Set(42, []byte("baz"), 1))
+	assert.False(c.Set(1.5, "bar", 1))
+	assert.False(c.Set("foo", 42, 1))
+
+	value, found := c.Get("foo")
+	assert.True(found)
+	assert.Equal([]byte("bar"), value)
+
+	// Integer keys of different types are the same key
+	value, found = c.Get(uint64(42))
+	assert.True(found)
+	assert.Equal([]byte("baz"), value)
+
+	c.Del("foo")
+	_, found = c.Get("foo")
+	assert.False(found)
+
+	c.Clear()
+	_, found = c.Get(42)
+	assert.False(found)
+	assert.Equal(0, db.Len())
+}
@@ -0,0 +1,76 @@
+// Package session implements an alexedwards/scs session store over
+// Bitcask, satisfying its Store and IterableStore interfaces:
+//
+//	type Store interface {
+//		Delete(token string) (err error)
+//		Find(token string) (b []byte, found bool, err error)
+//		Commit(token string, b []byte, expiry time.Time) (err error)
+//	}
+//
+// Sessions expire using the per-key expiry of the cache package.
+package session
+
+import (
+	"time"
+
+	"github.com/prologic/bitcask"
+	"github.com/prologic/bitcask/contrib/cache"
+)
+
+// DefaultPrefix is the default key prefix of the sessions
+const DefaultPrefix = "session/"
+
+// Store is a session store backed by a Bitcask database
+type Store struct {
+	cache *cache.Store
+}
+
+// New returns a session store keeping sessions under DefaultPrefix in an
+// already open database
+func New(db *bitcask.Bitcask) *Store {
+	return NewWithPrefix(db, DefaultPrefix)
+}
+
+// NewWithPrefix returns a session store keeping sessions under the given
+// key prefix in an already open database
+func NewWithPrefix(db *bitcask.Bitcask, prefix string) *Store {
+	return &Store{cache: cache.New(db, []byte(prefix))}
+}
+
+// Find returns the data of the session with the given token, found is
+// false if it does not exist or has expired
+func (s *Store) Find(token string) ([]byte, bool, error) {
+	b, err := s.cache.Get([]byte(token))
+	if err == cache.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Commit stores the data of the session with the given token until its
+// expiry
+func (s *Store) Commit(token string, b []byte, expiry time.Time) error {
+	ttl := time.Until(expiry)
+	if ttl <= 0 {
+		return s.Delete(token)
+	}
+	return s.cache.Set([]byte(token), b, ttl)
+}
+
+// Delete deletes the session with the given token
+func (s *Store) Delete(token string) error {
+	return s.cache.Delete([]byte(token))
+}
+
+// All returns the data of all sessions that have not expired by token
+func (s *Store) All() (map[string][]byte, error) {
+	return s.cache.All()
+}
+
+// Sweep deletes all expired sessions, which should be done periodically
+func (s *Store) Sweep() (int, error) {
+	return s.cache.Sweep()
+}
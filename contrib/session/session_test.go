@@ -0,0 +1,57 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := bitcask.Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	s := New(db)
+
+	assert.NoError(s.Commit("token1", []byte("data1"), time.Now().Add(time.Hour)))
+	assert.NoError(s.Commit("token2", []byte("data2"), time.Now().Add(50*time.Millisecond)))
+
+	b, found, err := s.Find("token1")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]byte("data1"), b)
+
+	all, err := s.All()
+	assert.NoError(err)
+	assert.Len(all, 2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, found, err = s.Find("token2")
+	assert.NoError(err)
+	assert.False(found)
+
+	// Committing an expired session deletes it
+	assert.NoError(s.Commit("token1", []byte("data1"), time.Now().Add(-time.Second)))
+	_, found, err = s.Find("token1")
+	assert.NoError(err)
+	assert.False(found)
+
+	assert.NoError(s.Commit("token3", []byte("data3"), time.Now().Add(time.Hour)))
+	assert.NoError(s.Delete("token3"))
+	_, found, err = s.Find("token3")
+	assert.NoError(err)
+	assert.False(found)
+	assert.Equal(0, db.Len())
+}
@@ -0,0 +1,51 @@
+package bitcask
+
+import (
+	"sync/atomic"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// Corruption describes corrupted data found by a database, see
+// WithCorruptionHandler()
+type Corruption = internal.Corruption
+
+// CorruptionPolicy is what a database does once it finds corrupted data,
+// see WithCorruptionPolicy()
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail fails the operation that found the corrupted data with
+	// an error such as ErrChecksumFailed or ErrCorrupted (the default)
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionDegrade carries on as if keys with corrupted data did not
+	// exist: reads return ErrKeyNotFound and Merge() drops them. The number
+	// of corruptions found is reported by Stats().
+	CorruptionDegrade
+	// CorruptionPanic panics with a *Corruption
+	CorruptionPanic
+)
+
+// onCorruption handles the corrupted entry of the key found with `err` as
+// per the configured policy, returning the error the operation fails with
+func (b *Bitcask) onCorruption(key []byte, item internal.Item, err error) error {
+	atomic.AddUint64(&b.corruptions, 1)
+
+	c := Corruption{
+		Key:    append([]byte(nil), key...),
+		FileID: item.FileID,
+		Offset: item.Offset,
+		Err:    err,
+	}
+	if b.config.CorruptionHandler != nil {
+		b.config.CorruptionHandler(c)
+	}
+
+	switch CorruptionPolicy(b.config.CorruptionPolicy) {
+	case CorruptionDegrade:
+		return ErrKeyNotFound
+	case CorruptionPanic:
+		panic(&c)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package bitcask
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+)
+
+// DebugHandlers returns a http.ServeMux serving the standard pprof profiles
+// under /debug/pprof/ as well as database specific debug pages under
+// /debug/bitcask/. It is intended to be served on a private listener by
+// server modes such as bitcaskd.
+func (b *Bitcask) DebugHandlers() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/debug/bitcask/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := b.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, stats)
+	})
+
+	mux.HandleFunc("/debug/bitcask/config", func(w http.ResponseWriter, r *http.Request) {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		writeJSON(w, b.config)
+	})
+
+	mux.HandleFunc("/debug/bitcask/schemas", func(w http.ResponseWriter, r *http.Request) {
+		schemas := make(map[string]interface{})
+		for prefix, schema := range b.Schemas() {
+			if _, ok := schema.(json.Marshaler); ok {
+				schemas[prefix] = schema
+			} else {
+				schemas[prefix] = fmt.Sprintf("%T", schema)
+			}
+		}
+		writeJSON(w, schemas)
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
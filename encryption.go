@@ -0,0 +1,130 @@
+package bitcask
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/config"
+)
+
+// encryptionCheck is the plaintext of config.EncryptionCheck
+var encryptionCheck = []byte("bitcask")
+
+var errDecrypt = errors.New("error: decrypting value failed")
+
+// openEncryption returns the AEAD encrypting the values of the database as
+// configured with WithEncryption(), nil if it is not encrypted. The key is
+// checked against the encryption check of the configuration which is set
+// for a new encrypted database.
+func openEncryption(path string, cfg *config.Config) (cipher.AEAD, error) {
+	if len(cfg.EncryptionKey) == 0 {
+		if len(cfg.EncryptionCheck) > 0 {
+			return nil, ErrInvalidEncryptionKey
+		}
+		return nil, nil
+	}
+
+	block, err := aes.NewCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEncryptionKey, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.EncryptionCheck) > 0 {
+		check, err := unseal(aead, cfg.EncryptionCheck)
+		if err != nil || !bytes.Equal(check, encryptionCheck) {
+			return nil, ErrInvalidEncryptionKey
+		}
+		return aead, nil
+	}
+
+	empty, err := hasNoData(cfg.FS(), path)
+	if err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, ErrEncryptionMismatch
+	}
+	if cfg.EncryptionCheck, err = seal(aead, encryptionCheck); err != nil {
+		return nil, err
+	}
+	return aead, nil
+}
+
+// hasNoData returns true if all datafiles in `path` are empty
+func hasNoData(fsys fs.FileSystem, path string) (bool, error) {
+	fns, err := internal.GetDatafiles(fsys, path)
+	if err != nil {
+		return false, err
+	}
+	for _, fn := range fns {
+		stat, err := fsys.Stat(fn)
+		if err != nil {
+			return false, err
+		}
+		if stat.Size() > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// maxValueSize returns the maximum size of values written to the database,
+// leaving room for the nonce and tag of encrypted values
+func (b *Bitcask) maxValueSize() uint64 {
+	if b.aead == nil {
+		return b.config.MaxValueSize
+	}
+	overhead := uint64(b.aead.NonceSize() + b.aead.Overhead())
+	if b.config.MaxValueSize < overhead {
+		return 0
+	}
+	return b.config.MaxValueSize - overhead
+}
+
+// encrypt encrypts the value if the database is encrypted
+func (b *Bitcask) encrypt(value []byte) ([]byte, error) {
+	if b.aead == nil {
+		return value, nil
+	}
+	return seal(b.aead, value)
+}
+
+// decrypt decrypts the value if the database is encrypted
+func (b *Bitcask) decrypt(value []byte) ([]byte, error) {
+	if b.aead == nil || len(value) == 0 {
+		return value, nil
+	}
+	return unseal(b.aead, value)
+}
+
+// seal encrypts the plaintext prefixing it with a random nonce
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts a ciphertext sealed by seal()
+func unseal(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errDecrypt
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,228 @@
+package bitcask
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+)
+
+// EvictionPolicy is what a database does once a write would take it over
+// its limits, see WithMaxDatastoreSize() and WithMaxKeys()
+type EvictionPolicy int
+
+const (
+	// EvictNone rejects the write with ErrDatabaseFull (the default)
+	EvictNone EvictionPolicy = iota
+	// EvictOldest deletes the keys written the longest ago until the
+	// database is within its limits again
+	EvictOldest
+	// EvictLRU deletes the keys written or read the longest ago until the
+	// database is within its limits again
+	EvictLRU
+)
+
+// evictor orders the keys of a database for eviction. The order is kept in
+// memory only: once reopened keys are ordered by the position of their
+// entries in the datafiles, which merges may reorder.
+type evictor struct {
+	mu    sync.Mutex
+	lru   bool
+	order *list.List // of keys, the next to evict first
+	elems map[string]*list.Element
+}
+
+func newEvictor(policy EvictionPolicy) *evictor {
+	return &evictor{
+		lru:   policy == EvictLRU,
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+// add moves the key written last in the order
+func (ev *evictor) add(key []byte) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	if elem, ok := ev.elems[string(key)]; ok {
+		ev.order.MoveToBack(elem)
+		return
+	}
+	k := string(key)
+	ev.elems[k] = ev.order.PushBack(k)
+}
+
+// read moves the key read last in the order of the LRU policy
+func (ev *evictor) read(key []byte) {
+	if ev == nil || !ev.lru {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	if elem, ok := ev.elems[string(key)]; ok {
+		ev.order.MoveToBack(elem)
+	}
+}
+
+func (ev *evictor) remove(key []byte) {
+	if ev == nil {
+		return
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	if elem, ok := ev.elems[string(key)]; ok {
+		ev.order.Remove(elem)
+		delete(ev.elems, string(key))
+	}
+}
+
+// load orders the keys of the index by the position of their entries
+func (ev *evictor) load(t art.Tree) {
+	if ev == nil {
+		return
+	}
+
+	type keyItem struct {
+		key  string
+		item internal.Item
+	}
+	keys := make([]keyItem, 0, t.Size())
+	t.ForEach(func(node art.Node) bool {
+		keys = append(keys, keyItem{string(node.Key()), node.Value().(internal.Item)})
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i].item, keys[j].item
+		if a.FileID != b.FileID {
+			return a.FileID < b.FileID
+		}
+		return a.Offset < b.Offset
+	})
+
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.order.Init()
+	ev.elems = make(map[string]*list.Element, len(keys))
+	for _, k := range keys {
+		ev.elems[k.key] = ev.order.PushBack(k.key)
+	}
+}
+
+// next returns the next key to evict but those to keep, nil if none
+func (ev *evictor) next(keep map[string]bool) []byte {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+
+	for elem := ev.order.Front(); elem != nil; elem = elem.Next() {
+		if k := elem.Value.(string); !keep[k] {
+			return []byte(k)
+		}
+	}
+	return nil
+}
+
+// limited returns whether the database has a size or key limit
+func (b *Bitcask) limited() bool {
+	return b.config.MaxDatastoreSize > 0 || b.config.MaxKeys > 0
+}
+
+// overLimits returns whether the database holds more keys or live bytes
+// than its limits
+func (b *Bitcask) overLimits() bool {
+	if max := b.config.MaxKeys; max > 0 && b.trie.Size() > max {
+		return true
+	}
+	if max := b.config.MaxDatastoreSize; max > 0 && atomic.LoadInt64(&b.liveBytes) > max {
+		return true
+	}
+	return false
+}
+
+// checkLimits returns ErrDatabaseFull if writing the encoded entries would
+// take the database over its limits without evicting keys. Writes that do
+// not grow the database are always allowed. The caller must hold the write
+// lock with no Put() in flight, see quiesce().
+func (b *Bitcask) checkLimits(entries []internal.Entry) error {
+	if !b.limited() || b.evictor != nil {
+		return nil
+	}
+
+	keys, size := b.trie.Size(), atomic.LoadInt64(&b.liveBytes)
+	newKeys, newSize := keys, size
+	// written is the size of the keys written by the entries so far, -1 if
+	// deleted
+	written := make(map[string]int64, len(entries))
+	for _, e := range entries {
+		old, ok := written[string(e.Key)]
+		if !ok {
+			old = -1
+			if value, found := b.trie.Search(e.Key); found {
+				old = value.(internal.Item).Size
+			}
+		}
+		if old >= 0 {
+			newKeys--
+			newSize -= old
+		}
+
+		n := int64(-1)
+		if len(e.Value) > 0 {
+			n = b.format().EntrySize(uint64(len(e.Key)), uint64(len(e.Value)), e.Expiry)
+			newKeys++
+			newSize += n
+		}
+		written[string(e.Key)] = n
+	}
+
+	if max := b.config.MaxKeys; max > 0 && newKeys > max && newKeys > keys {
+		return ErrDatabaseFull
+	}
+	if max := b.config.MaxDatastoreSize; max > 0 && newSize > max && newSize > size {
+		return ErrDatabaseFull
+	}
+	return nil
+}
+
+// evict deletes keys in the order of the eviction policy until the database
+// is within its limits again, but the keys just written. The caller must
+// hold the write lock.
+func (b *Bitcask) evict(written ...[]byte) error {
+	if b.evictor == nil || !b.overLimits() {
+		return nil
+	}
+	b.quiesce()
+
+	keep := make(map[string]bool, len(written))
+	for _, key := range written {
+		keep[string(key)] = true
+	}
+	for b.overLimits() {
+		key := b.evictor.next(keep)
+		if key == nil {
+			return nil
+		}
+
+		// Evicted keys skip the trash, they are gone for good
+		offset, n, err := b.put(key, []byte{})
+		if err != nil {
+			return err
+		}
+		if old, deleted := b.trie.Delete(key); deleted {
+			b.untrackSizes(key, old.(internal.Item))
+			b.notifyDelete(key, Seq{FileID: b.curr.FileID(), Offset: offset + n})
+		} else {
+			b.evictor.remove(key)
+		}
+		atomic.AddUint64(&b.evictions, 1)
+	}
+	return nil
+}
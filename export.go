@@ -0,0 +1,273 @@
+package bitcask
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Format is the format of the key/value pairs written by Export() and read
+// by Import()
+type Format int
+
+const (
+	// FormatJSON writes one JSON object per line (newline-delimited JSON)
+	// with the key, the value and, if any, the origin and the expiry of a
+	// pair. Keys and values are base64 encoded as per encoding/json.
+	FormatJSON Format = iota
+	// FormatCSV writes a `key,value,origin,expiry` header followed by one
+	// record per pair. Keys and values are base64 encoded, origins are
+	// decimal and expiries RFC 3339 times, both empty if not set.
+	FormatCSV
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatCSV:
+		return "csv"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// ImportMode is how Import() treats the keys already in the database
+type ImportMode int
+
+const (
+	// ImportMerge keeps the keys of the database that are not imported and
+	// overwrites the values of those that are
+	ImportMerge ImportMode = iota
+	// ImportReplace deletes the keys of the database that are not imported
+	// once the import is done, so the database holds exactly the imported
+	// keys
+	ImportReplace
+)
+
+var (
+	// ErrUnsupportedFormat is the error returned by Export() and Import()
+	// with an unknown format
+	ErrUnsupportedFormat = errors.New("error: unsupported export format")
+
+	csvHeader = []string{"key", "value", "origin", "expiry"}
+)
+
+// exportedPair is a key/value pair as written by Export()
+type exportedPair struct {
+	Key    []byte     `json:"key"`
+	Value  []byte     `json:"value"`
+	Origin uint32     `json:"origin,omitempty"`
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// Export writes all keys and values of the database to `w` in the given
+// format, which can be read back with Import(). Unlike Backup() the export
+// doesn't depend on the on-disk format, so it can be used to migrate
+// between formats or to other stores. The keys are exported as they were
+// when the export started, as with Snapshot().
+func (b *Bitcask) Export(w io.Writer, format Format) error {
+	bw := bufio.NewWriter(w)
+
+	var write func(pair *exportedPair) error
+	flush := bw.Flush
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(bw)
+		write = func(pair *exportedPair) error {
+			return enc.Encode(pair)
+		}
+	case FormatCSV:
+		cw := csv.NewWriter(bw)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		flush = func() error {
+			if cw.Flush(); cw.Error() != nil {
+				return cw.Error()
+			}
+			return bw.Flush()
+		}
+		write = func(pair *exportedPair) error {
+			record := []string{
+				base64.StdEncoding.EncodeToString(pair.Key),
+				base64.StdEncoding.EncodeToString(pair.Value),
+				"",
+				"",
+			}
+			if pair.Origin != 0 {
+				record[2] = strconv.FormatUint(uint64(pair.Origin), 10)
+			}
+			if pair.Expiry != nil {
+				record[3] = pair.Expiry.Format(time.RFC3339Nano)
+			}
+			return cw.Write(record)
+		}
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	b.mu.RLock()
+	s := b.snapshot(nil)
+	b.mu.RUnlock()
+	defer s.release()
+
+	for i, key := range s.keys {
+		b.reads.background()
+		e, err := s.entry(i, true)
+		if err == ErrKeyNotFound {
+			// Corrupted and skipped as per the corruption policy
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		value, err := b.value(e)
+		if err != nil {
+			return err
+		}
+
+		pair := exportedPair{Key: key, Value: value, Origin: e.Origin}
+		if e.Expiry != 0 {
+			expiry := time.Unix(0, e.Expiry).UTC()
+			pair.Expiry = &expiry
+		}
+		if err := write(&pair); err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+// Import reads the key/value pairs written by Export() in the given format
+// from `r` and stores them in the database, merging them with the keys of
+// the database. It is ImportWithMode() with ImportMerge.
+func (b *Bitcask) Import(r io.Reader, format Format) error {
+	return b.ImportWithMode(r, format, ImportMerge)
+}
+
+// ImportWithMode reads the key/value pairs written by Export() in the given
+// format from `r` and stores them in the database, overwriting the values of
+// keys that exist, and with ImportReplace deletes the other keys the
+// database had before the import once it is done. Pairs that expired since
+// they were exported are skipped. On error the pairs read up to the error
+// are stored but no key is deleted.
+func (b *Bitcask) ImportWithMode(r io.Reader, format Format, mode ImportMode) error {
+	var read func(pair *exportedPair) error
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(r)
+		read = func(pair *exportedPair) error {
+			return dec.Decode(pair)
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i := range csvHeader {
+			if header[i] != csvHeader[i] {
+				return fmt.Errorf("error: invalid CSV header %q", header)
+			}
+		}
+		read = func(pair *exportedPair) error {
+			record, err := cr.Read()
+			if err != nil {
+				return err
+			}
+			return parseCSVPair(record, pair)
+		}
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	var (
+		s        *snapshot
+		imported map[string]struct{}
+	)
+	if mode == ImportReplace {
+		b.mu.RLock()
+		s = b.snapshot(nil)
+		b.mu.RUnlock()
+		defer s.release()
+		imported = make(map[string]struct{})
+	}
+
+	for {
+		var pair exportedPair
+		if err := read(&pair); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if imported != nil {
+			imported[string(pair.Key)] = struct{}{}
+		}
+		if err := b.importPair(&pair); err != nil {
+			return err
+		}
+	}
+
+	if s != nil {
+		for _, key := range s.keys {
+			if _, ok := imported[string(key)]; ok {
+				continue
+			}
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importPair stores an imported key/value pair
+func (b *Bitcask) importPair(pair *exportedPair) error {
+	// Pairs without metadata are stored with the metadata of this database
+	if pair.Origin == 0 && pair.Expiry == nil {
+		return b.Put(pair.Key, pair.Value)
+	}
+
+	meta := Meta{Origin: pair.Origin}
+	if pair.Expiry != nil {
+		if !pair.Expiry.After(b.now()) {
+			return nil
+		}
+		meta.Expiry = *pair.Expiry
+	}
+	return b.PutWithMeta(pair.Key, pair.Value, meta)
+}
+
+// parseCSVPair parses a CSV record written by Export()
+func parseCSVPair(record []string, pair *exportedPair) (err error) {
+	if pair.Key, err = base64.StdEncoding.DecodeString(record[0]); err != nil {
+		return fmt.Errorf("error: invalid CSV key %q: %w", record[0], err)
+	}
+	if pair.Value, err = base64.StdEncoding.DecodeString(record[1]); err != nil {
+		return fmt.Errorf("error: invalid CSV value of key %q: %w", pair.Key, err)
+	}
+	if record[2] != "" {
+		origin, err := strconv.ParseUint(record[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("error: invalid CSV origin of key %q: %w", pair.Key, err)
+		}
+		pair.Origin = uint32(origin)
+	}
+	if record[3] != "" {
+		expiry, err := time.Parse(time.RFC3339Nano, record[3])
+		if err != nil {
+			return fmt.Errorf("error: invalid CSV expiry of key %q: %w", pair.Key, err)
+		}
+		pair.Expiry = &expiry
+	}
+	return nil
+}
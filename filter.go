@@ -0,0 +1,152 @@
+package bitcask
+
+import (
+	"sync"
+	"sync/atomic"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/filter"
+	"github.com/prologic/bitcask/internal"
+)
+
+// BuildFilter returns a bloom filter of all live keys with the given false
+// positive rate, which can be marshalled and queried without the database,
+// see the filter package. Keys written after the call are not in the filter.
+func (b *Bitcask) BuildFilter(fpr float64) (*filter.Filter, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	f, err := filter.New(b.trie.Size(), fpr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := b.now().UnixNano()
+	b.trie.ForEach(func(node art.Node) bool {
+		// Skip the root node
+		if len(node.Key()) == 0 {
+			return true
+		}
+		if !node.Value().(internal.Item).Expired(now) {
+			f.Add(node.Key())
+		}
+		return true
+	})
+	return f, nil
+}
+
+// bloomMinKeys is the minimum number of keys the filter of WithBloomFilter()
+// is sized for
+const bloomMinKeys = 1024
+
+// bloom is the filter of the keys in the index kept with WithBloomFilter(),
+// so lookups of missing keys skip the index and its lock. Deleted keys stay
+// in the filter until it is rebuilt, which happens as it fills up and after
+// merges. A nil bloom contains all keys.
+type bloom struct {
+	// checks, negatives and falsePositives are accessed atomically and
+	// must stay 64-bit aligned (first in the struct) for 32-bit platforms
+	checks         uint64
+	negatives      uint64
+	falsePositives uint64
+
+	fpr float64
+
+	// mu guards the filter, which is only written to with the database's
+	// write lock held
+	mu       sync.RWMutex
+	filter   *filter.Filter
+	capacity int
+	keys     int
+}
+
+// mayContain returns false if the key is certainly not in the index
+func (bf *bloom) mayContain(key []byte) bool {
+	if bf == nil {
+		return true
+	}
+
+	atomic.AddUint64(&bf.checks, 1)
+	bf.mu.RLock()
+	found := bf.filter.Contains(key)
+	bf.mu.RUnlock()
+	if !found {
+		atomic.AddUint64(&bf.negatives, 1)
+	}
+	return found
+}
+
+// missed records a lookup of a key the filter may contain that was not
+// found, i.e. whether it was a false positive
+func (bf *bloom) missed(found bool) {
+	if bf != nil && !found {
+		atomic.AddUint64(&bf.falsePositives, 1)
+	}
+}
+
+// reset empties the filter sized for n keys
+func (bf *bloom) reset(n int) {
+	if n < bloomMinKeys {
+		n = bloomMinKeys
+	}
+	// The rate is checked by WithBloomFilter()
+	f, _ := filter.New(n, bf.fpr)
+
+	bf.mu.Lock()
+	bf.filter, bf.capacity, bf.keys = f, n, 0
+	bf.mu.Unlock()
+}
+
+// add adds the key to the filter, reporting false if it is full
+func (bf *bloom) add(key []byte) bool {
+	if bf.keys >= bf.capacity {
+		return false
+	}
+
+	bf.mu.Lock()
+	bf.filter.Add(key)
+	bf.keys++
+	bf.mu.Unlock()
+	return true
+}
+
+// addBloom adds the key to the filter of the keys in the index, if any,
+// rebuilding it twice as large once full. The key must already be in the
+// index and the caller must hold the write lock.
+func (b *Bitcask) addBloom(key []byte) {
+	if b.bloom != nil && !b.bloom.add(key) {
+		b.rebuildBloom(2 * b.trie.Size())
+	}
+}
+
+// rebuildBloom rebuilds the filter of the keys in the index, if any, sized
+// for at least n keys. The caller must hold the write lock.
+func (b *Bitcask) rebuildBloom(n int) {
+	if b.bloom == nil {
+		return
+	}
+
+	b.bloom.reset(n)
+	b.trie.ForEach(func(node art.Node) bool {
+		// Skip the root node
+		if len(node.Key()) > 0 {
+			b.bloom.add(node.Key())
+		}
+		return true
+	})
+}
+
+// bloomStats sets the statistics of the filter of the keys in the index
+func (b *Bitcask) bloomStats(stats *Stats) {
+	if b.bloom == nil {
+		return
+	}
+
+	stats.BloomFilterChecks = atomic.LoadUint64(&b.bloom.checks)
+	stats.BloomFilterNegatives = atomic.LoadUint64(&b.bloom.negatives)
+	stats.BloomFilterFalsePositives = atomic.LoadUint64(&b.bloom.falsePositives)
+	b.bloom.mu.RLock()
+	stats.BloomFilterKeys = b.bloom.keys
+	stats.BloomFilterBytes = b.bloom.filter.Size()
+	b.bloom.mu.RUnlock()
+}
@@ -0,0 +1,123 @@
+// Package filter implements a serializable bloom filter of keys, as built by
+// Bitcask.BuildFilter(), so frontends can tell keys that are certainly not
+// in a database without querying it.
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+var (
+	// ErrInvalidRate is the error returned if the false positive rate is not
+	// between 0 and 1 (both exclusive)
+	ErrInvalidRate = errors.New("error: invalid false positive rate")
+
+	// ErrInvalidFilter is the error returned when unmarshalling data that is
+	// not a valid filter
+	ErrInvalidFilter = errors.New("error: invalid filter")
+)
+
+// magic identifies marshalled filters, followed by the version of their
+// encoding
+const (
+	magic   = "BCBF"
+	version = 1
+
+	headerSize = len(magic) + 1 + 4 + 8
+)
+
+// Filter is a bloom filter: Contains() is true for all keys added and false
+// for other keys with the probability of the false positive rate it was
+// created with. It is not safe for concurrent writes.
+type Filter struct {
+	k    uint32
+	m    uint64
+	bits []uint64
+}
+
+// New returns an empty filter sized for n keys and the given false positive
+// rate
+func New(n int, fpr float64) (*Filter, error) {
+	if !(fpr > 0 && fpr < 1) {
+		return nil, ErrInvalidRate
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpr) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Filter{k: k, m: m, bits: make([]uint64, (m+63)/64)}, nil
+}
+
+// hashes returns the two hashes of the key the k hashes are derived from
+func hashes(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return sum & math.MaxUint32, sum>>32 | 1
+}
+
+// Add adds the key to the filter
+func (f *Filter) Add(key []byte) {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains returns false if the key was certainly not added to the filter
+func (f *Filter) Contains(key []byte) bool {
+	h1, h2 := hashes(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the size of the filter in memory in bytes
+func (f *Filter) Size() int {
+	return 8 * len(f.bits)
+}
+
+// MarshalBinary encodes the filter
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	data := make([]byte, headerSize+8*len(f.bits))
+	copy(data, magic)
+	data[len(magic)] = version
+	binary.BigEndian.PutUint32(data[len(magic)+1:], f.k)
+	binary.BigEndian.PutUint64(data[len(magic)+5:], f.m)
+	for i, word := range f.bits {
+		binary.BigEndian.PutUint64(data[headerSize+8*i:], word)
+	}
+	return data, nil
+}
+
+// UnmarshalBinary decodes a filter encoded by MarshalBinary()
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize || string(data[:len(magic)]) != magic || data[len(magic)] != version {
+		return ErrInvalidFilter
+	}
+	k := binary.BigEndian.Uint32(data[len(magic)+1:])
+	m := binary.BigEndian.Uint64(data[len(magic)+5:])
+	if k == 0 || m == 0 || uint64(len(data)-headerSize) != (m+63)/64*8 {
+		return ErrInvalidFilter
+	}
+
+	f.k, f.m = k, m
+	f.bits = make([]uint64, (m+63)/64)
+	for i := range f.bits {
+		f.bits[i] = binary.BigEndian.Uint64(data[headerSize+8*i:])
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	_, err := New(10, 0)
+	assert.Equal(ErrInvalidRate, err)
+	_, err = New(10, 1)
+	assert.Equal(ErrInvalidRate, err)
+
+	const n = 10000
+	f, err := New(n, 0.01)
+	require.NoError(err)
+	for i := 0; i < n; i++ {
+		f.Add([]byte(fmt.Sprintf("key%d", i)))
+	}
+
+	data, err := f.MarshalBinary()
+	require.NoError(err)
+	assert.Equal(len(data)-headerSize, f.Size())
+	var g Filter
+	require.NoError(g.UnmarshalBinary(data))
+
+	for i := 0; i < n; i++ {
+		assert.True(g.Contains([]byte(fmt.Sprintf("key%d", i))))
+	}
+	var positives int
+	for i := 0; i < n; i++ {
+		if g.Contains([]byte(fmt.Sprintf("missing%d", i))) {
+			positives++
+		}
+	}
+	assert.True(positives < n*2/100)
+
+	assert.Equal(ErrInvalidFilter, g.UnmarshalBinary(data[:len(data)-1]))
+	assert.Equal(ErrInvalidFilter, g.UnmarshalBinary([]byte("nope")))
+}
@@ -0,0 +1,17 @@
+//go:build !wasm && !windows
+// +build !wasm,!windows
+
+package bitcask
+
+import (
+	"github.com/gofrs/flock"
+)
+
+// Flock is the lock file held by an open database
+type Flock struct {
+	*flock.Flock
+}
+
+func newFlock(path string) *Flock {
+	return &Flock{flock.New(path)}
+}
@@ -0,0 +1,87 @@
+package bitcask
+
+import (
+	"sync"
+)
+
+// WebAssembly runtimes (js and wasip1) have no file locking, so the lock
+// file only guards against opening a database twice in the same process.
+// locks holds the number of shared locks of every lock file, -1 if it is
+// locked exclusively.
+var (
+	locksMu sync.Mutex
+	locks   = make(map[string]int)
+)
+
+// Flock is the lock file held by an open database
+type Flock struct {
+	path    string
+	locked  bool
+	rlocked bool
+}
+
+func newFlock(path string) *Flock {
+	return &Flock{path: path}
+}
+
+// Path returns the path of the lock file
+func (f *Flock) Path() string {
+	return f.path
+}
+
+// Locked returns whether the lock is held
+func (f *Flock) Locked() bool {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+	return f.locked
+}
+
+// TryLock takes the lock if it is not already held
+func (f *Flock) TryLock() (bool, error) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if f.locked {
+		return true, nil
+	}
+	if locks[f.path] != 0 {
+		return false, nil
+	}
+	locks[f.path] = -1
+	f.locked = true
+	return true, nil
+}
+
+// TryRLock takes a shared lock if the lock is not held exclusively
+func (f *Flock) TryRLock() (bool, error) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if f.locked || f.rlocked {
+		return true, nil
+	}
+	if locks[f.path] < 0 {
+		return false, nil
+	}
+	locks[f.path]++
+	f.rlocked = true
+	return true, nil
+}
+
+// Unlock releases the lock
+func (f *Flock) Unlock() error {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if f.locked {
+		delete(locks, f.path)
+		f.locked = false
+	}
+	if f.rlocked {
+		if locks[f.path]--; locks[f.path] == 0 {
+			delete(locks, f.path)
+		}
+		f.rlocked = false
+	}
+	return nil
+}
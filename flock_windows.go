@@ -0,0 +1,115 @@
+package bitcask
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/prologic/bitcask/fs"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+
+	// lockOffsetHigh is the high 32 bits of the offset of the byte locked
+	// in the lock file. Windows locks are mandatory, locking a byte far past
+	// the contents of the lock file leaves them readable and writable by
+	// other processes.
+	lockOffsetHigh = 1<<31 - 1
+)
+
+// Flock is the lock file held by an open database, locked with LockFileEx
+type Flock struct {
+	mu      sync.Mutex
+	path    string
+	fh      *os.File
+	locked  bool
+	rlocked bool
+}
+
+func newFlock(path string) *Flock {
+	return &Flock{path: path}
+}
+
+// Path returns the path of the lock file
+func (f *Flock) Path() string {
+	return f.path
+}
+
+// Locked returns whether the lock is held
+func (f *Flock) Locked() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.locked
+}
+
+// TryLock takes the lock if it is not already held
+func (f *Flock) TryLock() (bool, error) {
+	return f.try(lockfileExclusiveLock, &f.locked)
+}
+
+// TryRLock takes a shared lock if the lock is not held exclusively
+func (f *Flock) TryRLock() (bool, error) {
+	return f.try(0, &f.rlocked)
+}
+
+func (f *Flock) try(flags uintptr, held *bool) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.locked || f.rlocked {
+		return *held, nil
+	}
+
+	if f.fh == nil {
+		// Shared for deletion so a stale lock file can be replaced
+		fh, err := fs.OS.OpenFile(f.path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return false, err
+		}
+		f.fh = fh.(*os.File)
+	}
+
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procLockFileEx.Call(f.fh.Fd(), flags|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		f.fh.Close()
+		f.fh = nil
+		if err == errorLockViolation {
+			return false, nil
+		}
+		return false, err
+	}
+	*held = true
+	return true, nil
+}
+
+// Unlock releases the lock
+func (f *Flock) Unlock() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.locked && !f.rlocked {
+		return nil
+	}
+
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	if r, _, err := procUnlockFileEx.Call(f.fh.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&ol))); r == 0 {
+		return err
+	}
+	f.locked, f.rlocked = false, false
+
+	err := f.fh.Close()
+	f.fh = nil
+	return err
+}
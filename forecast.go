@@ -0,0 +1,224 @@
+package bitcask
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+const (
+	// forecastPoints is the number of points of a forecast
+	forecastPoints = 30
+
+	// forecastMinWindow is how long the database must have been open for
+	// Forecast() to estimate the rates from its own writes rather than
+	// from the datafiles
+	forecastMinWindow = time.Minute
+
+	// forecastMaxSteps limits the number of automatic merges simulated, a
+	// shorter merge interval is simulated as merging every step
+	forecastMaxSteps = 100000
+)
+
+// Forecast is the disk usage of a database forecast by Forecast()
+type Forecast struct {
+	// WriteRate is the number of bytes written per second the forecast
+	// assumes, LiveGrowthRate and DeadGrowthRate how fast the live and dead
+	// bytes (see Stats()) grow
+	WriteRate      float64
+	LiveGrowthRate float64
+	DeadGrowthRate float64
+
+	// Points is the forecast disk usage at regular intervals, starting with
+	// the current one
+	Points []ForecastPoint
+	// Merges is the number of automatic merges forecast (see
+	// WithAutoMerge()), without them the dead bytes are never reclaimed
+	Merges int
+	// PeakSize is the largest size forecast, including the space merges
+	// need while they copy the live bytes
+	PeakSize int64
+
+	// FreeSpace is the free disk space of the file system of the database
+	// and DiskFull when the forecast size exceeds it, zero if not within the
+	// forecast or the free disk space is unknown
+	FreeSpace uint64
+	DiskFull  time.Time
+}
+
+// ForecastPoint is the forecast disk usage of a database at a point in time
+type ForecastPoint struct {
+	Time      time.Time
+	Size      int64
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// Forecast estimates the disk usage of the database over the given horizon
+// from the current write rate and share of dead bytes, and from the
+// automatic merges that would reclaim them (see WithAutoMerge() and
+// WithAutoMergeThresholds()). Once the database has been open for a minute
+// the rates are those of its writes since, otherwise they are estimated from
+// the sizes and modification times of the datafiles written since the last
+// merge, which is less accurate. It is a rough estimate for capacity
+// planning that assumes the rates stay the same.
+func (b *Bitcask) Forecast(horizon time.Duration) (Forecast, error) {
+	var f Forecast
+
+	stats, err := b.Stats()
+	if err != nil {
+		return f, err
+	}
+	live, dead := float64(stats.LiveBytes), float64(stats.DeadBytes)
+	// The index, configuration and the like are assumed not to grow
+	overhead := stats.Size - stats.LiveBytes - stats.DeadBytes
+
+	now := time.Now()
+	if elapsed := now.Sub(b.opened); elapsed >= forecastMinWindow && stats.BytesWritten > 0 {
+		seconds := elapsed.Seconds()
+		f.WriteRate = float64(stats.BytesWritten) / seconds
+		f.LiveGrowthRate = float64(stats.LiveBytes-b.openedLiveBytes) / seconds
+		f.DeadGrowthRate = math.Max(f.WriteRate-f.LiveGrowthRate, 0)
+	} else if f.WriteRate, err = b.datafileWriteRate(); err != nil {
+		return f, err
+	} else if total := live + dead; total > 0 {
+		f.LiveGrowthRate = f.WriteRate * live / total
+		f.DeadGrowthRate = f.WriteRate * dead / total
+	}
+
+	if b.fsys == fs.OS {
+		if free, ok, err := internal.FreeDiskSpace(b.path); err == nil && ok {
+			f.FreeSpace = free
+		}
+	}
+
+	interval := b.config.AutoMergeInterval
+	if interval > 0 && horizon/interval > forecastMaxSteps {
+		interval = horizon / forecastMaxSteps
+	}
+	step := horizon / forecastPoints
+	if step <= 0 {
+		step = horizon
+	}
+
+	point := func(t time.Duration) {
+		p := ForecastPoint{
+			Time:      now.Add(t),
+			Size:      overhead + int64(live+dead),
+			LiveBytes: int64(live),
+			DeadBytes: int64(dead),
+		}
+		f.Points = append(f.Points, p)
+		f.peak(p.Time, p.Size)
+	}
+	// grow grows the live and dead bytes for the given duration
+	grow := func(d time.Duration) {
+		live = math.Max(live+f.LiveGrowthRate*d.Seconds(), 0)
+		dead += f.DeadGrowthRate * d.Seconds()
+	}
+
+	point(0)
+	var t, nextMerge time.Duration
+	nextMerge = interval
+	for next := step; next <= horizon && step > 0; next += step {
+		for interval > 0 && nextMerge <= next {
+			grow(nextMerge - t)
+			t = nextMerge
+			nextMerge += interval
+			if b.forecastMerge(live, dead) {
+				// The live bytes are copied before the dead ones are removed
+				f.peak(now.Add(t), overhead+int64(2*live+dead))
+				dead = 0
+				f.Merges++
+			}
+		}
+		grow(next - t)
+		t = next
+		point(t)
+	}
+	return f, nil
+}
+
+// peak records the forecast size at the given time
+func (f *Forecast) peak(t time.Time, size int64) {
+	if size > f.PeakSize {
+		f.PeakSize = size
+	}
+	if f.FreeSpace > 0 && f.DiskFull.IsZero() && size > f.Points[0].Size+int64(f.FreeSpace) {
+		f.DiskFull = t
+	}
+}
+
+// forecastMerge returns true if an automatic merge would merge a database
+// with the given live and dead bytes, as per needsMerge()
+func (b *Bitcask) forecastMerge(live, dead float64) bool {
+	if dead <= 0 {
+		return false
+	}
+
+	deadRatio, datafiles := b.config.AutoMergeDeadRatio, b.config.AutoMergeDatafiles
+	if deadRatio <= 0 && datafiles <= 0 {
+		return true
+	}
+	if deadRatio > 0 && dead/(live+dead) >= deadRatio {
+		return true
+	}
+	return datafiles > 0 && (live+dead)/float64(b.config.MaxDatafileSize)+1 >= float64(datafiles)
+}
+
+// datafileWriteRate estimates the number of bytes written per second from
+// the datafiles written since the last merge: the bytes written after the
+// first of them was last modified over the time until the last of them was.
+// It is zero if there are not enough datafiles to tell.
+func (b *Bitcask) datafileWriteRate() (float64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	type written struct {
+		id      int
+		size    int64
+		modTime time.Time
+	}
+	var files []written
+	end := b.mergedEnd()
+	dfs := []data.Datafile{b.curr}
+	for _, df := range b.datafiles {
+		dfs = append(dfs, df)
+	}
+	for _, df := range dfs {
+		if df.FileID() < end {
+			continue
+		}
+		stat, err := b.fsys.Stat(df.Name())
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, written{df.FileID(), stat.Size(), stat.ModTime()})
+	}
+	if len(files) < 2 {
+		return 0, nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].id < files[j].id })
+
+	var bytes int64
+	for _, file := range files[1:] {
+		bytes += file.size
+	}
+	elapsed := files[len(files)-1].modTime.Sub(files[0].modTime).Seconds()
+	if elapsed <= 0 {
+		return 0, nil
+	}
+	return float64(bytes) / elapsed, nil
+}
+
+// openedAt records when the database was opened and its live bytes then,
+// which Forecast() estimates the growth rates from
+func (b *Bitcask) openedAt(t time.Time) {
+	b.opened = t
+	b.openedLiveBytes = atomic.LoadInt64(&b.liveBytes)
+}
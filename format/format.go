@@ -0,0 +1,41 @@
+// Package format describes the on-disk format of the entries of datafiles,
+// as encoded by each format version (see bitcask.WithFormatVersion()), so
+// tools reading datafiles always match the code writing them. FORMAT.md is
+// generated from it with go generate.
+package format
+
+//go:generate go run gen.go
+
+import (
+	"errors"
+
+	"github.com/prologic/bitcask/internal/data/codec"
+)
+
+// ErrUnsupportedVersion is the error returned when describing an unknown
+// format version
+var ErrUnsupportedVersion = errors.New("error: unsupported format version")
+
+// Field describes a field of an encoded entry: its name, encoding, offset
+// from the start of the entry (-1 if it follows a field of variable size),
+// size in bytes (-1 if variable) and the description of its value
+type Field = codec.Field
+
+// Versions returns the known format versions, in increasing order
+func Versions() []int {
+	var versions []int
+	for f := codec.FormatLegacy; f.Valid(); f++ {
+		versions = append(versions, int(f))
+	}
+	return versions
+}
+
+// Describe returns the fields of the entries encoded by the given format
+// version, in order
+func Describe(version int) ([]Field, error) {
+	fields := codec.Format(version).Describe()
+	if fields == nil {
+		return nil, ErrUnsupportedVersion
+	}
+	return fields, nil
+}
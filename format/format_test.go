@@ -0,0 +1,39 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]int{0, 1, 2, 3, 4, 5}, Versions())
+
+	fields, err := Describe(0)
+	assert.NoError(err)
+	var names []string
+	for _, field := range fields {
+		names = append(names, field.Name)
+	}
+	assert.Equal([]string{"key_size", "value_size", "key", "value", "checksum"}, names)
+	assert.Equal(Field{Name: "value_size", Encoding: "uint64", Offset: 4, Size: 8, Description: "size of the value in bytes"}, fields[1])
+	assert.Equal(12, fields[2].Offset)
+	assert.Equal(-1, fields[4].Offset)
+
+	fields, err = Describe(4)
+	assert.NoError(err)
+	assert.Equal("compression", fields[4].Name)
+	assert.Equal(-1, fields[4].Offset)
+	assert.Equal(1, fields[4].Size)
+
+	fields, err = Describe(5)
+	assert.NoError(err)
+	assert.Equal("version", fields[5].Name)
+	assert.Equal("timestamp", fields[6].Name)
+	assert.Equal(8, fields[6].Size)
+
+	_, err = Describe(6)
+	assert.Equal(ErrUnsupportedVersion, err)
+}
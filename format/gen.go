@@ -0,0 +1,53 @@
+//go:build ignore
+// +build ignore
+
+// gen writes FORMAT.md, the reference of the on-disk format of entries
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/prologic/bitcask/format"
+)
+
+func main() {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "<!-- Code generated by gen.go; DO NOT EDIT. -->")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "# On-disk format")
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "Datafiles are named `%09d.data` after their id and hold a sequence of")
+	fmt.Fprintln(&buf, "entries encoded by the format version of the database, stored in its")
+	fmt.Fprintln(&buf, "`config.json`. Integers are big endian, uvarints are encoded as by")
+	fmt.Fprintln(&buf, "`encoding/binary`.")
+
+	for _, version := range format.Versions() {
+		fields, err := format.Describe(version)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintln(&buf)
+		fmt.Fprintf(&buf, "## Version %d\n", version)
+		fmt.Fprintln(&buf)
+		fmt.Fprintln(&buf, "| Offset | Size | Field | Encoding | Description |")
+		fmt.Fprintln(&buf, "|-------:|-----:|-------|----------|-------------|")
+		for _, field := range fields {
+			offset, size := "-", "-"
+			if field.Offset >= 0 {
+				offset = fmt.Sprint(field.Offset)
+			}
+			if field.Size >= 0 {
+				size = fmt.Sprint(field.Size)
+			}
+			fmt.Fprintf(&buf, "| %s | %s | `%s` | %s | %s |\n", offset, size, field.Name, field.Encoding, field.Description)
+		}
+	}
+
+	if err := ioutil.WriteFile("FORMAT.md", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,184 @@
+package bitcask
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal/config"
+)
+
+var (
+	// ErrFrozen is the error returned by Merge() while a generation of the
+	// database is frozen, see Freeze()
+	ErrFrozen = errors.New("error: database frozen")
+
+	// ErrFrozenInUse is the error returned by Freeze() and Thaw() while
+	// databases opened with OpenShared() use the frozen generation
+	ErrFrozenInUse = errors.New("error: frozen generation in use")
+
+	// ErrNotFrozen is the error returned by OpenShared() if no generation of
+	// the database is frozen
+	ErrNotFrozen = errors.New("error: database not frozen")
+)
+
+// frozen is the manifest of the frozen generation of a database
+type frozen struct {
+	Datafiles []int `json:"datafiles"`
+}
+
+// Freeze freezes the generation of the database made of all the keys
+// written so far, so processes on the same host can open it read-only with
+// OpenShared() while this one keeps writing. Writes after the call go to
+// new datafiles and are not part of the frozen generation.
+//
+// The frozen generation is recorded in the `frozen` file of the database,
+// which lists its immutable datafiles, and is shared with readers through
+// the `frozen.lock` file: readers hold a shared lock on it and Thaw() needs
+// an exclusive one. Merge() returns ErrFrozen until the generation is thawed
+// as its datafiles must not change. Freezing a frozen database freezes a new
+// generation once the previous one is no longer in use.
+func (b *Bitcask) Freeze() error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if err := b.thaw(); err != nil {
+		return err
+	}
+
+	if b.curr.Size() > 0 {
+		if err := b.sync(b.curr); err != nil {
+			return err
+		}
+		if err := b.rotate(1); err != nil {
+			return err
+		}
+	}
+
+	manifest := frozen{Datafiles: make([]int, 0, len(b.datafiles))}
+	for id := range b.datafiles {
+		manifest.Datafiles = append(manifest.Datafiles, id)
+	}
+	sort.Ints(manifest.Datafiles)
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	// Readers must never see a partial manifest
+	temp := filepath.Join(b.path, "frozen.tmp")
+	if err := fs.WriteFile(b.fsys, temp, data, 0600); err != nil {
+		return err
+	}
+	return b.fsys.Rename(temp, filepath.Join(b.path, "frozen"))
+}
+
+// Thaw thaws the frozen generation of the database (see Freeze()) so it can
+// be merged again, or returns ErrFrozenInUse while databases opened with
+// OpenShared() use it
+func (b *Bitcask) Thaw() error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.thaw()
+}
+
+// thaw removes the manifest of the frozen generation, if any, unless it is
+// in use. The caller must hold the write lock.
+func (b *Bitcask) thaw() error {
+	if !b.frozen() {
+		return nil
+	}
+
+	if b.fsys == fs.OS {
+		lock := newFlock(filepath.Join(b.path, "frozen.lock"))
+		locked, err := lock.TryLock()
+		if err != nil {
+			return err
+		}
+		if !locked {
+			return ErrFrozenInUse
+		}
+		defer lock.Unlock()
+	}
+
+	return b.fsys.Remove(filepath.Join(b.path, "frozen"))
+}
+
+// frozen returns true if a generation of the database is frozen
+func (b *Bitcask) frozen() bool {
+	return fs.Exists(b.fsys, filepath.Join(b.path, "frozen"))
+}
+
+// OpenShared opens the generation of the database at the given path frozen
+// by its writer with Freeze() read-only, like OpenReadOnly() but holding a
+// shared lock so the writer cannot thaw it while it is open. The database
+// sees the keys of the frozen generation only and Refresh() does nothing.
+// ErrNotFrozen is returned if no generation is frozen.
+func OpenShared(path string, options ...Option) (*Bitcask, error) {
+	return Open(path, append(options, WithReadOnly(), withShared())...)
+}
+
+// withShared opens the frozen generation of the database, see OpenShared()
+func withShared() Option {
+	return func(cfg *config.Config) error {
+		cfg.Shared = true
+		return nil
+	}
+}
+
+// loadFrozen takes the shared lock of the frozen generation of a database
+// opened with OpenShared() and returns the ids of its datafiles
+func (b *Bitcask) loadFrozen() (map[int]bool, error) {
+	if b.fsys == fs.OS {
+		b.shared = newFlock(filepath.Join(b.path, "frozen.lock"))
+		locked, err := b.shared.TryRLock()
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			// The generation is being thawed
+			return nil, ErrNotFrozen
+		}
+	}
+
+	data, err := fs.ReadFile(b.fsys, filepath.Join(b.path, "frozen"))
+	if os.IsNotExist(err) {
+		b.unlockShared()
+		return nil, ErrNotFrozen
+	} else if err != nil {
+		b.unlockShared()
+		return nil, err
+	}
+	var manifest frozen
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		b.unlockShared()
+		return nil, err
+	}
+
+	ids := make(map[int]bool, len(manifest.Datafiles))
+	for _, id := range manifest.Datafiles {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// unlockShared releases the shared lock of a database opened with
+// OpenShared(), if any
+func (b *Bitcask) unlockShared() {
+	if b.shared != nil {
+		b.shared.Unlock()
+		b.shared = nil
+	}
+}
@@ -0,0 +1,169 @@
+// Package fs abstracts the file access of a database so it can be stored in
+// memory, see NewMemory(), or in any other file system implementing
+// FileSystem. OS is the file system of the operating system.
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// File is an open file
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileSystem is a hierarchical file system. Its methods behave as their
+// namesakes of the os package and return errors satisfying os.IsNotExist()
+// and os.IsExist() as they do.
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir returns the entries of the directory sorted by name
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// OS is the file system of the operating system
+var OS FileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := openFile(name, flag, perm)
+	if err != nil {
+		// Not a nil *os.File in a non-nil File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)         { return os.Stat(name) }
+func (osFS) Remove(name string) error                      { return os.Remove(name) }
+func (osFS) RemoveAll(path string) error                   { return os.RemoveAll(path) }
+func (osFS) Rename(oldpath, newpath string) error          { return os.Rename(oldpath, newpath) }
+func (osFS) Mkdir(name string, perm os.FileMode) error     { return os.Mkdir(name, perm) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error  { return os.MkdirAll(path, perm) }
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) { return ioutil.ReadDir(dirname) }
+
+// Open opens the file for reading
+func Open(fsys FileSystem, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Exists returns true if the file or directory exists
+func Exists(fsys FileSystem, name string) bool {
+	_, err := fsys.Stat(name)
+	return err == nil
+}
+
+// ReadFile returns the contents of the file
+func ReadFile(fsys FileSystem, name string) ([]byte, error) {
+	f, err := Open(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes the data to the file, creating or truncating it
+func WriteFile(fsys FileSystem, name string, data []byte, perm os.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// TempDir creates a new directory in `dir` whose name starts with `prefix`
+// followed by a random number and returns its path
+func TempDir(fsys FileSystem, dir, prefix string) (string, error) {
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%s%d", prefix, rand.Uint32()))
+		err := fsys.Mkdir(name, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		return name, err
+	}
+	return "", &os.PathError{Op: "mkdir", Path: filepath.Join(dir, prefix+"*"), Err: os.ErrExist}
+}
+
+// Glob returns the names of the files of `dir` matching the pattern as per
+// filepath.Match(), sorted
+func Glob(fsys FileSystem, dir, pattern string) ([]string, error) {
+	infos, err := fsys.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		matched, err := filepath.Match(pattern, info.Name())
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Size returns the total size of the files under `path`
+func Size(fsys FileSystem, path string) (int64, error) {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return info.Size(), nil
+	}
+
+	infos, err := fsys.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, info := range infos {
+		n, err := Size(fsys, filepath.Join(path, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// isUnder returns true if `name` is `dir` or a path under it
+func isUnder(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	t.Run("ReadWrite", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fsys := NewMemory()
+		require.NoError(fsys.MkdirAll("db", 0755))
+
+		f, err := fsys.OpenFile(filepath.Join("db", "file"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+		require.NoError(err)
+		_, err = f.Write([]byte("hello "))
+		require.NoError(err)
+		_, err = f.Write([]byte("world"))
+		require.NoError(err)
+
+		buf := make([]byte, 5)
+		_, err = f.ReadAt(buf, 6)
+		require.NoError(err)
+		assert.Equal([]byte("world"), buf)
+		_, err = f.ReadAt(buf, 8)
+		assert.Equal(io.EOF, err)
+
+		require.NoError(f.Truncate(5))
+		require.NoError(f.Close())
+
+		data, err := ReadFile(fsys, filepath.Join("db", "file"))
+		require.NoError(err)
+		assert.Equal([]byte("hello"), data)
+		assert.False(Exists(OS, filepath.Join("db", "file")))
+	})
+
+	t.Run("NotExist", func(t *testing.T) {
+		assert := assert.New(t)
+
+		fsys := NewMemory()
+		_, err := Open(fsys, "missing")
+		assert.True(os.IsNotExist(err))
+		_, err = fsys.OpenFile(filepath.Join("missing", "file"), os.O_CREATE|os.O_WRONLY, 0600)
+		assert.True(os.IsNotExist(err))
+		assert.True(os.IsNotExist(fsys.Remove("missing")))
+	})
+
+	t.Run("Removed", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fsys := NewMemory()
+		require.NoError(WriteFile(fsys, "file", []byte("data"), 0600))
+		f, err := Open(fsys, "file")
+		require.NoError(err)
+		defer f.Close()
+
+		// Open files keep the data of removed files
+		require.NoError(fsys.Remove("file"))
+		assert.False(Exists(fsys, "file"))
+		data := make([]byte, 4)
+		_, err = io.ReadFull(f, data)
+		assert.NoError(err)
+		assert.Equal([]byte("data"), data)
+	})
+
+	t.Run("Directories", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		fsys := NewMemory()
+		require.NoError(fsys.MkdirAll(filepath.Join("db", "sub"), 0755))
+		require.NoError(WriteFile(fsys, filepath.Join("db", "000000001.data"), []byte("ab"), 0600))
+		require.NoError(WriteFile(fsys, filepath.Join("db", "000000000.data"), []byte("c"), 0600))
+		require.NoError(WriteFile(fsys, filepath.Join("db", "sub", "file"), []byte("def"), 0600))
+
+		names, err := Glob(fsys, "db", "*.data")
+		require.NoError(err)
+		assert.Equal([]string{filepath.Join("db", "000000000.data"), filepath.Join("db", "000000001.data")}, names)
+
+		size, err := Size(fsys, "db")
+		require.NoError(err)
+		assert.Equal(int64(6), size)
+
+		temp, err := TempDir(fsys, "db", "merge")
+		require.NoError(err)
+		require.NoError(WriteFile(fsys, filepath.Join(temp, "file"), []byte("g"), 0600))
+		require.NoError(fsys.Rename(filepath.Join(temp, "file"), filepath.Join("db", "moved")))
+		assert.True(Exists(fsys, filepath.Join("db", "moved")))
+
+		assert.Error(fsys.Remove("db"))
+		require.NoError(fsys.RemoveAll("db"))
+		assert.False(Exists(fsys, "db"))
+		assert.False(Exists(fsys, filepath.Join("db", "sub", "file")))
+	})
+}
+
+func TestOS(t *testing.T) {
+	t.Run("RemoveOpen", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		// Files open in a process can be removed by another on all platforms
+		name := filepath.Join(testdir, "000000000.data")
+		require.NoError(WriteFile(OS, name, []byte("data"), 0600))
+		f, err := Open(OS, name)
+		require.NoError(err)
+		defer f.Close()
+
+		require.NoError(OS.Remove(name))
+		data := make([]byte, 4)
+		_, err = f.ReadAt(data, 0)
+		assert.NoError(err)
+		assert.Equal([]byte("data"), data)
+	})
+}
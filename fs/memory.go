@@ -0,0 +1,466 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNotEmpty = errors.New("directory not empty")
+
+// memFS is a file system held in memory
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]time.Time
+}
+
+// memData is the data of a file, shared by its open files, which keep it
+// once the file is removed
+type memData struct {
+	mu      sync.RWMutex
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+}
+
+// NewMemory returns an empty file system held in memory. It is safe for
+// concurrent use and files can be read and written while they are open,
+// including after they are removed, as with the file system of a Unix
+// operating system.
+func NewMemory() FileSystem {
+	return &memFS{
+		files: make(map[string]*memData),
+		dirs:  make(map[string]time.Time),
+	}
+}
+
+// isDir returns true if the directory exists. The caller must hold the lock.
+func (m *memFS) isDir(name string) bool {
+	if name == "." || name == string(filepath.Separator) {
+		return true
+	}
+	_, ok := m.dirs[name]
+	return ok
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isDir(name) {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		return &memFile{name: name, d: &memData{}, flag: flag, dir: true}, nil
+	}
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !m.isDir(filepath.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{perm: perm, modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		d.mu.Lock()
+		d.data = nil
+		d.modTime = time.Now()
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, d: d, flag: flag}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isDir(name) {
+		return &memInfo{name: filepath.Base(name), modTime: m.dirs[name], dir: true}, nil
+	}
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return d.info(name), nil
+}
+
+func (m *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for other := range m.files {
+		if filepath.Dir(other) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	for other := range m.dirs {
+		if filepath.Dir(other) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: errNotEmpty}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range m.files {
+		if isUnder(name, path) {
+			delete(m.files, name)
+		}
+	}
+	for name := range m.dirs {
+		if isUnder(name, path) {
+			delete(m.dirs, name)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(filepath.Dir(newpath)) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+
+	if d, ok := m.files[oldpath]; ok {
+		if m.isDir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+		}
+		delete(m.files, oldpath)
+		m.files[newpath] = d
+		return nil
+	}
+	if _, ok := m.dirs[oldpath]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if _, ok := m.files[newpath]; ok || m.isDir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrExist}
+	}
+	for name, d := range m.files {
+		if isUnder(name, oldpath) {
+			delete(m.files, name)
+			m.files[newpath+name[len(oldpath):]] = d
+		}
+	}
+	for name, modTime := range m.dirs {
+		if isUnder(name, oldpath) {
+			delete(m.dirs, name)
+			m.dirs[newpath+name[len(oldpath):]] = modTime
+		}
+	}
+	return nil
+}
+
+func (m *memFS) Mkdir(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok || m.isDir(name) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !m.isDir(filepath.Dir(name)) {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	m.dirs[name] = time.Now()
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := path; !m.isDir(dir); dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		m.dirs[dir] = time.Now()
+	}
+	return nil
+}
+
+func (m *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = filepath.Clean(dirname)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isDir(dirname) {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+
+	var infos []os.FileInfo
+	for name, d := range m.files {
+		if filepath.Dir(name) == dirname {
+			infos = append(infos, d.info(name))
+		}
+	}
+	for name, modTime := range m.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			infos = append(infos, &memInfo{name: filepath.Base(name), modTime: modTime, dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (d *memData) info(name string) *memInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return &memInfo{name: filepath.Base(name), size: int64(len(d.data)), perm: d.perm, modTime: d.modTime}
+}
+
+// memFile is an open file of a memFS
+type memFile struct {
+	mu     sync.Mutex
+	name   string
+	d      *memData
+	flag   int
+	dir    bool
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string, write bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	if !write && f.flag&os.O_WRONLY != 0 {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errors.New("negative offset")}
+	}
+
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+
+	if off >= int64(len(f.d.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.d.mu.RLock()
+		f.offset = int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errors.New("negative offset")}
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		f.d.resize(end)
+	}
+	copy(f.d.data[off:], p)
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+// resize resizes the data, growing it with zeros. The caller must hold the
+// write lock.
+func (d *memData) resize(size int64) {
+	if size <= int64(cap(d.data)) {
+		old := len(d.data)
+		d.data = d.data[:size]
+		for i := old; i < len(d.data); i++ {
+			d.data[i] = 0
+		}
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, d.data)
+	d.data = data
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.d.mu.RLock()
+		offset += int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.dir {
+		return &memInfo{name: filepath.Base(f.name), dir: true}, nil
+	}
+	return f.d.info(f.name), nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	f.d.resize(size)
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// memInfo describes a file or directory of a memFS
+type memInfo struct {
+	name    string
+	size    int64
+	perm    os.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Sys() interface{}   { return nil }
+
+func (i *memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return i.perm
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package fs
+
+import (
+	"os"
+)
+
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
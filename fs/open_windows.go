@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFile opens the file like os.OpenFile() but shares it for deletion, so
+// files open in a process can be removed and renamed by another as on Unix
+// platforms, e.g. the datafiles merged away by the writer of a database
+// opened read-only by another process. The name of a removed file remains
+// until it is closed by all processes.
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	// Directories need backup semantics, they are not removed while open
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return os.OpenFile(name, flag, perm)
+	}
+
+	path, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	var access uint32
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		access = syscall.GENERIC_READ
+	case os.O_WRONLY:
+		access = syscall.GENERIC_WRITE
+	case os.O_RDWR:
+		access = syscall.GENERIC_READ | syscall.GENERIC_WRITE
+	}
+	if flag&os.O_CREATE != 0 {
+		access |= syscall.GENERIC_WRITE
+	}
+	if flag&os.O_APPEND != 0 {
+		access &^= syscall.GENERIC_WRITE
+		access |= syscall.FILE_APPEND_DATA
+	}
+
+	var mode uint32
+	switch {
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		mode = syscall.CREATE_NEW
+	case flag&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE|os.O_TRUNC:
+		mode = syscall.CREATE_ALWAYS
+	case flag&os.O_CREATE == os.O_CREATE:
+		mode = syscall.OPEN_ALWAYS
+	case flag&os.O_TRUNC == os.O_TRUNC:
+		mode = syscall.TRUNCATE_EXISTING
+	default:
+		mode = syscall.OPEN_EXISTING
+	}
+
+	attrs := uint32(syscall.FILE_ATTRIBUTE_NORMAL)
+	if perm&0200 == 0 {
+		attrs = syscall.FILE_ATTRIBUTE_READONLY
+	}
+
+	share := uint32(syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE)
+	h, err := syscall.CreateFile(path, access, share, nil, mode, attrs, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
@@ -0,0 +1,32 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// releaseIdle is the background task closing the immutable datafiles once
+// the database has been idle for the configured timeout. Datafiles are only
+// closed once per idle period and are reopened on demand by the next read.
+func (b *Bitcask) releaseIdle(stop <-chan struct{}) {
+	timeout := b.config.IdleTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	var released int64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		last := atomic.LoadInt64(&b.lastActive)
+		if last == released || time.Since(time.Unix(0, last)) < timeout {
+			continue
+		}
+		b.fds.CloseIdle()
+		released = last
+		atomic.AddUint64(&b.idleReleases, 1)
+	}
+}
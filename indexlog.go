@@ -0,0 +1,116 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/index"
+)
+
+// indexLogMinSize is the size the index log grows to before it is compacted
+// into the index, once larger than the index too
+const indexLogMinSize = 1 << 20
+
+// logIndexPeriodically is the background task appending the changes of the
+// index to the index log every configured interval, see WithIndexLog()
+func (b *Bitcask) logIndexPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.config.IndexLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A delta that failed is retried with the next one
+		b.logIndex()
+	}
+}
+
+// logIndex appends the changes of the index since the last delta to the
+// index log, so reopening the database after a crash only indexes the
+// entries written since
+func (b *Bitcask) logIndex() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if b.dirty == nil {
+		return nil
+	}
+	pos := b.position()
+	if pos == b.indexLogPos && len(b.dirty) == 0 {
+		return nil
+	}
+
+	// The index log must not refer to entries lost when crashing
+	if err := b.sync(b.curr); err != nil {
+		return err
+	}
+	changes := make([]index.Change, 0, len(b.dirty))
+	for key := range b.dirty {
+		c := index.Change{Key: []byte(key), Deleted: true}
+		if value, found := b.trie.Search(c.Key); found {
+			c.Item, c.Deleted = value.(internal.Item), false
+		}
+		changes = append(changes, c)
+	}
+	n, err := index.AppendDelta(b.fsys, filepath.Join(b.path, "index.log"), b.indexLogPos, pos, changes)
+	if err != nil {
+		return err
+	}
+	b.indexLogPos = pos
+	b.indexLogSize += n
+	b.dirty = make(map[string]struct{})
+	if err := b.saveVersion(pos); err != nil {
+		return err
+	}
+
+	if b.indexLogSize < indexLogMinSize {
+		return nil
+	}
+	if stat, err := b.fsys.Stat(filepath.Join(b.path, "index")); err == nil && b.indexLogSize < stat.Size() {
+		return nil
+	}
+	return b.saveIndex()
+}
+
+// saveIndex saves the index at the current position and starts a new
+// index log. The caller must hold the write lock with no Put() in flight,
+// see quiesce().
+func (b *Bitcask) saveIndex() error {
+	pos := b.position()
+	if err := b.indexer.Save(b.trie, pos, filepath.Join(b.path, "index")); err != nil {
+		return err
+	}
+	if err := b.saveVersion(pos); err != nil {
+		return err
+	}
+	return b.resetIndexLog(pos)
+}
+
+// resetIndexLog starts a new index log from the given position, removing
+// the deltas of the index saved
+func (b *Bitcask) resetIndexLog(pos index.Position) error {
+	if err := b.fsys.Remove(filepath.Join(b.path, "index.log")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	b.indexLogPos = pos
+	b.indexLogSize = 0
+	if b.config.IndexLogInterval > 0 {
+		b.dirty = make(map[string]struct{})
+	}
+	return nil
+}
+
+// markDirty records that the key changed since the last delta of the index
+// log, if any. The caller must hold the write lock.
+func (b *Bitcask) markDirty(key []byte) {
+	if b.dirty != nil {
+		b.dirty[string(key)] = struct{}{}
+	}
+}
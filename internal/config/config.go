@@ -2,24 +2,124 @@ package config
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"os"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/metrics"
 )
 
 // Config contains the bitcask configuration parameters
 type Config struct {
-	MaxDatafileSize int    `json:"max_datafile_size"`
-	MaxKeySize      uint32 `json:"max_key_size"`
-	MaxValueSize    uint64 `json:"max_value_size"`
-	Sync            bool   `json:"sync"`
-	AutoRecovery    bool   `json:"autorecovery"`
+	MaxDatafileSize  int           `json:"max_datafile_size"`
+	MaxKeySize       uint32        `json:"max_key_size"`
+	MaxValueSize     uint64        `json:"max_value_size"`
+	Sync             bool          `json:"sync"`
+	SyncInterval     time.Duration `json:"sync_interval"`
+	AutoRecovery     bool          `json:"autorecovery"`
+	MaxOpenFiles     int           `json:"max_open_files"`
+	MinFreeDiskSpace uint64        `json:"min_free_disk_space"`
+	MaxFilesPerMerge int           `json:"max_files_per_merge"`
+	FormatVersion    int           `json:"format_version"`
+
+	NodeID uint32 `json:"node_id"`
+
+	Compression uint8 `json:"compression"`
+	// PrefixCompression overrides Compression for the keys with a prefix
+	PrefixCompression []PrefixCompression `json:"prefix_compression,omitempty"`
+
+	// EncryptionCheck is a value sealed with the encryption key to detect
+	// a wrong key, the key itself is not persisted
+	EncryptionCheck []byte `json:"encryption_check,omitempty"`
+	EncryptionKey   []byte `json:"-"`
+
+	AutoMergeInterval  time.Duration `json:"auto_merge_interval"`
+	AutoMergeDeadRatio float64       `json:"auto_merge_dead_ratio"`
+	AutoMergeDatafiles int           `json:"auto_merge_datafiles"`
+
+	TrashWindow time.Duration `json:"trash_window"`
+
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	IndexLogInterval time.Duration `json:"index_log_interval"`
+
+	// ActiveDir is where the current datafile is written, checkpointed into
+	// the database every CheckpointInterval
+	ActiveDir          string        `json:"active_dir,omitempty"`
+	CheckpointInterval time.Duration `json:"checkpoint_interval"`
+
+	MaxDatastoreSize int64 `json:"max_datastore_size"`
+	MaxKeys          int   `json:"max_keys"`
+	EvictionPolicy   int   `json:"eviction_policy"`
+
+	// ReadOnly opens the database without writing to it and Shared opens its
+	// frozen generation, they are not persisted
+	ReadOnly bool `json:"-"`
+	Shared   bool `json:"-"`
+	// DisableMMap reads immutable datafiles with pread instead of memory
+	// mapping them, it is not persisted
+	DisableMMap bool `json:"-"`
+	// TolerateInvalidDatafiles skips the checks of the datafiles made by a
+	// single Open(), it is not persisted
+	TolerateInvalidDatafiles bool `json:"-"`
+
+	// RetryAttempts and RetryBackoff control how transient I/O errors are
+	// retried, they are not persisted
+	RetryAttempts int           `json:"-"`
+	RetryBackoff  time.Duration `json:"-"`
+
+	// WorkerPool spawns background tasks, it is not persisted
+	WorkerPool func(func()) `json:"-"`
+	// TaskRestarts and TaskBackoff control how background tasks that
+	// panicked are restarted, they are not persisted
+	TaskRestarts int           `json:"-"`
+	TaskBackoff  time.Duration `json:"-"`
+	// RecoveryHandler is called with the report of every recovery, it is
+	// not persisted
+	RecoveryHandler func(internal.RecoveryReport) `json:"-"`
+	// Metrics collects the operations of the database, it is not persisted
+	Metrics metrics.Collector `json:"-"`
+	// CorruptionPolicy and CorruptionHandler handle corrupted data found by
+	// the database, they are not persisted
+	CorruptionPolicy  int                       `json:"-"`
+	CorruptionHandler func(internal.Corruption) `json:"-"`
+	// FileSystem stores the database, the operating system's if nil, it is
+	// not persisted
+	FileSystem fs.FileSystem `json:"-"`
+	// OpenTimeout and ForceLock control how Open() takes the lock of the
+	// database, they are not persisted
+	OpenTimeout time.Duration `json:"-"`
+	ForceLock   bool          `json:"-"`
+	// BloomFilter is the false positive rate of the filter of the keys kept
+	// in memory, zero if none, it is not persisted
+	BloomFilter float64 `json:"-"`
+	// ReadLatencyTarget is the latency of foreground reads above which
+	// background reads are throttled, the default if zero and never if
+	// negative, it is not persisted
+	ReadLatencyTarget time.Duration `json:"-"`
+}
+
+// PrefixCompression is how the values of the keys with a prefix are
+// compressed
+type PrefixCompression struct {
+	Prefix      []byte `json:"prefix"`
+	Compression uint8  `json:"compression"`
+}
+
+// FS returns the file system storing the database
+func (c *Config) FS() fs.FileSystem {
+	if c.FileSystem == nil {
+		return fs.OS
+	}
+	return c.FileSystem
 }
 
-// Load loads a configuration from the given path
-func Load(path string) (*Config, error) {
+// Load loads a configuration from the given path of the file system
+func Load(fsys fs.FileSystem, path string) (*Config, error) {
 	var cfg Config
 
-	data, err := ioutil.ReadFile(path)
+	data, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return nil, err
 	}
@@ -31,9 +131,9 @@ func Load(path string) (*Config, error) {
 	return &cfg, nil
 }
 
-// Save saves the configuration to the provided path
+// Save saves the configuration to the provided path of its file system
 func (c *Config) Save(path string) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	f, err := c.FS().OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,21 @@
+package internal
+
+import (
+	"fmt"
+)
+
+// Corruption describes corrupted data found by a database, such as a value
+// failing its checksum or the index referring to a datafile that is gone
+type Corruption struct {
+	// Key is the key whose entry is corrupted
+	Key []byte
+	// FileID and Offset locate the entry of the key
+	FileID int
+	Offset int64
+	// Err is the error the corruption was detected with
+	Err error
+}
+
+func (c *Corruption) Error() string {
+	return fmt.Sprintf("corrupted entry of key %q in datafile %d at offset %d: %s", c.Key, c.FileID, c.Offset, c.Err)
+}
@@ -0,0 +1,38 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// batchKey is the key of the header entry written before the entries of a
+// batch. A header is told apart from an entry of a user key that happens to
+// be the same by its inverted checksum.
+var batchKey = []byte("\x00batch")
+
+// NewBatchHeader returns the header entry of a batch of n entries
+func NewBatchHeader(n int) internal.Entry {
+	value := make([]byte, binary.MaxVarintLen64)
+	value = value[:binary.PutUvarint(value, uint64(n))]
+	return internal.Entry{
+		Key:      batchKey,
+		Value:    value,
+		Checksum: ^crc32.ChecksumIEEE(value),
+	}
+}
+
+// BatchHeader returns the number of entries of the batch and true if the
+// entry is a batch header, which is never indexed
+func BatchHeader(e internal.Entry) (int, bool) {
+	if !bytes.Equal(e.Key, batchKey) || e.Checksum != ^crc32.ChecksumIEEE(e.Value) {
+		return 0, false
+	}
+	n, m := binary.Uvarint(e.Value)
+	if m <= 0 || m != len(e.Value) {
+		return 0, false
+	}
+	return int(n), true
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data/codec"
+)
+
+// Cache limits the number of read-only datafiles that are open at the same
+// time by closing the least recently used ones and reopening them on demand.
+// Datafiles in use are never closed, so the limit may be exceeded briefly
+// if more datafiles than allowed are read from concurrently.
+type Cache struct {
+	mu       sync.Mutex
+	fs       fs.FileSystem
+	max      int
+	lazy     bool
+	unmapped bool
+	lru      *list.List
+}
+
+// NewCache returns a cache keeping at most max read-only datafiles of the
+// file system open.
+// A max of zero or less means no limit, datafiles are then opened directly
+// unless `lazy` is set so they can still be closed by CloseIdle(). Datafiles
+// are memory mapped unless `unmapped` is set.
+func NewCache(fsys fs.FileSystem, max int, lazy, unmapped bool) *Cache {
+	return &Cache{fs: fsys, max: max, lazy: lazy, unmapped: unmapped, lru: list.New()}
+}
+
+// open opens the read-only datafile memory mapped or not
+func (c *Cache) open(path string, id int, maxKeySize uint32, maxValueSize uint64, format codec.Format) (Datafile, error) {
+	if c.unmapped {
+		return NewUnmappedDatafile(c.fs, path, id, maxKeySize, maxValueSize, format)
+	}
+	return NewDatafile(c.fs, path, id, true, maxKeySize, maxValueSize, format)
+}
+
+// Len returns the number of datafiles currently open
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// CloseIdle closes all datafiles not in use, they are reopened on demand.
+// It returns the number of datafiles closed.
+func (c *Cache) CloseIdle() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	closed := 0
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if cdf := e.Value.(*cachedDatafile); cdf.refs == 0 {
+			c.remove(cdf)
+			closed++
+		}
+		e = prev
+	}
+	return closed
+}
+
+// Open opens an existing read-only datafile through the cache. Without a
+// limit and unless lazy this opens the datafile directly.
+func (c *Cache) Open(path string, id int, maxKeySize uint32, maxValueSize uint64, format codec.Format) (Datafile, error) {
+	if c.max <= 0 && !c.lazy {
+		return c.open(path, id, maxKeySize, maxValueSize, format)
+	}
+
+	fn := filepath.Join(path, fmt.Sprintf(defaultDatafileFilename, id))
+	stat, err := c.fs.Stat(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedDatafile{
+		c:            c,
+		path:         path,
+		id:           id,
+		name:         fn,
+		size:         stat.Size(),
+		maxKeySize:   maxKeySize,
+		maxValueSize: maxValueSize,
+		format:       format,
+	}, nil
+}
+
+// acquire opens the datafile if needed and marks it as in use until it is
+// released, closing least recently used datafiles over the limit
+func (c *Cache) acquire(cdf *cachedDatafile) (Datafile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cdf.df == nil {
+		df, err := c.open(cdf.path, cdf.id, cdf.maxKeySize, cdf.maxValueSize, cdf.format)
+		if err != nil {
+			return nil, err
+		}
+		// Resume sequential reads where they left off
+		if cdf.offset > 0 {
+			if _, err := df.(*datafile).r.Seek(cdf.offset, io.SeekStart); err != nil {
+				df.Close()
+				return nil, err
+			}
+		}
+		cdf.df = df
+		cdf.elem = c.lru.PushFront(cdf)
+	} else {
+		c.lru.MoveToFront(cdf.elem)
+	}
+	cdf.refs++
+
+	c.evict()
+	return cdf.df, nil
+}
+
+func (c *Cache) release(cdf *cachedDatafile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cdf.refs--
+	c.evict()
+}
+
+// evict closes least recently used datafiles not in use while over the
+// limit. The caller must hold the lock.
+func (c *Cache) evict() {
+	if c.max <= 0 {
+		return
+	}
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.max; {
+		prev := e.Prev()
+		if cdf := e.Value.(*cachedDatafile); cdf.refs == 0 {
+			c.remove(cdf)
+		}
+		e = prev
+	}
+}
+
+// remove closes the datafile and removes it from the cache. The caller must
+// hold the lock.
+func (c *Cache) remove(cdf *cachedDatafile) error {
+	if cdf.df == nil {
+		return nil
+	}
+	c.lru.Remove(cdf.elem)
+	err := cdf.df.Close()
+	cdf.df, cdf.elem = nil, nil
+	return err
+}
+
+// cachedDatafile is a read-only datafile that is opened on demand
+type cachedDatafile struct {
+	c            *Cache
+	path         string
+	id           int
+	name         string
+	size         int64
+	maxKeySize   uint32
+	maxValueSize uint64
+	format       codec.Format
+
+	// guarded by the cache's lock
+	df     Datafile
+	elem   *list.Element
+	refs   int
+	offset int64
+}
+
+func (cdf *cachedDatafile) FileID() int {
+	return cdf.id
+}
+
+func (cdf *cachedDatafile) Name() string {
+	return cdf.name
+}
+
+func (cdf *cachedDatafile) Close() error {
+	cdf.c.mu.Lock()
+	defer cdf.c.mu.Unlock()
+	return cdf.c.remove(cdf)
+}
+
+func (cdf *cachedDatafile) Sync() error {
+	return nil
+}
+
+func (cdf *cachedDatafile) Size() int64 {
+	return cdf.size
+}
+
+func (cdf *cachedDatafile) Read() (internal.Entry, int64, error) {
+	df, err := cdf.c.acquire(cdf)
+	if err != nil {
+		return internal.Entry{}, 0, err
+	}
+	defer cdf.c.release(cdf)
+
+	e, n, err := df.Read()
+	if err == nil {
+		cdf.c.mu.Lock()
+		cdf.offset += n
+		cdf.c.mu.Unlock()
+	}
+	return e, n, err
+}
+
+func (cdf *cachedDatafile) ReadAt(index, size int64) (internal.Entry, error) {
+	df, err := cdf.c.acquire(cdf)
+	if err != nil {
+		return internal.Entry{}, err
+	}
+	defer cdf.c.release(cdf)
+
+	return df.ReadAt(index, size)
+}
+
+func (cdf *cachedDatafile) ReadRaw(b []byte, index int64) (int, error) {
+	df, err := cdf.c.acquire(cdf)
+	if err != nil {
+		return 0, err
+	}
+	defer cdf.c.release(cdf)
+
+	return df.ReadRaw(b, index)
+}
+
+func (cdf *cachedDatafile) Write(internal.Entry) (int64, int64, error) {
+	return -1, 0, errReadonly
+}
+
+func (cdf *cachedDatafile) Reserve(internal.Entry) (int64, int64, error) {
+	return -1, 0, errReadonly
+}
+
+func (cdf *cachedDatafile) WriteAt(internal.Entry, int64) error {
+	return errReadonly
+}
+
+func (cdf *cachedDatafile) Truncate(int64) error {
+	return errReadonly
+}
@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Compression is how the value of an entry is compressed
+type Compression uint8
+
+const (
+	// CompressionNone stores values as is
+	CompressionNone Compression = iota
+
+	// CompressionGzip compresses values with gzip
+	CompressionGzip
+)
+
+var errValueTooLarge = errors.New("decompressed value is too large")
+
+// Valid returns true if the compression is known
+func (c Compression) Valid() bool {
+	return c == CompressionNone || c == CompressionGzip
+}
+
+// Compress returns the compressed value
+func (c Compression) Compress(value []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(value); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
+
+// Decompress returns the decompressed value, failing if it is larger than
+// maxValueSize
+func (c Compression) Decompress(value []byte, maxValueSize uint64) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing value")
+		}
+		limit := int64(math.MaxInt64)
+		if maxValueSize < math.MaxInt64 {
+			limit = int64(maxValueSize) + 1
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(r, limit))
+		if err != nil {
+			return nil, errors.Wrap(err, "decompressing value")
+		}
+		if uint64(len(value)) > maxValueSize {
+			return nil, errValueTooLarge
+		}
+		return value, r.Close()
+	}
+	return nil, errors.Errorf("unknown compression %d", c)
+}
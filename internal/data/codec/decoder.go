@@ -1,8 +1,10 @@
 package codec
 
 import (
+	"bufio"
 	"encoding/binary"
 	"io"
+	"math"
 
 	"github.com/pkg/errors"
 	"github.com/prologic/bitcask/internal"
@@ -14,19 +16,39 @@ var (
 	errTruncatedData         = errors.New("data is truncated")
 )
 
-// NewDecoder creates a streaming Entry decoder.
-func NewDecoder(r io.Reader, maxKeySize uint32, maxValueSize uint64) *Decoder {
-	return &Decoder{
+const maxInt = int(^uint(0) >> 1)
+
+// NewDecoder creates a streaming Entry decoder reading the given format.
+func NewDecoder(r io.Reader, format Format, maxKeySize uint32, maxValueSize uint64) *Decoder {
+	d := &Decoder{
 		r:            r,
+		format:       format,
 		maxKeySize:   maxKeySize,
 		maxValueSize: maxValueSize,
 	}
+	if format.varintSizes() {
+		// Varints are read a byte at a time
+		if br, ok := r.(byteReader); ok {
+			d.br = br
+		} else {
+			d.br = bufio.NewReader(r)
+		}
+		d.r = d.br
+	}
+	return d
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
 }
 
 // Decoder wraps an underlying io.Reader and allows you to stream
 // Entry decodings on it.
 type Decoder struct {
 	r            io.Reader
+	br           byteReader
+	format       Format
 	maxKeySize   uint32
 	maxValueSize uint64
 }
@@ -37,14 +59,21 @@ func (d *Decoder) Decode(v *internal.Entry) (int64, error) {
 		return 0, errCantDecodeOnNilEntry
 	}
 
-	prefixBuf := make([]byte, keySize+valueSize)
-
-	_, err := io.ReadFull(d.r, prefixBuf)
-	if err != nil {
-		return 0, err
+	var (
+		actualKeySize   uint32
+		actualValueSize uint64
+		expiry          int64
+		err             error
+	)
+	if d.br != nil {
+		actualKeySize, actualValueSize, expiry, err = d.readVarintSizes(v)
+	} else {
+		prefixBuf := make([]byte, keySize+valueSize)
+		if _, err = io.ReadFull(d.r, prefixBuf); err != nil {
+			return 0, err
+		}
+		actualKeySize, actualValueSize, err = getKeyValueSizes(prefixBuf, d.maxKeySize, d.maxValueSize)
 	}
-
-	actualKeySize, actualValueSize, err := getKeyValueSizes(prefixBuf, d.maxKeySize, d.maxValueSize)
 	if err != nil {
 		return 0, err
 	}
@@ -54,18 +83,133 @@ func (d *Decoder) Decode(v *internal.Entry) (int64, error) {
 		return 0, errTruncatedData
 	}
 
-	decodeWithoutPrefix(buf, actualKeySize, v)
-	return int64(keySize + valueSize + uint64(actualKeySize) + actualValueSize + checksumSize), nil
+	if err := decodeWithoutPrefix(buf, actualKeySize, actualValueSize, v); err != nil {
+		return 0, err
+	}
+	v.Expiry = expiry
+	return d.format.EntrySize(uint64(actualKeySize), actualValueSize, expiry), nil
 }
 
-// DecodeEntry decodes a serialized entry
-func DecodeEntry(b []byte, e *internal.Entry, maxKeySize uint32, maxValueSize uint64) error {
-	valueOffset, _, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
+// readVarintSizes reads the key and value sizes and the expiry of an entry,
+// setting its other metadata
+func (d *Decoder) readVarintSizes(v *internal.Entry) (uint32, uint64, int64, error) {
+	keyLen, err := binary.ReadUvarint(d.br)
+	if err == io.EOF {
+		return 0, 0, 0, io.EOF
+	}
+	if err != nil {
+		return 0, 0, 0, varintError(err)
+	}
+	valueLen, err := binary.ReadUvarint(d.br)
+	if err != nil {
+		return 0, 0, 0, varintError(err)
+	}
+	var expiry uint64
+	if d.format.HasExpiry() {
+		if expiry, err = binary.ReadUvarint(d.br); err != nil {
+			return 0, 0, 0, varintError(err)
+		}
+		if expiry > math.MaxInt64 {
+			return 0, 0, 0, errInvalidKeyOrValueSize
+		}
+	}
+	v.Origin, v.Compression, v.Version, v.Timestamp = 0, 0, 0, 0
+	if d.format.HasOrigin() {
+		buf := make([]byte, originSize)
+		if _, err := io.ReadFull(d.br, buf); err != nil {
+			return 0, 0, 0, errTruncatedData
+		}
+		v.Origin = binary.BigEndian.Uint32(buf)
+	}
+	if d.format.HasCompression() {
+		if v.Compression, err = d.br.ReadByte(); err != nil {
+			return 0, 0, 0, errTruncatedData
+		}
+	}
+	if d.format.HasVersion() {
+		buf := make([]byte, versionSize+timestampSize)
+		if _, err := io.ReadFull(d.br, buf); err != nil {
+			return 0, 0, 0, errTruncatedData
+		}
+		v.Version = binary.BigEndian.Uint64(buf)
+		v.Timestamp = int64(binary.BigEndian.Uint64(buf[versionSize:]))
+	}
+	actualKeySize, actualValueSize, err := checkKeyValueSizes(keyLen, valueLen, d.maxKeySize, d.maxValueSize)
+	return actualKeySize, actualValueSize, int64(expiry), err
+}
+
+func varintError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errTruncatedData
+	}
+	return errInvalidKeyOrValueSize
+}
+
+// DecodeEntry decodes a serialized entry of the given format
+func DecodeEntry(b []byte, e *internal.Entry, format Format, maxKeySize uint32, maxValueSize uint64) error {
+	var (
+		prefix          int
+		actualKeySize   uint32
+		actualValueSize uint64
+		expiry          uint64
+		err             error
+	)
+	if format.varintSizes() {
+		keyLen, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.Wrap(errInvalidKeyOrValueSize, "key/value sizes are invalid")
+		}
+		valueLen, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return errors.Wrap(errInvalidKeyOrValueSize, "key/value sizes are invalid")
+		}
+		prefix = n + m
+		if format.HasExpiry() {
+			var k int
+			expiry, k = binary.Uvarint(b[prefix:])
+			if k <= 0 || expiry > math.MaxInt64 {
+				return errors.Wrap(errInvalidKeyOrValueSize, "expiry is invalid")
+			}
+			prefix += k
+		}
+		if format.HasOrigin() {
+			if len(b) < prefix+originSize {
+				return errors.Wrap(errTruncatedData, "origin is truncated")
+			}
+			e.Origin = binary.BigEndian.Uint32(b[prefix:])
+			prefix += originSize
+		}
+		if format.HasCompression() {
+			if len(b) < prefix+compressionSize {
+				return errors.Wrap(errTruncatedData, "compression is truncated")
+			}
+			e.Compression = b[prefix]
+			prefix += compressionSize
+		}
+		if format.HasVersion() {
+			if len(b) < prefix+versionSize+timestampSize {
+				return errors.Wrap(errTruncatedData, "version is truncated")
+			}
+			e.Version = binary.BigEndian.Uint64(b[prefix:])
+			e.Timestamp = int64(binary.BigEndian.Uint64(b[prefix+versionSize:]))
+			prefix += versionSize + timestampSize
+		}
+		actualKeySize, actualValueSize, err = checkKeyValueSizes(keyLen, valueLen, maxKeySize, maxValueSize)
+	} else {
+		prefix = keySize + valueSize
+		if len(b) < prefix {
+			return errors.Wrap(errTruncatedData, "key/value sizes are truncated")
+		}
+		actualKeySize, actualValueSize, err = getKeyValueSizes(b, maxKeySize, maxValueSize)
+	}
 	if err != nil {
 		return errors.Wrap(err, "key/value sizes are invalid")
 	}
 
-	decodeWithoutPrefix(b[keySize+valueSize:], valueOffset, e)
+	if err := decodeWithoutPrefix(b[prefix:], actualKeySize, actualValueSize, e); err != nil {
+		return errors.Wrap(err, "entry is corrupted")
+	}
+	e.Expiry = int64(expiry)
 
 	return nil
 }
@@ -74,23 +218,41 @@ func getKeyValueSizes(buf []byte, maxKeySize uint32, maxValueSize uint64) (uint3
 	actualKeySize := binary.BigEndian.Uint32(buf[:keySize])
 	actualValueSize := binary.BigEndian.Uint64(buf[keySize:])
 
-	if actualKeySize > maxKeySize || actualValueSize > maxValueSize || actualKeySize == 0 {
+	return checkKeyValueSizes(uint64(actualKeySize), actualValueSize, maxKeySize, maxValueSize)
+}
+
+func checkKeyValueSizes(actualKeySize, actualValueSize uint64, maxKeySize uint32, maxValueSize uint64) (uint32, uint64, error) {
+	if actualKeySize > uint64(maxKeySize) || actualValueSize > maxValueSize || actualKeySize == 0 {
 
 		return 0, 0, errInvalidKeyOrValueSize
 	}
+	// The entry must fit in a byte slice (int is 32 bits on 32-bit platforms)
+	if actualValueSize > uint64(maxInt)-actualKeySize-checksumSize {
+		return 0, 0, errInvalidKeyOrValueSize
+	}
 
-	return actualKeySize, actualValueSize, nil
+	return uint32(actualKeySize), actualValueSize, nil
 }
 
-func decodeWithoutPrefix(buf []byte, valueOffset uint32, v *internal.Entry) {
-	v.Key = buf[:valueOffset]
-	v.Value = buf[valueOffset : len(buf)-checksumSize]
+// decodeWithoutPrefix decodes the key, value and checksum of an entry of the
+// given sizes. The value may be cut short, e.g. to decode only the header of
+// an entry, but the key and checksum may not.
+func decodeWithoutPrefix(buf []byte, keyLen uint32, valueLen uint64, v *internal.Entry) error {
+	if uint64(len(buf)) < uint64(keyLen)+checksumSize {
+		return errTruncatedData
+	}
+	if uint64(len(buf))-uint64(keyLen)-checksumSize > valueLen {
+		return errInvalidKeyOrValueSize
+	}
+	v.Key = buf[:keyLen]
+	v.Value = buf[keyLen : len(buf)-checksumSize]
 	v.Checksum = binary.BigEndian.Uint32(buf[len(buf)-checksumSize:])
+	return nil
 }
 
 // IsCorruptedData indicates if the error correspondes to possible data corruption
 func IsCorruptedData(err error) bool {
-	switch err {
+	switch errors.Cause(err) {
 	case errCantDecodeOnNilEntry, errInvalidKeyOrValueSize, errTruncatedData:
 		return true
 	default:
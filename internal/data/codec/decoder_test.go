@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"testing"
 
 	"github.com/prologic/bitcask/internal"
@@ -13,7 +14,7 @@ import (
 func TestDecodeOnNilEntry(t *testing.T) {
 	t.Parallel()
 	assert := assert.New(t)
-	decoder := NewDecoder(&bytes.Buffer{}, 1, 1)
+	decoder := NewDecoder(&bytes.Buffer{}, FormatLegacy, 1, 1)
 
 	_, err := decoder.Decode(nil)
 	if assert.Error(err) {
@@ -31,7 +32,7 @@ func TestShortPrefix(t *testing.T) {
 
 	truncBytesCount := 2
 	buf := bytes.NewBuffer(prefix[:keySize+valueSize-truncBytesCount])
-	decoder := NewDecoder(buf, maxKeySize, maxValueSize)
+	decoder := NewDecoder(buf, FormatLegacy, maxKeySize, maxValueSize)
 	_, err := decoder.Decode(&internal.Entry{})
 	if assert.Error(err) {
 		assert.Equal(io.ErrUnexpectedEOF, err)
@@ -62,7 +63,7 @@ func TestInvalidValueKeySizes(t *testing.T) {
 			binary.BigEndian.PutUint64(prefix[keySize:], tests[i].valueSize)
 
 			buf := bytes.NewBuffer(prefix)
-			decoder := NewDecoder(buf, maxKeySize, maxValueSize)
+			decoder := NewDecoder(buf, FormatLegacy, maxKeySize, maxValueSize)
 			_, err := decoder.Decode(&internal.Entry{})
 			if assert.Error(err) {
 				assert.Equal(errInvalidKeyOrValueSize, err)
@@ -71,6 +72,22 @@ func TestInvalidValueKeySizes(t *testing.T) {
 	}
 }
 
+func TestValueSizeOverflow(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// Sizes within the limits but too large for a byte slice
+	prefix := make([]byte, keySize+valueSize)
+	binary.BigEndian.PutUint32(prefix, 1)
+	binary.BigEndian.PutUint64(prefix[keySize:], uint64(maxInt))
+
+	decoder := NewDecoder(bytes.NewBuffer(prefix), FormatLegacy, 10, math.MaxUint64)
+	_, err := decoder.Decode(&internal.Entry{})
+	if assert.Error(err) {
+		assert.Equal(errInvalidKeyOrValueSize, err)
+	}
+}
+
 func TestTruncatedData(t *testing.T) {
 	assert := assert.New(t)
 	maxKeySize, maxValueSize := uint32(10), uint64(20)
@@ -99,7 +116,7 @@ func TestTruncatedData(t *testing.T) {
 		t.Run(tests[i].name, func(t *testing.T) {
 			t.Parallel()
 			buf := bytes.NewBuffer(tests[i].data)
-			decoder := NewDecoder(buf, maxKeySize, maxValueSize)
+			decoder := NewDecoder(buf, FormatLegacy, maxKeySize, maxValueSize)
 			_, err := decoder.Decode(&internal.Entry{})
 			if assert.Error(err) {
 				assert.Equal(errTruncatedData, err)
@@ -107,3 +124,46 @@ func TestTruncatedData(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeEntryCorrupted(t *testing.T) {
+	assert := assert.New(t)
+	maxKeySize, maxValueSize := uint32(10), uint64(20)
+
+	entry := func(format Format) []byte {
+		var buf bytes.Buffer
+		_, err := NewEncoder(&buf, format).Encode(internal.Entry{Key: []byte("foo"), Value: []byte("bar")})
+		assert.NoError(err)
+		return buf.Bytes()
+	}
+	legacy, compact := entry(FormatLegacy), entry(FormatCompact)
+
+	// A key size larger than the entry but within the limits
+	largeKey := append([]byte(nil), legacy...)
+	binary.BigEndian.PutUint32(largeKey, 9)
+	// A value size smaller than the entry
+	smallValue := append([]byte(nil), compact...)
+	smallValue[1] = 1
+
+	tests := []struct {
+		data   []byte
+		format Format
+		name   string
+	}{
+		{data: legacy[:keySize+valueSize-1], format: FormatLegacy, name: "truncated prefix"},
+		{data: legacy[:keySize+valueSize+2], format: FormatLegacy, name: "truncated key"},
+		{data: largeKey, format: FormatLegacy, name: "corrupted key size"},
+		{data: compact[:1], format: FormatCompact, name: "truncated varint prefix"},
+		{data: compact[:4], format: FormatCompact, name: "truncated checksum"},
+		{data: smallValue, format: FormatCompact, name: "corrupted value size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e internal.Entry
+			err := DecodeEntry(tt.data, &e, tt.format, maxKeySize, maxValueSize)
+			if assert.Error(err) {
+				assert.True(IsCorruptedData(err))
+			}
+		})
+	}
+}
@@ -10,28 +10,62 @@ import (
 )
 
 const (
-	keySize      = 4
-	valueSize    = 8
-	checksumSize = 4
+	keySize         = 4
+	valueSize       = 8
+	checksumSize    = 4
+	originSize      = 4
+	compressionSize = 1
+	versionSize     = 8
+	timestampSize   = 8
+
+	// MetaInfoSize is the size in bytes of the metadata (key and value size
+	// prefix and checksum) encoded alongside every key/value in the legacy
+	// format
+	MetaInfoSize = keySize + valueSize + checksumSize
 )
 
-// NewEncoder creates a streaming Entry encoder.
-func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: bufio.NewWriter(w)}
+// NewEncoder creates a streaming Entry encoder writing the given format.
+func NewEncoder(w io.Writer, format Format) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), format: format}
 }
 
 // Encoder wraps an underlying io.Writer and allows you to stream
 // Entry encodings on it.
 type Encoder struct {
-	w *bufio.Writer
+	w      *bufio.Writer
+	format Format
 }
 
 // Encode takes any Entry and streams it to the underlying writer.
 // Messages are framed with a key-length and value-length prefix.
 func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
-	var bufKeyValue = make([]byte, keySize+valueSize)
-	binary.BigEndian.PutUint32(bufKeyValue[:keySize], uint32(len(msg.Key)))
-	binary.BigEndian.PutUint64(bufKeyValue[keySize:keySize+valueSize], uint64(len(msg.Value)))
+	var bufKeyValue []byte
+	if e.format.varintSizes() {
+		bufKeyValue = make([]byte, 3*binary.MaxVarintLen64+originSize+compressionSize+versionSize+timestampSize)
+		n := binary.PutUvarint(bufKeyValue, uint64(len(msg.Key)))
+		n += binary.PutUvarint(bufKeyValue[n:], uint64(len(msg.Value)))
+		if e.format.HasExpiry() {
+			n += binary.PutUvarint(bufKeyValue[n:], uint64(msg.Expiry))
+		}
+		if e.format.HasOrigin() {
+			binary.BigEndian.PutUint32(bufKeyValue[n:], msg.Origin)
+			n += originSize
+		}
+		if e.format.HasCompression() {
+			bufKeyValue[n] = msg.Compression
+			n += compressionSize
+		}
+		if e.format.HasVersion() {
+			binary.BigEndian.PutUint64(bufKeyValue[n:], msg.Version)
+			binary.BigEndian.PutUint64(bufKeyValue[n+versionSize:], uint64(msg.Timestamp))
+			n += versionSize + timestampSize
+		}
+		bufKeyValue = bufKeyValue[:n]
+	} else {
+		bufKeyValue = make([]byte, keySize+valueSize)
+		binary.BigEndian.PutUint32(bufKeyValue[:keySize], uint32(len(msg.Key)))
+		binary.BigEndian.PutUint64(bufKeyValue[keySize:keySize+valueSize], uint64(len(msg.Value)))
+	}
 	if _, err := e.w.Write(bufKeyValue); err != nil {
 		return 0, errors.Wrap(err, "failed writing key & value length prefix")
 	}
@@ -43,7 +77,7 @@ func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
 		return 0, errors.Wrap(err, "failed writing value data")
 	}
 
-	bufChecksumSize := bufKeyValue[:checksumSize]
+	bufChecksumSize := make([]byte, checksumSize)
 	binary.BigEndian.PutUint32(bufChecksumSize, msg.Checksum)
 	if _, err := e.w.Write(bufChecksumSize); err != nil {
 		return 0, errors.Wrap(err, "failed writing checksum data")
@@ -53,5 +87,5 @@ func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
 		return 0, errors.Wrap(err, "failed flushing data")
 	}
 
-	return int64(keySize + valueSize + len(msg.Key) + len(msg.Value) + checksumSize), nil
+	return e.format.EntrySize(uint64(len(msg.Key)), uint64(len(msg.Value)), msg.Expiry), nil
 }
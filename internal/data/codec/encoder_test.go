@@ -14,7 +14,7 @@ func TestEncode(t *testing.T) {
 	assert := assert.New(t)
 
 	var buf bytes.Buffer
-	encoder := NewEncoder(&buf)
+	encoder := NewEncoder(&buf, FormatLegacy)
 	_, err := encoder.Encode(internal.Entry{
 		Key:      []byte("mykey"),
 		Value:    []byte("myvalue"),
@@ -0,0 +1,129 @@
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// Format is the on-disk format of the entries in a datafile
+type Format int
+
+const (
+	// FormatLegacy frames every entry with a fixed width 4 byte key size and
+	// 8 byte value size prefix
+	FormatLegacy Format = iota
+
+	// FormatCompact frames every entry with varint encoded key and value
+	// sizes, typically taking 2 bytes instead of 12 for small entries
+	FormatCompact
+
+	// FormatExpiry frames every entry like FormatCompact followed by the
+	// varint encoded expiry of the entry, taking 1 byte if it never expires
+	FormatExpiry
+
+	// FormatOrigin frames every entry like FormatExpiry followed by the 4
+	// byte id of the node that wrote the entry
+	FormatOrigin
+
+	// FormatCompression frames every entry like FormatOrigin followed by
+	// the 1 byte compression of the value
+	FormatCompression
+
+	// FormatVersion frames every entry like FormatCompression followed by
+	// the 8 byte version and 8 byte timestamp of the entry
+	FormatVersion
+)
+
+// Valid returns true if the format is known
+func (f Format) Valid() bool {
+	return f >= FormatLegacy && f <= FormatVersion
+}
+
+// HasExpiry returns true if the format encodes the expiry of entries
+func (f Format) HasExpiry() bool {
+	return f >= FormatExpiry && f.Valid()
+}
+
+// HasOrigin returns true if the format encodes the origin of entries
+func (f Format) HasOrigin() bool {
+	return f >= FormatOrigin && f.Valid()
+}
+
+// HasCompression returns true if the format encodes the compression of
+// the values of entries
+func (f Format) HasCompression() bool {
+	return f >= FormatCompression && f.Valid()
+}
+
+// HasVersion returns true if the format encodes the version and timestamp
+// of entries
+func (f Format) HasVersion() bool {
+	return f == FormatVersion
+}
+
+// varintSizes returns true if the format encodes sizes as varints
+func (f Format) varintSizes() bool {
+	return f != FormatLegacy
+}
+
+// EntrySize returns the encoded size of an entry with the given key and
+// value sizes and expiry
+func (f Format) EntrySize(keyLen, valueLen uint64, expiry int64) int64 {
+	return int64(f.prefixSize(keyLen, valueLen, expiry) + keyLen + valueLen + checksumSize)
+}
+
+// ValueSize returns the value size of an encoded entry of the given size
+// with the given key size and expiry
+func (f Format) ValueSize(keyLen uint64, size, expiry int64) uint64 {
+	if f == FormatLegacy {
+		return uint64(size) - keyLen - MetaInfoSize
+	}
+
+	rest := uint64(size) - keyLen - checksumSize - uvarintSize(keyLen)
+	if f.HasExpiry() {
+		rest -= uvarintSize(uint64(expiry))
+	}
+	if f.HasOrigin() {
+		rest -= originSize
+	}
+	if f.HasCompression() {
+		rest -= compressionSize
+	}
+	if f.HasVersion() {
+		rest -= versionSize + timestampSize
+	}
+	for n := uint64(1); n <= binary.MaxVarintLen64; n++ {
+		if uvarintSize(rest-n) == n {
+			return rest - n
+		}
+	}
+	return 0
+}
+
+func (f Format) prefixSize(keyLen, valueLen uint64, expiry int64) uint64 {
+	if f == FormatLegacy {
+		return keySize + valueSize
+	}
+	size := uvarintSize(keyLen) + uvarintSize(valueLen)
+	if f.HasExpiry() {
+		size += uvarintSize(uint64(expiry))
+	}
+	if f.HasOrigin() {
+		size += originSize
+	}
+	if f.HasCompression() {
+		size += compressionSize
+	}
+	if f.HasVersion() {
+		size += versionSize + timestampSize
+	}
+	return size
+}
+
+func uvarintSize(x uint64) uint64 {
+	n := uint64(1)
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
@@ -0,0 +1,270 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, FormatCompact)
+	n, err := encoder.Encode(internal.Entry{
+		Key:      []byte("mykey"),
+		Value:    []byte("myvalue"),
+		Checksum: 414141,
+	})
+
+	expectedHex := "05076d796b65796d7976616c7565000651bd"
+	if assert.NoError(err) {
+		assert.Equal(expectedHex, hex.EncodeToString(buf.Bytes()))
+		assert.Equal(int64(buf.Len()), n)
+	}
+}
+
+func TestDecodeCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := []internal.Entry{
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 1},
+		{Key: []byte("foo"), Value: []byte{}, Checksum: 2},
+		{Key: bytes.Repeat([]byte("k"), 200), Value: bytes.Repeat([]byte("v"), 20000), Checksum: 3},
+	}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, FormatCompact)
+	var sizes []int64
+	for _, e := range entries {
+		n, err := encoder.Encode(e)
+		assert.NoError(err)
+		sizes = append(sizes, n)
+	}
+	data := buf.Bytes()
+
+	decoder := NewDecoder(bytes.NewReader(data), FormatCompact, 256, 1<<16)
+	var offset int64
+	for i, expected := range entries {
+		var e internal.Entry
+		n, err := decoder.Decode(&e)
+		assert.NoError(err)
+		assert.Equal(sizes[i], n)
+		assert.Equal(expected.Key, e.Key)
+		assert.Equal(expected.Value, e.Value)
+		assert.Equal(expected.Checksum, e.Checksum)
+
+		e = internal.Entry{}
+		assert.NoError(DecodeEntry(data[offset:offset+n], &e, FormatCompact, 256, 1<<16))
+		assert.Equal(expected.Key, e.Key)
+		assert.Equal(expected.Value, e.Value)
+		offset += n
+	}
+	_, err := decoder.Decode(&internal.Entry{})
+	assert.Equal(io.EOF, err)
+
+	t.Run("Truncated", func(t *testing.T) {
+		last := data[offset-sizes[2]:]
+		for _, size := range []int{1, 3, len(last) - 1} {
+			decoder := NewDecoder(bytes.NewReader(last[:size]), FormatCompact, 256, 1<<16)
+			_, err := decoder.Decode(&internal.Entry{})
+			assert.Equal(errTruncatedData, err)
+		}
+	})
+
+	t.Run("InvalidSizes", func(t *testing.T) {
+		decoder := NewDecoder(bytes.NewReader(data), FormatCompact, 2, 1<<16)
+		_, err := decoder.Decode(&internal.Entry{})
+		assert.Equal(errInvalidKeyOrValueSize, err)
+
+		decoder = NewDecoder(bytes.NewReader([]byte{0, 1, 0, 0, 0, 0, 0}), FormatCompact, 2, 1<<16)
+		_, err = decoder.Decode(&internal.Entry{})
+		assert.Equal(errInvalidKeyOrValueSize, err)
+	})
+}
+
+func TestDecodeExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := []internal.Entry{
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 1, Expiry: 1 << 60},
+		{Key: []byte("foo"), Value: []byte("bar"), Checksum: 2},
+	}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, FormatExpiry)
+	var sizes []int64
+	for _, e := range entries {
+		n, err := encoder.Encode(e)
+		assert.NoError(err)
+		sizes = append(sizes, n)
+	}
+	data := buf.Bytes()
+	assert.Equal(int64(len(data)), sizes[0]+sizes[1])
+
+	decoder := NewDecoder(bytes.NewReader(data), FormatExpiry, 256, 1<<16)
+	var offset int64
+	for i, expected := range entries {
+		var e internal.Entry
+		n, err := decoder.Decode(&e)
+		assert.NoError(err)
+		assert.Equal(sizes[i], n)
+		assert.Equal(expected, e)
+
+		e = internal.Entry{}
+		assert.NoError(DecodeEntry(data[offset:offset+n], &e, FormatExpiry, 256, 1<<16))
+		assert.Equal(expected, e)
+		offset += n
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		decoder := NewDecoder(bytes.NewReader(data[:4]), FormatExpiry, 256, 1<<16)
+		_, err := decoder.Decode(&internal.Entry{})
+		assert.Equal(errTruncatedData, err)
+	})
+}
+
+func TestDecodeOrigin(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 1, Expiry: 1 << 60, Origin: 42}
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf, FormatOrigin).Encode(expected)
+	assert.NoError(err)
+	assert.Equal(int64(buf.Len()), n)
+	data := buf.Bytes()
+
+	var e internal.Entry
+	m, err := NewDecoder(bytes.NewReader(data), FormatOrigin, 256, 1<<16).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal(expected, e)
+
+	e = internal.Entry{}
+	assert.NoError(DecodeEntry(data, &e, FormatOrigin, 256, 1<<16))
+	assert.Equal(expected, e)
+
+	// Truncated in the middle of the origin
+	_, err = NewDecoder(bytes.NewReader(data[:12]), FormatOrigin, 256, 1<<16).Decode(&internal.Entry{})
+	assert.Equal(errTruncatedData, err)
+}
+
+func TestDecodeCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 1, Expiry: 1 << 60, Origin: 42, Compression: uint8(CompressionGzip)}
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf, FormatCompression).Encode(expected)
+	assert.NoError(err)
+	assert.Equal(int64(buf.Len()), n)
+	data := buf.Bytes()
+
+	var e internal.Entry
+	m, err := NewDecoder(bytes.NewReader(data), FormatCompression, 256, 1<<16).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal(expected, e)
+
+	e = internal.Entry{}
+	assert.NoError(DecodeEntry(data, &e, FormatCompression, 256, 1<<16))
+	assert.Equal(expected, e)
+
+	// Truncated before the compression
+	_, err = NewDecoder(bytes.NewReader(data[:14]), FormatCompression, 256, 1<<16).Decode(&internal.Entry{})
+	assert.Equal(errTruncatedData, err)
+}
+
+func TestDecodeVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := internal.Entry{Key: []byte("foo"), Value: []byte("bar"), Checksum: 1, Origin: 42, Version: 1 << 40, Timestamp: 1 << 60}
+
+	var buf bytes.Buffer
+	n, err := NewEncoder(&buf, FormatVersion).Encode(expected)
+	assert.NoError(err)
+	assert.Equal(int64(buf.Len()), n)
+	assert.Equal(FormatVersion.EntrySize(3, 3, 0), n)
+	data := buf.Bytes()
+
+	var e internal.Entry
+	m, err := NewDecoder(bytes.NewReader(data), FormatVersion, 256, 1<<16).Decode(&e)
+	assert.NoError(err)
+	assert.Equal(n, m)
+	assert.Equal(expected, e)
+
+	e = internal.Entry{}
+	assert.NoError(DecodeEntry(data, &e, FormatVersion, 256, 1<<16))
+	assert.Equal(expected, e)
+
+	// Truncated in the middle of the timestamp
+	_, err = NewDecoder(bytes.NewReader(data[:20]), FormatVersion, 256, 1<<16).Decode(&internal.Entry{})
+	assert.Equal(errTruncatedData, err)
+	assert.Error(DecodeEntry(data[:20], &internal.Entry{}, FormatVersion, 256, 1<<16))
+}
+
+func TestCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	value := bytes.Repeat([]byte("foobar"), 100)
+	for _, c := range []Compression{CompressionNone, CompressionGzip} {
+		assert.True(c.Valid())
+		compressed, err := c.Compress(value)
+		assert.NoError(err)
+		actual, err := c.Decompress(compressed, 1<<16)
+		assert.NoError(err)
+		assert.Equal(value, actual)
+	}
+
+	compressed, err := CompressionGzip.Compress(value)
+	assert.NoError(err)
+	assert.True(len(compressed) < len(value))
+	_, err = CompressionGzip.Decompress(compressed, 100)
+	assert.Equal(errValueTooLarge, err)
+	_, err = CompressionGzip.Decompress([]byte("foo"), 1<<16)
+	assert.Error(err)
+
+	assert.False(Compression(2).Valid())
+}
+
+func TestFormatSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, format := range []Format{FormatLegacy, FormatCompact, FormatExpiry, FormatOrigin, FormatCompression, FormatVersion} {
+		for _, keyLen := range []uint64{1, 127, 128, 300} {
+			for _, valueLen := range []uint64{0, 1, 126, 127, 128, 16383, 16384, 1 << 30} {
+				for _, expiry := range []int64{0, 1 << 60} {
+					size := format.EntrySize(keyLen, valueLen, expiry)
+					assert.Equal(valueLen, format.ValueSize(keyLen, size, expiry))
+				}
+			}
+		}
+	}
+
+	assert.Equal(int64(22), FormatLegacy.EntrySize(3, 3, 0))
+	assert.Equal(int64(12), FormatCompact.EntrySize(3, 3, 0))
+	assert.Equal(int64(12), FormatCompact.EntrySize(3, 3, 1<<60))
+	assert.Equal(int64(13), FormatExpiry.EntrySize(3, 3, 0))
+	assert.Equal(int64(21), FormatExpiry.EntrySize(3, 3, 1<<60))
+	assert.Equal(int64(17), FormatOrigin.EntrySize(3, 3, 0))
+	assert.Equal(int64(18), FormatCompression.EntrySize(3, 3, 0))
+	assert.Equal(int64(34), FormatVersion.EntrySize(3, 3, 0))
+	assert.True(FormatLegacy.Valid())
+	assert.True(FormatCompact.Valid())
+	assert.True(FormatExpiry.Valid())
+	assert.True(FormatOrigin.Valid())
+	assert.True(FormatCompression.Valid())
+	assert.True(FormatCompression.HasExpiry())
+	assert.True(FormatCompression.HasOrigin())
+	assert.True(FormatVersion.Valid())
+	assert.True(FormatVersion.HasCompression())
+	assert.False(FormatCompression.HasVersion())
+	assert.False(Format(6).Valid())
+	assert.False(Format(6).HasExpiry())
+	assert.False(Format(6).HasCompression())
+}
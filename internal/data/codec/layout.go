@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Field describes a field of an encoded entry
+type Field struct {
+	// Name is the name of the field
+	Name string `json:"name"`
+	// Encoding is how the field is encoded: uint8, uint32 or uint64 (big
+	// endian), uvarint or bytes
+	Encoding string `json:"encoding"`
+	// Offset is the offset of the field from the start of the entry, -1 if
+	// it follows a field of variable size
+	Offset int `json:"offset"`
+	// Size is the size of the field in bytes, -1 if it is variable
+	Size int `json:"size"`
+	// Description describes the value of the field
+	Description string `json:"description"`
+}
+
+// entry is the layout of an encoded entry, in order. The format tag of a
+// field gives its name, its encoding and the first and, optionally, last
+// format encoding it. The doc tag describes its value.
+type entry struct {
+	KeySize     uint32 `format:"key_size,uint32,0,0" doc:"size of the key in bytes"`
+	ValueSize   uint64 `format:"value_size,uint64,0,0" doc:"size of the value in bytes"`
+	KeyLen      uint64 `format:"key_size,uvarint,1" doc:"size of the key in bytes"`
+	ValueLen    uint64 `format:"value_size,uvarint,1" doc:"size of the value in bytes"`
+	Expiry      uint64 `format:"expiry,uvarint,2" doc:"when the entry expires in Unix nanoseconds, 0 if never"`
+	Origin      uint32 `format:"origin,uint32,3" doc:"id of the node that wrote the entry, 0 if unknown"`
+	Compression uint8  `format:"compression,uint8,4" doc:"compression of the value: 0 none, 1 gzip"`
+	Version     uint64 `format:"version,uint64,5" doc:"version of the entry, increasing with every write to the database"`
+	Timestamp   uint64 `format:"timestamp,uint64,5" doc:"when the entry was written in Unix nanoseconds"`
+	Key         []byte `format:"key,bytes,0" doc:"key_size bytes of key"`
+	Value       []byte `format:"value,bytes,0" doc:"value_size bytes of value, as stored"`
+	Checksum    uint32 `format:"checksum,uint32,0" doc:"CRC-32 (IEEE) of the stored value, inverted in batch headers"`
+}
+
+// encodingSizes are the sizes of the fixed size encodings
+var encodingSizes = map[string]int{
+	"uint8":  1,
+	"uint32": 4,
+	"uint64": 8,
+}
+
+// Describe returns the fields of the entries encoded in the format, in
+// order, or nil if the format is not valid
+func (f Format) Describe() []Field {
+	if !f.Valid() {
+		return nil
+	}
+
+	var fields []Field
+	offset := 0
+	t := reflect.TypeOf(entry{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("format"), ",")
+		first, _ := strconv.Atoi(tag[2])
+		last := int(FormatVersion)
+		if len(tag) > 3 {
+			last, _ = strconv.Atoi(tag[3])
+		}
+		if int(f) < first || int(f) > last {
+			continue
+		}
+
+		size, ok := encodingSizes[tag[1]]
+		if !ok {
+			size = -1
+		}
+		fields = append(fields, Field{
+			Name:        tag[0],
+			Encoding:    tag[1],
+			Offset:      offset,
+			Size:        size,
+			Description: t.Field(i).Tag.Get("doc"),
+		})
+		if offset >= 0 && size >= 0 {
+			offset += size
+		} else {
+			offset = -1
+		}
+	}
+	return fields
+}
@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(Format(-1).Describe())
+	assert.Nil(Format(FormatVersion + 1).Describe())
+
+	entry := internal.Entry{
+		Key:         []byte("mykey"),
+		Value:       []byte("myvalue"),
+		Checksum:    414141,
+		Expiry:      1 << 40,
+		Origin:      7,
+		Compression: 1,
+		Version:     42,
+		Timestamp:   1 << 50,
+	}
+	for f := FormatLegacy; f <= FormatVersion; f++ {
+		e := entry
+		if !f.HasExpiry() {
+			e.Expiry = 0
+		}
+		if !f.HasOrigin() {
+			e.Origin = 0
+		}
+		if !f.HasCompression() {
+			e.Compression = 0
+		}
+		if !f.HasVersion() {
+			e.Version, e.Timestamp = 0, 0
+		}
+		var buf bytes.Buffer
+		_, err := NewEncoder(&buf, f).Encode(e)
+		assert.NoError(err)
+
+		// Decode the entry by walking its description
+		b := buf.Bytes()
+		values := make(map[string]uint64)
+		var offset int
+		for _, field := range f.Describe() {
+			if field.Offset >= 0 {
+				assert.Equal(offset, field.Offset, field.Name)
+			}
+			switch field.Encoding {
+			case "uint8":
+				values[field.Name] = uint64(b[offset])
+			case "uint32":
+				values[field.Name] = uint64(binary.BigEndian.Uint32(b[offset:]))
+			case "uint64":
+				values[field.Name] = binary.BigEndian.Uint64(b[offset:])
+			case "uvarint":
+				var n int
+				values[field.Name], n = binary.Uvarint(b[offset:])
+				offset += n
+				continue
+			case "bytes":
+				size := int(values[field.Name+"_size"])
+				data := b[offset : offset+size]
+				if field.Name == "key" {
+					assert.Equal(e.Key, data)
+				} else {
+					assert.Equal(e.Value, data)
+				}
+				offset += size
+				continue
+			default:
+				t.Fatalf("format %d field %s has unknown encoding %s", f, field.Name, field.Encoding)
+			}
+			offset += field.Size
+		}
+		assert.Equal(len(b), offset)
+		assert.Equal(uint64(e.Checksum), values["checksum"])
+		assert.Equal(uint64(e.Expiry), values["expiry"])
+		assert.Equal(uint64(e.Origin), values["origin"])
+		assert.Equal(uint64(e.Compression), values["compression"])
+		assert.Equal(e.Version, values["version"])
+		assert.Equal(uint64(e.Timestamp), values["timestamp"])
+	}
+}
@@ -1,12 +1,14 @@
 package data
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/prologic/bitcask/fs"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/data/codec"
 	"golang.org/x/exp/mmap"
@@ -30,42 +32,57 @@ type Datafile interface {
 	Size() int64
 	Read() (internal.Entry, int64, error)
 	ReadAt(index, size int64) (internal.Entry, error)
+	ReadRaw(b []byte, index int64) (int, error)
 	Write(internal.Entry) (int64, int64, error)
+	Reserve(internal.Entry) (int64, int64, error)
+	WriteAt(internal.Entry, int64) error
+	Truncate(int64) error
 }
 
 type datafile struct {
 	sync.RWMutex
 
 	id           int
-	r            *os.File
+	r            fs.File
 	ra           *mmap.ReaderAt
-	w            *os.File
+	w            fs.File
 	offset       int64
 	dec          *codec.Decoder
-	enc          *codec.Encoder
 	maxKeySize   uint32
 	maxValueSize uint64
+	format       codec.Format
 }
 
 // NewDatafile opens an existing datafile
-func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64) (Datafile, error) {
+func NewDatafile(fsys fs.FileSystem, path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64, format codec.Format) (Datafile, error) {
+	return openDatafile(fsys, path, id, readonly, readonly, maxKeySize, maxValueSize, format)
+}
+
+// NewUnmappedDatafile opens an existing datafile read-only without memory
+// mapping it, so entries appended to it by another process can be read
+func NewUnmappedDatafile(fsys fs.FileSystem, path string, id int, maxKeySize uint32, maxValueSize uint64, format codec.Format) (Datafile, error) {
+	return openDatafile(fsys, path, id, true, false, maxKeySize, maxValueSize, format)
+}
+
+func openDatafile(fsys fs.FileSystem, path string, id int, readonly, mmapped bool, maxKeySize uint32, maxValueSize uint64, format codec.Format) (Datafile, error) {
 	var (
-		r   *os.File
+		r   fs.File
 		ra  *mmap.ReaderAt
-		w   *os.File
+		w   fs.File
 		err error
 	)
 
 	fn := filepath.Join(path, fmt.Sprintf(defaultDatafileFilename, id))
 
 	if !readonly {
-		w, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		// Not O_APPEND as entries are written at their reserved offsets
+		w, err = fsys.OpenFile(fn, os.O_WRONLY|os.O_CREATE, 0640)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	r, err = os.Open(fn)
+	r, err = fs.Open(fsys, fn)
 	if err != nil {
 		return nil, err
 	}
@@ -74,15 +91,19 @@ func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValue
 		return nil, errors.Wrap(err, "error calling Stat()")
 	}
 
-	ra, err = mmap.Open(fn)
-	if err != nil {
-		return nil, err
-	}
-
 	offset := stat.Size()
 
-	dec := codec.NewDecoder(r, maxKeySize, maxValueSize)
-	enc := codec.NewEncoder(w)
+	// Read-only datafiles of the operating system's file system are memory
+	// mapped unless too large for the address space (over 2GB on 32-bit
+	// platforms), the mapping fails or the platform cannot remove mapped
+	// files, in which case they are read with pread like the current datafile
+	if _, ok := r.(*os.File); ok && mmapped && mmapSupported && offset == int64(int(offset)) {
+		if ra, err = mmap.Open(fn); err != nil {
+			ra = nil
+		}
+	}
+
+	dec := codec.NewDecoder(r, format, maxKeySize, maxValueSize)
 
 	return &datafile{
 		id:           id,
@@ -91,9 +112,9 @@ func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValue
 		w:            w,
 		offset:       offset,
 		dec:          dec,
-		enc:          enc,
 		maxKeySize:   maxKeySize,
 		maxValueSize: maxValueSize,
+		format:       format,
 	}, nil
 }
 
@@ -107,7 +128,9 @@ func (df *datafile) Name() string {
 
 func (df *datafile) Close() error {
 	defer func() {
-		df.ra.Close()
+		if df.ra != nil {
+			df.ra.Close()
+		}
 		df.r.Close()
 	}()
 
@@ -153,9 +176,13 @@ func (df *datafile) Read() (e internal.Entry, n int64, err error) {
 func (df *datafile) ReadAt(index, size int64) (e internal.Entry, err error) {
 	var n int
 
+	if size < 0 || size != int64(int(size)) {
+		err = errReadError
+		return
+	}
 	b := make([]byte, size)
 
-	if df.w == nil {
+	if df.ra != nil {
 		n, err = df.ra.ReadAt(b, index)
 	} else {
 		n, err = df.r.ReadAt(b, index)
@@ -168,11 +195,21 @@ func (df *datafile) ReadAt(index, size int64) (e internal.Entry, err error) {
 		return
 	}
 
-	codec.DecodeEntry(b, &e, df.maxKeySize, df.maxValueSize)
+	err = codec.DecodeEntry(b, &e, df.format, df.maxKeySize, df.maxValueSize)
 
 	return
 }
 
+// ReadRaw reads len(b) bytes of the datafile as is from offset index, like
+// io.ReaderAt
+func (df *datafile) ReadRaw(b []byte, index int64) (int, error) {
+	if df.ra != nil {
+		return df.ra.ReadAt(b, index)
+	}
+	return df.r.ReadAt(b, index)
+}
+
+// Write appends an entry to the datafile
 func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 	if df.w == nil {
 		return -1, 0, errReadonly
@@ -183,7 +220,7 @@ func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 
 	e.Offset = df.offset
 
-	n, err := df.enc.Encode(e)
+	n, err := df.writeAt(e, e.Offset)
 	if err != nil {
 		return -1, 0, err
 	}
@@ -191,3 +228,61 @@ func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 
 	return e.Offset, n, nil
 }
+
+// Reserve reserves space for the entry at the end of the datafile to be
+// written with WriteAt(), returning its offset and size. Space reserved but
+// never written is read back as a corrupted entry.
+func (df *datafile) Reserve(e internal.Entry) (int64, int64, error) {
+	if df.w == nil {
+		return -1, 0, errReadonly
+	}
+
+	df.Lock()
+	defer df.Unlock()
+
+	offset := df.offset
+	n := df.format.EntrySize(uint64(len(e.Key)), uint64(len(e.Value)), e.Expiry)
+	df.offset += n
+
+	return offset, n, nil
+}
+
+// WriteAt writes the entry to the space reserved for it at offset by
+// Reserve(). Entries may be written concurrently to their reserved space.
+func (df *datafile) WriteAt(e internal.Entry, offset int64) error {
+	if df.w == nil {
+		return errReadonly
+	}
+
+	_, err := df.writeAt(e, offset)
+	return err
+}
+
+// Truncate discards the entries at and after offset, such as those reserved
+// after an entry failed to be written. None of them may be in flight.
+func (df *datafile) Truncate(offset int64) error {
+	if df.w == nil {
+		return errReadonly
+	}
+
+	df.Lock()
+	defer df.Unlock()
+
+	if err := df.w.Truncate(offset); err != nil {
+		return err
+	}
+	df.offset = offset
+	return nil
+}
+
+func (df *datafile) writeAt(e internal.Entry, offset int64) (int64, error) {
+	var buf bytes.Buffer
+	n, err := codec.NewEncoder(&buf, df.format).Encode(e)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := df.w.WriteAt(buf.Bytes(), offset); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package data
+
+// mmapSupported is true if memory mapped datafiles can be removed, e.g. by
+// the merge of another process
+const mmapSupported = true
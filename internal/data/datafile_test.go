@@ -0,0 +1,121 @@
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLargeOffsets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test creating a large sparse file in short mode")
+	}
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// A sparse datafile past 4GB so offsets overflow 32 bits
+	const size = int64(5 << 30)
+	f, err := os.Create(filepath.Join(testdir, fmt.Sprintf(defaultDatafileFilename, 0)))
+	assert.NoError(err)
+	assert.NoError(f.Truncate(size))
+	assert.NoError(f.Close())
+
+	for _, format := range []codec.Format{codec.FormatLegacy, codec.FormatCompact} {
+		t.Run(fmt.Sprintf("Format%d", format), func(t *testing.T) {
+			df, err := NewDatafile(fs.OS, testdir, 0, false, 64, 1<<16, format)
+			assert.NoError(err)
+
+			e := internal.NewEntry([]byte("foo"), []byte("bar"))
+			offset, n, err := df.Write(e)
+			assert.NoError(err)
+			assert.True(offset >= size)
+			assert.Equal(offset+n, df.Size())
+
+			actual, err := df.ReadAt(offset, n)
+			assert.NoError(err)
+			assert.Equal(e.Value, actual.Value)
+			assert.NoError(df.Close())
+
+			df, err = NewDatafile(fs.OS, testdir, 0, true, 64, 1<<16, format)
+			assert.NoError(err)
+			defer df.Close()
+
+			actual, err = df.ReadAt(offset, n)
+			assert.NoError(err)
+			assert.Equal(e.Key, actual.Key)
+			assert.Equal(e.Value, actual.Value)
+		})
+	}
+}
+
+func TestReadAtInvalidSize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	df, err := NewDatafile(fs.OS, testdir, 0, false, 64, 1<<16, codec.FormatLegacy)
+	assert.NoError(err)
+	defer df.Close()
+
+	_, err = df.ReadAt(0, -1)
+	assert.Equal(errReadError, err)
+}
+
+func TestReadAtCorrupted(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	df, err := NewDatafile(fs.OS, testdir, 0, false, 64, 1<<16, codec.FormatLegacy)
+	assert.NoError(err)
+	defer df.Close()
+
+	_, n, err := df.Write(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(err)
+
+	// Cut within the key
+	_, err = df.ReadAt(0, n-8)
+	assert.True(codec.IsCorruptedData(err))
+}
+
+func TestCacheMMap(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	df, err := NewDatafile(fs.OS, testdir, 0, false, 64, 1<<16, codec.FormatLegacy)
+	assert.NoError(err)
+	_, n, err := df.Write(internal.NewEntry([]byte("foo"), []byte("bar")))
+	assert.NoError(err)
+	assert.NoError(df.Close())
+
+	for _, unmapped := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Unmapped%v", unmapped), func(t *testing.T) {
+			df, err := NewCache(fs.OS, 0, false, unmapped).Open(testdir, 0, 64, 1<<16, codec.FormatLegacy)
+			assert.NoError(err)
+			defer df.Close()
+			assert.Equal(!unmapped, df.(*datafile).ra != nil)
+
+			e, err := df.ReadAt(0, n)
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), e.Value)
+		})
+	}
+}
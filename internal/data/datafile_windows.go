@@ -0,0 +1,5 @@
+package data
+
+// mmapSupported is false as Windows cannot remove memory mapped files, so
+// a merge would fail to remove the datafiles mapped by another process
+const mmapSupported = false
@@ -5,7 +5,9 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/prologic/bitcask/fs"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data/codec"
@@ -16,31 +18,34 @@ import (
 // the longest non-corrupted prefix will be kept and the rest
 // will be *deleted*. Also, the index file is also *deleted* which
 // will be automatically recreated on next startup.
-func CheckAndRecover(path string, cfg *config.Config) error {
-	dfs, err := internal.GetDatafiles(path)
+// A report of the recovery is returned if the datafile was recovered,
+// otherwise nil.
+func CheckAndRecover(path string, cfg *config.Config) (*internal.RecoveryReport, error) {
+	dfs, err := internal.GetDatafiles(cfg.FS(), path)
 	if err != nil {
-		return fmt.Errorf("scanning datafiles: %s", err)
+		return nil, fmt.Errorf("scanning datafiles: %s", err)
 	}
 	if len(dfs) == 0 {
-		return nil
+		return nil, nil
 	}
 	f := dfs[len(dfs)-1]
-	recovered, err := recoverDatafile(f, cfg)
+	report, err := recoverDatafile(f, cfg)
 	if err != nil {
-		return fmt.Errorf("recovering data file")
+		return nil, fmt.Errorf("recovering data file: %w", err)
 	}
-	if recovered {
-		if err := os.Remove(filepath.Join(path, "index")); err != nil {
-			return fmt.Errorf("error deleting the index on recovery: %s", err)
+	if report != nil {
+		if err := cfg.FS().Remove(filepath.Join(path, "index")); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error deleting the index on recovery: %s", err)
 		}
 	}
-	return nil
+	return report, nil
 }
 
-func recoverDatafile(path string, cfg *config.Config) (recovered bool, err error) {
-	f, err := os.Open(path)
+func recoverDatafile(path string, cfg *config.Config) (report *internal.RecoveryReport, err error) {
+	fsys := cfg.FS()
+	f, err := fs.Open(fsys, path)
 	if err != nil {
-		return false, fmt.Errorf("opening the datafile: %s", err)
+		return nil, fmt.Errorf("opening the datafile: %s", err)
 	}
 	defer func() {
 		closeErr := f.Close()
@@ -48,11 +53,10 @@ func recoverDatafile(path string, cfg *config.Config) (recovered bool, err error
 			err = closeErr
 		}
 	}()
-	_, file := filepath.Split(path)
-	rPath := fmt.Sprintf("%s.recovered", file)
-	fr, err := os.OpenFile(rPath, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	rPath := fmt.Sprintf("%s.recovered", path)
+	fr, err := fsys.OpenFile(rPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
-		return false, fmt.Errorf("creating the recovered datafile: %w", err)
+		return nil, fmt.Errorf("creating the recovered datafile: %w", err)
 	}
 	defer func() {
 		closeErr := fr.Close()
@@ -61,35 +65,81 @@ func recoverDatafile(path string, cfg *config.Config) (recovered bool, err error
 		}
 	}()
 
-	dec := codec.NewDecoder(f, cfg.MaxKeySize, cfg.MaxValueSize)
-	enc := codec.NewEncoder(fr)
+	format := codec.Format(cfg.FormatVersion)
+	dec := codec.NewDecoder(f, format, cfg.MaxKeySize, cfg.MaxValueSize)
+	enc := codec.NewEncoder(fr, format)
 	e := internal.Entry{}
 
-	corrupted := false
+	var (
+		size      int64
+		entries   int
+		corrupted bool
+
+		// batch buffers the entries of a batch, which are only recovered
+		// if the batch is complete
+		batch     []internal.Entry
+		batchSize int64
+		batchLeft int
+	)
 	for !corrupted {
-		_, err = dec.Decode(&e)
+		n, err := dec.Decode(&e)
 		if err == io.EOF {
+			// A partially written batch is truncated
+			corrupted = batchLeft > 0
 			break
 		}
-		if codec.IsCorruptedData(err) {
+		// A torn key/value size prefix is reported as an unexpected EOF
+		if codec.IsCorruptedData(err) || err == io.ErrUnexpectedEOF {
 			corrupted = true
 			continue
 		}
 		if err != nil {
-			return false, fmt.Errorf("unexpected error while reading datafile: %w", err)
+			return nil, fmt.Errorf("unexpected error while reading datafile: %w", err)
+		}
+
+		if batchLeft == 0 {
+			if count, ok := BatchHeader(e); ok {
+				batch, batchSize, batchLeft = []internal.Entry{e}, n, count
+				if batchLeft > 0 {
+					continue
+				}
+			} else {
+				batch, batchSize = []internal.Entry{e}, n
+			}
+		} else {
+			batch = append(batch, e)
+			batchSize += n
+			if batchLeft--; batchLeft > 0 {
+				continue
+			}
 		}
-		if _, err := enc.Encode(e); err != nil {
-			return false, fmt.Errorf("writing to recovered datafile: %w", err)
+
+		for _, e := range batch {
+			if _, err := enc.Encode(e); err != nil {
+				return nil, fmt.Errorf("writing to recovered datafile: %w", err)
+			}
 		}
+		size += batchSize
+		entries += len(batch)
 	}
 	if !corrupted {
-		if err := os.Remove(fr.Name()); err != nil {
-			return false, fmt.Errorf("can't remove temporal recovered datafile: %w", err)
+		if err := fsys.Remove(fr.Name()); err != nil {
+			return nil, fmt.Errorf("can't remove temporal recovered datafile: %w", err)
 		}
-		return false, nil
+		return nil, nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("calling Stat() on the datafile: %w", err)
 	}
-	if err := os.Rename(rPath, path); err != nil {
-		return false, fmt.Errorf("removing corrupted file: %s", err)
+	if err := fsys.Rename(rPath, path); err != nil {
+		return nil, fmt.Errorf("removing corrupted file: %s", err)
 	}
-	return true, nil
+	return &internal.RecoveryReport{
+		Time:             time.Now(),
+		Datafile:         filepath.Base(path),
+		TruncatedBytes:   stat.Size() - size,
+		RecoveredEntries: entries,
+	}, nil
 }
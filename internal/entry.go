@@ -10,6 +10,17 @@ type Entry struct {
 	Key      []byte
 	Offset   int64
 	Value    []byte
+	// Expiry is when the entry expires in Unix nanoseconds, zero if never
+	Expiry int64
+	// Origin is the id of the node that wrote the entry, zero if unknown
+	Origin uint32
+	// Compression is how the value is compressed, zero if not compressed
+	Compression uint8
+	// Version is the version of the entry, increasing with every write to
+	// the database, and Timestamp when it was written in Unix nanoseconds,
+	// both zero if unknown
+	Version   uint64
+	Timestamp int64
 }
 
 // NewEntry creates a new `Entry` with the given `key` and `value`
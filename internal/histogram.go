@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// Bucket is a bucket of a Histogram counting the sizes up to and including
+// UpperBound (and larger than the previous bucket's upper bound)
+type Bucket struct {
+	UpperBound uint64 `json:"upper_bound"`
+	Count      uint64 `json:"count"`
+}
+
+// Histogram is an approximate histogram of sizes using power of two buckets.
+// Sizes can be removed as well as added so it can track a live dataset.
+// Sizes must be added and removed by one goroutine at a time, but a copy
+// can be taken with Snapshot() concurrently. Histogram must be 64-bit
+// aligned on 32-bit platforms.
+type Histogram struct {
+	buckets [65]uint64
+	count   uint64
+	sum     uint64
+}
+
+// Add adds a size to the histogram
+func (h *Histogram) Add(size uint64) {
+	atomic.AddUint64(&h.buckets[bits.Len64(size)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, size)
+}
+
+// Remove removes a size previously added to the histogram
+func (h *Histogram) Remove(size uint64) {
+	i := bits.Len64(size)
+	if atomic.LoadUint64(&h.buckets[i]) == 0 {
+		return
+	}
+	atomic.AddUint64(&h.buckets[i], ^uint64(0))
+	atomic.AddUint64(&h.count, ^uint64(0))
+	atomic.AddUint64(&h.sum, -size)
+}
+
+// Reset removes all sizes from the histogram
+func (h *Histogram) Reset() {
+	for i := range h.buckets {
+		atomic.StoreUint64(&h.buckets[i], 0)
+	}
+	atomic.StoreUint64(&h.count, 0)
+	atomic.StoreUint64(&h.sum, 0)
+}
+
+// Snapshot returns a copy of the histogram. It may be taken while sizes
+// are added or removed, the count is then that of the buckets copied.
+func (h *Histogram) Snapshot() Histogram {
+	var c Histogram
+	for i := range h.buckets {
+		c.buckets[i] = atomic.LoadUint64(&h.buckets[i])
+		c.count += c.buckets[i]
+	}
+	c.sum = atomic.LoadUint64(&h.sum)
+	return c
+}
+
+// Count returns the number of sizes in the histogram
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Sum returns the sum of all sizes in the histogram
+func (h *Histogram) Sum() uint64 {
+	return h.sum
+}
+
+// Quantile returns an upper bound of the size at the given quantile `q`
+// (between 0 and 1) or zero if the histogram is empty
+func (h *Histogram) Quantile(q float64) uint64 {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+
+	var seen uint64
+	for i, n := range h.buckets {
+		seen += n
+		if seen > rank {
+			return upperBound(i)
+		}
+	}
+	return upperBound(len(h.buckets) - 1)
+}
+
+// Buckets returns all non-empty buckets in increasing order of size
+func (h *Histogram) Buckets() []Bucket {
+	var buckets []Bucket
+	for i, n := range h.buckets {
+		if n > 0 {
+			buckets = append(buckets, Bucket{UpperBound: upperBound(i), Count: n})
+		}
+	}
+	return buckets
+}
+
+func upperBound(i int) uint64 {
+	if i == 64 {
+		return ^uint64(0)
+	}
+	return 1<<uint(i) - 1
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	var h Histogram
+	assert.Equal(uint64(0), h.Quantile(0.5))
+	assert.Empty(h.Buckets())
+
+	for _, size := range []uint64{0, 1, 3, 3, 100, 1000} {
+		h.Add(size)
+	}
+	assert.Equal(uint64(6), h.Count())
+	assert.Equal(uint64(1107), h.Sum())
+	assert.Equal([]Bucket{
+		{UpperBound: 0, Count: 1},
+		{UpperBound: 1, Count: 1},
+		{UpperBound: 3, Count: 2},
+		{UpperBound: 127, Count: 1},
+		{UpperBound: 1023, Count: 1},
+	}, h.Buckets())
+	assert.Equal(uint64(3), h.Quantile(0.5))
+	assert.Equal(uint64(1023), h.Quantile(0.99))
+	assert.Equal(uint64(1023), h.Quantile(1))
+
+	h.Remove(1000)
+	h.Remove(3)
+	assert.Equal(uint64(4), h.Count())
+	assert.Equal(uint64(104), h.Sum())
+	assert.Equal(uint64(127), h.Quantile(0.99))
+
+	// Removing a size that was never added is a noop
+	h.Remove(1 << 40)
+	assert.Equal(uint64(4), h.Count())
+
+	h.Add(^uint64(0))
+	assert.Equal(^uint64(0), h.Quantile(1))
+
+	h.Reset()
+	assert.Equal(uint64(0), h.Count())
+}
+
+func TestLatencies(t *testing.T) {
+	assert := assert.New(t)
+
+	var l Latencies
+	l.Observe(3)
+	l.Observe(100)
+	l.Observe(-1)
+
+	h := l.Histogram()
+	assert.Equal(uint64(3), h.Count())
+	assert.Equal(uint64(103), h.Sum())
+	assert.Equal(uint64(3), h.Quantile(0.5))
+	assert.Equal(uint64(127), h.Quantile(1))
+}
@@ -22,6 +22,11 @@ const (
 	fileIDSize = int32Size
 	offsetSize = int64Size
 	sizeSize   = int64Size
+	expirySize = int64Size
+
+	// expiryFlag is set in the file id of items followed by an expiry,
+	// datafile ids never use the sign bit
+	expiryFlag = 1 << 31
 )
 
 func readKeyBytes(r io.Reader, maxKeySize uint32) ([]byte, error) {
@@ -67,18 +72,33 @@ func readItem(r io.Reader) (internal.Item, error) {
 		return internal.Item{}, errors.Wrap(errTruncatedData, err.Error())
 	}
 
-	return internal.Item{
-		FileID: int(binary.BigEndian.Uint32(buf[:fileIDSize])),
+	fileID := binary.BigEndian.Uint32(buf[:fileIDSize])
+	item := internal.Item{
+		FileID: int(fileID &^ expiryFlag),
 		Offset: int64(binary.BigEndian.Uint64(buf[fileIDSize:(fileIDSize + offsetSize)])),
 		Size:   int64(binary.BigEndian.Uint64(buf[(fileIDSize + offsetSize):])),
-	}, nil
+	}
+	if fileID&expiryFlag != 0 {
+		buf = buf[:expirySize]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return internal.Item{}, errors.Wrap(errTruncatedData, err.Error())
+		}
+		item.Expiry = int64(binary.BigEndian.Uint64(buf))
+	}
+	return item, nil
 }
 
 func writeItem(item internal.Item, w io.Writer) error {
-	buf := make([]byte, (fileIDSize + offsetSize + sizeSize))
-	binary.BigEndian.PutUint32(buf[:fileIDSize], uint32(item.FileID))
+	fileID := uint32(item.FileID)
+	buf := make([]byte, (fileIDSize + offsetSize + sizeSize), (fileIDSize + offsetSize + sizeSize + expirySize))
+	if item.Expiry != 0 {
+		fileID |= expiryFlag
+		buf = buf[:cap(buf)]
+		binary.BigEndian.PutUint64(buf[(fileIDSize+offsetSize+sizeSize):], uint64(item.Expiry))
+	}
+	binary.BigEndian.PutUint32(buf[:fileIDSize], fileID)
 	binary.BigEndian.PutUint64(buf[fileIDSize:(fileIDSize+offsetSize)], uint64(item.Offset))
-	binary.BigEndian.PutUint64(buf[(fileIDSize+offsetSize):], uint64(item.Size))
+	binary.BigEndian.PutUint64(buf[(fileIDSize+offsetSize):(fileIDSize+offsetSize+sizeSize)], uint64(item.Size))
 	_, err := w.Write(buf)
 	if err != nil {
 		return err
@@ -127,7 +147,7 @@ func writeIndex(t art.Tree, w io.Writer) (err error) {
 func IsIndexCorruption(err error) bool {
 	cause := errors.Cause(err)
 	switch cause {
-	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize:
+	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize, errNoHeader, errChecksumMismatch:
 		return true
 	}
 	return false
@@ -55,6 +55,29 @@ func TestReadIndex(t *testing.T) {
 	})
 }
 
+func TestIndexExpiry(t *testing.T) {
+	at := art.New()
+	at.Insert([]byte("foo"), internal.Item{FileID: 1, Offset: 2, Size: 3})
+	at.Insert([]byte("bar"), internal.Item{FileID: 4, Offset: 5, Size: 6, Expiry: 7})
+
+	var b bytes.Buffer
+	if err := writeIndex(at, &b); err != nil {
+		t.Fatalf("writing index failed: %v", err)
+	}
+
+	actual := art.New()
+	if err := readIndex(&b, actual, 1024); err != nil {
+		t.Fatalf("reading index failed: %v", err)
+	}
+	at.ForEach(func(node art.Node) bool {
+		value, found := actual.Search(node.Key())
+		if !found || value != node.Value() {
+			t.Fatalf("expected %v for %s, got %v", node.Value(), node.Key(), value)
+		}
+		return true
+	})
+}
+
 func TestReadCorruptedData(t *testing.T) {
 	sampleBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
 
@@ -1,59 +1,174 @@
 package index
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
 	"os"
+	"sort"
 
+	"github.com/pkg/errors"
 	art "github.com/plar/go-adaptive-radix-tree"
-	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/fs"
 )
 
+var (
+	errNoHeader         = errors.New("index has no header")
+	errChecksumMismatch = errors.New("index checksum mismatch")
+)
+
+// magic starts the header of an index file, it can not be mistaken for the
+// key size of the first key of a legacy index file without header
+var magic = [4]byte{'B', 'C', 'I', 'X'}
+
+const (
+	version     = 1
+	headerSize  = len(magic) + 1 + int64Size + fileIDSize + offsetSize
+	trailerSize = int32Size
+)
+
+// Position is how far the datafiles were indexed when an index was saved:
+// all entries of the datafiles of the generation and of the current
+// datafile up to the offset
+type Position struct {
+	// Generation identifies the immutable datafiles, see Generation()
+	Generation uint64
+	// FileID is the id of the current datafile
+	FileID int
+	// Offset is the end of the last entry indexed in the current datafile
+	Offset int64
+}
+
+// Generation returns the generation of the immutable datafiles with the
+// given ids, which changes whenever the datafiles are merged. It is never
+// zero, so the zero Position is never valid.
+func Generation(ids []int) uint64 {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+
+	h := fnv.New64a()
+	buf := make([]byte, fileIDSize)
+	for _, id := range sorted {
+		binary.BigEndian.PutUint32(buf, uint32(id))
+		h.Write(buf)
+	}
+	return h.Sum64()
+}
+
 // Indexer is an interface for loading and saving the index (an Adaptive Radix Tree)
 type Indexer interface {
-	Load(path string, maxkeySize uint32) (art.Tree, bool, error)
-	Save(t art.Tree, path string) error
+	Load(path string, maxkeySize uint32) (art.Tree, Position, bool, error)
+	Save(t art.Tree, pos Position, path string) error
 }
 
 // NewIndexer returns an instance of the default `Indexer` implemtnation
 // which perists the index (an Adaptive Radix Tree) as a binary blob on file
-func NewIndexer() Indexer {
-	return &indexer{}
+// along with the position of the datafiles it was saved at and a checksum
+// in the given file system
+func NewIndexer(fsys fs.FileSystem) Indexer {
+	return &indexer{fs: fsys}
 }
 
-type indexer struct{}
+type indexer struct {
+	fs fs.FileSystem
+}
 
-func (i *indexer) Load(path string, maxKeySize uint32) (art.Tree, bool, error) {
+// Load loads the index and its position. A partially written or legacy
+// index file without a position is reported as corrupted (see
+// IsIndexCorruption()) along with the keys that could be read.
+func (i *indexer) Load(path string, maxKeySize uint32) (art.Tree, Position, bool, error) {
 	t := art.New()
 
-	if !internal.Exists(path) {
-		return t, false, nil
+	if !fs.Exists(i.fs, path) {
+		return t, Position{}, false, nil
 	}
 
-	f, err := os.Open(path)
+	data, err := fs.ReadFile(i.fs, path)
 	if err != nil {
-		return t, true, err
+		return t, Position{}, true, err
+	}
+
+	if len(data) < len(magic) || !bytes.Equal(data[:len(magic)], magic[:]) {
+		if err := readIndex(bytes.NewReader(data), t, maxKeySize); err != nil {
+			return t, Position{}, true, err
+		}
+		return t, Position{}, true, errNoHeader
+	}
+	if len(data) < headerSize+trailerSize {
+		return t, Position{}, true, errors.Wrap(errTruncatedData, "header")
+	}
+
+	body, trailer := data[:len(data)-trailerSize], data[len(data)-trailerSize:]
+	checksumErr := error(nil)
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(trailer) {
+		// Read what can be read for recovery, see IsIndexCorruption()
+		checksumErr = errChecksumMismatch
 	}
-	defer f.Close()
 
-	if err := readIndex(f, t, maxKeySize); err != nil {
-		return t, true, err
+	header := body[len(magic):headerSize]
+	if header[0] != version {
+		return t, Position{}, true, errNoHeader
+	}
+	pos := Position{
+		Generation: binary.BigEndian.Uint64(header[1:]),
+		FileID:     int(binary.BigEndian.Uint32(header[1+int64Size:])),
+		Offset:     int64(binary.BigEndian.Uint64(header[1+int64Size+fileIDSize:])),
+	}
+
+	if err := readIndex(bytes.NewReader(body[headerSize:]), t, maxKeySize); err != nil {
+		return t, Position{}, true, err
+	}
+	if checksumErr != nil {
+		return t, Position{}, true, checksumErr
 	}
-	return t, true, nil
+	return t, pos, true, nil
 }
 
-func (i *indexer) Save(t art.Tree, path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// Save saves the index and its position to a temporary file first which
+// is then renamed, so an index file is never partially written.
+func (i *indexer) Save(t art.Tree, pos Position, path string) error {
+	temp := path + ".tmp"
+	f, err := i.fs.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	defer i.fs.Remove(temp)
 
-	if err := writeIndex(t, f); err != nil {
+	h := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+
+	header := make([]byte, headerSize)
+	copy(header, magic[:])
+	header[len(magic)] = version
+	binary.BigEndian.PutUint64(header[len(magic)+1:], pos.Generation)
+	binary.BigEndian.PutUint32(header[len(magic)+1+int64Size:], uint32(pos.FileID))
+	binary.BigEndian.PutUint64(header[len(magic)+1+int64Size+fileIDSize:], uint64(pos.Offset))
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
 
-	if err := f.Sync(); err != nil {
+	if err := writeIndex(t, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
 		return err
 	}
 
-	return f.Close()
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint32(trailer, h.Sum32())
+	if _, err := f.Write(trailer); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return i.fs.Rename(temp, path)
 }
@@ -0,0 +1,116 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+func TestIndexerSaveLoad(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	path := filepath.Join(testdir, "index")
+
+	at, _ := getSampleTree()
+	pos := Position{Generation: Generation([]int{0, 1}), FileID: 2, Offset: 42}
+
+	indexer := NewIndexer(fs.OS)
+	if err := indexer.Save(at, pos, path); err != nil {
+		t.Fatalf("saving index failed: %v", err)
+	}
+	if internal.Exists(path + ".tmp") {
+		t.Fatalf("temporary index file was not renamed")
+	}
+
+	actual, actualPos, found, err := indexer.Load(path, 1024)
+	if err != nil || !found {
+		t.Fatalf("loading index failed: %v (found: %v)", err, found)
+	}
+	if actualPos != pos {
+		t.Fatalf("expected position %v, got %v", pos, actualPos)
+	}
+	if actual.Size() != at.Size() {
+		t.Fatalf("trees aren't the same size, expected %v, got %v", at.Size(), actual.Size())
+	}
+
+	t.Run("Missing", func(t *testing.T) {
+		_, pos, found, err := indexer.Load(filepath.Join(testdir, "missing"), 1024)
+		if err != nil || found || pos != (Position{}) {
+			t.Fatalf("expected no index, got %v, %v, %v", pos, found, err)
+		}
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		torn := filepath.Join(testdir, "torn")
+		for n := 0; n < len(data); n++ {
+			if err := ioutil.WriteFile(torn, data[:n], 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, pos, found, err := indexer.Load(torn, 1024)
+			if !found || !IsIndexCorruption(err) {
+				t.Fatalf("expected corruption of index truncated to %d bytes, got %v", n, err)
+			}
+			if pos != (Position{}) {
+				t.Fatalf("expected no position of index truncated to %d bytes, got %v", n, pos)
+			}
+		}
+	})
+
+	t.Run("ChecksumMismatch", func(t *testing.T) {
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		if err := ioutil.WriteFile(path, corrupted, 0600); err != nil {
+			t.Fatal(err)
+		}
+		actual, _, _, err := indexer.Load(path, 1024)
+		if err != errChecksumMismatch {
+			t.Fatalf("expected %v, got %v", errChecksumMismatch, err)
+		}
+		if actual.Size() != at.Size() {
+			t.Fatalf("expected the keys to be read for recovery, got %d keys", actual.Size())
+		}
+	})
+
+	t.Run("Legacy", func(t *testing.T) {
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeIndex(at, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		actual, _, found, err := indexer.Load(path, 1024)
+		if !found || err != errNoHeader {
+			t.Fatalf("expected %v, got %v", errNoHeader, err)
+		}
+		if actual.Size() != at.Size() {
+			t.Fatalf("expected the keys to be read for recovery, got %d keys", actual.Size())
+		}
+	})
+}
+
+func TestGeneration(t *testing.T) {
+	if Generation([]int{1, 2, 3}) != Generation([]int{3, 1, 2}) {
+		t.Fatalf("generation depends on the order of the ids")
+	}
+	if Generation([]int{1, 2, 3}) == Generation([]int{1, 2}) {
+		t.Fatalf("generation doesn't change with the ids")
+	}
+	if Generation(nil) == 0 {
+		t.Fatalf("generation of no ids is zero")
+	}
+}
@@ -0,0 +1,156 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+
+	"github.com/pkg/errors"
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+const (
+	positionSize = int64Size + fileIDSize + offsetSize
+	// deltaHeaderSize is the size of the length, positions and number of
+	// changes starting a delta
+	deltaHeaderSize = int32Size + 2*positionSize + int32Size
+)
+
+// Change is the change of a key of the index: its new item or its removal
+type Change struct {
+	Key     []byte
+	Item    internal.Item
+	Deleted bool
+}
+
+// AppendDelta appends the changes of the index from one position to the
+// next to the index log at the given path and syncs it, and returns the
+// size of the delta appended. Every delta is checksummed, so one partially
+// written when crashing is ignored by ApplyDeltas().
+func AppendDelta(fsys fs.FileSystem, path string, from, to Position, changes []Change) (int64, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, deltaHeaderSize))
+	for _, c := range changes {
+		if err := writeBytes(c.Key, &buf); err != nil {
+			return 0, err
+		}
+		if c.Deleted {
+			buf.WriteByte(0)
+			continue
+		}
+		buf.WriteByte(1)
+		if err := writeItem(c.Item, &buf); err != nil {
+			return 0, err
+		}
+	}
+	buf.Write(make([]byte, trailerSize))
+
+	delta := buf.Bytes()
+	binary.BigEndian.PutUint32(delta, uint32(len(delta)))
+	putPosition(delta[int32Size:], from)
+	putPosition(delta[int32Size+positionSize:], to)
+	binary.BigEndian.PutUint32(delta[int32Size+2*positionSize:], uint32(len(changes)))
+	body := delta[:len(delta)-trailerSize]
+	binary.BigEndian.PutUint32(delta[len(body):], crc32.ChecksumIEEE(body))
+
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Write(delta); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return int64(len(delta)), f.Close()
+}
+
+// ApplyDeltas applies the deltas of the index log at the given path to the
+// index at the given position, in order, as long as each follows on from
+// the position reached and `valid` accepts the position it leads to, and
+// returns the position reached. Deltas partially written or corrupted end
+// the log.
+func ApplyDeltas(fsys fs.FileSystem, path string, t art.Tree, pos Position, maxKeySize uint32, valid func(Position) bool) (Position, error) {
+	data, err := fs.ReadFile(fsys, path)
+	if os.IsNotExist(err) {
+		return pos, nil
+	} else if err != nil {
+		return pos, err
+	}
+
+	for len(data) >= deltaHeaderSize+trailerSize {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < deltaHeaderSize+trailerSize || size > len(data) {
+			break
+		}
+		delta := data[:size]
+		data = data[size:]
+
+		body := delta[:size-trailerSize]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(delta[len(body):]) {
+			break
+		}
+		from := getPosition(body[int32Size:])
+		to := getPosition(body[int32Size+positionSize:])
+		if from != pos || !valid(to) {
+			break
+		}
+		count := int(binary.BigEndian.Uint32(body[int32Size+2*positionSize:]))
+		changes, err := readChanges(bytes.NewReader(body[deltaHeaderSize:]), count, maxKeySize)
+		if err != nil {
+			break
+		}
+
+		for _, c := range changes {
+			if c.Deleted {
+				t.Delete(c.Key)
+			} else {
+				t.Insert(c.Key, c.Item)
+			}
+		}
+		pos = to
+	}
+	return pos, nil
+}
+
+// readChanges reads the given number of changes of a delta
+func readChanges(r *bytes.Reader, count int, maxKeySize uint32) ([]Change, error) {
+	changes := make([]Change, 0, count)
+	for len(changes) < count {
+		key, err := readKeyBytes(r, maxKeySize)
+		if err != nil {
+			return nil, errors.Wrap(errTruncatedData, "delta")
+		}
+		flag, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(errTruncatedData, "delta")
+		}
+		c := Change{Key: key, Deleted: flag == 0}
+		if !c.Deleted {
+			if c.Item, err = readItem(r); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func putPosition(buf []byte, pos Position) {
+	binary.BigEndian.PutUint64(buf, pos.Generation)
+	binary.BigEndian.PutUint32(buf[int64Size:], uint32(pos.FileID))
+	binary.BigEndian.PutUint64(buf[int64Size+fileIDSize:], uint64(pos.Offset))
+}
+
+func getPosition(buf []byte) Position {
+	return Position{
+		Generation: binary.BigEndian.Uint64(buf),
+		FileID:     int(binary.BigEndian.Uint32(buf[int64Size:])),
+		Offset:     int64(binary.BigEndian.Uint64(buf[int64Size+fileIDSize:])),
+	}
+}
@@ -0,0 +1,102 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+func TestApplyDeltas(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+	path := filepath.Join(testdir, "index.log")
+
+	p0 := Position{Generation: Generation(nil), FileID: 0, Offset: 10}
+	p1 := Position{Generation: Generation(nil), FileID: 0, Offset: 20}
+	p2 := Position{Generation: Generation([]int{0}), FileID: 1, Offset: 5}
+	item := internal.Item{FileID: 1, Offset: 0, Size: 5, Expiry: 42}
+
+	if _, err := AppendDelta(fs.OS, path, p0, p1, []Change{
+		{Key: []byte("foo"), Item: internal.Item{FileID: 0, Offset: 10, Size: 10}},
+		{Key: []byte("bar"), Deleted: true},
+	}); err != nil {
+		t.Fatalf("appending delta failed: %v", err)
+	}
+	if _, err := AppendDelta(fs.OS, path, p1, p2, []Change{{Key: []byte("foo"), Item: item}}); err != nil {
+		t.Fatalf("appending delta failed: %v", err)
+	}
+	valid := func(Position) bool { return true }
+
+	t.Run("Apply", func(t *testing.T) {
+		tree := art.New()
+		tree.Insert([]byte("bar"), internal.Item{})
+		pos, err := ApplyDeltas(fs.OS, path, tree, p0, 1024, valid)
+		if err != nil {
+			t.Fatalf("applying deltas failed: %v", err)
+		}
+		if pos != p2 {
+			t.Fatalf("expected position %v, got %v", p2, pos)
+		}
+		if value, found := tree.Search([]byte("foo")); !found || value.(internal.Item) != item {
+			t.Fatalf("expected item %v, got %v", item, value)
+		}
+		if _, found := tree.Search([]byte("bar")); found {
+			t.Fatalf("expected deleted key")
+		}
+	})
+
+	t.Run("OtherPosition", func(t *testing.T) {
+		tree := art.New()
+		pos, err := ApplyDeltas(fs.OS, path, tree, p1, 1024, valid)
+		if err != nil {
+			t.Fatalf("applying deltas failed: %v", err)
+		}
+		if pos != p1 || tree.Size() != 0 {
+			t.Fatalf("expected no delta applied, got position %v", pos)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tree := art.New()
+		pos, err := ApplyDeltas(fs.OS, path, tree, p0, 1024, func(pos Position) bool { return pos != p2 })
+		if err != nil {
+			t.Fatalf("applying deltas failed: %v", err)
+		}
+		if pos != p1 {
+			t.Fatalf("expected position %v, got %v", p1, pos)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, stat.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+		tree := art.New()
+		pos, err := ApplyDeltas(fs.OS, path, tree, p0, 1024, valid)
+		if err != nil {
+			t.Fatalf("applying deltas failed: %v", err)
+		}
+		if pos != p1 {
+			t.Fatalf("expected position %v, got %v", p1, pos)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		pos, err := ApplyDeltas(fs.OS, filepath.Join(testdir, "missing"), art.New(), p0, 1024, valid)
+		if err != nil || pos != p0 {
+			t.Fatalf("expected position %v, got %v (%v)", p0, pos, err)
+		}
+	})
+}
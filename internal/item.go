@@ -7,4 +7,11 @@ type Item struct {
 	FileID int   `json:"fileid"`
 	Offset int64 `json:"offset"`
 	Size   int64 `json:"size"`
+	Expiry int64 `json:"expiry,omitempty"`
+}
+
+// Expired returns true if the item has an expiry at or before `now` (in
+// Unix nanoseconds)
+func (i Item) Expired(now int64) bool {
+	return i.Expiry != 0 && i.Expiry <= now
 }
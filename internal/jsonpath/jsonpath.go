@@ -0,0 +1,326 @@
+// Package jsonpath locates and replaces values in JSON documents by simple
+// paths such as "a.b[2].c" scanning the raw bytes of the document only as
+// far as needed rather than decoding it as a whole.
+package jsonpath
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var (
+	// ErrInvalidPath is the error returned for a malformed path
+	ErrInvalidPath = errors.New("error: invalid path")
+
+	// ErrNotFound is the error returned if the path does not exist in the
+	// document
+	ErrNotFound = errors.New("error: path not found")
+
+	// ErrInvalidJSON is the error returned if the document (or a value to be
+	// set) is not valid JSON
+	ErrInvalidJSON = errors.New("error: invalid JSON")
+)
+
+// Segment is a single step of a path, either an object member by key or an
+// array element by index
+type Segment struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// Parse parses a path of dot separated object keys and bracketed array
+// indexes such as "a.b[2].c" or "[0].name". The empty path refers to the
+// whole document. Keys containing '.' or '[' are not supported.
+func Parse(path string) ([]Segment, error) {
+	var segs []Segment
+
+	for i := 0; i < len(path); {
+		if path[i] == '[' {
+			j := i + 1
+			for j < len(path) && path[j] != ']' {
+				j++
+			}
+			if j == len(path) {
+				return nil, ErrInvalidPath
+			}
+			index, err := strconv.Atoi(path[i+1 : j])
+			if err != nil || index < 0 {
+				return nil, ErrInvalidPath
+			}
+			segs = append(segs, Segment{Index: index, IsIndex: true})
+			i = j + 1
+		} else {
+			j := i
+			for j < len(path) && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			if j == i {
+				return nil, ErrInvalidPath
+			}
+			segs = append(segs, Segment{Key: path[i:j]})
+			i = j
+		}
+
+		if i < len(path) && path[i] == '.' {
+			i++
+			if i == len(path) || path[i] == '[' || path[i] == '.' {
+				return nil, ErrInvalidPath
+			}
+		}
+	}
+
+	return segs, nil
+}
+
+// Get returns the raw JSON value at the given path in the document
+func Get(doc []byte, segs []Segment) ([]byte, error) {
+	start, end, err := locate(doc, segs)
+	if err != nil {
+		return nil, err
+	}
+	return doc[start:end], nil
+}
+
+// Set returns a copy of the document with the value at the given path
+// replaced by the given raw JSON value. If the last segment of the path is
+// a key missing from its object the key is added.
+func Set(doc []byte, segs []Segment, raw []byte) ([]byte, error) {
+	if !json.Valid(raw) {
+		return nil, ErrInvalidJSON
+	}
+
+	start, end, err := locate(doc, segs)
+	if err == ErrNotFound && len(segs) > 0 && !segs[len(segs)-1].IsIndex {
+		return add(doc, segs[:len(segs)-1], segs[len(segs)-1].Key, raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return splice(doc, start, end, raw), nil
+}
+
+// add adds a key to the object at the given path
+func add(doc []byte, segs []Segment, key string, raw []byte) ([]byte, error) {
+	start, end, err := locate(doc, segs)
+	if err != nil {
+		return nil, err
+	}
+	if doc[start] != '{' {
+		return nil, ErrNotFound
+	}
+
+	member, _ := json.Marshal(key)
+	member = append(member, ':')
+	member = append(member, raw...)
+
+	// Insert before the closing brace, after any other members
+	s := &scanner{doc: doc, pos: start + 1}
+	s.ws()
+	if s.pos < end-1 {
+		member = append([]byte{','}, member...)
+	}
+	return splice(doc, end-1, end-1, member), nil
+}
+
+func splice(doc []byte, start, end int, raw []byte) []byte {
+	out := make([]byte, 0, len(doc)-(end-start)+len(raw))
+	out = append(out, doc[:start]...)
+	out = append(out, raw...)
+	return append(out, doc[end:]...)
+}
+
+// locate returns the start and end offsets of the value at the given path
+func locate(doc []byte, segs []Segment) (int, int, error) {
+	s := &scanner{doc: doc}
+
+	for _, seg := range segs {
+		var err error
+		if seg.IsIndex {
+			err = s.element(seg.Index)
+		} else {
+			err = s.member(seg.Key)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	s.ws()
+	start := s.pos
+	if err := s.skip(); err != nil {
+		return 0, 0, err
+	}
+	return start, s.pos, nil
+}
+
+// scanner scans raw JSON, it validates only as much as needed to find its
+// way through the document
+type scanner struct {
+	doc []byte
+	pos int
+}
+
+func (s *scanner) ws() {
+	for s.pos < len(s.doc) {
+		switch s.doc[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *scanner) peek() byte {
+	s.ws()
+	if s.pos < len(s.doc) {
+		return s.doc[s.pos]
+	}
+	return 0
+}
+
+func (s *scanner) expect(c byte) error {
+	if s.peek() != c {
+		return ErrInvalidJSON
+	}
+	s.pos++
+	return nil
+}
+
+// member moves to the value of the given key of the object at the current
+// position
+func (s *scanner) member(key string) error {
+	if s.peek() != '{' {
+		return ErrNotFound
+	}
+	s.pos++
+
+	if s.peek() == '}' {
+		return ErrNotFound
+	}
+	for {
+		start := s.pos
+		if err := s.skipString(); err != nil {
+			return err
+		}
+		var k string
+		if err := json.Unmarshal(s.doc[start:s.pos], &k); err != nil {
+			return ErrInvalidJSON
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		if k == key {
+			return nil
+		}
+		if err := s.skip(); err != nil {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+			s.ws()
+		case '}':
+			return ErrNotFound
+		default:
+			return ErrInvalidJSON
+		}
+	}
+}
+
+// element moves to the given element of the array at the current position
+func (s *scanner) element(index int) error {
+	if s.peek() != '[' {
+		return ErrNotFound
+	}
+	s.pos++
+
+	if s.peek() == ']' {
+		return ErrNotFound
+	}
+	for i := 0; i < index; i++ {
+		if err := s.skip(); err != nil {
+			return err
+		}
+
+		switch s.peek() {
+		case ',':
+			s.pos++
+		case ']':
+			return ErrNotFound
+		default:
+			return ErrInvalidJSON
+		}
+	}
+	s.ws()
+	return nil
+}
+
+// skip moves past the value at the current position
+func (s *scanner) skip() error {
+	switch s.peek() {
+	case 0:
+		return ErrInvalidJSON
+	case '"':
+		return s.skipString()
+	case '{', '[':
+		depth := 0
+		for s.pos < len(s.doc) {
+			switch s.doc[s.pos] {
+			case '"':
+				if err := s.skipString(); err != nil {
+					return err
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			s.pos++
+			if depth == 0 {
+				return nil
+			}
+		}
+		return ErrInvalidJSON
+	case '}', ']', ',', ':':
+		return ErrInvalidJSON
+	default:
+		start := s.pos
+		for s.pos < len(s.doc) {
+			switch s.doc[s.pos] {
+			case ',', '}', ']', ' ', '\t', '\r', '\n':
+				return s.literal(start)
+			}
+			s.pos++
+		}
+		return s.literal(start)
+	}
+}
+
+func (s *scanner) literal(start int) error {
+	if !json.Valid(s.doc[start:s.pos]) {
+		return ErrInvalidJSON
+	}
+	return nil
+}
+
+func (s *scanner) skipString() error {
+	if s.peek() != '"' {
+		return ErrInvalidJSON
+	}
+	for s.pos++; s.pos < len(s.doc); s.pos++ {
+		switch s.doc[s.pos] {
+		case '\\':
+			s.pos++
+		case '"':
+			s.pos++
+			return nil
+		}
+	}
+	return ErrInvalidJSON
+}
@@ -0,0 +1,97 @@
+package jsonpath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const doc = `{"a": {"b": [1, {"c": "x\"}"}, {"c": [true, null]}], "d": 1.5e3}, "e": "f", "g": {}}`
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	segs, err := Parse("a.b[2].c")
+	assert.NoError(err)
+	assert.Equal([]Segment{{Key: "a"}, {Key: "b"}, {Index: 2, IsIndex: true}, {Key: "c"}}, segs)
+
+	segs, err = Parse("[0][1]")
+	assert.NoError(err)
+	assert.Equal([]Segment{{Index: 0, IsIndex: true}, {Index: 1, IsIndex: true}}, segs)
+
+	segs, err = Parse("")
+	assert.NoError(err)
+	assert.Empty(segs)
+
+	for _, path := range []string{".a", "a.", "a..b", "a.[0]", "a[", "a[x]", "a[-1]"} {
+		_, err := Parse(path)
+		assert.Equal(ErrInvalidPath, err, path)
+	}
+}
+
+func TestGet(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := map[string]string{
+		"":         doc,
+		"a.b[0]":   `1`,
+		"a.b[1].c": `"x\"}"`,
+		"a.b[2].c": `[true, null]`,
+		"a.d":      `1.5e3`,
+		"e":        `"f"`,
+		"g":        `{}`,
+	}
+	for path, expected := range tests {
+		segs, err := Parse(path)
+		assert.NoError(err)
+		value, err := Get([]byte(doc), segs)
+		assert.NoError(err, path)
+		assert.Equal(expected, string(value), path)
+	}
+
+	for _, path := range []string{"x", "a.b[3]", "a.b[0].c", "e[0]", "g.h", "a.b.c"} {
+		segs, err := Parse(path)
+		assert.NoError(err)
+		_, err = Get([]byte(doc), segs)
+		assert.Equal(ErrNotFound, err, path)
+	}
+
+	_, err := Get([]byte(`{"a": tru}`), []Segment{{Key: "a"}})
+	assert.Equal(ErrInvalidJSON, err)
+	_, err = Get([]byte(`{"a": [1, 2`), []Segment{{Key: "a"}})
+	assert.Equal(ErrInvalidJSON, err)
+}
+
+func TestSet(t *testing.T) {
+	assert := assert.New(t)
+
+	set := func(doc, path, raw string) (string, error) {
+		segs, err := Parse(path)
+		assert.NoError(err)
+		out, err := Set([]byte(doc), segs, []byte(raw))
+		return string(out), err
+	}
+
+	out, err := set(`{"a": [1, 2, 3]}`, "a[1]", `{"b": 1}`)
+	assert.NoError(err)
+	assert.Equal(`{"a": [1, {"b": 1}, 3]}`, out)
+
+	out, err = set(`{"a": {"b": 1}}`, "a.c", `"x"`)
+	assert.NoError(err)
+	assert.Equal(`{"a": {"b": 1,"c":"x"}}`, out)
+
+	out, err = set(`{"a": { }}`, "a.c", `2`)
+	assert.NoError(err)
+	assert.Equal(`{"a": { "c":2}}`, out)
+
+	out, err = set(`[1]`, "", `true`)
+	assert.NoError(err)
+	assert.Equal(`true`, out)
+
+	_, err = set(`{"a": [1]}`, "a[1]", `2`)
+	assert.Equal(ErrNotFound, err)
+	_, err = set(`{"a": [1]}`, "b.c", `2`)
+	assert.Equal(ErrNotFound, err)
+	_, err = set(`{"a": 1}`, "a", `{`)
+	assert.Equal(ErrInvalidJSON, err)
+}
@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Latencies is an approximate histogram of durations using power of two
+// nanosecond buckets. Unlike Histogram it is safe for concurrent use, and
+// must be 64-bit aligned on 32-bit platforms.
+type Latencies struct {
+	buckets [65]uint64
+	sum     uint64
+}
+
+// Observe adds a duration to the histogram
+func (l *Latencies) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	atomic.AddUint64(&l.buckets[bits.Len64(uint64(d))], 1)
+	atomic.AddUint64(&l.sum, uint64(d))
+}
+
+// Histogram returns a copy of the histogram as a Histogram of nanoseconds
+func (l *Latencies) Histogram() Histogram {
+	var h Histogram
+	for i := range l.buckets {
+		h.buckets[i] = atomic.LoadUint64(&l.buckets[i])
+		h.count += h.buckets[i]
+	}
+	h.sum = atomic.LoadUint64(&l.sum)
+	return h
+}
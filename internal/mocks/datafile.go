@@ -101,6 +101,55 @@ func (_m *Datafile) ReadAt(index int64, size int64) (internal.Entry, error) {
 	return r0, r1
 }
 
+// ReadRaw provides a mock function with given fields: b, index
+func (_m *Datafile) ReadRaw(b []byte, index int64) (int, error) {
+	ret := _m.Called(b, index)
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func([]byte, int64) int); ok {
+		r0 = rf(b, index)
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func([]byte, int64) error); ok {
+		r1 = rf(b, index)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Reserve provides a mock function with given fields: _a0
+func (_m *Datafile) Reserve(_a0 internal.Entry) (int64, int64, error) {
+	ret := _m.Called(_a0)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(internal.Entry) int64); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 int64
+	if rf, ok := ret.Get(1).(func(internal.Entry) int64); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(internal.Entry) error); ok {
+		r2 = rf(_a0)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // Size provides a mock function with given fields:
 func (_m *Datafile) Size() int64 {
 	ret := _m.Called()
@@ -129,6 +178,20 @@ func (_m *Datafile) Sync() error {
 	return r0
 }
 
+// Truncate provides a mock function with given fields: _a0
+func (_m *Datafile) Truncate(_a0 int64) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(int64) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Write provides a mock function with given fields: _a0
 func (_m *Datafile) Write(_a0 internal.Entry) (int64, int64, error) {
 	ret := _m.Called(_a0)
@@ -156,3 +219,17 @@ func (_m *Datafile) Write(_a0 internal.Entry) (int64, int64, error) {
 
 	return r0, r1, r2
 }
+
+// WriteAt provides a mock function with given fields: _a0, _a1
+func (_m *Datafile) WriteAt(_a0 internal.Entry, _a1 int64) error {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(internal.Entry, int64) error); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -3,6 +3,7 @@
 package mocks
 
 import art "github.com/plar/go-adaptive-radix-tree"
+import index "github.com/prologic/bitcask/internal/index"
 
 import mock "github.com/stretchr/testify/mock"
 
@@ -12,7 +13,7 @@ type Indexer struct {
 }
 
 // Load provides a mock function with given fields: path, maxkeySize
-func (_m *Indexer) Load(path string, maxkeySize uint32) (art.Tree, bool, error) {
+func (_m *Indexer) Load(path string, maxkeySize uint32) (art.Tree, index.Position, bool, error) {
 	ret := _m.Called(path, maxkeySize)
 
 	var r0 art.Tree
@@ -24,30 +25,37 @@ func (_m *Indexer) Load(path string, maxkeySize uint32) (art.Tree, bool, error)
 		}
 	}
 
-	var r1 bool
-	if rf, ok := ret.Get(1).(func(string, uint32) bool); ok {
+	var r1 index.Position
+	if rf, ok := ret.Get(1).(func(string, uint32) index.Position); ok {
 		r1 = rf(path, maxkeySize)
 	} else {
-		r1 = ret.Get(1).(bool)
+		r1 = ret.Get(1).(index.Position)
 	}
 
-	var r2 error
-	if rf, ok := ret.Get(2).(func(string, uint32) error); ok {
+	var r2 bool
+	if rf, ok := ret.Get(2).(func(string, uint32) bool); ok {
 		r2 = rf(path, maxkeySize)
 	} else {
-		r2 = ret.Error(2)
+		r2 = ret.Get(2).(bool)
 	}
 
-	return r0, r1, r2
+	var r3 error
+	if rf, ok := ret.Get(3).(func(string, uint32) error); ok {
+		r3 = rf(path, maxkeySize)
+	} else {
+		r3 = ret.Error(3)
+	}
+
+	return r0, r1, r2, r3
 }
 
-// Save provides a mock function with given fields: t, path
-func (_m *Indexer) Save(t art.Tree, path string) error {
-	ret := _m.Called(t, path)
+// Save provides a mock function with given fields: t, pos, path
+func (_m *Indexer) Save(t art.Tree, pos index.Position, path string) error {
+	ret := _m.Called(t, pos, path)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(art.Tree, string) error); ok {
-		r0 = rf(t, path)
+	if rf, ok := ret.Get(0).(func(art.Tree, index.Position, string) error); ok {
+		r0 = rf(t, pos, path)
 	} else {
 		r0 = ret.Error(0)
 	}
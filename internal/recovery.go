@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"time"
+)
+
+// RecoveryReport describes the recovery actions taken when opening a
+// database, such as truncating the corrupted tail of a datafile or
+// rebuilding the index from the datafiles.
+type RecoveryReport struct {
+	// Time is when the recovery happened
+	Time time.Time `json:"time"`
+
+	// Datafile is the datafile whose corrupted tail was truncated (if any)
+	Datafile string `json:"datafile,omitempty"`
+	// TruncatedBytes is the number of bytes removed from Datafile
+	TruncatedBytes int64 `json:"truncated_bytes"`
+	// RecoveredEntries is the number of valid entries kept in Datafile
+	RecoveredEntries int `json:"recovered_entries"`
+
+	// IndexRebuilt is true if the index was rebuilt from the datafiles
+	IndexRebuilt bool `json:"index_rebuilt"`
+	// IndexedKeys is the number of keys in the rebuilt index
+	IndexedKeys int `json:"indexed_keys"`
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// IsTransientError returns true if the given error is a transient I/O error
+// (EINTR or EAGAIN) for which retrying the operation is expected to succeed.
+func IsTransientError(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// Retry calls `fn` until it succeeds, returns a non-transient error or the
+// given number of `attempts` is exhausted. Between attempts it sleeps for
+// `backoff`, doubling the delay each time. The number of retries performed
+// is returned along with the last error (if any).
+func Retry(attempts int, backoff time.Duration, fn func() error) (int, error) {
+	var retries int
+
+	for {
+		err := fn()
+		if err == nil || !IsTransientError(err) || retries >= attempts {
+			return retries, err
+		}
+		retries++
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTransientError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(IsTransientError(syscall.EINTR))
+	assert.True(IsTransientError(&os.PathError{Op: "read", Path: "foo", Err: syscall.EAGAIN}))
+	assert.False(IsTransientError(syscall.EIO))
+	assert.False(IsTransientError(errors.New("foo")))
+	assert.False(IsTransientError(nil))
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Success", func(t *testing.T) {
+		calls := 0
+		retries, err := Retry(3, 0, func() error {
+			calls++
+			if calls < 3 {
+				return syscall.EINTR
+			}
+			return nil
+		})
+		assert.NoError(err)
+		assert.Equal(2, retries)
+		assert.Equal(3, calls)
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		calls := 0
+		retries, err := Retry(2, 0, func() error {
+			calls++
+			return syscall.EAGAIN
+		})
+		assert.Equal(syscall.EAGAIN, err)
+		assert.Equal(2, retries)
+		assert.Equal(3, calls)
+	})
+
+	t.Run("NotTransient", func(t *testing.T) {
+		calls := 0
+		retries, err := Retry(3, 0, func() error {
+			calls++
+			return syscall.EIO
+		})
+		assert.Equal(syscall.EIO, err)
+		assert.Equal(0, retries)
+		assert.Equal(1, calls)
+	})
+}
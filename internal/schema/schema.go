@@ -0,0 +1,200 @@
+// Package schema implements validation of JSON values against a subset of
+// JSON Schema: type, enum, properties, required, additionalProperties,
+// items, minimum, maximum, minLength and maxLength.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchema is a compiled JSON Schema
+type JSONSchema struct {
+	raw  json.RawMessage
+	root *node
+}
+
+type node struct {
+	Type                 json.RawMessage  `json:"type"`
+	Enum                 []interface{}    `json:"enum"`
+	Properties           map[string]*node `json:"properties"`
+	Required             []string         `json:"required"`
+	AdditionalProperties *bool            `json:"additionalProperties"`
+	Items                *node            `json:"items"`
+	Minimum              *float64         `json:"minimum"`
+	Maximum              *float64         `json:"maximum"`
+	MinLength            *int             `json:"minLength"`
+	MaxLength            *int             `json:"maxLength"`
+
+	types []string
+}
+
+// Compile compiles the given JSON Schema
+func Compile(raw []byte) (*JSONSchema, error) {
+	var root node
+	if err := decode(raw, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	if err := root.compile(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	return &JSONSchema{raw: append(json.RawMessage(nil), raw...), root: &root}, nil
+}
+
+func (n *node) compile() error {
+	if len(n.Type) > 0 {
+		if n.Type[0] == '[' {
+			if err := json.Unmarshal(n.Type, &n.types); err != nil {
+				return err
+			}
+		} else {
+			var t string
+			if err := json.Unmarshal(n.Type, &t); err != nil {
+				return err
+			}
+			n.types = []string{t}
+		}
+		for _, t := range n.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	}
+
+	for _, p := range n.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	if n.Items != nil {
+		return n.Items.compile()
+	}
+	return nil
+}
+
+// MarshalJSON returns the source of the schema
+func (s *JSONSchema) MarshalJSON() ([]byte, error) {
+	return s.raw, nil
+}
+
+// Validate validates the given JSON value against the schema
+func (s *JSONSchema) Validate(value []byte) error {
+	var v interface{}
+	if err := decode(value, &v); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+	return s.root.validate("$", v)
+}
+
+func decode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (n *node) validate(path string, v interface{}) error {
+	if len(n.types) > 0 && !n.hasType(v) {
+		return fmt.Errorf("%s: expected %s", path, strings.Join(n.types, " or "))
+	}
+
+	if len(n.Enum) > 0 {
+		found := false
+		for _, e := range n.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: not one of the allowed values", path)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range n.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, value := range v {
+			p, ok := n.Properties[name]
+			if !ok {
+				if n.AdditionalProperties != nil && !*n.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := p.validate(path+"."+name, value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n.Items != nil {
+			for i, item := range v {
+				if err := n.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n.Minimum != nil && f < *n.Minimum {
+			return fmt.Errorf("%s: less than minimum %v", path, *n.Minimum)
+		}
+		if n.Maximum != nil && f > *n.Maximum {
+			return fmt.Errorf("%s: greater than maximum %v", path, *n.Maximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.MinLength != nil && length < *n.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *n.MinLength)
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *n.MaxLength)
+		}
+	}
+
+	return nil
+}
+
+func (n *node) hasType(v interface{}) bool {
+	for _, t := range n.types {
+		switch v := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if _, err := v.Int64(); t == "integer" && err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const user = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 8},
+		"age": {"type": "integer", "minimum": 0, "maximum": 150},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}},
+		"email": {"type": ["string", "null"]}
+	}
+}`
+
+func TestCompile(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := Compile([]byte(user))
+	assert.NoError(err)
+
+	data, err := s.MarshalJSON()
+	assert.NoError(err)
+	assert.Equal(user, string(data))
+
+	_, err = Compile([]byte(`{"type": "foo"}`))
+	assert.Error(err)
+	_, err = Compile([]byte(`{"properties": {"a": {"type": 1}}}`))
+	assert.Error(err)
+	_, err = Compile([]byte(`{`))
+	assert.Error(err)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := Compile([]byte(user))
+	assert.NoError(err)
+
+	valid := []string{
+		`{"name": "alice", "age": 30}`,
+		`{"name": "bob", "age": 0, "role": "admin", "tags": ["a", "b"], "email": null}`,
+		`{"name": "carol", "age": 150, "email": "c@example.com"}`,
+	}
+	for _, value := range valid {
+		assert.NoError(s.Validate([]byte(value)), value)
+	}
+
+	invalid := map[string]string{
+		`[]`:                     "$: expected object",
+		`{"name": "alice"}`:      `$: missing required property "age"`,
+		`{"name": "", "age": 1}`: "$.name: shorter than 1 characters",
+		`{"name": "alice-in-wonderland", "age": 1}`:  "$.name: longer than 8 characters",
+		`{"name": "alice", "age": 1.5}`:              "$.age: expected integer",
+		`{"name": "alice", "age": -1}`:               "$.age: less than minimum 0",
+		`{"name": "alice", "age": 151}`:              "$.age: greater than maximum 150",
+		`{"name": "alice", "age": 1, "role": "foo"}`: "$.role: not one of the allowed values",
+		`{"name": "alice", "age": 1, "tags": [1]}`:   "$.tags[0]: expected string",
+		`{"name": "alice", "age": 1, "email": 1}`:    "$.email: expected string or null",
+		`{"name": "alice", "age": 1, "foo": 1}`:      `$: unexpected property "foo"`,
+	}
+	for value, msg := range invalid {
+		err := s.Validate([]byte(value))
+		if assert.Error(err, value) {
+			assert.Equal(msg, err.Error())
+		}
+	}
+
+	assert.Error(s.Validate([]byte(`{`)))
+}
@@ -0,0 +1,22 @@
+package internal
+
+// FreeDiskSpace returns the number of bytes available to unprivileged users
+// on the file system containing the given `path`. If this is not supported
+// on the current platform `false` is returned.
+func FreeDiskSpace(path string) (uint64, bool, error) {
+	return freeDiskSpace(path)
+}
+
+// OpenFilesLimit returns the (soft) limit on the number of files the process
+// may have open at the same time. If this is not supported on the current
+// platform `false` is returned.
+func OpenFilesLimit() (uint64, bool, error) {
+	return openFilesLimit()
+}
+
+// ProcessRunning returns true if a process with the given `pid` is running
+// on this host. If this is not supported on the current platform `false` is
+// returned as second value.
+func ProcessRunning(pid int) (bool, bool) {
+	return processRunning(pid)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package internal
+
+func freeDiskSpace(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
+
+func openFilesLimit() (uint64, bool, error) {
+	return 0, false, nil
+}
+
+func processRunning(pid int) (bool, bool) {
+	return false, false
+}
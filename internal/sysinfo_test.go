@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeDiskSpace(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	free, ok, err := FreeDiskSpace(testdir)
+	assert.NoError(err)
+	if !ok {
+		t.Skip("Free disk space is not supported on this platform")
+	}
+	assert.True(free > 0)
+
+	_, _, err = FreeDiskSpace("/no/such/path")
+	assert.Error(err)
+}
+
+func TestOpenFilesLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	limit, ok, err := OpenFilesLimit()
+	assert.NoError(err)
+	if !ok {
+		t.Skip("Open files limit is not supported on this platform")
+	}
+	assert.True(limit > 0)
+}
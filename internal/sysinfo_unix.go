@@ -0,0 +1,31 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package internal
+
+import (
+	"syscall"
+)
+
+func freeDiskSpace(path string) (uint64, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, false, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true, nil
+}
+
+func openFilesLimit() (uint64, bool, error) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		return 0, false, err
+	}
+	return uint64(rlim.Cur), true, nil
+}
+
+func processRunning(pid int) (bool, bool) {
+	// Signal 0 only checks the process exists, EPERM means it does but
+	// belongs to another user
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM, true
+}
@@ -0,0 +1,110 @@
+package bitcask
+
+import (
+	"bytes"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+)
+
+// Iterator is a cursor over the keys of the database in order. Unlike
+// Keys() and Fold() it does not take a snapshot of the keys and holds no
+// lock between calls, so it can page through large keyspaces: keys written
+// or deleted while iterating may or may not be visited, but keys are never
+// visited twice nor out of order. Once keys are written or deleted the
+// iterator repositions itself by skipping over the keys already visited.
+//
+//	it := db.Iterator()
+//	it.Seek([]byte("user/"))
+//	for it.Next() {
+//		value, err := it.Value()
+//		...
+//	}
+type Iterator struct {
+	b *Bitcask
+
+	// it iterates over trie and is restarted if the trie is modified
+	trie art.Tree
+	it   art.Iterator
+
+	// from is the key iteration resumes from, inclusive or not
+	from      []byte
+	inclusive bool
+
+	key []byte
+}
+
+// Iterator returns an Iterator positioned before the first key
+func (b *Bitcask) Iterator() *Iterator {
+	return &Iterator{b: b, inclusive: true}
+}
+
+// Seek positions the iterator before the first key greater than or equal
+// to `key`, which is the next key returned by Next()
+func (it *Iterator) Seek(key []byte) {
+	it.from = append([]byte(nil), key...)
+	it.inclusive = true
+	it.it = nil
+	it.key = nil
+}
+
+// Next advances the iterator to the next key returning false once there
+// are no more keys
+func (it *Iterator) Next() bool {
+	b := it.b
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	now := b.now().UnixNano()
+	for {
+		if it.it == nil || it.trie != b.trie {
+			// Keys before `from` are skipped when restarting
+			it.trie = b.trie
+			it.it = b.trie.Iterator(art.TraverseLeaf)
+		}
+		if !it.it.HasNext() {
+			it.key = nil
+			return false
+		}
+		node, err := it.it.Next()
+		if err == art.ErrConcurrentModification {
+			it.it = nil
+			continue
+		}
+		if err != nil {
+			it.key = nil
+			return false
+		}
+
+		key := node.Key()
+		if len(key) == 0 {
+			continue
+		}
+		if c := bytes.Compare(key, it.from); c < 0 || c == 0 && !it.inclusive {
+			continue
+		}
+		if node.Value().(internal.Item).Expired(now) {
+			continue
+		}
+
+		it.key = append([]byte(nil), key...)
+		it.from = it.key
+		it.inclusive = false
+		return true
+	}
+}
+
+// Key returns the current key, nil before the first call to Next() and
+// once Next() returned false
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value of the current key, ErrKeyNotFound if it
+// was deleted since Next() returned it
+func (it *Iterator) Value() ([]byte, error) {
+	if it.key == nil {
+		return nil, ErrKeyNotFound
+	}
+	return it.b.Get(it.key)
+}
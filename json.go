@@ -0,0 +1,57 @@
+package bitcask
+
+import (
+	"github.com/prologic/bitcask/internal/jsonpath"
+)
+
+// GetPath returns the raw JSON at the given path (such as "a.b[2].c") of the
+// JSON value of the given key. The value is only scanned as far as needed
+// to find the path and is never decoded as a whole, making it cheap to read
+// small fields of large JSON documents.
+func (b *Bitcask) GetPath(key []byte, path string) ([]byte, error) {
+	segs, err := jsonpath.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := jsonpath.Get(value, segs)
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// SetPath replaces the JSON at the given path (such as "a.b[2].c") of the
+// JSON value of the given key with the given raw JSON, adding the last key
+// of the path if it is missing from its object. The value is read, modified
+// and written atomically with respect to other writers.
+func (b *Bitcask) SetPath(key []byte, path string, raw []byte) error {
+	segs, err := jsonpath.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	value, err := b.get(key)
+	if err != nil {
+		return err
+	}
+
+	value, err = jsonpath.Set(value, segs, raw)
+	if err != nil {
+		return err
+	}
+	if uint64(len(value)) > b.maxValueSize() {
+		return ErrValueTooLarge
+	}
+
+	return b.set(key, value)
+}
@@ -0,0 +1,102 @@
+package bitcask
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// lockRetryDelay is the delay between attempts to take a lock held by
+// another process
+const lockRetryDelay = 10 * time.Millisecond
+
+// LockContext takes the lock, retrying until the context is done in which
+// case the error of the context is returned
+func (f *Flock) LockContext(ctx context.Context) error {
+	for {
+		locked, err := f.TryLock()
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryDelay):
+		}
+	}
+}
+
+// LockWithTimeout takes the lock, retrying for up to the given timeout
+// before returning ErrDatabaseLocked. A zero timeout tries once.
+func (f *Flock) LockWithTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := f.LockContext(ctx); err == context.DeadlineExceeded {
+		return ErrDatabaseLocked
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// lock takes the lock of the database, waiting for up to the timeout of
+// WithOpenTimeout(), and records this process as its owner. A lock whose
+// owner is not running anymore is stale and taken over with WithForceLock(),
+// otherwise ErrStaleLock is returned.
+func (b *Bitcask) lock() error {
+	path := b.Flock.Path()
+	err := b.Flock.LockWithTimeout(b.config.OpenTimeout)
+	if err == ErrDatabaseLocked && staleLock(path) {
+		if !b.config.ForceLock {
+			return ErrStaleLock
+		}
+		// The stale lock is held on the old lock file, lock a new one
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.Flock = newFlock(path)
+		err = b.Flock.LockWithTimeout(0)
+	}
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d %s\n", os.Getpid(), host)), 0600); err != nil {
+		b.Flock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// staleLock returns true if the owner recorded in the lock file is a process
+// of this host that is not running anymore, e.g. a crashed process whose
+// lock was inherited by a child process
+func staleLock(path string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	var (
+		pid  int
+		host string
+	)
+	if _, err := fmt.Sscanf(string(data), "%d %s", &pid, &host); err != nil {
+		return false
+	}
+	if current, _ := os.Hostname(); host != current || pid == os.Getpid() {
+		return false
+	}
+	running, ok := internal.ProcessRunning(pid)
+	return ok && !running
+}
@@ -0,0 +1,162 @@
+package bitcask
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+)
+
+// mergeDatafiles returns the ids of the datafiles to merge, in order, and
+// the id of the first datafile after the merge pass in progress if it is
+// not completed by this merge, otherwise zero. Without a maximum number of
+// datafiles per merge all immutable datafiles and the current one, which
+// is rotated, are merged. The caller must hold the write lock.
+//
+// A merge pass merges the datafiles a database had when it started, so
+// the datafiles written by the merges of the pass are left to the next
+// pass. As merges write their datafiles after all others the datafiles left
+// in the pass are always the oldest ones.
+func (b *Bitcask) mergeDatafiles() ([]int, int) {
+	ids := make([]int, 0, len(b.datafiles)+1)
+	for id := range b.datafiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ids = append(ids, b.curr.FileID())
+
+	max := b.config.MaxFilesPerMerge
+	if max <= 0 {
+		return ids, 0
+	}
+
+	n := sort.SearchInts(ids, b.mergePass())
+	if n == 0 {
+		// Start a new merge pass
+		n = len(ids)
+	}
+	if n <= max {
+		return ids[:n], 0
+	}
+	return ids[:max], ids[n-1] + 1
+}
+
+// mergePass returns the id of the first datafile after the merge pass in
+// progress or zero if there is none
+func (b *Bitcask) mergePass() int {
+	data, err := fs.ReadFile(b.fsys, filepath.Join(b.path, "merge"))
+	if err != nil {
+		return 0
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return end
+}
+
+// saveMergePass saves the id of the first datafile after the merge pass in
+// progress so the next merge continues it, or removes it once the pass is
+// completed (zero)
+func (b *Bitcask) saveMergePass(end int) error {
+	path := filepath.Join(b.path, "merge")
+	if end == 0 {
+		if err := b.fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fs.WriteFile(b.fsys, path, []byte(strconv.Itoa(end)), 0600)
+}
+
+// MergeOptions are the options of a single merge, see MergeWithOptions()
+type MergeOptions struct {
+	// Progress is called with the progress of the merge every time it is
+	// done with a datafile, from the goroutine merging without holding any
+	// lock
+	Progress func(MergeProgress)
+	// RateLimit limits the bytes read and written by the merge per second,
+	// so merging does not saturate the disk. Zero means no limit.
+	RateLimit int64
+	// MinDeadRatio only merges the datafiles with at least this share of
+	// dead bytes, and the older datafiles as a datafile is never merged
+	// without all older ones (which may hold the values of the keys it
+	// deletes). Zero merges all datafiles.
+	MinDeadRatio float64
+}
+
+// MergeProgress is the progress of a merge, see MergeOptions
+type MergeProgress struct {
+	// Datafiles is the number of datafiles merged out of TotalDatafiles
+	Datafiles      int
+	TotalDatafiles int
+	// BytesCopied is the size of the live entries copied so far
+	BytesCopied uint64
+	// BytesReclaimed is the size of the dead entries of the datafiles
+	// merged so far
+	BytesReclaimed uint64
+}
+
+// MergeWithOptions merges the database like Merge() with the given options
+func (b *Bitcask) MergeWithOptions(opts MergeOptions) (err error) {
+	pprof.Do(context.Background(), b.labels("merge"), func(ctx context.Context) {
+		err = b.merge(ctx, opts)
+	})
+	return
+}
+
+// deadDatafiles returns the oldest of the datafiles to merge up to the last
+// one with at least the given share of dead bytes, none if no datafile has
+// that many, from the live bytes of every datafile. The caller must hold the
+// write lock.
+func (b *Bitcask) deadDatafiles(ids []int, live map[int]int64, ratio float64) []int {
+	n := 0
+	for i, id := range ids {
+		size := b.curr.Size()
+		if df, ok := b.datafiles[id]; ok {
+			size = df.Size()
+		}
+		if size > 0 && float64(size-live[id])/float64(size) >= ratio {
+			n = i + 1
+		}
+	}
+	return ids[:n]
+}
+
+// throttle paces I/O to a rate in bytes per second, see MergeOptions
+type throttle struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait accounts for n more bytes and waits until they are within the rate,
+// unless the context is done first
+func (t *throttle) wait(ctx context.Context, n int64) error {
+	if t.rate <= 0 {
+		return nil
+	}
+	t.bytes += n
+	d := time.Duration(float64(t.bytes)/float64(t.rate)*float64(time.Second)) - time.Since(t.start)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"expvar"
+	"time"
+)
+
+// Expvar is a Collector publishing the number of operations, failed
+// operations and the total time taken by operations of each kind as
+// expvar variables, e.g. `puts`, `put_errors` and `put_seconds`.
+type Expvar struct {
+	m *expvar.Map
+}
+
+// NewExpvar creates a new Expvar collector publishing its variables in a
+// map with the given name. Like expvar.Publish() it panics if the name is
+// already in use.
+func NewExpvar(name string) *Expvar {
+	return &Expvar{m: expvar.NewMap(name)}
+}
+
+// Observe records the operation
+func (e *Expvar) Observe(op Op, d time.Duration, err error) {
+	e.m.Add(op.String()+"s", 1)
+	if err != nil {
+		e.m.Add(op.String()+"_errors", 1)
+	}
+	e.m.AddFloat(op.String()+"_seconds", d.Seconds())
+}
+
+// Map returns the map holding the variables
+func (e *Expvar) Map() *expvar.Map {
+	return e.m
+}
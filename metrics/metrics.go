@@ -0,0 +1,53 @@
+// Package metrics defines the Collector interface through which an open
+// Bitcask database reports its operations as they happen, so they can be
+// exported to a monitoring system such as Prometheus or expvar without
+// changing the database itself. See also Bitcask.Stats() for the state of
+// the database (number of keys, live and dead bytes, etc.) to export as
+// gauges.
+package metrics
+
+import (
+	"time"
+)
+
+// Op is the kind of an operation reported to a Collector
+type Op int
+
+const (
+	// Get is a read of a key
+	Get Op = iota
+	// Put is a write of a key, or of a batch of keys
+	Put
+	// Delete is a delete of a key
+	Delete
+	// Merge is a merge of the datafiles
+	Merge
+	// Sync is an fsync of a datafile
+	Sync
+)
+
+var names = [...]string{"get", "put", "delete", "merge", "sync"}
+
+func (op Op) String() string {
+	if op < 0 || int(op) >= len(names) {
+		return "unknown"
+	}
+	return names[op]
+}
+
+// Collector collects the operations of a database, see
+// bitcask.WithMetrics(). Observe is called synchronously at the end of
+// every operation, so it must be cheap and safe for concurrent use.
+type Collector interface {
+	// Observe records an operation that took `d` and failed with `err`,
+	// nil if it succeeded. Not finding a key is reported as an error.
+	Observe(op Op, d time.Duration, err error)
+}
+
+// CollectorFunc is a function implementing Collector
+type CollectorFunc func(op Op, d time.Duration, err error)
+
+// Observe calls the function
+func (f CollectorFunc) Observe(op Op, d time.Duration, err error) {
+	f(op, d, err)
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOp(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("get", Get.String())
+	assert.Equal("sync", Sync.String())
+	assert.Equal("unknown", Op(42).String())
+}
+
+func TestExpvar(t *testing.T) {
+	assert := assert.New(t)
+
+	var c Collector = NewExpvar("bitcask_test")
+	c.Observe(Put, time.Second, nil)
+	c.Observe(Put, time.Second/2, errors.New("error"))
+	c.Observe(Get, time.Second, nil)
+
+	m := c.(*Expvar).Map()
+	assert.Equal("2", m.Get("puts").String())
+	assert.Equal("1", m.Get("put_errors").String())
+	assert.Equal("1.5", m.Get("put_seconds").String())
+	assert.Equal("1", m.Get("gets").String())
+	assert.Nil(m.Get("get_errors"))
+
+	assert.Panics(func() { NewExpvar("bitcask_test") })
+}
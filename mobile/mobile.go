@@ -0,0 +1,152 @@
+// Package mobile is a facade over Bitcask for use from Android and iOS apps
+// with gomobile (`gomobile bind github.com/prologic/bitcask/mobile`). Its
+// exported API only uses types supported by gobind: strings, byte slices,
+// numbers, booleans, errors and structs thereof; no channels or funcs.
+//
+// Lifecycle guidance:
+//
+//   - Open the database once, from the app's private files directory
+//     (e.g. Context.getFilesDir() or the Application Support directory),
+//     and share the DB between threads; it is safe for concurrent use.
+//   - Call Sync() when the app is backgrounded as it may be suspended or
+//     killed without notice, or open it with Options.Sync set to sync on
+//     every write at the cost of throughput.
+//   - Call Close() when the app terminates or the database is no longer
+//     needed. A database left open by a killed app can be reopened as the
+//     OS releases its lock.
+//   - Merge() rewrites all datafiles, so run it off the main thread, e.g.
+//     when the device is idle and charging.
+package mobile
+
+import (
+	"github.com/prologic/bitcask"
+)
+
+// Options configures a database opened with OpenWithOptions(), see
+// NewOptions() for the defaults
+type Options struct {
+	MaxDatafileSize int
+	MaxKeySize      int
+	MaxValueSize    int64
+	Sync            bool
+}
+
+// NewOptions returns the default options
+func NewOptions() *Options {
+	return &Options{
+		MaxDatafileSize: bitcask.DefaultMaxDatafileSize,
+		MaxKeySize:      int(bitcask.DefaultMaxKeySize),
+		MaxValueSize:    int64(bitcask.DefaultMaxValueSize),
+		Sync:            bitcask.DefaultSync,
+	}
+}
+
+// DB is an open database
+type DB struct {
+	db *bitcask.Bitcask
+}
+
+// Open opens the database at the given path with the default options,
+// creating it if it does not exist
+func Open(path string) (*DB, error) {
+	return OpenWithOptions(path, NewOptions())
+}
+
+// OpenWithOptions opens the database at the given path with the given
+// options, creating it if it does not exist
+func OpenWithOptions(path string, opts *Options) (*DB, error) {
+	db, err := bitcask.Open(
+		path,
+		bitcask.WithMaxDatafileSize(opts.MaxDatafileSize),
+		bitcask.WithMaxKeySize(uint32(opts.MaxKeySize)),
+		bitcask.WithMaxValueSize(uint64(opts.MaxValueSize)),
+		bitcask.WithSync(opts.Sync),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// Get returns the value of the key, or an error if it is not found (see
+// Has())
+func (d *DB) Get(key []byte) ([]byte, error) {
+	return d.db.Get(key)
+}
+
+// GetString is Get() for string keys and values
+func (d *DB) GetString(key string) (string, error) {
+	value, err := d.db.Get([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Has returns true if the key exists
+func (d *DB) Has(key []byte) bool {
+	return d.db.Has(key)
+}
+
+// Put stores the key and value
+func (d *DB) Put(key, value []byte) error {
+	return d.db.Put(key, value)
+}
+
+// PutString is Put() for string keys and values
+func (d *DB) PutString(key, value string) error {
+	return d.db.Put([]byte(key), []byte(value))
+}
+
+// Delete deletes the key
+func (d *DB) Delete(key []byte) error {
+	return d.db.Delete(key)
+}
+
+// Len returns the number of keys
+func (d *DB) Len() int {
+	return d.db.Len()
+}
+
+// Scan returns the keys with the given prefix (all keys if empty)
+func (d *DB) Scan(prefix []byte) (*Keys, error) {
+	keys := &Keys{}
+	err := d.db.Scan(prefix, func(key []byte) error {
+		keys.keys = append(keys.keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Merge reclaims the disk space of deleted and overwritten values
+func (d *DB) Merge() error {
+	return d.db.Merge()
+}
+
+// Sync flushes all writes to disk
+func (d *DB) Sync() error {
+	return d.db.Sync()
+}
+
+// Close closes the database
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Keys is a list of keys returned by Scan()
+type Keys struct {
+	keys [][]byte
+}
+
+// Len returns the number of keys
+func (k *Keys) Len() int {
+	return len(k.keys)
+}
+
+// Get returns the i-th key
+func (k *Keys) Get(i int) []byte {
+	return k.keys[i]
+}
@@ -0,0 +1,57 @@
+package mobile
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestDB(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	opts := NewOptions()
+	opts.MaxDatafileSize = 32
+	db, err := OpenWithOptions(testdir, opts)
+	assert.NoError(err)
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	assert.NoError(db.PutString("hello", "world"))
+	assert.NoError(db.PutString("help", "me"))
+
+	value, err := db.Get([]byte("foo"))
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), value)
+
+	s, err := db.GetString("hello")
+	assert.NoError(err)
+	assert.Equal("world", s)
+
+	_, err = db.GetString("missing")
+	assert.Equal(bitcask.ErrKeyNotFound, err)
+	assert.False(db.Has([]byte("missing")))
+
+	keys, err := db.Scan([]byte("hel"))
+	assert.NoError(err)
+	assert.Equal(2, keys.Len())
+	assert.Equal([]byte("hello"), keys.Get(0))
+	assert.Equal([]byte("help"), keys.Get(1))
+
+	assert.NoError(db.Delete([]byte("foo")))
+	assert.Equal(2, db.Len())
+	assert.NoError(db.Merge())
+	assert.NoError(db.Sync())
+	assert.NoError(db.Close())
+
+	db, err = Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+	assert.Equal(2, db.Len())
+}
@@ -0,0 +1,143 @@
+package bitcask
+
+import (
+	"bytes"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+)
+
+// Move renames the key `oldKey` to `newKey` atomically, overwriting the value
+// of `newKey` if it exists. The value keeps its expiry (see PutWithTTL()).
+// The new key and the deletion of the old one are written as a batch (see
+// Write()) so they are applied together or not at all, even when crashing.
+// If `oldKey` doesn't exist ErrKeyNotFound is returned.
+func (b *Bitcask) Move(oldKey, newKey []byte) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(newKey) == 0 {
+		return ErrEmptyKey
+	}
+	if uint32(len(newKey)) > b.config.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	e, err := b.getEntry(oldKey)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return nil
+	}
+
+	return b.write([]internal.Entry{b.moved(e, newKey), internal.NewEntry(oldKey, []byte{})}, true)
+}
+
+// Copy stores the value of the key `srcKey` under `dstKey` too, overwriting
+// the value of `dstKey` if it exists, without the value passing through the
+// caller. The copy keeps the expiry of `srcKey` if `preserveTTL` is set and
+// never expires otherwise. As every entry on disk holds its key the value
+// is written again rather than shared between the keys. If `srcKey` doesn't
+// exist ErrKeyNotFound is returned.
+func (b *Bitcask) Copy(srcKey, dstKey []byte, preserveTTL bool) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(dstKey) == 0 {
+		return ErrEmptyKey
+	}
+	if uint32(len(dstKey)) > b.config.MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	e, err := b.getEntry(srcKey)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(srcKey, dstKey) {
+		return nil
+	}
+
+	c := b.moved(e, dstKey)
+	if !preserveTTL {
+		c.Expiry = 0
+	}
+	return b.write([]internal.Entry{c}, true)
+}
+
+// RenamePrefix renames all keys starting with `oldPrefix` to start with
+// `newPrefix` instead, atomically like Move(), overwriting the values of
+// keys that already exist. All the renamed values are read into memory and
+// written as a single batch, so prefixes with very many or large values are
+// better moved in smaller steps.
+func (b *Bitcask) RenamePrefix(oldPrefix, newPrefix []byte) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(oldPrefix) == 0 {
+		return ErrEmptyKey
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if bytes.Equal(oldPrefix, newPrefix) {
+		return nil
+	}
+
+	var keys [][]byte
+	b.trie.ForEachPrefix(oldPrefix, func(node art.Node) bool {
+		keys = append(keys, node.Key())
+		return true
+	})
+
+	// All old keys are deleted before the new ones are written, as a new key
+	// may also be one of the old ones
+	deletes := make([]internal.Entry, 0, len(keys))
+	puts := make([]internal.Entry, 0, len(keys))
+	for _, key := range keys {
+		e, err := b.getEntry(key)
+		if err == ErrKeyNotFound {
+			// Expired
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		newKey := append(append([]byte(nil), newPrefix...), key[len(oldPrefix):]...)
+		if len(newKey) == 0 {
+			return ErrEmptyKey
+		}
+		if uint32(len(newKey)) > b.config.MaxKeySize {
+			return ErrKeyTooLarge
+		}
+
+		deletes = append(deletes, internal.NewEntry(key, []byte{}))
+		puts = append(puts, b.moved(e, newKey))
+	}
+	if len(puts) == 0 {
+		return nil
+	}
+
+	return b.write(append(deletes, puts...), true)
+}
+
+// moved returns the entry storing the value of `e` under the new key, the
+// value is stored as is without decoding it
+func (b *Bitcask) moved(e internal.Entry, key []byte) internal.Entry {
+	m := b.newEntry(key, e.Value)
+	m.Expiry = e.Expiry
+	m.Compression = e.Compression
+	return m
+}
@@ -1,6 +1,15 @@
 package bitcask
 
-import "github.com/prologic/bitcask/internal/config"
+import (
+	"bytes"
+	"time"
+
+	"github.com/prologic/bitcask/filter"
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/metrics"
+)
 
 const (
 	// DefaultMaxDatafileSize is the default maximum datafile size in bytes
@@ -16,6 +25,34 @@ const (
 	DefaultSync = false
 
 	// DefaultAutoRecovery is the default auto-recovery action.
+	DefaultAutoRecovery = false
+
+	// DefaultRetryAttempts is the default number of times a transient I/O
+	// error is retried before being returned to the caller
+	DefaultRetryAttempts = 3
+
+	// DefaultRetryBackoff is the default initial delay between retries
+	DefaultRetryBackoff = time.Millisecond
+
+	// DefaultFormatVersion is the default on-disk format version of new
+	// databases, the legacy format with fixed width record headers
+	DefaultFormatVersion = 0
+
+	// DefaultTaskRestarts is the default number of times a background task
+	// that panicked is restarted
+	DefaultTaskRestarts = 3
+
+	// DefaultTaskBackoff is the default delay before restarting a background
+	// task that panicked
+	DefaultTaskBackoff = time.Second
+
+	// DefaultReadLatencyTarget is the default latency of foreground reads
+	// above which background reads are throttled
+	DefaultReadLatencyTarget = 10 * time.Millisecond
+
+	// MemoryPath opens a database in a new in-memory file system, see
+	// fs.NewMemory()
+	MemoryPath = ":memory:"
 )
 
 // Option is a function that takes a config struct and modifies it
@@ -55,11 +92,452 @@ func WithMaxValueSize(size uint64) Option {
 	}
 }
 
+// SyncPolicy is when the writes to a database are synced to disk, see
+// WithSyncPolicy()
+type SyncPolicy time.Duration
+
+const (
+	// SyncNever leaves syncing writes to the operating system, to Sync()
+	// and to Close() (the default)
+	SyncNever SyncPolicy = 0
+	// SyncAlways syncs every key/value written before the write returns
+	SyncAlways SyncPolicy = -1
+)
+
+// SyncInterval syncs the writes to a database every interval from a
+// background task, so at most an interval of writes is lost on a crash
+func SyncInterval(interval time.Duration) SyncPolicy {
+	if interval <= 0 {
+		return SyncNever
+	}
+	return SyncPolicy(interval)
+}
+
 // WithSync causes Sync() to be called on every key/value written increasing
-// durability and safety at the expense of performance
+// durability and safety at the expense of performance. It is
+// WithSyncPolicy(SyncAlways) if `sync` is true and
+// WithSyncPolicy(SyncNever) otherwise.
 func WithSync(sync bool) Option {
+	if sync {
+		return WithSyncPolicy(SyncAlways)
+	}
+	return WithSyncPolicy(SyncNever)
+}
+
+// WithSyncPolicy sets when writes are synced to disk: SyncAlways increases
+// durability and safety at the expense of performance, SyncInterval(d)
+// bounds the writes lost on a crash to those of the last interval. Sync()
+// can be called to sync at any time whatever the policy.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(cfg *config.Config) error {
+		cfg.Sync = policy == SyncAlways
+		cfg.SyncInterval = 0
+		if policy > 0 {
+			cfg.SyncInterval = time.Duration(policy)
+		}
+		return nil
+	}
+}
+
+// WithRetryPolicy sets the number of times reads and syncs failing with a
+// transient I/O error (EINTR, EAGAIN) are retried and the initial backoff
+// between attempts (doubled on every retry). Zero attempts disables retries.
+func WithRetryPolicy(attempts int, backoff time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.RetryAttempts = attempts
+		cfg.RetryBackoff = backoff
+		return nil
+	}
+}
+
+// WithWorkerPool sets the function used to spawn the background tasks of
+// the database (e.g: a goroutine pool's submit function). The function must
+// eventually run the task it is given. By default every task runs on its
+// own goroutine.
+func WithWorkerPool(spawn func(task func())) Option {
+	return func(cfg *config.Config) error {
+		cfg.WorkerPool = spawn
+		return nil
+	}
+}
+
+// WithTaskRestartPolicy sets how many times a background task that panicked
+// is recovered and restarted and the delay before each restart. Once the
+// restarts are exhausted the task is no longer run.
+func WithTaskRestartPolicy(restarts int, backoff time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.TaskRestarts = restarts
+		cfg.TaskBackoff = backoff
+		return nil
+	}
+}
+
+// WithNodeID sets the id of the node recorded as the origin of every entry
+// written, so the writer of a key can be told apart when the databases of
+// several nodes are combined (see GetWithMeta()). The database must use
+// format version 3, see WithFormatVersion(). Zero (the default) means the
+// origin is unknown.
+func WithNodeID(id uint32) Option {
+	return func(cfg *config.Config) error {
+		cfg.NodeID = id
+		return nil
+	}
+}
+
+// WithAutoMerge merges the database in the background, checking every
+// `interval` whether there is anything to reclaim and the thresholds set
+// with WithAutoMergeThresholds() are reached. Zero (the default) disables
+// automatic merges. See also PauseAutoMerge().
+func WithAutoMerge(interval time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.AutoMergeInterval = interval
+		return nil
+	}
+}
+
+// WithTrash turns on trash mode: Delete() and DeleteAll() move keys under
+// TrashPrefix where they expire after the given window, until then they can
+// be restored with Undelete(). Keys too large to be moved to the trash fail
+// to delete with ErrKeyTooLarge. Zero (the default) deletes keys right away.
+// The database must use format version 2 or later to store the expiry.
+func WithTrash(window time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.TrashWindow = window
+		return nil
+	}
+}
+
+// WithAutoMergeThresholds sets when automatic merges run: once the ratio
+// of dead (overwritten or deleted) bytes to all bytes in the datafiles is
+// at least `deadRatio` or there are at least `datafiles` datafiles. Zero
+// disables a threshold, with both disabled (the default) the database is
+// merged whenever there are dead bytes.
+func WithAutoMergeThresholds(deadRatio float64, datafiles int) Option {
+	return func(cfg *config.Config) error {
+		cfg.AutoMergeDeadRatio = deadRatio
+		cfg.AutoMergeDatafiles = datafiles
+		return nil
+	}
+}
+
+// WithMaxOpenFiles limits the number of immutable datafiles kept open at
+// the same time. Least recently used datafiles are closed and reopened on
+// demand when the limit is reached. Zero (the default) means no limit.
+func WithMaxOpenFiles(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxOpenFiles = n
+		return nil
+	}
+}
+
+// WithIndexLog appends the changes of the index to an index log every
+// interval from a background task, rather than only saving the index when
+// the database is closed or merged, so reopening it after a crash only
+// indexes the entries written since the last interval instead of all the
+// entries written since it was opened. The index log is compacted into the
+// index once it gets larger than the index.
+func WithIndexLog(interval time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.IndexLogInterval = interval
+		return nil
+	}
+}
+
+// WithReadLatencyTarget sets the latency of foreground reads above which
+// reads at background priority, such as merges and exports, are throttled
+// (see Priority). Zero uses DefaultReadLatencyTarget and a negative target
+// never throttles background reads.
+func WithReadLatencyTarget(d time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.ReadLatencyTarget = d
+		return nil
+	}
+}
+
+// WithMaxDatastoreSize limits the size of the entries of all live keys, as
+// reported by Stats().LiveBytes, to the given number of bytes. Writes over
+// the limit fail or evict keys as per WithEvictionPolicy(). The datafiles
+// may be larger until merged. Zero (the default) means no limit.
+func WithMaxDatastoreSize(bytes int64) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxDatastoreSize = bytes
+		return nil
+	}
+}
+
+// WithMaxKeys limits the number of keys in the database. Writes over the
+// limit fail or evict keys as per WithEvictionPolicy(). Zero (the default)
+// means no limit.
+func WithMaxKeys(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxKeys = n
+		return nil
+	}
+}
+
+// WithEvictionPolicy sets what the database does once a write would take it
+// over the limits of WithMaxDatastoreSize() or WithMaxKeys(): reject it
+// (the default) or evict the oldest or least recently used keys. See
+// EvictionPolicy.
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(cfg *config.Config) error {
+		cfg.EvictionPolicy = int(policy)
+		return nil
+	}
+}
+
+// WithActiveDir writes the current datafile, which all writes go to, in the
+// given directory rather than the database's, such as a tmpfs mount for
+// write-heavy workloads, and checkpoints it every interval: it is moved into
+// the database and a new current datafile is started. Writes since the last
+// checkpoint are lost if the directory is (e.g. a tmpfs on reboot), so the
+// interval is the durability window. Datafiles left in the directory by a
+// crashed process are checkpointed when the database is reopened. The
+// directory must not be shared with other databases, and read-only
+// databases only see the datafiles checkpointed.
+func WithActiveDir(dir string, interval time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.ActiveDir = dir
+		cfg.CheckpointInterval = interval
+		return nil
+	}
+}
+
+// WithIdleTimeout closes the immutable datafiles once the database has not
+// been read from nor written to for the given duration, they are reopened
+// on demand by the next read. This keeps processes holding many rarely used
+// databases open within their file descriptor and memory limits. Zero (the
+// default) keeps datafiles open.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.IdleTimeout = d
+		return nil
+	}
+}
+
+// WithMMap sets whether immutable datafiles are memory mapped, letting the
+// page cache serve reads without a system call each (the default), or read
+// with pread. Datafiles that can't be memory mapped, for example on
+// filesystems not supporting it, are read with pread either way.
+func WithMMap(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.DisableMMap = !enabled
+		return nil
+	}
+}
+
+// WithFileSystem stores the database in the given file system instead of the
+// operating system's. Databases in other file systems are not locked against
+// other processes and skip the checks of the disk space and open files limit.
+func WithFileSystem(fsys fs.FileSystem) Option {
+	return func(cfg *config.Config) error {
+		cfg.FileSystem = fsys
+		return nil
+	}
+}
+
+// WithOpenTimeout makes Open() wait for up to the given timeout for another
+// process to release the lock of the database before failing with
+// ErrDatabaseLocked. Zero (the default) fails right away.
+func WithOpenTimeout(timeout time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.OpenTimeout = timeout
+		return nil
+	}
+}
+
+// WithForceLock makes Open() take over a stale lock, held on behalf of a
+// process of this host that is not running anymore, instead of failing with
+// ErrStaleLock. Only use it if no other process may still be writing to the
+// database, e.g. a child process that inherited the lock.
+func WithForceLock() Option {
+	return func(cfg *config.Config) error {
+		cfg.ForceLock = true
+		return nil
+	}
+}
+
+// WithBloomFilter keeps a bloom filter of the keys in memory with the given
+// false positive rate, so Get(), Has() and their variants answer most
+// lookups of missing keys without searching the index nor taking its lock.
+// It suits workloads with many misses and costs about 10 bits per key at a
+// rate of 0.01. See Stats() for how well it performs.
+func WithBloomFilter(fpRate float64) Option {
+	return func(cfg *config.Config) error {
+		if !(fpRate > 0 && fpRate < 1) {
+			return filter.ErrInvalidRate
+		}
+		cfg.BloomFilter = fpRate
+		return nil
+	}
+}
+
+// WithMinFreeDiskSpace makes Open() fail with ErrInsufficientDiskSpace if
+// less than the given number of bytes are free on the file system holding
+// the database, Merge() also refuses to run if it would leave less free disk
+// space than this. Zero (the default) disables the check.
+func WithMinFreeDiskSpace(bytes uint64) Option {
+	return func(cfg *config.Config) error {
+		cfg.MinFreeDiskSpace = bytes
+		return nil
+	}
+}
+
+// WithTolerateInvalidDatafiles disables the checks of the datafiles made
+// when opening the database (see ErrInvalidDatafiles), for example to open
+// a database restored from a backup with skewed modification times. It only
+// applies to the Open() it is given to.
+func WithTolerateInvalidDatafiles(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.TolerateInvalidDatafiles = enabled
+		return nil
+	}
+}
+
+// WithReadOnly opens the database read-only alongside a process writing to
+// it, see OpenReadOnly().
+func WithReadOnly() Option {
+	return func(cfg *config.Config) error {
+		cfg.ReadOnly = true
+		return nil
+	}
+}
+
+// WithFormatVersion sets the on-disk format version of a new database.
+// Version 0 (the default) frames every record with a fixed 16 byte header
+// and checksum, version 1 uses varint encoded key and value sizes which
+// saves about 10 bytes per record for small keys and values, version 2
+// also stores the expiry of keys written with PutWithTTL() and version 3
+// also stores the id of the node that wrote every record (see WithNodeID()),
+// version 4 also stores how every value is compressed (see
+// WithCompression()) and version 5 also stores the version and timestamp
+// of every record (see PutIfVersion()).
+// The format of a database that already has data cannot be changed.
+func WithFormatVersion(version int) Option {
+	return func(cfg *config.Config) error {
+		if !codec.Format(version).Valid() {
+			return ErrUnsupportedFormatVersion
+		}
+		cfg.FormatVersion = version
+		return nil
+	}
+}
+
+// Compression is how values are compressed, see WithCompression()
+type Compression = codec.Compression
+
+const (
+	// CompressionNone stores values as is
+	CompressionNone = codec.CompressionNone
+	// CompressionGzip compresses values with gzip
+	CompressionGzip = codec.CompressionGzip
+)
+
+// WithCompression compresses the values written from now on, values that
+// do not get any smaller are stored as is. How every value is compressed
+// is stored along with it so values written with other or no compression
+// can still be read, and Merge() recompresses them as configured unless
+// they would get larger. The database must use format version 4.
+func WithCompression(compression Compression) Option {
+	return func(cfg *config.Config) error {
+		if !compression.Valid() {
+			return ErrUnsupportedCompression
+		}
+		cfg.Compression = uint8(compression)
+		return nil
+	}
+}
+
+// WithPrefixCodec compresses the values of the keys with the given prefix
+// as given rather than as set by WithCompression(), e.g. CompressionNone
+// for values that are compressed already. The longest prefix matching a key
+// applies, and the prefixes are kept with the configuration of the
+// database like its compression. The database must use format version 4.
+func WithPrefixCodec(prefix []byte, compression Compression) Option {
+	return func(cfg *config.Config) error {
+		if !compression.Valid() {
+			return ErrUnsupportedCompression
+		}
+		for i, p := range cfg.PrefixCompression {
+			if bytes.Equal(p.Prefix, prefix) {
+				cfg.PrefixCompression[i].Compression = uint8(compression)
+				return nil
+			}
+		}
+		cfg.PrefixCompression = append(cfg.PrefixCompression, config.PrefixCompression{
+			Prefix:      append([]byte(nil), prefix...),
+			Compression: uint8(compression),
+		})
+		return nil
+	}
+}
+
+// WithEncryption encrypts the values of the database with AES-GCM using
+// the given 16, 24 or 32 byte key (AES-128, AES-192 or AES-256). Keys are
+// not encrypted. Every encrypted value takes 28 more bytes, which count
+// towards the maximum value size (see WithMaxValueSize()). Encryption can
+// only be turned on for a new database, which must then always be opened
+// with the same key: Open() fails with ErrInvalidEncryptionKey for a wrong
+// or missing key.
+func WithEncryption(key []byte) Option {
+	return func(cfg *config.Config) error {
+		cfg.EncryptionKey = append([]byte(nil), key...)
+		return nil
+	}
+}
+
+// WithMetrics reports every Get(), Put(), Delete(), Merge() and sync of the
+// database (including their variants) to the given collector, e.g. to
+// export them to Prometheus or expvar (see metrics.NewExpvar()). The
+// counters and latencies are also available from Stats().
+func WithMetrics(c metrics.Collector) Option {
+	return func(cfg *config.Config) error {
+		cfg.Metrics = c
+		return nil
+	}
+}
+
+// WithRecoveryHandler sets a function called with a report every time a
+// recovery is performed when opening the database (such as truncating the
+// corrupted tail of a datafile or rebuilding the index), so silent data
+// truncation can be logged or alerted on. The handler must not call into
+// the database.
+func WithRecoveryHandler(handler func(RecoveryReport)) Option {
+	return func(cfg *config.Config) error {
+		cfg.RecoveryHandler = handler
+		return nil
+	}
+}
+
+// WithMaxFilesPerMerge limits the number of datafiles a merge rewrites, so
+// merging a large database can be split across several Merge() calls, such
+// as across maintenance windows. Each merge rewrites the oldest datafiles
+// not yet merged by the merge pass in progress. Zero (the default) merges
+// all datafiles at once.
+func WithMaxFilesPerMerge(n int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MaxFilesPerMerge = n
+		return nil
+	}
+}
+
+// WithCorruptionPolicy sets what the database does once it finds corrupted
+// data, such as a value failing its checksum or the index referring to a
+// datafile that is gone: fail the operation (the default), carry on in a
+// degraded mode or panic. See CorruptionPolicy.
+func WithCorruptionPolicy(policy CorruptionPolicy) Option {
+	return func(cfg *config.Config) error {
+		cfg.CorruptionPolicy = int(policy)
+		return nil
+	}
+}
+
+// WithCorruptionHandler sets a function called every time corrupted data is
+// found, whatever the corruption policy, so corruptions can be logged or
+// alerted on. The handler must not call into the database.
+func WithCorruptionHandler(handler func(Corruption)) Option {
 	return func(cfg *config.Config) error {
-		cfg.Sync = sync
+		cfg.CorruptionHandler = handler
 		return nil
 	}
 }
@@ -70,5 +548,11 @@ func newDefaultConfig() *config.Config {
 		MaxKeySize:      DefaultMaxKeySize,
 		MaxValueSize:    DefaultMaxValueSize,
 		Sync:            DefaultSync,
+		AutoRecovery:    DefaultAutoRecovery,
+		RetryAttempts:   DefaultRetryAttempts,
+		RetryBackoff:    DefaultRetryBackoff,
+		TaskRestarts:    DefaultTaskRestarts,
+		TaskBackoff:     DefaultTaskBackoff,
+		FormatVersion:   DefaultFormatVersion,
 	}
 }
@@ -0,0 +1,154 @@
+package bitcask
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/config"
+)
+
+// reservedFiles is the number of files, besides the datafiles, the database
+// and the process around it are expected to need open
+const reservedFiles = 32
+
+// preflight checks there are enough file descriptors available to open all
+// datafiles in `path` and enough free disk space as configured, so Open()
+// fails early with an actionable error rather than the database failing in
+// the middle of an operation later on
+func preflight(path string, cfg *config.Config) error {
+	fns, err := internal.GetDatafiles(cfg.FS(), path)
+	if err != nil {
+		return err
+	}
+
+	needed := uint64(len(fns))
+	if cfg.MaxOpenFiles > 0 && needed > uint64(cfg.MaxOpenFiles) {
+		needed = uint64(cfg.MaxOpenFiles)
+	}
+	needed += reservedFiles
+
+	limit, ok, err := internal.OpenFilesLimit()
+	if err != nil {
+		return err
+	}
+	if ok && limit < needed {
+		return fmt.Errorf(
+			"%w: %d datafiles need about %d open files but the limit is %d, "+
+				"raise the limit (ulimit -n) or use WithMaxOpenFiles()",
+			ErrTooManyOpenFiles, len(fns), needed, limit,
+		)
+	}
+
+	// A read-only database does not write to the disk, nor does a database
+	// in another file system than the operating system's
+	if cfg.MinFreeDiskSpace > 0 && !cfg.ReadOnly && cfg.FS() == fs.OS {
+		free, ok, err := internal.FreeDiskSpace(path)
+		if err != nil {
+			return err
+		}
+		if ok && free < cfg.MinFreeDiskSpace {
+			return fmt.Errorf(
+				"%w: %d bytes free in %s but at least %d bytes are required, "+
+					"free up disk space or lower WithMinFreeDiskSpace()",
+				ErrInsufficientDiskSpace, free, path, cfg.MinFreeDiskSpace,
+			)
+		}
+	}
+
+	return nil
+}
+
+// maxClockSkew is how far in the future the modification time of a datafile
+// may be before it is considered written by a host with a skewed clock
+const maxClockSkew = time.Minute
+
+// checkDatafiles checks the ids of the datafiles in `path` reliably order
+// their entries from oldest to newest, the order the index is built in:
+//
+//   - No two datafiles have the same id, e.g. `1.data` and `000000001.data`,
+//     as only one of them would be loaded.
+//   - No datafile was modified after `now`, which would mean the clocks of
+//     the hosts that wrote the datafiles disagree.
+//   - The ids are contiguous except for the single gap a merge leaves
+//     between the merged datafiles and the ones written after them, any
+//     other gap means datafiles are missing.
+func checkDatafiles(fsys fs.FileSystem, path string, now time.Time) error {
+	fns, err := internal.GetDatafiles(fsys, path)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[int]string, len(fns))
+	for _, fn := range fns {
+		id, err := internal.ParseIds([]string{fn})
+		if err != nil {
+			return err
+		}
+		if other, ok := ids[id[0]]; ok {
+			return fmt.Errorf(
+				"%w: %s and %s have the same id",
+				ErrInvalidDatafiles, filepath.Base(other), filepath.Base(fn),
+			)
+		}
+		ids[id[0]] = fn
+
+		stat, err := fsys.Stat(fn)
+		if err != nil {
+			return err
+		}
+		if stat.ModTime().After(now.Add(maxClockSkew)) {
+			return fmt.Errorf(
+				"%w: %s was modified in the future (%s)",
+				ErrInvalidDatafiles, filepath.Base(fn), stat.ModTime().Format(time.RFC3339),
+			)
+		}
+	}
+
+	sorted, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+	gaps := 0
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i] != sorted[i-1]+1 {
+			gaps++
+		}
+		if gaps > 1 {
+			return fmt.Errorf(
+				"%w: datafiles %d to %d are missing",
+				ErrInvalidDatafiles, sorted[i-1]+1, sorted[i]-1,
+			)
+		}
+	}
+
+	return nil
+}
+
+// checkMergeSpace checks there is enough free disk space in `path` to merge
+// `live` bytes of entries into new datafiles and save the index, leaving at
+// least the configured minimum free disk space
+func checkMergeSpace(path string, cfg *config.Config, live int64) error {
+	required := uint64(live) + cfg.MinFreeDiskSpace
+	if stat, err := cfg.FS().Stat(filepath.Join(path, "index")); err == nil {
+		required += uint64(stat.Size())
+	}
+	if cfg.FS() != fs.OS {
+		return nil
+	}
+
+	free, ok, err := internal.FreeDiskSpace(path)
+	if err != nil {
+		return err
+	}
+	if ok && free < required {
+		return fmt.Errorf(
+			"%w: merging needs about %d bytes but only %d bytes are free in %s",
+			ErrInsufficientDiskSpace, required, free, path,
+		)
+	}
+
+	return nil
+}
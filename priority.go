@@ -0,0 +1,89 @@
+package bitcask
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// readSchedulerIdle is how long after the last foreground read the
+	// background reads are not throttled anymore
+	readSchedulerIdle = time.Second
+	// readSchedulerMaxInterval is the longest background reads are spaced
+	readSchedulerMaxInterval = 100 * time.Millisecond
+)
+
+// Priority is the priority of a read, see ReadOptions
+type Priority int
+
+const (
+	// PriorityForeground reads are served right away (the default)
+	PriorityForeground Priority = iota
+	// PriorityBackground reads are throttled while foreground reads are
+	// slower than the target of WithReadLatencyTarget(). Merges, exports,
+	// checks and Warmup() read at this priority.
+	PriorityBackground
+)
+
+// readScheduler throttles background reads while foreground reads are slow.
+// Background reads then take a token each before reading from disk, and
+// tokens are handed out every foreground read latency scaled by how far it
+// is over the target, so the slower foreground reads get the fewer
+// background reads compete with them.
+type readScheduler struct {
+	// latency is the moving average of the latencies of foreground reads
+	// and last when the last one completed in nanoseconds, both accessed
+	// atomically
+	latency int64
+	last    int64
+
+	target time.Duration
+
+	mu sync.Mutex
+	// next is when the next token is handed out
+	next time.Time
+}
+
+func newReadScheduler(target time.Duration) *readScheduler {
+	if target == 0 {
+		target = DefaultReadLatencyTarget
+	}
+	return &readScheduler{target: target}
+}
+
+// foreground records the latency of a foreground read started at `start`
+func (s *readScheduler) foreground(start time.Time) {
+	now := time.Now()
+	d := int64(now.Sub(start))
+	latency := atomic.LoadInt64(&s.latency)
+	atomic.StoreInt64(&s.latency, latency+(d-latency)/8)
+	atomic.StoreInt64(&s.last, now.UnixNano())
+}
+
+// background waits for a token to read from disk at background priority
+func (s *readScheduler) background() {
+	if s.target < 0 {
+		return
+	}
+	latency := time.Duration(atomic.LoadInt64(&s.latency))
+	if latency <= s.target || time.Since(time.Unix(0, atomic.LoadInt64(&s.last))) > readSchedulerIdle {
+		return
+	}
+
+	interval := time.Duration(float64(latency) * float64(latency) / float64(s.target))
+	if interval > readSchedulerMaxInterval {
+		interval = readSchedulerMaxInterval
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	if s.next.Before(now) {
+		s.next = now
+	}
+	wait := s.next.Sub(now)
+	s.next = s.next.Add(interval)
+	s.mu.Unlock()
+
+	time.Sleep(wait)
+}
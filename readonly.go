@@ -0,0 +1,165 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// OpenReadOnly opens the database at the given path read-only, so another
+// process can read from it while the process that opened it with Open()
+// writes to it. The database must already exist.
+//
+// A read-only database takes no lock (the writer's lock is exclusive) and
+// never writes to the disk: Put(), Delete(), Merge() and the like return
+// ErrReadOnly. It sees the keys written when it was opened, call Refresh()
+// to pick up keys written since. See also OpenShared().
+func OpenReadOnly(path string, options ...Option) (*Bitcask, error) {
+	return Open(path, append(options, WithReadOnly())...)
+}
+
+// Refresh picks up the keys written to a read-only database by the writer
+// since it was opened or last refreshed, including new datafiles rotated in
+// and datafiles merged away. A writable database is always up to date, for
+// it Refresh() does nothing, as for a database opened with OpenShared().
+func (b *Bitcask) Refresh() error {
+	if !b.config.ReadOnly || b.config.Shared {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.loadBuckets(); err != nil {
+		return err
+	}
+	return b.refresh(false)
+}
+
+// refresh indexes the datafiles that are new or grew since they were last
+// indexed, and everything after them so later entries still take precedence.
+// The index is rebuilt from scratch if `full` is set or a datafile was
+// removed. The caller must hold the write lock of a read-only database.
+func (b *Bitcask) refresh(full bool) error {
+	fns, err := internal.GetDatafiles(b.fsys, b.path)
+	if err != nil {
+		return err
+	}
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return err
+	}
+	if b.frozenIDs != nil {
+		// Only the datafiles of the frozen generation are shared
+		frozen := ids[:0]
+		for _, id := range ids {
+			if b.frozenIDs[id] {
+				frozen = append(frozen, id)
+			}
+		}
+		if len(frozen) != len(b.frozenIDs) {
+			return ErrNotFrozen
+		}
+		ids = frozen
+	}
+	if len(ids) == 0 {
+		return &os.PathError{Op: "open", Path: filepath.Join(b.path, "*.data"), Err: os.ErrNotExist}
+	}
+
+	sizes := make(map[int]int64, len(ids))
+	for _, id := range ids {
+		stat, err := b.fsys.Stat(filepath.Join(b.path, fmt.Sprintf("%09d.data", id)))
+		if err != nil {
+			// Merged away since listed
+			if os.IsNotExist(err) {
+				return b.refresh(true)
+			}
+			return err
+		}
+		sizes[id] = stat.Size()
+	}
+	for id := range b.indexed {
+		if _, ok := sizes[id]; !ok {
+			full = true
+		}
+	}
+
+	start := len(ids)
+	for i, id := range ids {
+		if size, ok := b.indexed[id]; full || !ok || size != sizes[id] {
+			start = i
+			break
+		}
+	}
+	if start == len(ids) {
+		b.dropBuckets()
+		return nil
+	}
+	// The previous last datafile is no longer the last one
+	for i := start - 1; i >= 0 && b.curr != nil && ids[i] >= b.curr.FileID(); i-- {
+		start = i
+	}
+
+	if full {
+		for _, df := range b.datafiles {
+			df.Close()
+		}
+		if b.curr != nil {
+			b.curr.Close()
+		}
+		b.datafiles = make(map[int]data.Datafile, len(ids))
+		b.trie = art.New()
+		b.indexed = make(map[int]int64, len(ids))
+	} else {
+		for _, id := range ids[start:] {
+			if df, ok := b.datafiles[id]; ok {
+				df.Close()
+				delete(b.datafiles, id)
+			}
+		}
+		b.curr.Close()
+	}
+
+	// The last datafile may still be appended to, so it is not memory mapped
+	last := len(ids) - 1
+	for i, id := range ids[start:] {
+		var df data.Datafile
+		if start+i == last {
+			df, err = data.NewUnmappedDatafile(b.fsys, b.path, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+		} else {
+			df, err = b.fds.Open(b.path, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+		}
+		if err != nil {
+			return err
+		}
+		if start+i == last {
+			b.curr = df
+		} else {
+			b.datafiles[id] = df
+		}
+
+		if err := indexDatafile(b.trie, df, 0, start+i == last); err != nil {
+			return err
+		}
+		// Entries appended after it was opened may have been indexed too,
+		// they are indexed again should it have grown
+		b.indexed[id] = df.Size()
+	}
+	b.publishDatafiles()
+	b.dropBuckets()
+
+	b.keySizes.Reset()
+	b.valueSizes.Reset()
+	atomic.StoreInt64(&b.liveBytes, 0)
+	b.trie.ForEach(func(node art.Node) bool {
+		b.trackSizes(node.Key(), node.Value().(internal.Item))
+		return true
+	})
+	b.rebuildBloom(b.trie.Size())
+
+	return nil
+}
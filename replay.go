@@ -0,0 +1,278 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// ErrSeqUnavailable is the error returned by Replay() and Subscribe() for a
+// Seq, and by Changes() for a sequence number, that is not in the log of the
+// database, e.g. as the entries after it were merged
+var ErrSeqUnavailable = errors.New("error: sequence not available")
+
+// Seq is a position in the log of a database, its datafiles in the order of
+// their ids. Every event carries the Seq right after the entry it is about,
+// so a consumer can resume from the last event it processed with Replay()
+// or Subscribe(). The zero Seq is the start of the log.
+type Seq struct {
+	FileID int
+	Offset int64
+}
+
+// Replay calls `fn` with an event for every entry of the log from the given
+// Seq up to its current end of the keys with the given prefix, in order,
+// until `fn` returns an error which is returned. Replayed events have no
+// Time and no events are replayed for keys expiring nor for the keys of
+// deleted buckets (see DeleteBucket()).
+//
+// Merges rewrite the log: ErrSeqUnavailable is returned for a Seq before
+// the last merge, except for the zero Seq which replays the whole log as
+// merged, i.e. the live keys before the merge and all changes after it.
+// Reads and writes carry on while replaying.
+func (b *Bitcask) Replay(prefix []byte, from Seq, fn func(Event) error) error {
+	b.mu.Lock()
+	b.quiesce()
+	r, err := b.newReplayer(from)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer r.release()
+
+	return r.replay(prefix, fn)
+}
+
+// Subscribe delivers the events of the keys with the given prefix from the
+// given Seq on: first the events replayed from the log like Replay() then
+// the events of new changes like Watch(), with no event missing nor
+// delivered twice in between, until the returned function is called or the
+// database is closed. A consumer reconnecting after a failure subscribes
+// from the Seq of the last event it processed.
+//
+// New changes are buffered like Watch() does while replaying: an
+// EventOverflow is delivered if the replay falls too far behind, or fails,
+// after which the consumer can subscribe again from the Seq of the last
+// event it received. ErrSeqUnavailable is returned as per Replay().
+func (b *Bitcask) Subscribe(prefix []byte, from Seq) (<-chan Event, CancelFunc, error) {
+	b.mu.Lock()
+	b.quiesce()
+	r, err := b.newReplayer(from)
+	if err != nil {
+		b.mu.Unlock()
+		return nil, nil, err
+	}
+	// No change is published before the watch starts, see quiesce()
+	live, cancelLive := b.Watch(prefix)
+	b.mu.Unlock()
+
+	events := make(chan Event)
+	done := make(chan struct{})
+	errStopped := errors.New("subscription stopped")
+	send := func(e Event) error {
+		select {
+		case events <- e:
+			return nil
+		case <-done:
+			return errStopped
+		}
+	}
+
+	go func() {
+		defer close(events)
+
+		err := r.replay(prefix, send)
+		r.release()
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			if send(Event{Type: EventOverflow, Time: b.now()}) != nil {
+				return
+			}
+		}
+		for e := range live {
+			if send(e) != nil {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			close(done)
+			cancelLive()
+		})
+	}, nil
+}
+
+// replayer replays the log from a Seq up to the end it had when created,
+// keeping the datafiles to replay until released
+type replayer struct {
+	b       *Bitcask
+	from    Seq
+	end     Seq
+	ids     []int
+	dropped [][]byte
+	s       *snapshot
+}
+
+// newReplayer returns a replayer of the log from the given Seq. The caller
+// must hold the write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) newReplayer(from Seq) (*replayer, error) {
+	end := Seq{FileID: b.curr.FileID(), Offset: b.curr.Size()}
+	if from != (Seq{}) && (from.FileID < b.mergedEnd() || from.FileID > end.FileID || from.FileID == end.FileID && from.Offset > end.Offset) {
+		return nil, ErrSeqUnavailable
+	}
+
+	r := &replayer{b: b, from: from, end: end}
+	for id := range b.datafiles {
+		if id >= from.FileID {
+			r.ids = append(r.ids, id)
+		}
+	}
+	r.ids = append(r.ids, end.FileID)
+	sort.Ints(r.ids)
+	for _, d := range b.buckets.Dropped {
+		r.dropped = append(r.dropped, bucketKeyPrefix(d.Name, d.Generation))
+	}
+
+	// Merges keep the datafiles until replayed
+	r.s = &snapshot{b: b}
+	r.s.pin(r.ids...)
+	return r, nil
+}
+
+// release lets merges remove the datafiles replayed
+func (r *replayer) release() {
+	r.s.release()
+}
+
+// replay calls `fn` with the events of the keys with the given prefix
+func (r *replayer) replay(prefix []byte, fn func(Event) error) error {
+	b := r.b
+	for _, id := range r.ids {
+		// Datafiles are read on their own so as not to disturb other reads
+		var df data.Datafile
+		err := b.openDatafile(func(dir string) (err error) {
+			df, err = data.NewUnmappedDatafile(b.fsys, dir, id, b.config.MaxKeySize, b.config.MaxValueSize, b.format())
+			return
+		})
+		if err != nil {
+			return err
+		}
+		err = r.replayDatafile(df, prefix, fn)
+		df.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayDatafile replays the entries of the datafile within the log to
+// replay, reading batches as a whole as indexDatafile() does
+func (r *replayer) replayDatafile(df data.Datafile, prefix []byte, fn func(Event) error) error {
+	id := df.FileID()
+	var from int64
+	if id == r.from.FileID {
+		from = r.from.Offset
+	}
+	end := int64(-1)
+	if id == r.end.FileID {
+		end = r.end.Offset
+	}
+
+	emit := func(e internal.Entry, offset, n int64) error {
+		if offset < from || !bytes.HasPrefix(e.Key, prefix) || r.droppedKey(e.Key) {
+			return nil
+		}
+		ev := Event{Type: EventDelete, Key: e.Key, Seq: Seq{FileID: id, Offset: offset + n}}
+		if len(e.Value) > 0 {
+			ev.Type = EventPut
+			ev.Size = int64(r.b.format().ValueSize(uint64(len(e.Key)), n, e.Expiry))
+		}
+		return fn(ev)
+	}
+
+	var offset int64
+	for end < 0 || offset < end {
+		e, n, err := df.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		count, ok := data.BatchHeader(e)
+		if !ok {
+			if err := emit(e, offset, n); err != nil {
+				return err
+			}
+			offset += n
+			continue
+		}
+		offset += n
+		for i := 0; i < count; i++ {
+			e, n, err := df.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := emit(e, offset, n); err != nil {
+				return err
+			}
+			offset += n
+		}
+	}
+	return nil
+}
+
+// droppedKey returns true for a key of a deleted bucket
+func (r *replayer) droppedKey(key []byte) bool {
+	for _, prefix := range r.dropped {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergedEnd returns the id of the first datafile written after the last
+// merge, or zero if the database was never merged. Merges rewrite the
+// entries of the datafiles before it.
+func (b *Bitcask) mergedEnd() int {
+	raw, err := fs.ReadFile(b.fsys, filepath.Join(b.path, "merged"))
+	if err != nil {
+		return 0
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0
+	}
+	return end
+}
+
+// saveMergedEnd saves the id of the first datafile written after a merge,
+// see mergedEnd()
+func (b *Bitcask) saveMergedEnd(end int) error {
+	// A partially written id would make older Seqs look available
+	path := filepath.Join(b.path, "merged")
+	if err := fs.WriteFile(b.fsys, path+".tmp", []byte(strconv.Itoa(end)), 0600); err != nil {
+		return err
+	}
+	return b.fsys.Rename(path+".tmp", path)
+}
@@ -0,0 +1,518 @@
+package bitcask
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+)
+
+const (
+	// replicationInterval is the interval between the changes sent to a
+	// follower
+	replicationInterval = 100 * time.Millisecond
+
+	// followerBackoff is the delay before a follower reconnects to its
+	// primary after losing the connection
+	followerBackoff = time.Second
+
+	// maxConfigSize is the largest configuration a follower accepts
+	maxConfigSize = 1 << 20
+
+	// manifestMargin is how many more datafiles than the primary has a
+	// follower may report, such as those merged away since it last synced
+	manifestMargin = 1024
+)
+
+// replicationMagic starts the handshake of a follower
+var replicationMagic = [4]byte{'B', 'C', 'R', '1'}
+
+// Messages sent by a primary to its followers
+const (
+	// msgConfig is the configuration of the database
+	msgConfig byte = 'C'
+	// msgData appends to a datafile, creating it if needed
+	msgData byte = 'D'
+	// msgRemove removes a datafile
+	msgRemove byte = 'R'
+	// msgSync ends the changes of a round, which are then applied
+	msgSync byte = 'S'
+)
+
+var (
+	errReplicationProtocol = errors.New("error: replication protocol error")
+	errFollowerStopped     = errors.New("error: follower stopped")
+)
+
+// ServeReplication streams the datafiles of the database to followers
+// connecting on the listener (see Follow()) until the listener is closed,
+// always returning a non-nil error like http.Serve(). Followers first
+// catch up from the datafiles they have, then the entries appended and
+// the datafiles rotated in or merged away are sent to them every 100ms.
+// Replication is asynchronous, writes never wait for followers.
+func (b *Bitcask) ServeReplication(l net.Listener) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+	)
+	defer func() {
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+
+		wg.Add(1)
+		go pprof.Do(context.Background(), b.labels("replication"), func(context.Context) {
+			defer wg.Done()
+			b.replicate(conn)
+
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+		})
+	}
+}
+
+// replicate streams the changes to the follower connected until the
+// connection fails
+func (b *Bitcask) replicate(conn net.Conn) error {
+	b.mu.RLock()
+	maxFiles := len(b.datafiles) + 1 + manifestMargin
+	b.mu.RUnlock()
+	have, err := readManifest(bufio.NewReader(conn), maxFiles)
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	config, err := json.Marshal(b.config)
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(conn)
+	if err := writeMessage(w, msgConfig, int64(len(config))); err != nil {
+		return err
+	}
+	if _, err := w.Write(config); err != nil {
+		return err
+	}
+
+	for {
+		if err := b.sendChanges(w, have); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		time.Sleep(replicationInterval)
+	}
+}
+
+// sendChanges sends the datafiles added, grown and removed since the
+// follower had the datafiles of the given sizes, which are updated
+func (b *Bitcask) sendChanges(w *bufio.Writer, have map[int]int64) error {
+	// The sizes are taken with no Put() in flight so only entries fully
+	// written are sent, and the datafiles are pinned so a merge does not
+	// remove them while they are sent
+	b.mu.Lock()
+	b.quiesce()
+	sizes := map[int]int64{b.curr.FileID(): b.curr.Size()}
+	ids := []int{b.curr.FileID()}
+	for id, df := range b.datafiles {
+		sizes[id] = df.Size()
+		ids = append(ids, id)
+	}
+	s := &snapshot{b: b}
+	s.pin(ids...)
+	b.mu.Unlock()
+	defer s.release()
+
+	sort.Ints(ids)
+	for _, id := range ids {
+		offset, ok := have[id]
+		if ok && offset == sizes[id] {
+			continue
+		}
+		// The follower's datafile is not a prefix of ours, send it again
+		if offset > sizes[id] {
+			if err := writeMessage(w, msgRemove, int64(id)); err != nil {
+				return err
+			}
+			offset = 0
+		}
+		if err := b.sendData(w, id, offset, sizes[id]); err != nil {
+			return err
+		}
+		have[id] = sizes[id]
+	}
+	for id := range have {
+		if _, ok := sizes[id]; !ok {
+			if err := writeMessage(w, msgRemove, int64(id)); err != nil {
+				return err
+			}
+			delete(have, id)
+		}
+	}
+
+	return writeMessage(w, msgSync)
+}
+
+// sendData sends the datafile from offset up to size
+func (b *Bitcask) sendData(w *bufio.Writer, id int, offset, size int64) error {
+	var f fs.File
+	err := b.openDatafile(func(dir string) (err error) {
+		f, err = fs.Open(b.fsys, filepath.Join(dir, fmt.Sprintf("%09d.data", id)))
+		return
+	})
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeMessage(w, msgData, int64(id), offset, size-offset); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, f, size-offset)
+	return err
+}
+
+// Follower replicates the database of a primary into a local read-only
+// database, see Follow()
+type Follower struct {
+	addr    string
+	path    string
+	options []Option
+
+	db   *Bitcask
+	stop chan struct{}
+	done chan struct{}
+
+	mu   sync.Mutex
+	conn net.Conn
+	err  error
+}
+
+// Follow replicates the database served with ServeReplication() by the
+// primary at the given address into the database at the given path,
+// catching up from the datafiles already there. It returns once caught up
+// and keeps following in the background, reconnecting should the
+// connection be lost, until closed or promoted. The replica is read with
+// DB(). The options are those to open the replica with, e.g. its
+// encryption key (see WithEncryption()).
+func Follow(addr, path string, options ...Option) (*Follower, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	f := &Follower{
+		addr:    addr,
+		path:    path,
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	r, err := f.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.apply(r); err != nil {
+		f.conn.Close()
+		if f.db != nil {
+			f.db.Close()
+		}
+		return nil, err
+	}
+
+	go pprof.Do(context.Background(), pprof.Labels("bitcask", "follower", "path", path), func(context.Context) {
+		defer close(f.done)
+		f.follow(r)
+	})
+
+	return f, nil
+}
+
+// DB returns the read-only replica, which is closed by Close() and
+// PromoteToPrimary()
+func (f *Follower) DB() *Bitcask {
+	return f.db
+}
+
+// Err returns the error the connection to the primary was last lost with,
+// nil if it never was
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close stops following the primary and closes the replica
+func (f *Follower) Close() error {
+	f.halt()
+	return f.db.Close()
+}
+
+// PromoteToPrimary stops following the primary and reopens the replica as
+// a writable database, e.g. for failover. Making sure the old primary no
+// longer takes writes is up to the caller.
+func (f *Follower) PromoteToPrimary() (*Bitcask, error) {
+	f.halt()
+	if err := f.db.Close(); err != nil {
+		return nil, err
+	}
+	return Open(f.path, f.options...)
+}
+
+// halt stops following and waits for the changes being applied
+func (f *Follower) halt() {
+	close(f.stop)
+	f.mu.Lock()
+	f.conn.Close()
+	f.mu.Unlock()
+	<-f.done
+}
+
+// connect connects to the primary sending the sizes of the datafiles of
+// the replica to catch up from
+func (f *Follower) connect() (*bufio.Reader, error) {
+	fns, err := internal.GetDatafiles(fs.OS, f.path)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", f.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	w.Write(replicationMagic[:])
+	binary.Write(w, binary.BigEndian, uint32(len(ids)))
+	for _, id := range ids {
+		stat, err := os.Stat(f.datafile(id))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		binary.Write(w, binary.BigEndian, [2]int64{int64(id), stat.Size()})
+	}
+	if err := w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Stopped while connecting, see halt()
+	select {
+	case <-f.stop:
+		conn.Close()
+		return nil, errFollowerStopped
+	default:
+	}
+	f.conn = conn
+	return bufio.NewReader(conn), nil
+}
+
+// follow applies the changes sent by the primary, reconnecting after the
+// connection was lost, until stopped
+func (f *Follower) follow(r *bufio.Reader) {
+	for {
+		err := f.apply(r)
+		if err == nil {
+			continue
+		}
+
+		f.mu.Lock()
+		f.conn.Close()
+		f.err = err
+		f.mu.Unlock()
+
+		for {
+			select {
+			case <-f.stop:
+				return
+			case <-time.After(followerBackoff):
+			}
+			if r, err = f.connect(); err == nil {
+				break
+			}
+			f.mu.Lock()
+			f.err = err
+			f.mu.Unlock()
+		}
+	}
+}
+
+// apply applies the changes of a round sent by the primary up to and
+// including its sync, opening the replica if it is not open yet
+func (f *Follower) apply(r *bufio.Reader) error {
+	var changed bool
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case msgConfig:
+			var size int64
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return err
+			}
+			if size < 0 || size > maxConfigSize {
+				return errReplicationProtocol
+			}
+			config := make([]byte, size)
+			if _, err := io.ReadFull(r, config); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(f.path, "config.json"), config, 0600); err != nil {
+				return err
+			}
+		case msgData:
+			var hdr [3]int64
+			if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+				return err
+			}
+			if err := f.write(int(hdr[0]), hdr[1], hdr[2], r); err != nil {
+				return err
+			}
+			changed = true
+		case msgRemove:
+			var id int64
+			if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+				return err
+			}
+			if err := os.Remove(f.datafile(int(id))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			changed = true
+		case msgSync:
+			if f.db == nil {
+				db, err := OpenReadOnly(f.path, f.options...)
+				if err != nil {
+					return err
+				}
+				f.db = db
+				return nil
+			}
+			if changed {
+				return f.db.Refresh()
+			}
+			return nil
+		default:
+			return errReplicationProtocol
+		}
+	}
+}
+
+// write appends `n` bytes read from `r` to the datafile which must be of
+// the size of the offset
+func (f *Follower) write(id int, offset, n int64, r io.Reader) error {
+	df, err := os.OpenFile(f.datafile(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	stat, err := df.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != offset {
+		return errReplicationProtocol
+	}
+
+	if _, err := io.CopyN(df, r, n); err != nil {
+		return err
+	}
+	if err := df.Sync(); err != nil {
+		return err
+	}
+	return df.Close()
+}
+
+func (f *Follower) datafile(id int) string {
+	return filepath.Join(f.path, fmt.Sprintf("%09d.data", id))
+}
+
+// readManifest reads the handshake of a follower with the sizes of its
+// datafiles, of which there may be at most `maxFiles`
+func readManifest(r *bufio.Reader, maxFiles int) (map[int]int64, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if magic != replicationMagic {
+		return nil, errReplicationProtocol
+	}
+
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if uint64(n) > uint64(maxFiles) {
+		return nil, errReplicationProtocol
+	}
+	have := make(map[int]int64, n)
+	for i := uint32(0); i < n; i++ {
+		var file [2]int64
+		if err := binary.Read(r, binary.BigEndian, &file); err != nil {
+			return nil, err
+		}
+		have[int(file[0])] = file[1]
+	}
+	return have, nil
+}
+
+// writeMessage writes a message of the given type and fields
+func writeMessage(w *bufio.Writer, typ byte, fields ...int64) error {
+	if err := w.WriteByte(typ); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
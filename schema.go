@@ -0,0 +1,64 @@
+package bitcask
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prologic/bitcask/internal/schema"
+)
+
+// Schema validates the values written to keys under a prefix, see
+// RegisterSchema()
+type Schema interface {
+	Validate(value []byte) error
+}
+
+// NewJSONSchema compiles a JSON Schema for use with RegisterSchema(). Only a
+// subset of JSON Schema is supported: type, enum, properties, required,
+// additionalProperties, items, minimum, maximum, minLength and maxLength.
+func NewJSONSchema(raw []byte) (Schema, error) {
+	return schema.Compile(raw)
+}
+
+// RegisterSchema registers a schema that all values written to keys with
+// the given prefix must satisfy, otherwise the write fails with
+// ErrSchemaViolation. A value must satisfy the schemas of all registered
+// prefixes of its key. A nil schema removes the prefix's schema. Schemas are
+// not persisted and have to be registered every time the database is opened,
+// existing values are not validated.
+func (b *Bitcask) RegisterSchema(prefix []byte, schema Schema) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if schema == nil {
+		delete(b.schemas, string(prefix))
+	} else {
+		b.schemas[string(prefix)] = schema
+	}
+}
+
+// Schemas returns the registered schemas by prefix
+func (b *Bitcask) Schemas() map[string]Schema {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	schemas := make(map[string]Schema, len(b.schemas))
+	for prefix, schema := range b.schemas {
+		schemas[prefix] = schema
+	}
+	return schemas
+}
+
+// validate validates the value against the schemas of all prefixes of the
+// key. The caller must hold at least the read lock.
+func (b *Bitcask) validate(key, value []byte) error {
+	for prefix, schema := range b.schemas {
+		if !strings.HasPrefix(string(key), prefix) {
+			continue
+		}
+		if err := schema.Validate(value); err != nil {
+			return fmt.Errorf("%w: %s", ErrSchemaViolation, err)
+		}
+	}
+	return nil
+}
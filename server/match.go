@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+)
+
+// match returns true if the key matches the glob-style pattern as used by
+// Redis: `*` matches any bytes, `?` any single byte, `[abc]`, `[a-z]` and
+// `[^abc]` one byte of (or not of) a class, and `\` escapes the next byte
+func match(pattern, key []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range key {
+				if match(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			var ok bool
+			if ok, pattern = matchClass(pattern[1:], key[0]); !ok {
+				return false
+			}
+			key = key[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matchClass matches the byte against the class following a `[` up to the
+// closing `]` (or the end of the pattern) and returns the rest of the
+// pattern after it
+func matchClass(class []byte, c byte) (bool, []byte) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	matched := false
+	for len(class) > 0 && class[0] != ']' {
+		if class[0] == '\\' && len(class) > 1 {
+			class = class[1:]
+		}
+		lo, hi := class[0], class[0]
+		class = class[1:]
+		if len(class) > 1 && class[0] == '-' && class[1] != ']' {
+			hi, class = class[1], class[2:]
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(class) > 0 {
+		class = class[1:]
+	}
+	return matched != negate, class
+}
+
+// literalPrefix returns the prefix of the pattern before any special
+// character, all keys matching the pattern start with it
+func literalPrefix(pattern []byte) []byte {
+	if i := bytes.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
@@ -0,0 +1,473 @@
+// Package server implements a server exposing a Bitcask database over the
+// Redis protocol (RESP) so that existing Redis clients can use it. The
+// commands supported are PING, QUIT, GET, SET, DEL, EXISTS, KEYS, SCAN,
+// TTL and EXPIRE.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+
+	"github.com/prologic/bitcask"
+)
+
+const (
+	// maxCursors is the number of SCAN cursors kept, the least recently
+	// created cursor is dropped once there are more
+	maxCursors = 1024
+
+	// defaultScanCount is the number of keys a SCAN visits by default
+	defaultScanCount = 10
+)
+
+// ErrServerClosed is returned by ListenAndServe() once Close() was called
+var ErrServerClosed = errors.New("server: closed")
+
+// Option is a function that configures a Server
+type Option func(*Server)
+
+// WithNotify sets a function called after every change made by a command
+// with the operation ("set" or "del"), the key and the value (nil for
+// "del"). It is called by one command at a time in the order of the changes.
+func WithNotify(notify func(op string, key, value []byte)) Option {
+	return func(s *Server) {
+		s.notify = notify
+	}
+}
+
+// Server serves a database over the Redis protocol
+type Server struct {
+	db     *bitcask.Bitcask
+	notify func(op string, key, value []byte)
+
+	// mu serializes the commands writing to the database so commands
+	// reading a value before writing it are atomic
+	mu sync.Mutex
+
+	// cursors are the iterators of SCAN cursors in progress by cursor id,
+	// order is the ids from the least recently created
+	cursorsMu  sync.Mutex
+	cursors    map[uint64]*bitcask.Iterator
+	order      []uint64
+	nextCursor uint64
+
+	srvMu  sync.Mutex
+	srv    *redcon.Server
+	closed bool
+}
+
+// New creates a new Server serving the database `db`
+func New(db *bitcask.Bitcask, options ...Option) *Server {
+	s := &Server{
+		db:      db,
+		cursors: make(map[uint64]*bitcask.Iterator),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// ListenAndServe listens on the TCP address `addr` and serves connections
+// until Close() is called, after which it returns nil
+func (s *Server) ListenAndServe(addr string) error {
+	s.srvMu.Lock()
+	if s.closed {
+		s.srvMu.Unlock()
+		return ErrServerClosed
+	}
+	s.srv = redcon.NewServerNetwork("tcp", addr, s.Handle, nil, nil)
+	srv := s.srv
+	s.srvMu.Unlock()
+
+	return srv.ListenAndServe()
+}
+
+// Close stops serving connections. It does not close the database.
+func (s *Server) Close() error {
+	s.srvMu.Lock()
+	defer s.srvMu.Unlock()
+
+	s.closed = true
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
+}
+
+// Handle handles a single command read from a connection
+func (s *Server) Handle(conn redcon.Conn, cmd redcon.Command) {
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "ping":
+		s.handlePing(cmd, conn)
+	case "quit":
+		conn.WriteString("OK")
+		conn.Close()
+	case "get":
+		s.handleGet(cmd, conn)
+	case "set":
+		s.handleSet(cmd, conn)
+	case "del":
+		s.handleDel(cmd, conn)
+	case "exists":
+		s.handleExists(cmd, conn)
+	case "keys":
+		s.handleKeys(cmd, conn)
+	case "scan":
+		s.handleScan(cmd, conn)
+	case "ttl":
+		s.handleTTL(cmd, conn)
+	case "expire":
+		s.handleExpire(cmd, conn)
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	}
+}
+
+func (s *Server) handlePing(cmd redcon.Command, conn redcon.Conn) {
+	switch len(cmd.Args) {
+	case 1:
+		conn.WriteString("PONG")
+	case 2:
+		conn.WriteBulk(cmd.Args[1])
+	default:
+		wrongArgs(cmd, conn)
+	}
+}
+
+func (s *Server) handleGet(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) != 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+
+	value, err := s.db.Get(cmd.Args[1])
+	switch err {
+	case nil:
+		conn.WriteBulk(value)
+	case bitcask.ErrKeyNotFound:
+		conn.WriteNull()
+	default:
+		writeError(conn, err)
+	}
+}
+
+// handleSet handles SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (s *Server) handleSet(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) < 3 {
+		wrongArgs(cmd, conn)
+		return
+	}
+	key, value := cmd.Args[1], cmd.Args[2]
+
+	var (
+		opts bitcask.WriteOptions
+		xx   bool
+	)
+	for i := 3; i < len(cmd.Args); i++ {
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "nx":
+			opts.NoOverwrite = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 == len(cmd.Args) || opts.TTL > 0 {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(string(cmd.Args[i+1]), 10, 64)
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if n <= 0 {
+				conn.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if cmd.Args[i][0] == 'p' || cmd.Args[i][0] == 'P' {
+				unit = time.Millisecond
+			}
+			opts.TTL = time.Duration(n) * unit
+			i++
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+	if opts.NoOverwrite && xx {
+		conn.WriteError("ERR syntax error")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if xx && !s.db.Has(key) {
+		conn.WriteNull()
+		return
+	}
+	switch err := s.db.PutWithOptions(key, value, opts); err {
+	case nil:
+		s.changed("set", key, value)
+		conn.WriteString("OK")
+	case bitcask.ErrKeyExists:
+		conn.WriteNull()
+	default:
+		writeError(conn, err)
+	}
+}
+
+func (s *Server) handleDel(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) < 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range cmd.Args[1:] {
+		if !s.db.Has(key) {
+			continue
+		}
+		if err := s.db.Delete(key); err != nil {
+			writeError(conn, err)
+			return
+		}
+		s.changed("del", key, nil)
+		deleted++
+	}
+	conn.WriteInt(deleted)
+}
+
+func (s *Server) handleExists(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) < 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+
+	n := 0
+	for _, found := range s.db.HasMulti(cmd.Args[1:]) {
+		if found {
+			n++
+		}
+	}
+	conn.WriteInt(n)
+}
+
+func (s *Server) handleKeys(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) != 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+	pattern := cmd.Args[1]
+
+	var keys [][]byte
+	err := s.db.Scan(literalPrefix(pattern), func(key []byte) error {
+		if match(pattern, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulk(key)
+	}
+}
+
+// handleScan handles SCAN cursor [MATCH pattern] [COUNT count]. Cursors
+// are kept by the server so that keys present for the whole iteration are
+// always returned, however many keys are written or deleted meanwhile.
+func (s *Server) handleScan(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) < 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+	cursor, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+
+	var pattern []byte
+	count := defaultScanCount
+	for i := 2; i < len(cmd.Args); i += 2 {
+		if i+1 == len(cmd.Args) {
+			conn.WriteError("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(cmd.Args[i])) {
+		case "match":
+			pattern = cmd.Args[i+1]
+		case "count":
+			count, err = strconv.Atoi(string(cmd.Args[i+1]))
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if count < 1 {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		default:
+			conn.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	it, cursor, ok := s.cursor(cursor)
+	if !ok {
+		conn.WriteError("ERR invalid cursor")
+		return
+	}
+
+	var keys [][]byte
+	for i := 0; i < count; i++ {
+		if !it.Next() {
+			s.dropCursor(cursor)
+			cursor = 0
+			break
+		}
+		if pattern == nil || match(pattern, it.Key()) {
+			keys = append(keys, it.Key())
+		}
+	}
+
+	conn.WriteArray(2)
+	conn.WriteBulkString(strconv.FormatUint(cursor, 10))
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulk(key)
+	}
+}
+
+// handleTTL replies with the seconds left before the key expires, -1 if
+// the key never expires and -2 if the key doesn't exist
+func (s *Server) handleTTL(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) != 2 {
+		wrongArgs(cmd, conn)
+		return
+	}
+
+	_, meta, err := s.db.GetWithMeta(cmd.Args[1])
+	switch {
+	case err == bitcask.ErrKeyNotFound:
+		conn.WriteInt(-2)
+	case err != nil:
+		writeError(conn, err)
+	case meta.Expiry.IsZero():
+		conn.WriteInt(-1)
+	default:
+		left := time.Until(meta.Expiry)
+		conn.WriteInt64(int64((left + time.Second/2) / time.Second))
+	}
+}
+
+// handleExpire handles EXPIRE key seconds, replying 1 if the key exists
+// and 0 otherwise. The key is deleted if seconds is not positive.
+func (s *Server) handleExpire(cmd redcon.Command, conn redcon.Conn) {
+	if len(cmd.Args) != 3 {
+		wrongArgs(cmd, conn)
+		return
+	}
+	key := cmd.Args[1]
+	seconds, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+	if err != nil {
+		conn.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := s.db.Get(key)
+	if err == bitcask.ErrKeyNotFound {
+		conn.WriteInt(0)
+		return
+	} else if err != nil {
+		writeError(conn, err)
+		return
+	}
+
+	if seconds <= 0 {
+		err = s.db.Delete(key)
+		if err == nil {
+			s.changed("del", key, nil)
+		}
+	} else {
+		err = s.db.PutWithTTL(key, value, time.Duration(seconds)*time.Second)
+		if err == nil {
+			s.changed("set", key, value)
+		}
+	}
+	if err != nil {
+		writeError(conn, err)
+		return
+	}
+	conn.WriteInt(1)
+}
+
+// changed notifies a change, the caller must hold mu
+func (s *Server) changed(op string, key, value []byte) {
+	if s.notify != nil {
+		s.notify(op, key, value)
+	}
+}
+
+// cursor returns the iterator of the cursor with the given id, or of a new
+// cursor along with its id if the id is zero
+func (s *Server) cursor(id uint64) (*bitcask.Iterator, uint64, bool) {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+
+	if id != 0 {
+		it, ok := s.cursors[id]
+		return it, id, ok
+	}
+
+	s.nextCursor++
+	id = s.nextCursor
+	it := s.db.Iterator()
+	s.cursors[id] = it
+	s.order = append(s.order, id)
+	for len(s.cursors) > maxCursors {
+		delete(s.cursors, s.order[0])
+		s.order = s.order[1:]
+	}
+	return it, id, true
+}
+
+// dropCursor drops a cursor once its iteration is complete
+func (s *Server) dropCursor(id uint64) {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+
+	delete(s.cursors, id)
+	for i, other := range s.order {
+		if other == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func wrongArgs(cmd redcon.Command, conn redcon.Conn) {
+	conn.WriteError("ERR wrong number of arguments for '" + strings.ToLower(string(cmd.Args[0])) + "' command")
+}
+
+func writeError(conn redcon.Conn, err error) {
+	conn.WriteError(fmt.Sprintf("ERR %s", err))
+}
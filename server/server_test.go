@@ -0,0 +1,192 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+
+	"github.com/prologic/bitcask"
+)
+
+// testConn records the replies written to it in a RESP like notation
+type testConn struct {
+	redcon.Conn
+	replies []string
+	closed  bool
+}
+
+func (c *testConn) Close() error                { c.closed = true; return nil }
+func (c *testConn) WriteError(msg string)       { c.replies = append(c.replies, "-"+msg) }
+func (c *testConn) WriteString(str string)      { c.replies = append(c.replies, "+"+str) }
+func (c *testConn) WriteBulk(bulk []byte)       { c.replies = append(c.replies, "$"+string(bulk)) }
+func (c *testConn) WriteBulkString(bulk string) { c.replies = append(c.replies, "$"+bulk) }
+func (c *testConn) WriteInt(num int)            { c.replies = append(c.replies, fmt.Sprintf(":%d", num)) }
+func (c *testConn) WriteInt64(num int64)        { c.replies = append(c.replies, fmt.Sprintf(":%d", num)) }
+func (c *testConn) WriteArray(count int)        { c.replies = append(c.replies, fmt.Sprintf("*%d", count)) }
+func (c *testConn) WriteNull()                  { c.replies = append(c.replies, "nil") }
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := bitcask.Open(testdir, bitcask.WithFormatVersion(2))
+	assert.NoError(err)
+	defer db.Close()
+
+	var changes []string
+	s := New(db, WithNotify(func(op string, key, value []byte) {
+		changes = append(changes, fmt.Sprintf("%s %s %s", op, key, value))
+	}))
+
+	do := func(args ...string) []string {
+		cmd := redcon.Command{}
+		for _, arg := range args {
+			cmd.Args = append(cmd.Args, []byte(arg))
+		}
+		conn := &testConn{}
+		s.Handle(conn, cmd)
+		return conn.replies
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		assert.Equal([]string{"+PONG"}, do("PING"))
+		assert.Equal([]string{"$hello"}, do("ping", "hello"))
+	})
+
+	t.Run("SetGet", func(t *testing.T) {
+		assert.Equal([]string{"+OK"}, do("SET", "foo", "bar"))
+		assert.Equal([]string{"$bar"}, do("GET", "foo"))
+		assert.Equal([]string{"nil"}, do("GET", "missing"))
+		assert.Equal([]string{"-ERR wrong number of arguments for 'get' command"}, do("GET"))
+		assert.Equal([]string{"-ERR syntax error"}, do("SET", "foo", "bar", "XY"))
+	})
+
+	t.Run("NXXX", func(t *testing.T) {
+		assert.Equal([]string{"nil"}, do("SET", "foo", "baz", "NX"))
+		assert.Equal([]string{"nil"}, do("SET", "new", "baz", "XX"))
+		assert.Equal([]string{"+OK"}, do("SET", "foo", "baz", "XX"))
+		assert.Equal([]string{"$baz"}, do("GET", "foo"))
+		assert.Equal([]string{"+OK"}, do("SET", "new", "baz", "NX"))
+		assert.Equal([]string{"-ERR syntax error"}, do("SET", "foo", "bar", "NX", "XX"))
+	})
+
+	t.Run("ExistsDel", func(t *testing.T) {
+		assert.Equal([]string{":2"}, do("EXISTS", "foo", "new", "missing"))
+		assert.Equal([]string{":1"}, do("DEL", "new", "missing"))
+		assert.Equal([]string{":0"}, do("EXISTS", "new"))
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		assert.Equal([]string{":-2"}, do("TTL", "missing"))
+		assert.Equal([]string{":-1"}, do("TTL", "foo"))
+		assert.Equal([]string{"+OK"}, do("SET", "ttl", "x", "EX", "100"))
+		assert.Equal([]string{":100"}, do("TTL", "ttl"))
+		assert.Equal([]string{"+OK"}, do("SET", "ttl", "x", "PX", "10000"))
+		assert.Equal([]string{":10"}, do("TTL", "ttl"))
+		assert.Equal([]string{"-ERR invalid expire time in 'set' command"}, do("SET", "ttl", "x", "EX", "0"))
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		assert.Equal([]string{":0"}, do("EXPIRE", "missing", "10"))
+		assert.Equal([]string{":1"}, do("EXPIRE", "foo", "50"))
+		assert.Equal([]string{":50"}, do("TTL", "foo"))
+		assert.Equal([]string{"$baz"}, do("GET", "foo"))
+		assert.Equal([]string{":1"}, do("EXPIRE", "ttl", "0"))
+		assert.Equal([]string{":0"}, do("EXISTS", "ttl"))
+	})
+
+	t.Run("Notify", func(t *testing.T) {
+		assert.Equal([]string{
+			"set foo bar",
+			"set foo baz",
+			"set new baz",
+			"del new ",
+			"set ttl x",
+			"set ttl x",
+			"set foo baz",
+			"del ttl ",
+		}, changes)
+	})
+
+	for i := 0; i < 25; i++ {
+		assert.Equal([]string{"+OK"}, do("SET", fmt.Sprintf("user/%02d", i), "x"))
+	}
+
+	t.Run("Keys", func(t *testing.T) {
+		assert.Equal([]string{"*1", "$foo"}, do("KEYS", "f*"))
+		assert.Equal([]string{"*3", "$user/00", "$user/10", "$user/20"}, do("KEYS", "user/?0"))
+		assert.Equal(26, len(do("KEYS", "*"))-1)
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		var keys []string
+		cursor := "0"
+		for {
+			replies := do("SCAN", cursor, "MATCH", "user/*", "COUNT", "7")
+			assert.Equal("*2", replies[0])
+			cursor = strings.TrimPrefix(replies[1], "$")
+			for _, reply := range replies[3:] {
+				key := strings.TrimPrefix(reply, "$")
+				keys = append(keys, key)
+				// Writing keys meanwhile doesn't skip nor repeat any key
+				assert.Equal([]string{"+OK"}, do("SET", key, "y"))
+				assert.Equal([]string{"+OK"}, do("SET", "a/"+key, "y"))
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+		assert.Len(keys, 25)
+		assert.Equal("user/00", keys[0])
+		assert.Equal("user/24", keys[24])
+
+		assert.Equal([]string{"-ERR invalid cursor"}, do("SCAN", "12345"))
+	})
+
+	t.Run("Quit", func(t *testing.T) {
+		conn := &testConn{}
+		s.Handle(conn, redcon.Command{Args: [][]byte{[]byte("QUIT")}})
+		assert.True(conn.closed)
+		assert.Equal([]string{"-ERR unknown command 'FOO'"}, do("FOO"))
+	})
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "foo", true},
+		{"f*", "foo", true},
+		{"f*o", "foo", true},
+		{"f*x", "foo", false},
+		{"*/*", "user/1", true},
+		{"?oo", "foo", true},
+		{"?oo", "fo", false},
+		{"[fb]oo", "boo", true},
+		{"[^fb]oo", "boo", false},
+		{"[a-c]oo", "boo", true},
+		{"[c-a]oo", "boo", true},
+		{"[a-c]oo", "foo", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`[\]]`, "]", true},
+		{"foo", "foo", true},
+		{"foo", "foobar", false},
+	}
+	for _, test := range tests {
+		if match([]byte(test.pattern), []byte(test.key)) != test.match {
+			t.Errorf("match(%q, %q) != %v", test.pattern, test.key, test.match)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package bitcask
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync/atomic"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+)
+
+// Snapshot is a consistent point-in-time view of the database returned by
+// Snapshot(). It does not see any write made after it was taken and keeps
+// the datafiles it reads from until it is closed, even if they are merged
+// away meanwhile, so a long backup or export does not block writes nor see
+// partially applied updates. Keys that expire after it was taken are still
+// seen. A Snapshot can be read from concurrently but must be closed once
+// done with, after which reads return ErrSnapshotClosed.
+type Snapshot struct {
+	// closed is accessed atomically
+	closed int32
+
+	s *snapshot
+}
+
+// Snapshot takes a snapshot of the database. The keys (but not the values)
+// are copied, blocking writes for as long as this takes.
+func (b *Bitcask) Snapshot() *Snapshot {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return &Snapshot{s: b.snapshot(nil)}
+}
+
+// Len returns the number of keys in the snapshot
+func (snap *Snapshot) Len() int {
+	return len(snap.s.keys)
+}
+
+// Has returns true if the key exists in the snapshot, false otherwise
+func (snap *Snapshot) Has(key []byte) bool {
+	if atomic.LoadInt32(&snap.closed) != 0 {
+		return false
+	}
+	_, found := snap.search(key)
+	return found
+}
+
+// Get fetches value of the key as of the time the snapshot was taken
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	return snap.get(key, true)
+}
+
+// get fetches the value of the key verifying its checksum if `verify` is set
+func (snap *Snapshot) get(key []byte, verify bool) ([]byte, error) {
+	if atomic.LoadInt32(&snap.closed) != 0 {
+		return nil, ErrSnapshotClosed
+	}
+	i, found := snap.search(key)
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+	e, err := snap.s.entry(i, verify)
+	if err != nil {
+		return nil, err
+	}
+	return snap.s.b.value(e)
+}
+
+// Scan calls the function `f` with the keys of the snapshot matching the
+// given prefix in order. If the function returns an error no further keys
+// are processed and the error is returned.
+func (snap *Snapshot) Scan(prefix []byte, f func(key []byte) error) error {
+	if atomic.LoadInt32(&snap.closed) != 0 {
+		return ErrSnapshotClosed
+	}
+	keys := snap.s.keys
+	for i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], prefix) >= 0 }); i < len(keys); i++ {
+		if !bytes.HasPrefix(keys[i], prefix) {
+			break
+		}
+		if err := f(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fold calls the function `f` with every key of the snapshot in order like
+// Scan() with an empty prefix
+func (snap *Snapshot) Fold(f func(key []byte) error) error {
+	return snap.Scan(nil, f)
+}
+
+// Close releases the snapshot allowing the datafiles it pinned to be
+// removed once merged away
+func (snap *Snapshot) Close() error {
+	if atomic.CompareAndSwapInt32(&snap.closed, 0, 1) {
+		snap.s.release()
+	}
+	return nil
+}
+
+// search returns the index of the key in the snapshot, whose keys are
+// sorted, and whether it was found
+func (snap *Snapshot) search(key []byte) (int, bool) {
+	keys := snap.s.keys
+	i := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], key) >= 0 })
+	return i, i < len(keys) && bytes.Equal(keys[i], key)
+}
+
+// snapshot is a point-in-time copy of the keys in the index and the items
+// they refer to. While a snapshot is held the datafiles it references are
+// pinned and are not removed by a concurrent merge until it is released.
+type snapshot struct {
+	b     *Bitcask
+	keys  [][]byte
+	items []internal.Item
+	ids   []int
+
+	// expired are the keys skipped as expired and the items they refer to
+	expired      [][]byte
+	expiredItems []internal.Item
+}
+
+// snapshot takes a snapshot of all keys matching the given prefix (or all
+// keys if the prefix is empty) skipping expired keys. The caller must hold
+// at least the read lock and must release the snapshot once done with it.
+func (b *Bitcask) snapshot(prefix []byte) *snapshot {
+	s := &snapshot{b: b}
+	add := s.adder()
+	if len(prefix) > 0 {
+		b.trie.ForEachPrefix(prefix, add)
+	} else {
+		b.trie.ForEach(add)
+	}
+	s.pin()
+	return s
+}
+
+// snapshotRange takes a snapshot of all keys between `start` and `end`
+// (both inclusive) like snapshot()
+func (b *Bitcask) snapshotRange(start, end []byte) *snapshot {
+	s := &snapshot{b: b}
+	add := s.adder()
+	b.trie.ForEach(func(node art.Node) bool {
+		if bytes.Compare(node.Key(), start) < 0 {
+			return true
+		}
+		if bytes.Compare(node.Key(), end) > 0 {
+			return false
+		}
+		return add(node)
+	})
+	s.pin()
+	return s
+}
+
+// adder returns a callback adding the keys of the nodes it is called with
+// to the snapshot
+func (s *snapshot) adder() art.Callback {
+	now := s.b.now().UnixNano()
+	return func(node art.Node) bool {
+		// Skip the root node
+		if len(node.Key()) == 0 {
+			return true
+		}
+		item := node.Value().(internal.Item)
+		if item.Expired(now) {
+			s.expired = append(s.expired, node.Key())
+			s.expiredItems = append(s.expiredItems, item)
+			return true
+		}
+		s.keys = append(s.keys, node.Key())
+		s.items = append(s.items, item)
+		return true
+	}
+}
+
+// pin pins the datafiles referenced by the snapshot and the given ones
+func (s *snapshot) pin(ids ...int) {
+	b := s.b
+
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			s.ids = append(s.ids, id)
+		}
+	}
+	for _, item := range s.items {
+		if !seen[item.FileID] {
+			seen[item.FileID] = true
+			s.ids = append(s.ids, item.FileID)
+		}
+	}
+
+	b.pinMu.Lock()
+	for _, id := range s.ids {
+		b.pins[id]++
+	}
+	b.pinMu.Unlock()
+}
+
+// entry reads the entry of the i'th key in the snapshot verifying its
+// checksum if `verify` is set
+func (s *snapshot) entry(i int, verify bool) (internal.Entry, error) {
+	s.b.mu.RLock()
+	defer s.b.mu.RUnlock()
+
+	key, item := s.keys[i], s.items[i]
+	df := s.b.datafile(item.FileID)
+	if df == nil {
+		return internal.Entry{}, s.b.onCorruption(key, item, ErrCorrupted)
+	}
+
+	var e internal.Entry
+	err := s.b.retry(func() (err error) {
+		e, err = df.ReadAt(item.Offset, item.Size)
+		return
+	})
+	if err == io.EOF || codec.IsCorruptedData(err) {
+		return internal.Entry{}, s.b.onCorruption(key, item, ErrCorrupted)
+	}
+	if err != nil {
+		return e, err
+	}
+
+	if verify && crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return e, s.b.onCorruption(key, item, ErrChecksumFailed)
+	}
+	if !bytes.Equal(e.Key, key) {
+		return e, s.b.onCorruption(key, item, ErrCorrupted)
+	}
+	return e, nil
+}
+
+// release unpins the datafiles referenced by the snapshot removing any that
+// were merged away while the snapshot was held
+func (s *snapshot) release() {
+	b := s.b
+
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+
+	for _, id := range s.ids {
+		b.pins[id]--
+		if b.pins[id] > 0 {
+			continue
+		}
+		delete(b.pins, id)
+		if df, ok := b.retired[id]; ok {
+			delete(b.retired, id)
+			b.removeDatafile(df)
+		}
+	}
+	s.ids = nil
+}
+
+// datafile returns the datafile with the given id including datafiles that
+// were merged away but are still pinned by a snapshot, or nil if there is no
+// such datafile. The caller must hold at least the read lock.
+func (b *Bitcask) datafile(id int) data.Datafile {
+	if id == b.curr.FileID() {
+		return b.curr
+	}
+	if df, ok := b.datafiles[id]; ok {
+		return df
+	}
+
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+	return b.retired[id]
+}
+
+// retire removes a datafile that was merged away, deferring its removal
+// until it is no longer pinned by any snapshot. The caller must hold the
+// write lock.
+func (b *Bitcask) retire(df data.Datafile) error {
+	delete(b.datafiles, df.FileID())
+	b.publishDatafiles()
+
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+
+	if b.pins[df.FileID()] > 0 {
+		b.retired[df.FileID()] = df
+		return nil
+	}
+	return b.removeDatafile(df)
+}
+
+// removeDatafile closes the datafile and removes it from disk
+func (b *Bitcask) removeDatafile(df data.Datafile) error {
+	if err := df.Close(); err != nil {
+		return err
+	}
+	return b.fsys.Remove(df.Name())
+}
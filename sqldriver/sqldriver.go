@@ -0,0 +1,332 @@
+// Package sqldriver implements a minimal database/sql driver over Bitcask
+// registered as "bitcask", with the path of the database as the data source
+// name:
+//
+//	db, err := sql.Open("bitcask", "/tmp/db")
+//
+// Statements are a verb followed by operands, each either a ? placeholder
+// or a single quoted string literal (quotes are escaped by doubling them):
+//
+//	GET <key>            returns a key, value row if the key exists
+//	PUT <key> <value>    stores the value
+//	DELETE <key>         deletes the key, one row affected if it existed
+//	SCAN [<prefix>]      returns a key, value row for every matching key
+//
+// Arguments must be strings or byte slices and values are returned as byte
+// slices. Transactions are not supported.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/prologic/bitcask"
+)
+
+var (
+	// ErrSyntax is the error returned when a statement cannot be parsed
+	ErrSyntax = errors.New("error: syntax error")
+
+	// ErrInvalidArgument is the error returned when an argument is not a
+	// string or byte slice
+	ErrInvalidArgument = errors.New("error: argument must be a string or []byte")
+
+	// ErrTransactionsNotSupported is the error returned by Begin()
+	ErrTransactionsNotSupported = errors.New("error: transactions are not supported")
+)
+
+func init() {
+	sql.Register("bitcask", &Driver{})
+}
+
+// Driver opens connections to a database by path. Connections to the same
+// path share the open database, which is closed with the last connection.
+type Driver struct {
+	mu  sync.Mutex
+	dbs map[string]*shared
+}
+
+type shared struct {
+	db   *bitcask.Bitcask
+	refs int
+}
+
+// Open opens a connection to the database at the given path
+func (d *Driver) Open(path string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dbs == nil {
+		d.dbs = make(map[string]*shared)
+	}
+	s, ok := d.dbs[path]
+	if !ok {
+		db, err := bitcask.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		s = &shared{db: db}
+		d.dbs[path] = s
+	}
+	s.refs++
+
+	return &conn{db: s.db, close: func() error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if s.refs--; s.refs > 0 {
+			return nil
+		}
+		delete(d.dbs, path)
+		return s.db.Close()
+	}}, nil
+}
+
+// NewConnector returns a connector for sql.OpenDB() using an already open
+// database, which the caller remains responsible for closing
+func NewConnector(db *bitcask.Bitcask) driver.Connector {
+	return &connector{db: db}
+}
+
+type connector struct {
+	db *bitcask.Bitcask
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db, close: func() error { return nil }}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return &Driver{}
+}
+
+type conn struct {
+	db    *bitcask.Bitcask
+	close func() error
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	verb, operands, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch verb {
+	case "GET", "DELETE":
+		n = 1
+	case "PUT":
+		n = 2
+	case "SCAN":
+		if len(operands) == 0 {
+			operands = []operand{{literal: []byte{}}}
+		}
+		n = 1
+	default:
+		return nil, fmt.Errorf("%w: unknown statement %q", ErrSyntax, verb)
+	}
+	if len(operands) != n {
+		return nil, fmt.Errorf("%w: %s expects %d operand(s)", ErrSyntax, verb, n)
+	}
+
+	return &stmt{db: c.db, verb: verb, operands: operands}, nil
+}
+
+func (c *conn) Close() error {
+	return c.close()
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, ErrTransactionsNotSupported
+}
+
+// operand is either a ? placeholder or a literal
+type operand struct {
+	placeholder bool
+	literal     []byte
+}
+
+// parse splits a statement into its upper cased verb and operands
+func parse(query string) (string, []operand, error) {
+	query = strings.TrimSpace(query)
+	i := strings.IndexAny(query, " \t\r\n")
+	if i < 0 {
+		i = len(query)
+	}
+	verb := strings.ToUpper(query[:i])
+	if verb == "" {
+		return "", nil, fmt.Errorf("%w: empty statement", ErrSyntax)
+	}
+
+	var operands []operand
+	rest := strings.TrimLeft(query[i:], " \t\r\n")
+	for rest != "" {
+		switch rest[0] {
+		case '?':
+			operands = append(operands, operand{placeholder: true})
+			rest = rest[1:]
+		case '\'':
+			var lit []byte
+			j := 1
+			for {
+				if j >= len(rest) {
+					return "", nil, fmt.Errorf("%w: unterminated string", ErrSyntax)
+				}
+				if rest[j] == '\'' {
+					if j+1 < len(rest) && rest[j+1] == '\'' {
+						lit = append(lit, '\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				lit = append(lit, rest[j])
+				j++
+			}
+			operands = append(operands, operand{literal: lit})
+			rest = rest[j+1:]
+		default:
+			return "", nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, rest)
+		}
+		if rest != "" && !strings.ContainsAny(rest[:1], " \t\r\n") {
+			return "", nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, rest)
+		}
+		rest = strings.TrimLeft(rest, " \t\r\n")
+	}
+
+	return verb, operands, nil
+}
+
+type stmt struct {
+	db       *bitcask.Bitcask
+	verb     string
+	operands []operand
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	var n int
+	for _, o := range s.operands {
+		if o.placeholder {
+			n++
+		}
+	}
+	return n
+}
+
+// bind returns the operands with the placeholders replaced by the args
+func (s *stmt) bind(args []driver.Value) ([][]byte, error) {
+	values := make([][]byte, len(s.operands))
+	for i, o := range s.operands {
+		if !o.placeholder {
+			values[i] = o.literal
+			continue
+		}
+		switch arg := args[0].(type) {
+		case []byte:
+			values[i] = arg
+		case string:
+			values[i] = []byte(arg)
+		default:
+			return nil, ErrInvalidArgument
+		}
+		args = args[1:]
+	}
+	return values, nil
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	values, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.verb {
+	case "PUT":
+		if err := s.db.Put(values[0], values[1]); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(1), nil
+	case "DELETE":
+		if !s.db.Has(values[0]) {
+			return driver.RowsAffected(0), nil
+		}
+		if err := s.db.Delete(values[0]); err != nil {
+			return nil, err
+		}
+		return driver.RowsAffected(1), nil
+	default:
+		return nil, fmt.Errorf("%w: %s is a query", ErrSyntax, s.verb)
+	}
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	values, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rows{}
+	switch s.verb {
+	case "GET":
+		value, err := s.db.Get(values[0])
+		if err == bitcask.ErrKeyNotFound {
+			return r, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.keys, r.values = [][]byte{values[0]}, [][]byte{value}
+	case "SCAN":
+		err := s.db.Scan(values[0], func(key []byte) error {
+			value, err := s.db.Get(key)
+			if err == bitcask.ErrKeyNotFound {
+				// Deleted since the scan started
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			r.keys = append(r.keys, key)
+			r.values = append(r.values, value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s is not a query", ErrSyntax, s.verb)
+	}
+	return r, nil
+}
+
+type rows struct {
+	keys   [][]byte
+	values [][]byte
+}
+
+func (r *rows) Columns() []string {
+	return []string{"key", "value"}
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.keys) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.keys[0], r.values[0]
+	r.keys, r.values = r.keys[1:], r.values[1:]
+	return nil
+}
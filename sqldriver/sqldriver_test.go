@@ -0,0 +1,109 @@
+package sqldriver
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestDriver(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := sql.Open("bitcask", testdir)
+	assert.NoError(err)
+
+	t.Run("Put", func(t *testing.T) {
+		res, err := db.Exec("PUT ? ?", "foo", []byte("bar"))
+		assert.NoError(err)
+		n, err := res.RowsAffected()
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
+
+		_, err = db.Exec("put 'hello' 'it''s me'")
+		assert.NoError(err)
+		_, err = db.Exec("PUT 'help' ?", "me")
+		assert.NoError(err)
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		var key, value []byte
+		assert.NoError(db.QueryRow("GET ?", "hello").Scan(&key, &value))
+		assert.Equal([]byte("hello"), key)
+		assert.Equal([]byte("it's me"), value)
+
+		err := db.QueryRow("GET 'missing'").Scan(&key, &value)
+		assert.Equal(sql.ErrNoRows, err)
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		scan := func(query string, args ...interface{}) []string {
+			rows, err := db.Query(query, args...)
+			assert.NoError(err)
+			defer rows.Close()
+
+			var keys []string
+			for rows.Next() {
+				var key, value string
+				assert.NoError(rows.Scan(&key, &value))
+				keys = append(keys, key)
+			}
+			assert.NoError(rows.Err())
+			return keys
+		}
+
+		assert.Equal([]string{"hello", "help"}, scan("SCAN ?", "hel"))
+		assert.Equal([]string{"foo", "hello", "help"}, scan("SCAN"))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		res, err := db.Exec("DELETE ?", "foo")
+		assert.NoError(err)
+		n, err := res.RowsAffected()
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
+
+		res, err = db.Exec("DELETE ?", "foo")
+		assert.NoError(err)
+		n, err = res.RowsAffected()
+		assert.NoError(err)
+		assert.Equal(int64(0), n)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, query := range []string{"", "SELECT ?", "GET", "PUT ?", "GET 'foo", "GET ?x", "GET foo"} {
+			_, err := db.Exec(query, "foo")
+			assert.True(errors.Is(err, ErrSyntax), query)
+		}
+
+		_, err := db.Exec("GET ?", 42)
+		assert.Equal(ErrInvalidArgument, err)
+
+		_, err = db.Begin()
+		assert.Equal(ErrTransactionsNotSupported, err)
+	})
+
+	assert.NoError(db.Close())
+
+	t.Run("Connector", func(t *testing.T) {
+		bc, err := bitcask.Open(testdir)
+		assert.NoError(err)
+		defer bc.Close()
+
+		db := sql.OpenDB(NewConnector(bc))
+		defer db.Close()
+
+		var key, value string
+		assert.NoError(db.QueryRow("GET 'hello'").Scan(&key, &value))
+		assert.Equal("it's me", value)
+	})
+}
@@ -0,0 +1,167 @@
+// Package statsd implements a reporter that periodically pushes the
+// statistics of an open Bitcask database to a StatsD (or DogStatsD)
+// compatible server over UDP.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prologic/bitcask"
+)
+
+const (
+	// DefaultInterval is the default interval between pushes
+	DefaultInterval = 10 * time.Second
+
+	// DefaultPrefix is the default prefix of all metric names
+	DefaultPrefix = "bitcask."
+)
+
+// ErrInvalidInterval is the error returned by NewReporter() for an interval
+// that is not positive
+var ErrInvalidInterval = errors.New("error: invalid interval")
+
+// Option is a function that configures a Reporter
+type Option func(*Reporter)
+
+// WithInterval sets the interval between pushes, it must be positive
+func WithInterval(interval time.Duration) Option {
+	return func(r *Reporter) {
+		r.interval = interval
+	}
+}
+
+// WithPrefix sets the prefix prepended to all metric names
+func WithPrefix(prefix string) Option {
+	return func(r *Reporter) {
+		r.prefix = prefix
+	}
+}
+
+// WithTags sets tags (in `key:value` form) attached to every metric using
+// the DogStatsD tag extension. Plain StatsD servers do not support tags.
+func WithTags(tags ...string) Option {
+	return func(r *Reporter) {
+		r.tags = tags
+	}
+}
+
+// Reporter pushes the statistics of a database to a StatsD server
+type Reporter struct {
+	db       *bitcask.Bitcask
+	conn     net.Conn
+	interval time.Duration
+	prefix   string
+	tags     []string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReporter creates a new Reporter pushing the statistics of `db` to the
+// StatsD server listening on the UDP address `addr`.
+func NewReporter(db *bitcask.Bitcask, addr string, options ...Option) (*Reporter, error) {
+	r := &Reporter{
+		db:       db,
+		interval: DefaultInterval,
+		prefix:   DefaultPrefix,
+	}
+	for _, opt := range options {
+		opt(r)
+	}
+	if r.interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+
+	return r, nil
+}
+
+// Start starts pushing statistics in the background every interval, it
+// does nothing if already started
+func (r *Reporter) Start() {
+	if r.stop != nil {
+		return
+	}
+
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("bitcask", "statsd")))
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.Report()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the background pushes started with Start() and closes the
+// connection to the StatsD server
+func (r *Reporter) Stop() error {
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+		r.stop = nil
+	}
+	return r.conn.Close()
+}
+
+// Report pushes the current statistics of the database once
+func (r *Reporter) Report() error {
+	stats, err := r.db.Stats()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	r.gauge(&buf, "datafiles", int64(stats.Datafiles))
+	r.gauge(&buf, "keys", int64(stats.Keys))
+	r.gauge(&buf, "size", stats.Size)
+	r.gauge(&buf, "retries", int64(stats.Retries))
+	r.gauge(&buf, "retry_failures", int64(stats.RetryFailures))
+	r.gauge(&buf, "bytes_written", int64(stats.BytesWritten))
+	r.gauge(&buf, "merges", int64(stats.Merges))
+	r.gauge(&buf, "merge_bytes_read", int64(stats.MergeBytesRead))
+	r.gauge(&buf, "merge_bytes_written", int64(stats.MergeBytesWritten))
+	r.gauge(&buf, "merge_bytes_reclaimed", int64(stats.MergeBytesReclaimed))
+	r.gauge(&buf, "gets", int64(stats.Gets))
+	r.gauge(&buf, "puts", int64(stats.Puts))
+	r.gauge(&buf, "deletes", int64(stats.Deletes))
+	r.gauge(&buf, "syncs", int64(stats.Syncs))
+	r.gauge(&buf, "live_bytes", stats.LiveBytes)
+	r.gauge(&buf, "dead_bytes", stats.DeadBytes)
+
+	_, err = r.conn.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return err
+}
+
+func (r *Reporter) gauge(buf *bytes.Buffer, name string, value int64) {
+	fmt.Fprintf(buf, "%s%s:%d|g", r.prefix, name, value)
+	if len(r.tags) > 0 {
+		fmt.Fprintf(buf, "|#%s", strings.Join(r.tags, ","))
+	}
+	buf.WriteByte('\n')
+}
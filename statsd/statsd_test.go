@@ -0,0 +1,83 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask"
+)
+
+func TestReporter(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := bitcask.Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
+
+	assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer conn.Close()
+
+	read := func() []string {
+		buf := make([]byte, 1024)
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		assert.NoError(err)
+		return strings.Split(string(buf[:n]), "\n")
+	}
+
+	t.Run("Report", func(t *testing.T) {
+		r, err := NewReporter(db, conn.LocalAddr().String())
+		assert.NoError(err)
+		defer r.Stop()
+
+		assert.NoError(r.Report())
+		lines := read()
+		assert.Contains(lines, "bitcask.datafiles:0|g")
+		assert.Contains(lines, "bitcask.keys:1|g")
+	})
+
+	t.Run("PrefixAndTags", func(t *testing.T) {
+		r, err := NewReporter(
+			db, conn.LocalAddr().String(),
+			WithPrefix("db."), WithTags("env:test", "shard:1"),
+		)
+		assert.NoError(err)
+		defer r.Stop()
+
+		assert.NoError(r.Report())
+		lines := read()
+		assert.Contains(lines, "db.keys:1|g|#env:test,shard:1")
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		r, err := NewReporter(db, conn.LocalAddr().String(), WithInterval(10*time.Millisecond))
+		assert.NoError(err)
+
+		r.Start()
+		r.Start()
+		lines := read()
+		assert.Contains(lines, "bitcask.keys:1|g")
+		assert.NoError(r.Stop())
+	})
+
+	t.Run("InvalidInterval", func(t *testing.T) {
+		_, err := NewReporter(db, conn.LocalAddr().String(), WithInterval(0))
+		assert.Equal(ErrInvalidInterval, err)
+
+		_, err = NewReporter(db, conn.LocalAddr().String(), WithInterval(-time.Second))
+		assert.Equal(ErrInvalidInterval, err)
+	})
+}
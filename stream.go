@@ -0,0 +1,261 @@
+package bitcask
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/metrics"
+)
+
+// ErrInvalidRange is the error returned by GetRange() for a negative offset
+// or length, or an offset past the end of the value
+var ErrInvalidRange = errors.New("error: invalid range")
+
+// checksumSize is the size of the checksum ending every entry
+const checksumSize = 4
+
+// storedValue is the location of a value in its datafile
+type storedValue struct {
+	key  []byte
+	item internal.Item
+	// offset and size are the offset of the value in the datafile and its
+	// size as stored
+	offset int64
+	size   int64
+	// plain is true if the value is stored as is, neither compressed nor
+	// encrypted
+	plain bool
+}
+
+// GetReader returns a reader streaming the value of the given key from its
+// datafile and the size of the value, so large values are not read into
+// memory as a whole. The checksum of the value is verified as it is read:
+// reading its end returns ErrChecksumFailed instead of io.EOF on mismatch.
+//
+// The reader reads the value as it was when GetReader() was called, writes
+// and merges carry on meanwhile, and must be closed once done. Compressed
+// or encrypted values cannot be streamed, they are read into memory first.
+func (b *Bitcask) GetReader(key []byte) (r io.ReadCloser, size int64, err error) {
+	defer b.observe(metrics.Get, time.Now(), &err)
+
+	if !b.bloom.mayContain(key) {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	defer b.reads.foreground(time.Now())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	v, err := b.storedValue(key)
+	b.bloom.missed(err != ErrKeyNotFound)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.evictor.read(key)
+
+	if !v.plain {
+		value, err := b.get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+	}
+
+	// Merges keep the datafile until the value is read
+	s := &snapshot{b: b}
+	s.pin(v.item.FileID)
+	return &valueReader{
+		s:      s,
+		v:      v,
+		offset: v.offset,
+		crc:    crc32.NewIEEE(),
+	}, v.size, nil
+}
+
+// GetRange retrieves `length` bytes of the value of the given key starting
+// at `offset`, fewer if the value ends first, reading only those bytes from
+// its datafile. The checksum of the value is not verified as that would
+// take reading all of it, see GetReader(). Compressed or encrypted values
+// are read as a whole.
+func (b *Bitcask) GetRange(key []byte, offset, length int64) (value []byte, err error) {
+	defer b.observe(metrics.Get, time.Now(), &err)
+
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+	if !b.bloom.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+
+	defer b.reads.foreground(time.Now())
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	v, err := b.storedValue(key)
+	b.bloom.missed(err != ErrKeyNotFound)
+	if err != nil {
+		return nil, err
+	}
+	b.evictor.read(key)
+
+	if !v.plain {
+		value, err := b.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if offset > int64(len(value)) {
+			return nil, ErrInvalidRange
+		}
+		if length > int64(len(value))-offset {
+			length = int64(len(value)) - offset
+		}
+		return append([]byte(nil), value[offset:offset+length]...), nil
+	}
+
+	if offset > v.size {
+		return nil, ErrInvalidRange
+	}
+	if length > v.size-offset {
+		length = v.size - offset
+	}
+	value = make([]byte, length)
+	if err := b.readValue(v, value, v.offset+offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// storedValue locates the value of the given key in its datafile, reading
+// only the header of its entry. The caller must hold at least the read lock.
+func (b *Bitcask) storedValue(key []byte) (storedValue, error) {
+	value, found := b.trie.Search(key)
+	if !found {
+		return storedValue{}, ErrKeyNotFound
+	}
+
+	item := value.(internal.Item)
+	if item.Expired(b.now().UnixNano()) {
+		return storedValue{}, ErrKeyNotFound
+	}
+
+	v := storedValue{key: key, item: item}
+	v.size = int64(b.format().ValueSize(uint64(len(key)), item.Size, item.Expiry))
+	header := item.Size - checksumSize - v.size
+	if header <= 0 || header > item.Size {
+		return storedValue{}, b.onCorruption(key, item, ErrCorrupted)
+	}
+	v.offset = item.Offset + header
+
+	// The header is decoded as an entry without value, with room for the
+	// checksum it ends with
+	buf := make([]byte, header+checksumSize)
+	if err := b.readValue(v, buf[:header], item.Offset); err != nil {
+		return storedValue{}, err
+	}
+	var e internal.Entry
+	if err := codec.DecodeEntry(buf, &e, b.format(), b.config.MaxKeySize, b.config.MaxValueSize); err != nil {
+		return storedValue{}, b.onCorruption(key, item, ErrCorrupted)
+	}
+	if !bytes.Equal(e.Key, key) {
+		return storedValue{}, b.onCorruption(key, item, ErrCorrupted)
+	}
+
+	v.plain = e.Compression == uint8(codec.CompressionNone) && b.aead == nil
+	return v, nil
+}
+
+// readValue reads len(p) bytes from offset `index` of the datafile of the
+// value. The caller must hold at least the read lock.
+func (b *Bitcask) readValue(v storedValue, p []byte, index int64) error {
+	df := b.datafile(v.item.FileID)
+	if df == nil {
+		return b.onCorruption(v.key, v.item, ErrCorrupted)
+	}
+
+	err := b.retry(func() error {
+		_, err := df.ReadRaw(p, index)
+		return err
+	})
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return b.onCorruption(v.key, v.item, ErrCorrupted)
+	}
+	return err
+}
+
+// valueReader streams a value from its datafile verifying its checksum,
+// see GetReader()
+type valueReader struct {
+	s      *snapshot
+	v      storedValue
+	offset int64
+	crc    hash.Hash32
+	err    error
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.s == nil {
+		return 0, os.ErrClosed
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	end := r.v.offset + r.v.size
+	if r.offset == end {
+		r.err = r.verify()
+		if r.err == nil {
+			r.err = io.EOF
+		}
+		return 0, r.err
+	}
+	if rest := end - r.offset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	b := r.s.b
+	b.mu.RLock()
+	err := b.readValue(r.v, p, r.offset)
+	b.mu.RUnlock()
+	if err != nil {
+		r.err = err
+		return 0, err
+	}
+	r.crc.Write(p)
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+// verify reads the checksum following the value and compares it with the
+// checksum of the bytes read
+func (r *valueReader) verify() error {
+	b := r.s.b
+	buf := make([]byte, checksumSize)
+	b.mu.RLock()
+	err := b.readValue(r.v, buf, r.offset)
+	b.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf) != r.crc.Sum32() {
+		return b.onCorruption(r.v.key, r.v.item, ErrChecksumFailed)
+	}
+	return nil
+}
+
+// Close releases the datafile of the value
+func (r *valueReader) Close() error {
+	if r.s != nil {
+		r.s.release()
+		r.s = nil
+	}
+	return nil
+}
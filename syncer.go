@@ -0,0 +1,33 @@
+package bitcask
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// syncPeriodically is the background task syncing the current datafile
+// every sync interval if anything was written to it since the last sync
+func (b *Bitcask) syncPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(b.config.SyncInterval)
+	defer ticker.Stop()
+
+	var synced uint64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		written := atomic.LoadUint64(&b.bytesWritten)
+		if written == synced {
+			continue
+		}
+		b.mu.RLock()
+		err := b.sync(b.curr)
+		b.mu.RUnlock()
+		if err == nil {
+			synced = written
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package bitcask
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tasks manages the lifecycle of the long-running background tasks of a
+// database. Tasks are spawned on the configured worker pool, recovered and
+// restarted (as per the restart policy) if they panic and are all stopped
+// and waited for by Close().
+type tasks struct {
+	// panics is accessed atomically and must stay 64-bit aligned
+	panics  uint64
+	running int64
+
+	spawn       func(func())
+	maxRestarts int
+	backoff     time.Duration
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newTasks(spawn func(func()), maxRestarts int, backoff time.Duration) *tasks {
+	if spawn == nil {
+		spawn = func(f func()) { go f() }
+	}
+	return &tasks{
+		spawn:       spawn,
+		maxRestarts: maxRestarts,
+		backoff:     backoff,
+		stop:        make(chan struct{}),
+	}
+}
+
+// run starts `fn` in the background. `fn` must return once the `stop`
+// channel is closed.
+func (t *tasks) run(labels pprof.LabelSet, fn func(stop <-chan struct{})) {
+	t.wg.Add(1)
+	atomic.AddInt64(&t.running, 1)
+	t.spawn(func() {
+		defer t.wg.Done()
+		defer atomic.AddInt64(&t.running, -1)
+
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+
+		for restarts := 0; ; restarts++ {
+			if !t.recover(fn) || restarts >= t.maxRestarts {
+				return
+			}
+
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(t.backoff):
+			}
+		}
+	})
+}
+
+// recover calls `fn` and returns true if it panicked
+func (t *tasks) recover(fn func(stop <-chan struct{})) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&t.panics, 1)
+			panicked = true
+		}
+	}()
+	fn(t.stop)
+	return
+}
+
+// close signals all tasks to stop and waits for them to return
+func (t *tasks) close() {
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+	t.wg.Wait()
+}
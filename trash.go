@@ -0,0 +1,115 @@
+package bitcask
+
+import (
+	"bytes"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/prologic/bitcask/internal"
+)
+
+// TrashPrefix is the prefix of the keys deleted keys are moved to in trash
+// mode (see WithTrash()): a deleted key `k` is moved to TrashPrefix + `k`.
+// Keys in the trash are ordinary keys, e.g. they can be listed with Scan()
+// and deleting them removes them for good. They expire at the end of the
+// trash window and are then removed by Merge().
+const TrashPrefix = "__trash__/"
+
+// Undelete restores a key deleted in trash mode (see WithTrash()) from the
+// trash, overwriting the value of the key if it was written again since. A
+// restored key does not expire, even if it did before it was deleted. If
+// the key is not in the trash, or its trash window is over, ErrKeyNotFound
+// is returned.
+func (b *Bitcask) Undelete(key []byte) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	trashKey := append([]byte(TrashPrefix), key...)
+	e, err := b.getEntry(trashKey)
+	if err != nil {
+		return err
+	}
+
+	restored := b.moved(e, key)
+	restored.Expiry = 0
+	return b.write([]internal.Entry{restored, internal.NewEntry(trashKey, []byte{})}, true)
+}
+
+// trash moves the key to the trash returning false if there was no such
+// key or it is in the trash already. The caller must hold the write lock
+// with no Put() in flight, see quiesce().
+func (b *Bitcask) trash(key []byte) (bool, error) {
+	if bytes.HasPrefix(key, []byte(TrashPrefix)) {
+		return false, nil
+	}
+
+	e, err := b.getEntry(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	trashed, err := b.trashed(e)
+	if err != nil {
+		return false, err
+	}
+	return true, b.write([]internal.Entry{trashed, internal.NewEntry(key, []byte{})}, true)
+}
+
+// trashAll moves all keys not in the trash yet to the trash. The caller
+// must hold the write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) trashAll() error {
+	var keys [][]byte
+	b.trie.ForEach(func(node art.Node) bool {
+		if !bytes.HasPrefix(node.Key(), []byte(TrashPrefix)) {
+			keys = append(keys, node.Key())
+		}
+		return true
+	})
+
+	deletes := make([]internal.Entry, 0, len(keys))
+	puts := make([]internal.Entry, 0, len(keys))
+	for _, key := range keys {
+		e, err := b.getEntry(key)
+		if err == ErrKeyNotFound {
+			// Expired
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		trashed, err := b.trashed(e)
+		if err != nil {
+			return err
+		}
+		deletes = append(deletes, internal.NewEntry(key, []byte{}))
+		puts = append(puts, trashed)
+	}
+	if len(puts) == 0 {
+		return nil
+	}
+
+	return b.write(append(puts, deletes...), true)
+}
+
+// trashed returns the entry storing the value of `e` in the trash
+func (b *Bitcask) trashed(e internal.Entry) (internal.Entry, error) {
+	key := append([]byte(TrashPrefix), e.Key...)
+	if uint32(len(key)) > b.config.MaxKeySize {
+		return internal.Entry{}, ErrKeyTooLarge
+	}
+
+	trashed := b.moved(e, key)
+	trashed.Expiry = b.now().Add(b.config.TrashWindow).UnixNano()
+	return trashed, nil
+}
@@ -0,0 +1,135 @@
+package bitcask
+
+import (
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/metrics"
+)
+
+// Txn is a read-write transaction returned by Begin(). Its writes are
+// buffered in memory and seen by its own reads, and are applied atomically
+// by Commit() as a Batch is, unless a key it read was modified meanwhile.
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	b    *Bitcask
+	done bool
+
+	// reads are the keys read from the database and their index items
+	// then, writes the latest put or delete of every key written in order
+	reads   map[string]txnRead
+	writes  map[string]int
+	entries []internal.Entry
+}
+
+// txnRead is the state of a key in the index when first read by a Txn
+type txnRead struct {
+	item  internal.Item
+	found bool
+}
+
+// Begin starts a transaction for check-then-set updates such as counters or
+// unique constraints. Transactions are optimistic: they do not lock the
+// keys they read, instead Commit() fails with ErrConflict if any was
+// written, deleted or merged (see Merge()) since, and the transaction can
+// be retried.
+func (b *Bitcask) Begin() *Txn {
+	return &Txn{
+		b:      b,
+		reads:  make(map[string]txnRead),
+		writes: make(map[string]int),
+	}
+}
+
+// Get retrieves the value of the given key, as written by the transaction
+// if it was, otherwise from the database like Bitcask.Get()
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	if i, ok := tx.writes[string(key)]; ok {
+		if len(tx.entries[i].Value) == 0 {
+			return nil, ErrKeyNotFound
+		}
+		return append([]byte(nil), tx.entries[i].Value...), nil
+	}
+
+	b := tx.b
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var read txnRead
+	if value, found := b.trie.Search(key); found {
+		read = txnRead{item: value.(internal.Item), found: true}
+	}
+	// Only the first read counts, a later one seeing another value
+	// conflicts at commit
+	if _, ok := tx.reads[string(key)]; !ok {
+		tx.reads[string(key)] = read
+	}
+	return b.get(key)
+}
+
+// Put stores the key and value in the transaction
+func (tx *Txn) Put(key, value []byte) error {
+	return tx.add(internal.NewEntry(append([]byte(nil), key...), append([]byte(nil), value...)))
+}
+
+// Delete deletes the key in the transaction
+func (tx *Txn) Delete(key []byte) error {
+	return tx.add(internal.NewEntry(append([]byte(nil), key...), []byte{}))
+}
+
+// add adds the put or delete to the writes of the transaction
+func (tx *Txn) add(e internal.Entry) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	if tx.b.config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := tx.b.checkEntries([]internal.Entry{e}); err != nil {
+		return err
+	}
+
+	if i, ok := tx.writes[string(e.Key)]; ok {
+		tx.entries[i] = e
+		return nil
+	}
+	tx.writes[string(e.Key)] = len(tx.entries)
+	tx.entries = append(tx.entries, e)
+	return nil
+}
+
+// Commit applies the writes of the transaction atomically like Write(), or
+// returns ErrConflict without applying any if a key the transaction read
+// was modified since. The transaction is done either way.
+func (tx *Txn) Commit() (err error) {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	defer tx.b.observe(metrics.Put, time.Now(), &err)
+
+	b := tx.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Writes not published yet are modifications too
+	b.quiesce()
+
+	for key, read := range tx.reads {
+		value, found := b.trie.Search([]byte(key))
+		if found != read.found || found && value.(internal.Item) != read.item {
+			return ErrConflict
+		}
+	}
+	if len(tx.entries) == 0 {
+		return nil
+	}
+	return b.write(tx.entries, false)
+}
+
+// Discard abandons the transaction and its writes
+func (tx *Txn) Discard() {
+	tx.done = true
+}
@@ -0,0 +1,70 @@
+package bitcask
+
+import (
+	"bytes"
+)
+
+// ConflictFunc resolves a key found in both databases combined by Union()
+// given its value in each of them, returning the value to keep
+type ConflictFunc func(key, a, b []byte) ([]byte, error)
+
+// PreferA resolves conflicts keeping the value of the first database
+func PreferA(key, a, b []byte) ([]byte, error) {
+	return a, nil
+}
+
+// PreferB resolves conflicts keeping the value of the second database
+func PreferB(key, a, b []byte) ([]byte, error) {
+	return b, nil
+}
+
+// Union writes all keys of the databases `a` and `b` into `dst`, calling
+// `resolve` for the keys found in both. Keys keep their metadata (see
+// GetWithMeta()), for a resolved key that of the database whose value was
+// kept or of `a` if the value was changed, so `dst` must use a format
+// version that stores any metadata of `a` and `b`. Both databases are
+// iterated over snapshots of their keys and may be written meanwhile.
+func Union(dst, a, b *Bitcask, resolve ConflictFunc) error {
+	err := a.Fold(func(key []byte) error {
+		value, meta, err := a.GetWithMeta(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		other, otherMeta, err := b.GetWithMeta(key)
+		if err == nil {
+			resolved, err := resolve(key, value, other)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(resolved, value) && bytes.Equal(resolved, other) {
+				meta = otherMeta
+			}
+			value = resolved
+		} else if err != ErrKeyNotFound {
+			return err
+		}
+
+		return dst.PutWithMeta(key, value, meta)
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.Fold(func(key []byte) error {
+		if a.Has(key) {
+			return nil
+		}
+		value, meta, err := b.GetWithMeta(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return dst.PutWithMeta(key, value, meta)
+	})
+}
@@ -0,0 +1,199 @@
+package bitcask
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prologic/bitcask/fs"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/metrics"
+)
+
+// PutIfVersion stores the key and value in the database like Put() if the
+// key is at the given version (see GetWithMeta()), zero if it must not
+// exist, and returns ErrConflict otherwise. Goroutines updating the same
+// key coordinate by reading it, then writing it back at the version they
+// read and retrying on a conflict. The database must use
+// format version 5.
+func (b *Bitcask) PutIfVersion(key, value []byte, version uint64) error {
+	if !b.format().HasVersion() {
+		return ErrVersionNotSupported
+	}
+	return b.putEntryIf(b.newEntry(key, value), WriteOptions{}, func() error {
+		return b.checkVersion(key, version)
+	})
+}
+
+// DeleteIfVersion deletes the key like Delete() if it is at the given
+// version as per PutIfVersion(), and returns ErrConflict otherwise
+func (b *Bitcask) DeleteIfVersion(key []byte, version uint64) (err error) {
+	defer b.observe(metrics.Delete, time.Now(), &err)
+
+	if !b.format().HasVersion() {
+		return ErrVersionNotSupported
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quiesce()
+
+	if err := b.checkVersion(key, version); err != nil {
+		return err
+	}
+	return b.delete(key)
+}
+
+// checkVersion returns ErrConflict unless the key is at the given version,
+// zero if it does not exist. The caller must hold the write lock with no
+// Put() in flight, see quiesce().
+func (b *Bitcask) checkVersion(key []byte, version uint64) error {
+	var current uint64
+	e, err := b.readEntry(key, false)
+	if err == nil {
+		current = e.Version
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	if current != version {
+		return ErrConflict
+	}
+	return nil
+}
+
+// stamp sets the version and timestamp of an entry about to be written if
+// the format stores them. The caller must hold the write lock and write
+// the entries in the order they are stamped.
+func (b *Bitcask) stamp(e *internal.Entry) {
+	if !b.format().HasVersion() {
+		return
+	}
+	b.version++
+	e.Version = b.version
+	e.Timestamp = b.now().UnixNano()
+}
+
+// lastVersion returns the latest version handed out. Merges drop deleted
+// and overwritten entries and reorder the live ones, so it is the highest of
+// the high-water mark saved with the index, see saveVersion(), and of the
+// versions of the entries written after its position, or of all datafiles
+// if there is no such position.
+func (b *Bitcask) lastVersion() (uint64, error) {
+	if !b.format().HasVersion() {
+		return 0, nil
+	}
+
+	version, pos, found, err := b.savedVersion()
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		_, found = b.datafiles[pos.FileID]
+	}
+	ids := make([]int, 0, len(b.datafiles))
+	for id := range b.datafiles {
+		if !found || id >= pos.FileID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		var from int64
+		if found && id == pos.FileID {
+			from = pos.Offset
+		}
+		last, err := b.scanVersions(id, from)
+		if err != nil {
+			return 0, err
+		}
+		if last > version {
+			version = last
+		}
+	}
+	return version, nil
+}
+
+// scanVersions returns the latest version of the entries of the datafile
+// from the given offset
+func (b *Bitcask) scanVersions(id int, from int64) (uint64, error) {
+	f, err := fs.Open(b.fsys, filepath.Join(b.path, fmt.Sprintf("%09d.data", id)))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	var version uint64
+	dec := codec.NewDecoder(f, b.format(), b.config.MaxKeySize, b.config.MaxValueSize)
+	for {
+		var e internal.Entry
+		if _, err := dec.Decode(&e); err == io.EOF {
+			return version, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if e.Version > version {
+			version = e.Version
+		}
+	}
+}
+
+// savedVersion returns the high-water mark of the versions saved by
+// saveVersion() and the position it was saved at, if any
+func (b *Bitcask) savedVersion() (uint64, index.Position, bool, error) {
+	raw, err := fs.ReadFile(b.fsys, filepath.Join(b.path, "version"))
+	if os.IsNotExist(err) {
+		return 0, index.Position{}, false, nil
+	}
+	if err != nil {
+		return 0, index.Position{}, false, err
+	}
+
+	// The mark of a backup has no position, see Backup()
+	fields := strings.Fields(string(raw))
+	if len(fields) != 1 && len(fields) != 3 {
+		return 0, index.Position{}, false, fmt.Errorf("error parsing version high-water mark: %q", raw)
+	}
+	version, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, index.Position{}, false, fmt.Errorf("error parsing version high-water mark: %w", err)
+	}
+	if len(fields) == 1 {
+		return version, index.Position{}, false, nil
+	}
+	var pos index.Position
+	if pos.FileID, err = strconv.Atoi(fields[1]); err != nil {
+		return 0, index.Position{}, false, fmt.Errorf("error parsing version high-water mark: %w", err)
+	}
+	if pos.Offset, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return 0, index.Position{}, false, fmt.Errorf("error parsing version high-water mark: %w", err)
+	}
+	return version, pos, true, nil
+}
+
+// saveVersion saves the latest version handed out along with the position
+// of the datafiles it was handed out at, so versions are never handed out
+// twice once a merge removes the datafiles holding the latest one and
+// reopening the database only reads the versions written after it. The
+// caller must hold the write lock with no Put() in flight, see quiesce().
+func (b *Bitcask) saveVersion(pos index.Position) error {
+	if !b.format().HasVersion() {
+		return nil
+	}
+	// A partially written mark would let versions go backwards
+	path := filepath.Join(b.path, "version")
+	mark := fmt.Sprintf("%d %d %d", b.version, pos.FileID, pos.Offset)
+	if err := fs.WriteFile(b.fsys, path+".tmp", []byte(mark), 0600); err != nil {
+		return err
+	}
+	return b.fsys.Rename(path+".tmp", path)
+}
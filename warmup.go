@@ -0,0 +1,75 @@
+package bitcask
+
+import (
+	"sort"
+	"sync"
+)
+
+// Warmup reads the values of all keys with any of the given prefixes, or of
+// all keys if none, in the background so they are in memory (the pages of
+// memory mapped datafiles are faulted in, otherwise the operating system
+// caches them) before they are first read. It returns a channel closed once
+// done or the database is closed.
+//
+// Warming up is best effort: values that cannot be read are skipped and
+// reads and writes carry on as usual meanwhile.
+func (b *Bitcask) Warmup(prefixes ...[]byte) <-chan struct{} {
+	if len(prefixes) == 0 {
+		prefixes = [][]byte{nil}
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	b.tasks.run(b.labels("warmup"), func(stop <-chan struct{}) {
+		defer once.Do(func() { close(done) })
+		for _, prefix := range prefixes {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if !b.warmup(prefix, stop) {
+				return
+			}
+		}
+	})
+	return done
+}
+
+// warmup reads the values of the keys with the given prefix in the order of
+// their datafiles and offsets, and returns false if stopped first
+func (b *Bitcask) warmup(prefix []byte, stop <-chan struct{}) bool {
+	b.mu.RLock()
+	s := b.snapshot(prefix)
+	b.mu.RUnlock()
+	defer s.release()
+
+	order := make([]int, len(s.items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := s.items[order[i]], s.items[order[j]]
+		if a.FileID != b.FileID {
+			return a.FileID < b.FileID
+		}
+		return a.Offset < b.Offset
+	})
+
+	for _, i := range order {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+
+		b.reads.background()
+		item := s.items[i]
+		b.mu.RLock()
+		if df := b.datafile(item.FileID); df != nil {
+			df.ReadAt(item.Offset, item.Size)
+		}
+		b.mu.RUnlock()
+	}
+	return true
+}
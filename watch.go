@@ -0,0 +1,331 @@
+package bitcask
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+const (
+	// watchBufferSize is the default number of events buffered for every
+	// watcher
+	watchBufferSize = 1024
+
+	// watchBlockTimeout is the default time a write waits for a WatchBlock
+	// watcher to make room in its buffer
+	watchBlockTimeout = 100 * time.Millisecond
+)
+
+// EventType is the kind of change of an Event
+type EventType int
+
+const (
+	// EventPut is a key written
+	EventPut EventType = iota
+	// EventDelete is a key deleted
+	EventDelete
+	// EventOverflow is delivered in place of the events dropped because the
+	// watcher fell behind, the watcher should resync e.g. with Scan()
+	EventOverflow
+)
+
+// WatchPolicy is what happens to the events of a watcher that falls behind,
+// see WatchOptions
+type WatchPolicy int
+
+const (
+	// WatchDropNewest drops new events while the buffer of the watcher is
+	// full and delivers an EventOverflow in their place
+	WatchDropNewest WatchPolicy = iota
+
+	// WatchDropOldest drops the oldest buffered events to make room for new
+	// ones, for watchers that only care about recent events
+	WatchDropOldest
+
+	// WatchBlock makes writes wait for room in the buffer of the watcher for
+	// up to the block timeout before dropping events like WatchDropNewest.
+	// Writes do not wait again until the watcher caught up.
+	WatchBlock
+
+	// WatchCoalesce keeps only the latest event of every key not delivered
+	// yet, in the order of these latest events. The buffer size limits the
+	// number of keys, beyond which the pending events are dropped for an
+	// EventOverflow.
+	WatchCoalesce
+)
+
+// WatchOptions are the options of a watch, see WatchWithOptions()
+type WatchOptions struct {
+	// Policy is what happens to the events of the watcher if it falls behind
+	Policy WatchPolicy
+	// BufferSize is the number of events buffered for the watcher, 1024 if
+	// zero
+	BufferSize int
+	// BlockTimeout is how long a write waits for a WatchBlock watcher, 100ms
+	// if zero
+	BlockTimeout time.Duration
+}
+
+// Event is a change of a key delivered to watchers, see Watch()
+type Event struct {
+	Type EventType
+	Key  []byte
+	// Size is the size of the new value as stored (see Stats().ValueSizes),
+	// zero for deletes
+	Size int64
+	Time time.Time
+	// Seq is the position in the log right after the change, see Subscribe()
+	Seq Seq
+}
+
+// CancelFunc stops a watch, closing its channel
+type CancelFunc func()
+
+// watcher is a watch of the keys with the prefix
+type watcher struct {
+	prefix     []byte
+	events     chan Event
+	opts       WatchOptions
+	overflowed bool
+
+	// A WatchCoalesce watcher delivers its pending events from a goroutine
+	// of its own, until done is closed. They are guarded by mu.
+	mu         sync.Mutex
+	cond       *sync.Cond
+	pending    *list.List
+	keys       map[string]*list.Element
+	overflowAt time.Time
+	done       chan struct{}
+}
+
+// Watch delivers an event for every key with the given prefix written or
+// deleted through this database (including moves, batches and deletes in
+// trash mode, but not keys expiring) in order, until the returned function
+// is called or the database is closed. Writes never wait for watchers: if
+// a watcher falls too far behind its events are dropped and an
+// EventOverflow is delivered instead.
+func (b *Bitcask) Watch(prefix []byte) (<-chan Event, CancelFunc) {
+	return b.WatchWithOptions(prefix, WatchOptions{})
+}
+
+// WatchWithOptions watches the keys with the given prefix like Watch() with
+// the given buffer size and policy for when the watcher falls behind. The
+// zero WatchOptions watch like Watch().
+func (b *Bitcask) WatchWithOptions(prefix []byte, opts WatchOptions) (<-chan Event, CancelFunc) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = watchBufferSize
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = watchBlockTimeout
+	}
+	w := &watcher{
+		prefix: append([]byte(nil), prefix...),
+		opts:   opts,
+	}
+	if opts.Policy == WatchCoalesce {
+		w.events = make(chan Event)
+		w.cond = sync.NewCond(&w.mu)
+		w.pending = list.New()
+		w.keys = make(map[string]*list.Element)
+		w.done = make(chan struct{})
+		go w.deliver()
+	} else {
+		w.events = make(chan Event, opts.BufferSize)
+	}
+
+	b.watchMu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*watcher]struct{})
+	}
+	b.watchers[w] = struct{}{}
+	b.watchMu.Unlock()
+
+	var once sync.Once
+	return w.events, func() {
+		once.Do(func() { b.unwatch(w) })
+	}
+}
+
+// unwatch removes the watcher closing its channel
+func (b *Bitcask) unwatch(w *watcher) {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	if _, ok := b.watchers[w]; ok {
+		delete(b.watchers, w)
+		w.close()
+	}
+}
+
+// unwatchAll removes all watchers closing their channels
+func (b *Bitcask) unwatchAll() {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	for w := range b.watchers {
+		delete(b.watchers, w)
+		w.close()
+	}
+}
+
+// notifyPut notifies the watchers of the key of the item written. The
+// caller must hold the write lock so events are delivered in order.
+func (b *Bitcask) notifyPut(key []byte, item internal.Item) {
+	size := b.format().ValueSize(uint64(len(key)), item.Size, item.Expiry)
+	b.notify(EventPut, key, int64(size), Seq{FileID: item.FileID, Offset: item.Offset + item.Size})
+}
+
+// notifyDelete notifies the watchers of the key deleted by the entry ending
+// at the given Seq as per notifyPut()
+func (b *Bitcask) notifyDelete(key []byte, seq Seq) {
+	b.notify(EventDelete, key, 0, seq)
+}
+
+func (b *Bitcask) notify(typ EventType, key []byte, size int64, seq Seq) {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+
+	if len(b.watchers) == 0 {
+		return
+	}
+	now := b.now()
+	for w := range b.watchers {
+		if bytes.HasPrefix(key, w.prefix) {
+			w.send(Event{Type: typ, Key: append([]byte(nil), key...), Size: size, Time: now, Seq: seq})
+		}
+	}
+}
+
+// close closes the channel of the watcher, or has its goroutine close it.
+// The caller must hold the watch lock.
+func (w *watcher) close() {
+	if w.opts.Policy != WatchCoalesce {
+		close(w.events)
+		return
+	}
+
+	w.mu.Lock()
+	close(w.done)
+	w.cond.Signal()
+	w.mu.Unlock()
+}
+
+// send delivers the event as per the policy of the watcher. The caller must
+// hold the watch lock.
+func (w *watcher) send(e Event) {
+	switch w.opts.Policy {
+	case WatchDropOldest:
+		for {
+			select {
+			case w.events <- e:
+				return
+			default:
+			}
+			select {
+			case <-w.events:
+			default:
+			}
+		}
+	case WatchCoalesce:
+		w.coalesce(e)
+	default:
+		if w.overflowed {
+			if !w.offer(Event{Type: EventOverflow, Time: e.Time}, false) {
+				return
+			}
+			w.overflowed = false
+		}
+		if !w.offer(e, w.opts.Policy == WatchBlock) {
+			w.overflowed = true
+		}
+	}
+}
+
+// offer delivers the event if there is room in the buffer, waiting up to the
+// block timeout for it if `block` is set
+func (w *watcher) offer(e Event, block bool) bool {
+	select {
+	case w.events <- e:
+		return true
+	default:
+	}
+	if !block {
+		return false
+	}
+
+	timer := time.NewTimer(w.opts.BlockTimeout)
+	defer timer.Stop()
+	select {
+	case w.events <- e:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// coalesce replaces the pending event of the key, if any, by the event
+func (w *watcher) coalesce(e Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.overflowed {
+		return
+	}
+	if elem, ok := w.keys[string(e.Key)]; ok {
+		w.pending.Remove(elem)
+	} else if w.pending.Len() >= w.opts.BufferSize {
+		w.pending.Init()
+		w.keys = make(map[string]*list.Element)
+		w.overflowed = true
+		w.overflowAt = e.Time
+		w.cond.Signal()
+		return
+	}
+	w.keys[string(e.Key)] = w.pending.PushBack(e)
+	w.cond.Signal()
+}
+
+// deliver delivers the pending events of a WatchCoalesce watcher, and an
+// EventOverflow once they were dropped, until the watch is stopped
+func (w *watcher) deliver() {
+	defer close(w.events)
+
+	for {
+		w.mu.Lock()
+		for w.pending.Len() == 0 && !w.overflowed && !w.stopped() {
+			w.cond.Wait()
+		}
+		if w.stopped() {
+			w.mu.Unlock()
+			return
+		}
+		var e Event
+		if w.overflowed {
+			e = Event{Type: EventOverflow, Time: w.overflowAt}
+			w.overflowed = false
+		} else {
+			e = w.pending.Remove(w.pending.Front()).(Event)
+			delete(w.keys, string(e.Key))
+		}
+		w.mu.Unlock()
+
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// stopped returns true once the watch of a WatchCoalesce watcher is stopped
+func (w *watcher) stopped() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}